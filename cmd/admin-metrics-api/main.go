@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/ipfilter"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestbody"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestid"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/shedding"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+)
+
+const (
+	defaultUsageTable = "USAGE"
+	defaultOTPTable   = "OTP"
+	defaultAuthTable  = "AUTH"
+	defaultDays       = 7
+	maxDays           = 30
+	defaultCacheTTL   = 5 * time.Minute
+	// funnelWindow matches the default OTP retention of the data janitor, older OTP items may already be gone
+	funnelWindow = 24 * time.Hour
+)
+
+// DailyMetrics aggregates the USAGE items of one UTC day
+type DailyMetrics struct {
+	Date           string  `json:"date"`
+	ActiveUsers    int     `json:"active_users"`
+	Requests       int64   `json:"requests"`
+	CachedRequests int64   `json:"cached_requests"`
+	InputTokens    int64   `json:"input_tokens"`
+	OutputTokens   int64   `json:"output_tokens"`
+	EstimatedCost  float64 `json:"estimated_cost"`
+}
+
+// OTPFunnel compares the OTP codes sent with the logins they turned into
+type OTPFunnel struct {
+	WindowHours    int     `json:"window_hours"`
+	Sent           int64   `json:"sent"`
+	Verified       int64   `json:"verified"`
+	ConversionRate float64 `json:"conversion_rate"`
+}
+
+// Metrics is the dashboard response
+type Metrics struct {
+	GeneratedAt int64          `json:"generated_at"`
+	Days        []DailyMetrics `json:"days"`
+	OTPFunnel   OTPFunnel      `json:"otp_funnel"`
+}
+
+// cachedMetrics keeps computed metrics per day range for the lifetime of the container, the scans are expensive
+var (
+	cacheMu       sync.Mutex
+	cachedMetrics = map[int]Metrics{}
+)
+
+func createResponse(statusCode int, body string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Body:       body,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
+
+// getTableName returns the table name from the environment variable or the default if it is unset
+func getTableName(name string, defaultValue string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		value = defaultValue
+	}
+	return testmode.Table(value)
+}
+
+// getCacheTTL reads how long computed metrics are served from memory from METRICS_CACHE_TTL_SECONDS
+func getCacheTTL() time.Duration {
+	value := os.Getenv("METRICS_CACHE_TTL_SECONDS")
+	if value == "" {
+		return defaultCacheTTL
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		fmt.Printf("Invalid METRICS_CACHE_TTL_SECONDS %q, using default\n", value)
+		return defaultCacheTTL
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// scanSince returns the items of a table with the time attribute at or after since, only reading the given attributes
+func scanSince(ctx context.Context, client *dynamodb.DynamoDB, table string, timeAttr string, since time.Time, attrs ...string) ([]map[string]*dynamodb.AttributeValue, error) {
+	names := map[string]*string{"#t": aws.String(timeAttr)}
+	projection := []string{"#t"}
+	for i, attr := range attrs {
+		placeholder := fmt.Sprintf("#a%d", i)
+		names[placeholder] = aws.String(attr)
+		projection = append(projection, placeholder)
+	}
+
+	var items []map[string]*dynamodb.AttributeValue
+	err := client.ScanPagesWithContext(ctx, &dynamodb.ScanInput{
+		TableName:                aws.String(table),
+		FilterExpression:         aws.String("#t >= :since"),
+		ProjectionExpression:     aws.String(strings.Join(projection, ", ")),
+		ExpressionAttributeNames: names,
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":since": {N: aws.String(strconv.FormatInt(since.Unix(), 10))},
+		},
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		items = append(items, page.Items...)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", table, err)
+	}
+	return items, nil
+}
+
+// getNumber reads a numeric attribute, returning 0 if it is missing or malformed
+func getNumber(item map[string]*dynamodb.AttributeValue, name string) float64 {
+	attr, ok := item[name]
+	if !ok || attr.N == nil {
+		return 0
+	}
+	value, err := strconv.ParseFloat(*attr.N, 64)
+	if err != nil {
+		return 0
+	}
+	return value
+}
+
+// aggregateUsage groups USAGE items by UTC day, oldest day first
+func aggregateUsage(items []map[string]*dynamodb.AttributeValue) []DailyMetrics {
+	days := map[string]*DailyMetrics{}
+	users := map[string]map[string]bool{}
+	for _, item := range items {
+		date := time.Unix(int64(getNumber(item, "created_at")), 0).UTC().Format("2006-01-02")
+		day, ok := days[date]
+		if !ok {
+			day = &DailyMetrics{Date: date}
+			days[date] = day
+			users[date] = map[string]bool{}
+		}
+
+		day.Requests++
+		if cached, ok := item["cached"]; ok && cached.BOOL != nil && *cached.BOOL {
+			day.CachedRequests++
+		}
+		day.InputTokens += int64(getNumber(item, "input_tokens"))
+		day.OutputTokens += int64(getNumber(item, "output_tokens"))
+		day.EstimatedCost += getNumber(item, "estimated_cost")
+		if userHash, ok := item["user_hash"]; ok && userHash.S != nil {
+			users[date][*userHash.S] = true
+		}
+	}
+
+	result := make([]DailyMetrics, 0, len(days))
+	for date, day := range days {
+		day.ActiveUsers = len(users[date])
+		result = append(result, *day)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Date < result[j].Date
+	})
+	return result
+}
+
+// computeMetrics scans USAGE for the last days and OTP and AUTH for the funnel window
+func computeMetrics(ctx context.Context, client *dynamodb.DynamoDB, days int, now time.Time) (Metrics, error) {
+	metrics := Metrics{GeneratedAt: now.Unix()}
+
+	year, month, day := now.UTC().Date()
+	since := time.Date(year, month, day, 0, 0, 0, 0, time.UTC).AddDate(0, 0, -(days - 1))
+	usageItems, err := scanSince(ctx, client, getTableName("USAGE_TABLE", defaultUsageTable), "created_at", since,
+		"user_hash", "input_tokens", "output_tokens", "estimated_cost", "cached")
+	if err != nil {
+		return metrics, err
+	}
+	metrics.Days = aggregateUsage(usageItems)
+
+	funnelSince := now.Add(-funnelWindow)
+	otpItems, err := scanSince(ctx, client, getTableName("OTP_TABLE", defaultOTPTable), "CreatedAt", funnelSince)
+	if err != nil {
+		return metrics, err
+	}
+	authItems, err := scanSince(ctx, client, getTableName("AUTH_TABLE", defaultAuthTable), "created_at", funnelSince)
+	if err != nil {
+		return metrics, err
+	}
+	metrics.OTPFunnel = OTPFunnel{
+		WindowHours: int(funnelWindow.Hours()),
+		Sent:        int64(len(otpItems)),
+		Verified:    int64(len(authItems)),
+	}
+	if metrics.OTPFunnel.Sent > 0 {
+		metrics.OTPFunnel.ConversionRate = float64(metrics.OTPFunnel.Verified) / float64(metrics.OTPFunnel.Sent)
+	}
+	return metrics, nil
+}
+
+// getMetrics returns the cached metrics for the day range if they are fresh enough, computing them otherwise
+func getMetrics(ctx context.Context, days int) (Metrics, error) {
+	now := time.Now()
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+
+	cached, ok := cachedMetrics[days]
+	if ok && now.Sub(time.Unix(cached.GeneratedAt, 0)) < getCacheTTL() {
+		return cached, nil
+	}
+
+	sess := session.Must(session.NewSession())
+	metrics, err := computeMetrics(ctx, dynamodb.New(sess), days, now)
+	if err != nil {
+		return metrics, err
+	}
+	cachedMetrics[days] = metrics
+	return metrics, nil
+}
+
+func getDashboardMetrics(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	days := defaultDays
+	if value := request.QueryStringParameters["days"]; value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxDays {
+			return createResponse(http.StatusBadRequest, fmt.Sprintf("days must be between 1 and %d", maxDays)), nil
+		}
+		days = parsed
+	}
+
+	metrics, err := getMetrics(ctx, days)
+	if err != nil {
+		fmt.Printf("failed to compute metrics: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to compute metrics"), nil
+	}
+
+	jsonResponse, err := json.Marshal(metrics)
+	if err != nil {
+		fmt.Printf("failed to marshal response: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to create response"), nil
+	}
+
+	return createResponse(http.StatusOK, string(jsonResponse)), nil
+}
+
+func main() {
+	filter, err := ipfilter.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load IP filter configuration: %v", err)
+		os.Exit(1)
+	}
+	shedder, err := shedding.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load latency budgets: %v", err)
+		os.Exit(1)
+	}
+	limits, err := requestbody.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load body limits: %v", err)
+		os.Exit(1)
+	}
+	handler := ipfilter.Middleware(filter, requestbody.Middleware(limits, handleRequest))
+	lambda.Start(requestid.Middleware(shedding.Middleware(shedder, handler)))
+}
+
+// handleRequest routes admin metrics requests, access is restricted with IAM auth on the API Gateway route
+func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Remove trailing slash from path if present
+	path := strings.TrimSuffix(request.Path, "/")
+
+	switch {
+	case request.HTTPMethod == "GET" && path == "/admin/metrics":
+		return getDashboardMetrics(ctx, request)
+	default:
+		return createResponse(http.StatusNotFound, "Not Found"), fmt.Errorf("unknown endpoint: %s %s", request.HTTPMethod, request.Path)
+	}
+}
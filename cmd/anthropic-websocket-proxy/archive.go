@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	awsV1 "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/archive"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+)
+
+// getArchiveConsent returns the purposes the user consented to archiving their readings for.
+// It is read fresh from USERS so a withdrawn consent applies to the next reading.
+func getArchiveConsent(ctx context.Context, client *dynamodb.Client, tableName string, userHash string) ([]string, error) {
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			users.AttrUserHash: &types.AttributeValueMemberS{Value: userHash},
+		},
+		ProjectionExpression:     aws.String("#consent"),
+		ExpressionAttributeNames: map[string]string{"#consent": archive.AttrConsent},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get archive consent: %w", err)
+	}
+
+	consent := make(map[string]bool)
+	if attr, ok := result.Item[archive.AttrConsent].(*types.AttributeValueMemberM); ok {
+		for purpose, value := range attr.Value {
+			if agreed, ok := value.(*types.AttributeValueMemberBOOL); ok {
+				consent[purpose] = agreed.Value
+			}
+		}
+	}
+	return archive.Consented(consent), nil
+}
+
+// newArchiveRecord builds the redacted record of a finished reading
+func newArchiveRecord(cfg archive.Config, requestID string, userHash string, purposes []string, req Request, answer string, usage Usage, createdAt int64) archive.Record {
+	record := archive.Record{
+		RequestID:      requestID,
+		Environment:    cfg.Environment,
+		UserHash:       cfg.HashUser(userHash),
+		PromptTemplate: req.PromptTemplate,
+		Model:          usage.Model,
+		Purposes:       purposes,
+		Response:       archive.Redact(answer),
+		InputTokens:    usage.InputTokens,
+		OutputTokens:   usage.OutputTokens,
+		CreatedAt:      createdAt,
+	}
+	for _, msg := range req.Messages {
+		record.Messages = append(record.Messages, archive.Message{Role: msg.Role, Content: archive.Redact(msg.Content)})
+	}
+	return record
+}
+
+// archiveReading writes a record to the archive bucket with SSE-KMS and the retention tag.
+// The AWS SDK v2 S3 module isn't a dependency yet, so this uses the v1 client like mail-redirector.
+func archiveReading(ctx context.Context, cfg archive.Config, record archive.Record) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal archive record: %w", err)
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create AWS session: %w", err)
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:               awsV1.String(cfg.Bucket),
+		Key:                  awsV1.String(cfg.Key(record)),
+		Body:                 bytes.NewReader(body),
+		ContentType:          awsV1.String("application/json"),
+		ServerSideEncryption: awsV1.String(s3.ServerSideEncryptionAwsKms),
+		Tagging:              awsV1.String(url.Values{archive.RetentionTag: []string{strconv.Itoa(cfg.RetentionDays)}}.Encode()),
+	}
+	if cfg.KMSKeyID != "" {
+		input.SSEKMSKeyId = awsV1.String(cfg.KMSKeyID)
+	}
+
+	_, err = s3.New(sess).PutObjectWithContext(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to archive reading %s: %w", record.RequestID, err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ResponseCache stores complete Anthropic responses keyed by a hash of the request
+type ResponseCache struct {
+	client    *dynamodb.Client
+	tableName string
+	ttl       time.Duration
+}
+
+// newResponseCache returns a ResponseCache, or nil if caching is not configured
+func newResponseCache(ctx context.Context, config Config) (*ResponseCache, error) {
+	if config.ResponseCacheTable == "" {
+		return nil, nil
+	}
+
+	client, err := newDynamoDBClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ResponseCache{
+		client:    client,
+		tableName: config.ResponseCacheTable,
+		ttl:       config.ResponseCacheTTL,
+	}, nil
+}
+
+// responseCacheKey hashes the marshalled Anthropic request, which covers model, system prompt and messages
+func responseCacheKey(requestBody []byte) string {
+	sum := sha256.Sum256(requestBody)
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the cached response for key, or false if there is no live entry
+func (c *ResponseCache) Get(ctx context.Context, key string) (string, bool, error) {
+	result, err := c.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(c.tableName),
+		Key: map[string]types.AttributeValue{
+			"cache_key": &types.AttributeValueMemberS{Value: key},
+		},
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("failed to get cached response: %w", err)
+	}
+
+	if result.Item == nil {
+		return "", false, nil
+	}
+
+	// DynamoDB TTL deletes expired items lazily, so check the expiry here as well
+	if expiresAttr, ok := result.Item["expires_at"].(*types.AttributeValueMemberN); ok {
+		expiresAt, err := strconv.ParseInt(expiresAttr.Value, 10, 64)
+		if err == nil && time.Now().Unix() > expiresAt {
+			return "", false, nil
+		}
+	}
+
+	responseAttr, ok := result.Item["response"].(*types.AttributeValueMemberS)
+	if !ok {
+		return "", false, nil
+	}
+	return responseAttr.Value, true, nil
+}
+
+// Put stores a complete response under key with the configured TTL
+func (c *ResponseCache) Put(ctx context.Context, key string, model string, response string) error {
+	expiresAt := time.Now().Add(c.ttl).Unix()
+	_, err := c.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(c.tableName),
+		Item: map[string]types.AttributeValue{
+			"cache_key":  &types.AttributeValueMemberS{Value: key},
+			"model":      &types.AttributeValueMemberS{Value: model},
+			"response":   &types.AttributeValueMemberS{Value: response},
+			"expires_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt, 10)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store cached response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+const (
+	// compressionQueryParam negotiates frame compression on the $connect URL, e.g. ?compression=gzip
+	compressionQueryParam = "compression"
+	compressionGzip       = "gzip"
+	compressionDeflate    = "deflate"
+	// compressionMinBytes keeps small deltas uncompressed, base64 would make them bigger
+	compressionMinBytes = 1024
+)
+
+// parseCompression validates the compression requested on $connect
+func parseCompression(value string) (string, error) {
+	switch value {
+	case "", compressionGzip, compressionDeflate:
+		return value, nil
+	default:
+		return "", fmt.Errorf("unsupported compression %q, use %s or %s", value, compressionGzip, compressionDeflate)
+	}
+}
+
+// compress encodes data with the negotiated compression
+func compress(encoding string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var writer io.WriteCloser
+	switch encoding {
+	case compressionGzip:
+		writer = gzip.NewWriter(&buf)
+	case compressionDeflate:
+		var err error
+		writer, err = flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", encoding)
+	}
+
+	_, err := writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compressFrame replaces a large frame text with its compressed base64 form and sets the frame encoding
+func compressFrame(frame Frame, encoding string) (Frame, error) {
+	if encoding == "" || len(frame.Text) < compressionMinBytes {
+		return frame, nil
+	}
+	compressed, err := compress(encoding, []byte(frame.Text))
+	if err != nil {
+		return frame, fmt.Errorf("failed to compress frame: %w", err)
+	}
+	frame.Text = base64.StdEncoding.EncodeToString(compressed)
+	frame.Encoding = encoding
+	return frame, nil
+}
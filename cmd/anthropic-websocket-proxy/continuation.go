@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+)
+
+const (
+	defaultContinuationTable = "CONTINUATIONS"
+	defaultContinuationTTL   = time.Hour
+	envContinuationTable     = "CONTINUATIONS_TABLE"
+
+	// frameTypeTruncated is sent when a response hit max_tokens, its continuation token resumes the response
+	frameTypeTruncated  = "truncated"
+	stopReasonMaxTokens = "max_tokens"
+)
+
+// Continuation is the context needed to resume a response that hit max_tokens.
+// Messages end with the partial response as an assistant message, which Anthropic continues from.
+type Continuation struct {
+	PromptTemplate string
+	TemplateParams map[string]interface{}
+	Model          string
+	Messages       []Message
+}
+
+// appendAssistantText adds the response text to the conversation, extending the last message if it is
+// already a partial assistant response. Anthropic rejects a final assistant message with trailing whitespace.
+func appendAssistantText(messages []Message, text string) []Message {
+	result := make([]Message, len(messages), len(messages)+1)
+	copy(result, messages)
+	if last := len(result) - 1; last >= 0 && result[last].Role == "assistant" {
+		result[last].Content = strings.TrimRight(result[last].Content+text, " \t\r\n")
+		return result
+	}
+	return append(result, Message{Role: "assistant", Content: strings.TrimRight(text, " \t\r\n")})
+}
+
+// newContinuationToken returns a random token that can't be guessed from other tokens
+func newContinuationToken() (string, error) {
+	token := make([]byte, 32)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate continuation token: %w", err)
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// storeContinuation stores the continuation for the user and returns its token
+func storeContinuation(ctx context.Context, client *dynamodb.Client, tableName string, userHash string, continuation Continuation) (string, error) {
+	token, err := newContinuationToken()
+	if err != nil {
+		return "", err
+	}
+	messages, err := json.Marshal(continuation.Messages)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal continuation messages: %w", err)
+	}
+
+	item := map[string]types.AttributeValue{
+		"token":           &types.AttributeValueMemberS{Value: token},
+		"prompt_template": &types.AttributeValueMemberS{Value: continuation.PromptTemplate},
+		"model":           &types.AttributeValueMemberS{Value: continuation.Model},
+		"messages":        &types.AttributeValueMemberS{Value: string(messages)},
+		"expires_at":      &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(defaultContinuationTTL).Unix(), 10)},
+	}
+	if userHash != "" {
+		item["user_hash"] = &types.AttributeValueMemberS{Value: userHash}
+	}
+	if len(continuation.TemplateParams) > 0 {
+		params, err := json.Marshal(continuation.TemplateParams)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal continuation template params: %w", err)
+		}
+		item["template_params"] = &types.AttributeValueMemberS{Value: string(params)}
+	}
+	if testmode.Enabled() {
+		item[testmode.AttrTestRecord] = &types.AttributeValueMemberBOOL{Value: true}
+	}
+
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to store continuation: %w", err)
+	}
+	return token, nil
+}
+
+// takeContinuation deletes and returns the continuation of token, so a token resumes a response only once.
+// It returns false if the token is unknown, expired or belongs to another user.
+func takeContinuation(ctx context.Context, client *dynamodb.Client, tableName string, token string, userHash string) (Continuation, bool, error) {
+	var continuation Continuation
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"token": &types.AttributeValueMemberS{Value: token},
+		},
+		// Another user's token is left alone
+		ConditionExpression: aws.String("attribute_not_exists(user_hash)"),
+		ReturnValues:        types.ReturnValueAllOld,
+	}
+	if userHash != "" {
+		input.ConditionExpression = aws.String("user_hash = :user_hash")
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":user_hash": &types.AttributeValueMemberS{Value: userHash},
+		}
+	}
+	result, err := client.DeleteItem(ctx, input)
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return continuation, false, nil
+	}
+	if err != nil {
+		return continuation, false, fmt.Errorf("failed to take continuation: %w", err)
+	}
+	if result.Attributes == nil {
+		return continuation, false, nil
+	}
+
+	// DynamoDB TTL deletes expired items lazily, so check the expiry here as well
+	if attr, ok := result.Attributes["expires_at"].(*types.AttributeValueMemberN); ok {
+		expiresAt, err := strconv.ParseInt(attr.Value, 10, 64)
+		if err == nil && time.Now().Unix() > expiresAt {
+			return continuation, false, nil
+		}
+	}
+
+	if attr, ok := result.Attributes["prompt_template"].(*types.AttributeValueMemberS); ok {
+		continuation.PromptTemplate = attr.Value
+	}
+	if attr, ok := result.Attributes["template_params"].(*types.AttributeValueMemberS); ok {
+		err = json.Unmarshal([]byte(attr.Value), &continuation.TemplateParams)
+		if err != nil {
+			return continuation, false, fmt.Errorf("invalid continuation template params: %w", err)
+		}
+	}
+	if attr, ok := result.Attributes["model"].(*types.AttributeValueMemberS); ok {
+		continuation.Model = attr.Value
+	}
+	if attr, ok := result.Attributes["messages"].(*types.AttributeValueMemberS); ok {
+		err = json.Unmarshal([]byte(attr.Value), &continuation.Messages)
+		if err != nil {
+			return continuation, false, fmt.Errorf("invalid continuation messages: %w", err)
+		}
+	}
+	return continuation, true, nil
+}
+
+// truncatedFrame stores the continuation of a truncated response and returns the frame telling the client about it.
+// Encrypted content is never stored, so the frame of an encrypted connection has no token and can't be resumed.
+func truncatedFrame(ctx context.Context, config Config, client *dynamodb.Client, userHash string, encrypted bool, delta Delta) Frame {
+	frame := Frame{Type: frameTypeTruncated, Model: delta.Model, Text: "Response reached the maximum length"}
+	if encrypted {
+		return frame
+	}
+	token, err := storeContinuation(ctx, client, config.ContinuationTable, userHash, *delta.Continuation)
+	if err != nil {
+		logFrom(ctx).Warn("Can't store continuation", "error", err)
+		return frame
+	}
+	frame.ContinuationToken = token
+	return frame
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+)
+
+const (
+	defaultConversationsTable      = "CONVERSATIONS"
+	defaultConversationTTL         = 30 * 24 * time.Hour
+	defaultConversationMaxMessages = 40
+	envConversationsTable          = "CONVERSATIONS_TABLE"
+	envConversationMaxMessages     = "CONVERSATION_MAX_MESSAGES"
+)
+
+// Conversation is the stored history of a multi-turn chat. The CONVERSATIONS table is keyed by
+// user_hash and conversation_id, connections only live for one reading.
+type Conversation struct {
+	Messages []Message
+	// Version is incremented on every store, so concurrent turns don't overwrite each other
+	Version int64
+}
+
+// loadConversationConfig reads the conversation settings into cfg
+func loadConversationConfig(cfg *Config) error {
+	cfg.ConversationsTable = os.Getenv(envConversationsTable)
+	if cfg.ConversationsTable == "" {
+		cfg.ConversationsTable = defaultConversationsTable
+	}
+	cfg.ConversationsTable = testmode.Table(cfg.ConversationsTable)
+
+	cfg.ConversationMaxMessages = defaultConversationMaxMessages
+	if limit := os.Getenv(envConversationMaxMessages); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 2 {
+			return fmt.Errorf("invalid message count in environment variable %s: %q", envConversationMaxMessages, limit)
+		}
+		cfg.ConversationMaxMessages = value
+	}
+	return nil
+}
+
+// conversationKey returns the key of a conversation item
+func conversationKey(userHash string, conversationID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"user_hash":       &types.AttributeValueMemberS{Value: userHash},
+		"conversation_id": &types.AttributeValueMemberS{Value: conversationID},
+	}
+}
+
+// getConversation returns the stored history, empty for a new conversation
+func getConversation(ctx context.Context, client *dynamodb.Client, tableName string, userHash string, conversationID string) (Conversation, error) {
+	var conversation Conversation
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		Key:            conversationKey(userHash, conversationID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return conversation, fmt.Errorf("failed to get conversation: %w", err)
+	}
+	if result.Item == nil {
+		return conversation, nil
+	}
+
+	// DynamoDB TTL deletes expired items lazily, an expired conversation starts over
+	if attr, ok := result.Item["expires_at"].(*types.AttributeValueMemberN); ok {
+		expiresAt, err := strconv.ParseInt(attr.Value, 10, 64)
+		if err == nil && time.Now().Unix() > expiresAt {
+			return conversation, nil
+		}
+	}
+
+	if attr, ok := result.Item["version"].(*types.AttributeValueMemberN); ok {
+		conversation.Version, err = strconv.ParseInt(attr.Value, 10, 64)
+		if err != nil {
+			return conversation, fmt.Errorf("invalid conversation version: %w", err)
+		}
+	}
+	if attr, ok := result.Item["messages"].(*types.AttributeValueMemberS); ok {
+		err = json.Unmarshal([]byte(attr.Value), &conversation.Messages)
+		if err != nil {
+			return conversation, fmt.Errorf("invalid conversation messages: %w", err)
+		}
+	}
+	return conversation, nil
+}
+
+// storeConversation writes the history if nobody stored a newer turn since it was loaded.
+// It returns false if the conversation changed in between.
+func storeConversation(ctx context.Context, client *dynamodb.Client, tableName string, userHash string, conversationID string, conversation Conversation) (bool, error) {
+	messages, err := json.Marshal(conversation.Messages)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal conversation messages: %w", err)
+	}
+
+	item := conversationKey(userHash, conversationID)
+	item["messages"] = &types.AttributeValueMemberS{Value: string(messages)}
+	item["version"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(conversation.Version+1, 10)}
+	item["updated_at"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)}
+	item["expires_at"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(defaultConversationTTL).Unix(), 10)}
+	if testmode.Enabled() {
+		item[testmode.AttrTestRecord] = &types.AttributeValueMemberBOOL{Value: true}
+	}
+
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(version) OR version = :version"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":version": &types.AttributeValueMemberN{Value: strconv.FormatInt(conversation.Version, 10)},
+		},
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to store conversation: %w", err)
+	}
+	return true, nil
+}
+
+// deleteConversation clears the history of a conversation
+func deleteConversation(ctx context.Context, client *dynamodb.Client, tableName string, userHash string, conversationID string) error {
+	_, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key:       conversationKey(userHash, conversationID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete conversation: %w", err)
+	}
+	return nil
+}
+
+// capHistory keeps the latest maxMessages messages. The history has to start with a user message,
+// so a leading assistant reply is dropped along with its question.
+func capHistory(messages []Message, maxMessages int) []Message {
+	if len(messages) > maxMessages {
+		messages = messages[len(messages)-maxMessages:]
+	}
+	for len(messages) > 0 && messages[0].Role != "user" {
+		messages = messages[1:]
+	}
+	return messages
+}
+
+// appendTurn adds a question and its answer to the history
+func appendTurn(conversation Conversation, question Message, answer string, maxMessages int) Conversation {
+	messages := append(append([]Message{}, conversation.Messages...), question)
+	messages = appendAssistantText(messages, answer)
+	conversation.Messages = capHistory(messages, maxMessages)
+	return conversation
+}
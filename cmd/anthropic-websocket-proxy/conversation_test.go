@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// recordingAnthropic streams stream for every call and records the requests it got
+func recordingAnthropic(t *testing.T, stream string) (*httptest.Server, func() []AnthropicRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	var requests []AnthropicRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request AnthropicRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			t.Errorf("Anthropic request isn't JSON: %v", err)
+		}
+		mu.Lock()
+		requests = append(requests, request)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, stream)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []AnthropicRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]AnthropicRequest{}, requests...)
+	}
+}
+
+// storedMessages decodes the history of a CONVERSATIONS PutItem
+func storedMessages(t *testing.T, call fakeDynamoCall) []Message {
+	t.Helper()
+	item := call.Input["Item"].(map[string]any)
+	var messages []Message
+	err := json.Unmarshal([]byte(item["messages"].(map[string]any)["S"].(string)), &messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
+
+func TestHandleSendMessageConversation(t *testing.T) {
+	question := Message{Role: "user", Content: "And the next card?"}
+	history := []Message{{Role: "user", Content: "Draw a card"}, {Role: "assistant", Content: "The Tower"}}
+	storedHistory := `{"Item": {
+		"user_hash": {"S": "user-1"},
+		"conversation_id": {"S": "chat-1"},
+		"version": {"N": "3"},
+		"messages": {"S": "[{\"role\":\"user\",\"content\":\"Draw a card\"},{\"role\":\"assistant\",\"content\":\"The Tower\"}]"}
+	}}`
+
+	tests := []struct {
+		name         string
+		body         string
+		conversation string
+		// sent is what Anthropic gets, stored the history written after the reading, nil if none is
+		sent    []Message
+		stored  []Message
+		version string
+		deleted bool
+	}{
+		{
+			name:    "new conversation",
+			body:    `{"prompt_template": "PROMPTS_TEST", "conversation_id": "chat-1", "messages": [{"role": "user", "content": "And the next card?"}]}`,
+			sent:    []Message{question},
+			stored:  []Message{question, {Role: "assistant", Content: "The Star"}},
+			version: "0",
+		},
+		{
+			name:         "rebuilt from history",
+			body:         `{"prompt_template": "PROMPTS_TEST", "conversation_id": "chat-1", "messages": [{"role": "user", "content": "And the next card?"}]}`,
+			conversation: storedHistory,
+			sent:         append(slices.Clone(history), question),
+			stored:       append(slices.Clone(history), question, Message{Role: "assistant", Content: "The Star"}),
+			version:      "3",
+		},
+		{
+			name:         "reset with a new question",
+			body:         `{"prompt_template": "PROMPTS_TEST", "conversation_id": "chat-1", "reset": true, "messages": [{"role": "user", "content": "And the next card?"}]}`,
+			conversation: storedHistory,
+			sent:         []Message{question},
+			stored:       []Message{question, {Role: "assistant", Content: "The Star"}},
+			version:      "0",
+			deleted:      true,
+		},
+		{
+			name:         "reset alone",
+			body:         `{"prompt_template": "PROMPTS_TEST", "conversation_id": "chat-1", "reset": true}`,
+			conversation: storedHistory,
+			deleted:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			anthropic, anthropicRequests := recordingAnthropic(t, streamOf("The Star"))
+			setTestConfig(t, anthropic)
+			t.Setenv(envAnthropicKey, t.Name())
+			responses := readingResponses(5)
+			if tt.conversation != "" {
+				responses["GetItem "+defaultConversationsTable] = tt.conversation
+			}
+			dynamo := newFakeDynamoDB(t, responses)
+			newTestWebSocketClient(t)
+
+			response, _ := handleSendMessage(context.Background(), testEvent("sendmessage", tt.body))
+			if response.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d: %s", response.StatusCode, response.Body)
+			}
+
+			if deletes := dynamo.Calls("DeleteItem", defaultConversationsTable); (len(deletes) == 1) != tt.deleted {
+				t.Errorf("conversation deleted %d times, want deleted %v", len(deletes), tt.deleted)
+			}
+
+			requests := anthropicRequests()
+			if tt.sent == nil {
+				if len(requests) != 0 {
+					t.Errorf("Anthropic was called %d times", len(requests))
+				}
+				return
+			}
+			if len(requests) != 1 {
+				t.Fatalf("Anthropic was called %d times", len(requests))
+			}
+			sent := make([]Message, 0, len(requests[0].Messages))
+			for _, msg := range requests[0].Messages {
+				sent = append(sent, Message(msg))
+			}
+			if !slices.Equal(sent, tt.sent) {
+				t.Errorf("sent %+v, want %+v", sent, tt.sent)
+			}
+
+			puts := dynamo.Calls("PutItem", defaultConversationsTable)
+			if len(puts) != 1 {
+				t.Fatalf("conversation stored %d times", len(puts))
+			}
+			if stored := storedMessages(t, puts[0]); !slices.Equal(stored, tt.stored) {
+				t.Errorf("stored %+v, want %+v", stored, tt.stored)
+			}
+			values := puts[0].Input["ExpressionAttributeValues"].(map[string]any)
+			if version := values[":version"].(map[string]any)["N"]; version != tt.version {
+				t.Errorf("stored on version %v, want %s", version, tt.version)
+			}
+		})
+	}
+}
+
+func TestAppendTurnCapsHistory(t *testing.T) {
+	var conversation Conversation
+	for i := 0; i < 3; i++ {
+		question := Message{Role: "user", Content: fmt.Sprintf("question %d", i)}
+		conversation = appendTurn(conversation, question, fmt.Sprintf("answer %d ", i), 4)
+	}
+
+	want := []Message{
+		{Role: "user", Content: "question 1"},
+		{Role: "assistant", Content: "answer 1"},
+		{Role: "user", Content: "question 2"},
+		{Role: "assistant", Content: "answer 2"},
+	}
+	if !slices.Equal(conversation.Messages, want) {
+		t.Errorf("history = %+v, want %+v", conversation.Messages, want)
+	}
+
+	// An odd cap would start the history with an answer, which is dropped along with its question
+	if capped := capHistory(want, 3); !slices.Equal(capped, want[2:]) {
+		t.Errorf("capHistory(3) = %+v", capped)
+	}
+}
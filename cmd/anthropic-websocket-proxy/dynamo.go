@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/connlimit"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+)
+
+const (
+	// inFlightTimeout matches the maximum Lambda run time
+	inFlightTimeout = 15 * time.Minute
+	// cancelPollInterval is how often a streaming reading checks whether the client stopped it
+	cancelPollInterval = time.Second
+)
+
+// newDynamoDBClient returns the DynamoDB client every handler uses
+var newDynamoDBClient = createDynamoDBClient
+
+// createDynamoDBClient creates a DynamoDB client from the default AWS config
+func createDynamoDBClient(ctx context.Context) (*dynamodb.Client, error) {
+	cfg, err := awsConfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %v", err)
+	}
+	return dynamodb.NewFromConfig(cfg), nil
+}
+
+// Connection is the state stored on a WS_CONNECTIONS item
+type Connection struct {
+	// Seq is the sequence number of the last frame sent on the connection
+	Seq  int64
+	Plan PlanSnapshot
+	// ClientKey is the X25519 public key of end-to-end encrypted connections
+	ClientKey []byte
+	// Compression is the frame compression negotiated at $connect, empty for none
+	Compression string
+	// DeploymentVersion is the version of the proxy that accepted the connection
+	DeploymentVersion string
+}
+
+// storeConnectionInDynamoDB records a new websocket connection with its frame sequence starting at 0.
+// The plan snapshot is only stored if the user is known. The item expires after ttl so DynamoDB TTL
+// removes the connections that never got a $disconnect.
+func storeConnectionInDynamoDB(ctx context.Context, client *dynamodb.Client, tableName string, connectionID string, connection Connection, ttl time.Duration) error {
+	now := time.Now()
+	item := map[string]types.AttributeValue{
+		"connection_id": &types.AttributeValueMemberS{Value: connectionID},
+		"connected_at":  &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		"seq":           &types.AttributeValueMemberN{Value: "0"},
+		"expires_at":    &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(ttl).Unix(), 10)},
+	}
+	if connection.DeploymentVersion != "" {
+		item["deployment_version"] = &types.AttributeValueMemberS{Value: connection.DeploymentVersion}
+	}
+	if len(connection.ClientKey) > 0 {
+		item["e2ee_public_key"] = &types.AttributeValueMemberB{Value: connection.ClientKey}
+	}
+	if connection.Compression != "" {
+		item["compression"] = &types.AttributeValueMemberS{Value: connection.Compression}
+	}
+	if testmode.Enabled() {
+		item[testmode.AttrTestRecord] = &types.AttributeValueMemberBOOL{Value: true}
+	}
+	if connection.Plan.UserHash != "" {
+		for name, value := range connection.Plan.Attributes() {
+			item[name] = value
+		}
+	}
+
+	_, err := client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store connection: %w", err)
+	}
+	return nil
+}
+
+// removeConnectionFromDynamoDB deletes the websocket connection record
+func removeConnectionFromDynamoDB(ctx context.Context, client *dynamodb.Client, tableName string, connectionID string) error {
+	_, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"connection_id": &types.AttributeValueMemberS{Value: connectionID},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove connection: %w", err)
+	}
+	return nil
+}
+
+// getConnection returns the connection's frame sequence, plan snapshot and negotiated options.
+// An expired item is treated like a missing one.
+func getConnection(ctx context.Context, client *dynamodb.Client, tableName string, connectionID string) (Connection, error) {
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"connection_id": &types.AttributeValueMemberS{Value: connectionID},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return Connection{}, fmt.Errorf("failed to get connection: %w", err)
+	}
+
+	// DynamoDB TTL deletes expired items lazily, a stale item must not resolve to its old user
+	if attr, ok := result.Item["expires_at"].(*types.AttributeValueMemberN); ok {
+		expiresAt, err := strconv.ParseInt(attr.Value, 10, 64)
+		if err == nil && time.Now().Unix() > expiresAt {
+			return Connection{}, nil
+		}
+	}
+
+	connection := Connection{Plan: planSnapshotFromItem(result.Item)}
+	if attr, ok := result.Item["e2ee_public_key"].(*types.AttributeValueMemberB); ok {
+		connection.ClientKey = attr.Value
+	}
+	if attr, ok := result.Item["compression"].(*types.AttributeValueMemberS); ok {
+		connection.Compression = attr.Value
+	}
+	seqAttr, ok := result.Item["seq"].(*types.AttributeValueMemberN)
+	if !ok {
+		return connection, nil
+	}
+	connection.Seq, err = strconv.ParseInt(seqAttr.Value, 10, 64)
+	return connection, err
+}
+
+// saveConnectionSequence advances the stored sequence number from the value read at the start of the request.
+// The condition fails if another request on the same connection moved the sequence in the meantime
+// or the connection record is already gone.
+func saveConnectionSequence(ctx context.Context, client *dynamodb.Client, tableName string, connectionID string, from, to int64) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"connection_id": &types.AttributeValueMemberS{Value: connectionID},
+		},
+		UpdateExpression:    aws.String("SET seq = :to"),
+		ConditionExpression: aws.String("attribute_exists(connection_id) AND seq = :from"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":from": &types.AttributeValueMemberN{Value: strconv.FormatInt(from, 10)},
+			":to":   &types.AttributeValueMemberN{Value: strconv.FormatInt(to, 10)},
+		},
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return fmt.Errorf("connection sequence changed concurrently or connection is gone: %w", err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save connection sequence: %w", err)
+	}
+	return nil
+}
+
+// errConnectionGone is returned for a connection whose item was already removed by $disconnect or TTL
+var errConnectionGone = errors.New("connection is gone")
+
+// markRequestInFlight flags the connection as busy. It returns false if another request already holds the flag,
+// and errConnectionGone if the connection has no item, which is left missing rather than recreated without a TTL.
+// Flags older than the maximum Lambda run time are ignored so a crashed invocation can't block the connection forever.
+func markRequestInFlight(ctx context.Context, client *dynamodb.Client, tableName string, connectionID string) (bool, error) {
+	now := time.Now()
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"connection_id": &types.AttributeValueMemberS{Value: connectionID},
+		},
+		UpdateExpression:    aws.String("SET in_flight = :now"),
+		ConditionExpression: aws.String("attribute_exists(connection_id) AND (attribute_not_exists(in_flight) OR in_flight < :stale)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now":   &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+			":stale": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(-inFlightTimeout).Unix(), 10)},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		if conditionErr.Item == nil {
+			return false, errConnectionGone
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to mark request in flight: %w", err)
+	}
+	return true, nil
+}
+
+// clearRequestInFlight removes the busy flag set by markRequestInFlight
+func clearRequestInFlight(ctx context.Context, client *dynamodb.Client, tableName string, connectionID string) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"connection_id": &types.AttributeValueMemberS{Value: connectionID},
+		},
+		UpdateExpression:    aws.String("REMOVE in_flight, cancel_requested"),
+		ConditionExpression: aws.String("attribute_exists(connection_id)"),
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		// The connection was already removed by $disconnect
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to clear request in flight: %w", err)
+	}
+	return nil
+}
+
+// requestCancel flags the reading in flight on a connection as stopped by the client.
+// It returns false if no reading is in flight.
+func requestCancel(ctx context.Context, client *dynamodb.Client, tableName string, connectionID string) (bool, error) {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"connection_id": &types.AttributeValueMemberS{Value: connectionID},
+		},
+		UpdateExpression:    aws.String("SET cancel_requested = :now"),
+		ConditionExpression: aws.String("attribute_exists(in_flight)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+		},
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to request cancel: %w", err)
+	}
+	return true, nil
+}
+
+// cancelRequested reports whether the client stopped the reading in flight on a connection
+func cancelRequested(ctx context.Context, client *dynamodb.Client, tableName string, connectionID string) (bool, error) {
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"connection_id": &types.AttributeValueMemberS{Value: connectionID},
+		},
+		ProjectionExpression: aws.String("cancel_requested"),
+		ConsistentRead:       aws.Bool(true),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to check cancel: %w", err)
+	}
+	_, ok := result.Item["cancel_requested"]
+	return ok, nil
+}
+
+// countMessage counts a message in the connection's current rate window. It returns false once the connection
+// sent limit messages in the window. Messages on connections without an item, e.g. expired ones, aren't limited.
+func countMessage(ctx context.Context, client *dynamodb.Client, tableName string, connectionID string, limit int64, now time.Time) (bool, error) {
+	key := map[string]types.AttributeValue{
+		"connection_id": &types.AttributeValueMemberS{Value: connectionID},
+	}
+	names := map[string]string{
+		"#window": connlimit.AttrWindow,
+		"#count":  connlimit.AttrCount,
+	}
+	values := map[string]types.AttributeValue{
+		":window": &types.AttributeValueMemberN{Value: strconv.FormatInt(connlimit.WindowStart(now), 10)},
+		":one":    &types.AttributeValueMemberN{Value: "1"},
+		":limit":  &types.AttributeValueMemberN{Value: strconv.FormatInt(limit, 10)},
+	}
+
+	// Count the message in the current window, or start a new window if the stored one is over
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       key,
+		UpdateExpression:          aws.String("SET #count = #count + :one"),
+		ConditionExpression:       aws.String("#window = :window AND #count < :limit"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if !errors.As(err, &conditionErr) {
+		if err != nil {
+			return false, fmt.Errorf("failed to count message: %w", err)
+		}
+		return true, nil
+	}
+	// DynamoDB rejects unused expression values
+	delete(values, ":limit")
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                           aws.String(tableName),
+		Key:                                 key,
+		UpdateExpression:                    aws.String("SET #window = :window, #count = :one"),
+		ConditionExpression:                 aws.String("attribute_exists(connection_id) AND (attribute_not_exists(#window) OR #window < :window)"),
+		ExpressionAttributeNames:            names,
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	if errors.As(err, &conditionErr) {
+		return conditionErr.Item == nil, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to count message: %w", err)
+	}
+	return true, nil
+}
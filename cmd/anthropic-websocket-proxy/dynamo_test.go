@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStoreConnectionSetsExpiry(t *testing.T) {
+	dynamo := newFakeDynamoDB(t, nil)
+	client, err := newDynamoDBClient(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now().Unix()
+	err = storeConnectionInDynamoDB(context.Background(), client, defaultConnectionsTable, testConnectionID, Connection{}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	puts := dynamo.Calls("PutItem", defaultConnectionsTable)
+	if len(puts) != 1 {
+		t.Fatalf("connection stored %d times", len(puts))
+	}
+	value, _ := attr(puts[0], "expires_at", "N").(string)
+	expiresAt, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		t.Fatalf("expires_at = %q: %v", value, err)
+	}
+	if expiresAt < before+3600 || expiresAt > time.Now().Unix()+3600 {
+		t.Errorf("expires_at = %d, want an hour from %d", expiresAt, before)
+	}
+}
+
+func TestGetConnectionIgnoresExpiredItems(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresAt string
+		userHash  string
+	}{
+		{"no expiry", "", testUserHash},
+		{"live", fmt.Sprintf(`, "expires_at": {"N": "%d"}`, time.Now().Add(time.Hour).Unix()), testUserHash},
+		{"expired", fmt.Sprintf(`, "expires_at": {"N": "%d"}`, time.Now().Add(-time.Minute).Unix()), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newFakeDynamoDB(t, map[string]string{
+				"GetItem " + defaultConnectionsTable: fmt.Sprintf(`{"Item": {"connection_id": {"S": %q}, "seq": {"N": "4"}, "user_hash": {"S": %q}%s}}`, testConnectionID, testUserHash, tt.expiresAt),
+			})
+			client, err := newDynamoDBClient(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			connection, err := getConnection(context.Background(), client, defaultConnectionsTable, testConnectionID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if connection.Plan.UserHash != tt.userHash {
+				t.Errorf("user = %q, want %q", connection.Plan.UserHash, tt.userHash)
+			}
+		})
+	}
+}
+
+func TestHandleSendMessageRejectsExpiredConnection(t *testing.T) {
+	setTestConfig(t, unreachableAnthropic(t))
+	t.Setenv(envAnthropicKey, t.Name())
+	responses := readingResponses(5)
+	responses["GetItem "+defaultConnectionsTable] = fmt.Sprintf(`{"Item": {
+		"connection_id": {"S": %q},
+		"seq": {"N": "0"},
+		"user_hash": {"S": %q},
+		"expires_at": {"N": "%d"}
+	}}`, testConnectionID, testUserHash, time.Now().Add(-time.Minute).Unix())
+	newFakeDynamoDB(t, responses)
+	wsClient := newTestWebSocketClient(t)
+
+	// The stale row must not resolve to its old user
+	response, _ := handleSendMessage(context.Background(), testEvent("sendmessage", readingBody))
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d: %s", response.StatusCode, http.StatusUnauthorized, response.Body)
+	}
+	if len(wsClient.deleted) != 1 {
+		t.Errorf("connection closed %d times, want once", len(wsClient.deleted))
+	}
+}
+
+func TestMarkRequestInFlight(t *testing.T) {
+	busy := `{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException","message":"The conditional request failed","Item":{"connection_id":{"S":"conn-1"},"in_flight":{"N":"1700000000"}}}`
+
+	tests := []struct {
+		name     string
+		response string
+		acquired bool
+		gone     bool
+		err      bool
+	}{
+		{name: "acquired", response: "{}", acquired: true},
+		{name: "busy", response: busy},
+		{name: "missing row", response: conditionFailed, gone: true, err: true},
+		{name: "DynamoDB failure", response: internalError, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dynamo := newFakeDynamoDB(t, map[string]string{"UpdateItem " + defaultConnectionsTable: tt.response})
+			client, err := newDynamoDBClient(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			acquired, err := markRequestInFlight(context.Background(), client, defaultConnectionsTable, testConnectionID)
+			if acquired != tt.acquired || (err != nil) != tt.err || errors.Is(err, errConnectionGone) != tt.gone {
+				t.Errorf("markRequestInFlight() = %v, %v", acquired, err)
+			}
+			// The flag is only set on an existing row, a missing one isn't recreated without its TTL
+			calls := dynamo.Calls("UpdateItem", defaultConnectionsTable)
+			if len(calls) != 1 || !strings.HasPrefix(calls[0].Input["ConditionExpression"].(string), "attribute_exists(connection_id) AND ") {
+				t.Errorf("UpdateItem calls = %+v", calls)
+			}
+		})
+	}
+}
+
+func TestHandleSendMessageRejectsMissingConnection(t *testing.T) {
+	setTestConfig(t, unreachableAnthropic(t))
+	t.Setenv(envAnthropicKey, t.Name())
+	responses := readingResponses(5)
+	responses["UpdateItem "+defaultConnectionsTable] = conditionFailed
+	newFakeDynamoDB(t, responses)
+	wsClient := newTestWebSocketClient(t)
+
+	response, _ := handleSendMessage(context.Background(), testEvent("sendmessage", readingBody))
+	if response.StatusCode != http.StatusGone {
+		t.Fatalf("status = %d, want %d: %s", response.StatusCode, http.StatusGone, response.Body)
+	}
+	if frames := wsClient.Frames(t); len(frames) != 1 || frames[0].Type != frameTypeError {
+		t.Errorf("frames = %+v, want one error frame", frames)
+	}
+	if len(wsClient.deleted) != 1 {
+		t.Errorf("connection closed %d times, want once", len(wsClient.deleted))
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	// e2eeQueryParam carries the client's base64 encoded X25519 public key on the $connect URL
+	e2eeQueryParam = "e2ee_key"
+	// frameTypeKey carries the wrapped content key, it is sent before the first encrypted frame of a request
+	frameTypeKey = "key"
+
+	contentKeySize = 32
+	// kekLabel separates the key wrapping KDF from any other use of the shared secret
+	kekLabel = "anthropic-websocket-proxy e2ee v1"
+)
+
+// WrappedKey is the content key of a request, encrypted for the client.
+// The client derives the wrapping key as SHA-256(label || X25519(client private, ephemeral public) || ephemeral public || client public)
+// and opens WrappedKey with AES-256-GCM, the nonce prepended to the ciphertext.
+type WrappedKey struct {
+	EphemeralPublicKey string `json:"ephemeral_public_key"`
+	WrappedKey         string `json:"wrapped_key"`
+}
+
+// SealedPayload is the plaintext of an encrypted frame's ciphertext. The ciphertext is sealed with the
+// frame's seq and type as additional data, see frameAAD, so a relay can't reorder, replay or retype frames.
+type SealedPayload struct {
+	Text string       `json:"text,omitempty"`
+	Card *CardMeaning `json:"card,omitempty"`
+}
+
+// frameSealer encrypts frame payloads with the content key of one request
+type frameSealer struct {
+	aead cipher.AEAD
+}
+
+// parseClientKey decodes the X25519 public key sent on $connect
+func parseClientKey(encoded string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(encoded)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s encoding: %w", e2eeQueryParam, err)
+	}
+	_, err = ecdh.X25519().NewPublicKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", e2eeQueryParam, err)
+	}
+	return key, nil
+}
+
+// newAEAD returns AES-256-GCM with key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce, returning nonce || ciphertext
+func seal(aead cipher.AEAD, plaintext []byte, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// frameAAD returns the additional data a frame's ciphertext is bound to:
+// the seq as 8 bytes big-endian followed by the type
+func frameAAD(seq int64, frameType string) []byte {
+	aad := binary.BigEndian.AppendUint64(nil, uint64(seq))
+	return append(aad, frameType...)
+}
+
+// newFrameSealer creates a random content key for one request and the key frame wrapping it for the client.
+// The content key only lives in memory for the duration of the request.
+func newFrameSealer(clientKey []byte) (*frameSealer, Frame, error) {
+	curve := ecdh.X25519()
+	clientPublic, err := curve.NewPublicKey(clientKey)
+	if err != nil {
+		return nil, Frame{}, fmt.Errorf("invalid client key: %w", err)
+	}
+	ephemeral, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, Frame{}, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	shared, err := ephemeral.ECDH(clientPublic)
+	if err != nil {
+		return nil, Frame{}, fmt.Errorf("failed to derive shared secret: %w", err)
+	}
+
+	kdf := sha256.New()
+	kdf.Write([]byte(kekLabel))
+	kdf.Write(shared)
+	kdf.Write(ephemeral.PublicKey().Bytes())
+	kdf.Write(clientKey)
+	kek, err := newAEAD(kdf.Sum(nil))
+	if err != nil {
+		return nil, Frame{}, err
+	}
+
+	contentKey := make([]byte, contentKeySize)
+	_, err = rand.Read(contentKey)
+	if err != nil {
+		return nil, Frame{}, fmt.Errorf("failed to generate content key: %w", err)
+	}
+	wrapped, err := seal(kek, contentKey, nil)
+	if err != nil {
+		return nil, Frame{}, fmt.Errorf("failed to wrap content key: %w", err)
+	}
+	aead, err := newAEAD(contentKey)
+	if err != nil {
+		return nil, Frame{}, err
+	}
+
+	keyFrame := Frame{
+		Type: frameTypeKey,
+		Key: &WrappedKey{
+			EphemeralPublicKey: base64.StdEncoding.EncodeToString(ephemeral.PublicKey().Bytes()),
+			WrappedKey:         base64.StdEncoding.EncodeToString(wrapped),
+		},
+	}
+	return &frameSealer{aead: aead}, keyFrame, nil
+}
+
+// sealFrame moves the text and card of a frame into its ciphertext, other fields stay readable.
+// The frame's seq must be set, it is authenticated with the type.
+func (s *frameSealer) sealFrame(frame Frame) (Frame, error) {
+	if frame.Text == "" && frame.Card == nil {
+		return frame, nil
+	}
+	plaintext, err := json.Marshal(SealedPayload{Text: frame.Text, Card: frame.Card})
+	if err != nil {
+		return frame, fmt.Errorf("failed to marshal frame payload: %w", err)
+	}
+	ciphertext, err := seal(s.aead, plaintext, frameAAD(frame.Seq, frame.Type))
+	if err != nil {
+		return frame, fmt.Errorf("failed to encrypt frame payload: %w", err)
+	}
+	frame.Text = ""
+	frame.Card = nil
+	frame.Ciphertext = base64.StdEncoding.EncodeToString(ciphertext)
+	return frame, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+// openSealed is the client side of seal
+func openSealed(t *testing.T, aead cipher.AEAD, encoded string, additionalData []byte) ([]byte, error) {
+	t.Helper()
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// clientContentKey unwraps the content key of a key frame the way the client does
+func clientContentKey(t *testing.T, clientPrivate *ecdh.PrivateKey, keyFrame Frame) cipher.AEAD {
+	t.Helper()
+	ephemeralBytes, err := base64.StdEncoding.DecodeString(keyFrame.Key.EphemeralPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(ephemeralBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := clientPrivate.ECDH(ephemeral)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kdf := sha256.New()
+	kdf.Write([]byte(kekLabel))
+	kdf.Write(shared)
+	kdf.Write(ephemeralBytes)
+	kdf.Write(clientPrivate.PublicKey().Bytes())
+	kek, err := newAEAD(kdf.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contentKey, err := openSealed(t, kek, keyFrame.Key.WrappedKey, nil)
+	if err != nil {
+		t.Fatalf("can't unwrap content key: %v", err)
+	}
+	aead, err := newAEAD(contentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+func TestSealFrameBindsSeqAndType(t *testing.T) {
+	clientPrivate, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealer, keyFrame, err := newFrameSealer(clientPrivate.PublicKey().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead := clientContentKey(t, clientPrivate, keyFrame)
+
+	sealed, err := sealer.sealFrame(Frame{Seq: 7, Type: frameTypeDelta, Text: "The Tower"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed.Text != "" || sealed.Ciphertext == "" {
+		t.Fatalf("frame text isn't sealed: %+v", sealed)
+	}
+
+	tests := []struct {
+		name      string
+		seq       int64
+		frameType string
+		opens     bool
+	}{
+		{"same frame", 7, frameTypeDelta, true},
+		{"replayed at another seq", 8, frameTypeDelta, false},
+		{"reordered before", 6, frameTypeDelta, false},
+		{"retyped", 7, frameTypeError, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext, err := openSealed(t, aead, sealed.Ciphertext, frameAAD(tt.seq, tt.frameType))
+			if (err == nil) != tt.opens {
+				t.Fatalf("open error = %v, want opened %v", err, tt.opens)
+			}
+			if !tt.opens {
+				return
+			}
+			var payload SealedPayload
+			err = json.Unmarshal(plaintext, &payload)
+			if err != nil || payload.Text != "The Tower" {
+				t.Errorf("payload = %+v, %v", payload, err)
+			}
+		})
+	}
+}
+
+func TestFrameSenderSealsWithTheSentSeq(t *testing.T) {
+	clientPrivate, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealer, keyFrame, err := newFrameSealer(clientPrivate.PublicKey().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead := clientContentKey(t, clientPrivate, keyFrame)
+
+	client := &fakeWebSocketClient{}
+	sender := newFrameSender(client, "conn-1", 41)
+	sender.sealer = sealer
+	err = sender.Send(context.Background(), Frame{Type: frameTypeDelta, Text: "sealed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames := client.Frames(t)
+	if len(frames) != 1 || frames[0].Seq != 42 {
+		t.Fatalf("frames = %+v", frames)
+	}
+	_, err = openSealed(t, aead, frames[0].Ciphertext, frameAAD(frames[0].Seq, frames[0].Type))
+	if err != nil {
+		t.Errorf("frame doesn't open with its own seq and type: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+const (
+	testConnectionID = "conn-1"
+	testUserHash     = "user-1"
+
+	// conditionFailed is the DynamoDB error of a failed condition expression
+	conditionFailed = `{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException","message":"The conditional request failed"}`
+	// internalError is a DynamoDB error other than a failed condition
+	internalError = `{"__type":"com.amazonaws.dynamodb.v20120810#InternalServerError","message":"Internal server error"}`
+)
+
+// fakeWebSocketClient records the messages posted to it
+type fakeWebSocketClient struct {
+	mu      sync.Mutex
+	posted  []string
+	deleted []string
+	// goneAfter makes every post after the first goneAfter fail with a GoneException, 0 never does
+	goneAfter int
+	// beforePost runs before every post if set
+	beforePost func()
+	// closedAfter is how many messages were posted when the connection was last closed
+	closedAfter int
+}
+
+func (c *fakeWebSocketClient) PostToConnection(ctx context.Context, params *apigatewaymanagementapi.PostToConnectionInput, optFns ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.PostToConnectionOutput, error) {
+	if c.beforePost != nil {
+		c.beforePost()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.goneAfter > 0 && len(c.posted) >= c.goneAfter {
+		return nil, &types.GoneException{Message: aws.String("connection is gone")}
+	}
+	c.posted = append(c.posted, string(params.Data))
+	return &apigatewaymanagementapi.PostToConnectionOutput{}, nil
+}
+
+func (c *fakeWebSocketClient) DeleteConnection(ctx context.Context, params *apigatewaymanagementapi.DeleteConnectionInput, optFns ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.DeleteConnectionOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deleted = append(c.deleted, aws.ToString(params.ConnectionId))
+	c.closedAfter = len(c.posted)
+	return &apigatewaymanagementapi.DeleteConnectionOutput{}, nil
+}
+
+// Frames decodes the posted messages
+func (c *fakeWebSocketClient) Frames(t *testing.T) []Frame {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	frames := make([]Frame, 0, len(c.posted))
+	for _, message := range c.posted {
+		var frame Frame
+		err := json.Unmarshal([]byte(message), &frame)
+		if err != nil {
+			t.Fatalf("posted message %q is not a frame: %v", message, err)
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// fakeDynamoCall is one request the fake DynamoDB received
+type fakeDynamoCall struct {
+	Operation string
+	Table     string
+	Input     map[string]any
+}
+
+// fakeDynamoDB serves the DynamoDB JSON protocol from canned responses
+type fakeDynamoDB struct {
+	mu sync.Mutex
+	// responses maps "Operation Table", e.g. "GetItem USERS", to the response body. Operations without
+	// a response get {}, a body with a __type is returned as an error.
+	responses map[string]string
+	calls     []fakeDynamoCall
+}
+
+// newFakeDynamoDB makes newDynamoDBClient return a client of the fake for the rest of the test
+func newFakeDynamoDB(t *testing.T, responses map[string]string) *fakeDynamoDB {
+	t.Helper()
+	fake := &fakeDynamoDB{responses: responses}
+	server := httptest.NewServer(http.HandlerFunc(fake.serveHTTP))
+	t.Cleanup(server.Close)
+
+	client := dynamodb.New(dynamodb.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String(server.URL),
+		Credentials:      aws.AnonymousCredentials{},
+		RetryMaxAttempts: 1,
+	})
+	previous := newDynamoDBClient
+	newDynamoDBClient = func(ctx context.Context) (*dynamodb.Client, error) {
+		return client, nil
+	}
+	t.Cleanup(func() { newDynamoDBClient = previous })
+	return fake
+}
+
+func (f *fakeDynamoDB) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.")
+	var input map[string]any
+	body, _ := io.ReadAll(r.Body)
+	_ = json.Unmarshal(body, &input)
+	table, _ := input["TableName"].(string)
+
+	f.mu.Lock()
+	f.calls = append(f.calls, fakeDynamoCall{Operation: operation, Table: table, Input: input})
+	response, ok := f.responses[operation+" "+table]
+	f.mu.Unlock()
+
+	if !ok {
+		response = "{}"
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	if strings.Contains(response, "__type") {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	_, _ = io.WriteString(w, response)
+}
+
+// Calls returns the requests of operation on table
+func (f *fakeDynamoDB) Calls(operation string, table string) []fakeDynamoCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var calls []fakeDynamoCall
+	for _, call := range f.calls {
+		if call.Operation == operation && call.Table == table {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// newTestWebSocketClient makes newWebSocketClient return a fake client for the rest of the test
+func newTestWebSocketClient(t *testing.T) *fakeWebSocketClient {
+	t.Helper()
+	client := &fakeWebSocketClient{}
+	previous := newWebSocketClient
+	newWebSocketClient = func(ctx context.Context, callbackURL string) (WebSocketClient, error) {
+		return client, nil
+	}
+	t.Cleanup(func() { newWebSocketClient = previous })
+	return client
+}
+
+// setTestConfig points the config at anthropic and allows the PROMPTS_TEST template
+func setTestConfig(t *testing.T, anthropic *httptest.Server) {
+	t.Helper()
+	t.Setenv(envAnthropicURL, anthropic.URL)
+	t.Setenv(envAnthropicKey, "test-key")
+	t.Setenv("PROMPTS_TEST", "You read tarot cards.")
+}
+
+// testEvent returns a websocket event of routeKey on the test connection
+func testEvent(routeKey string, body string) events.APIGatewayWebsocketProxyRequest {
+	var event events.APIGatewayWebsocketProxyRequest
+	event.RequestContext.ConnectionID = testConnectionID
+	event.RequestContext.RouteKey = routeKey
+	event.RequestContext.RequestID = "request-1"
+	event.RequestContext.DomainName = "ws.example.com"
+	event.RequestContext.Stage = "test"
+	event.Body = body
+	return event
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	awsV1 "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/health"
+)
+
+const (
+	// The fallback provider has to speak the Anthropic Messages API, e.g. another Anthropic account or a gateway
+	envFallbackURL       = "ANTHROPIC_FALLBACK_URL"
+	envFallbackKey       = "ANTHROPIC_FALLBACK_KEY"
+	envFallbackModel     = "ANTHROPIC_FALLBACK_MODEL"
+	envFallbackProvider  = "ANTHROPIC_FALLBACK_PROVIDER"
+	envFallbackWindow    = "FALLBACK_WINDOW"
+	envFallbackMinErrors = "FALLBACK_MIN_ERRORS"
+	envOpsAlertTopic     = "OPS_ALERT_TOPIC_ARN"
+
+	providerAnthropic        = "anthropic"
+	defaultFallbackProvider  = "fallback"
+	defaultFallbackWindow    = 5 * time.Minute
+	defaultFallbackMinErrors = 5
+	// failoverComponent is written to SERVICE_HEALTH once per window, so ops are alerted once per failover
+	failoverComponent = "anthropic_failover"
+)
+
+// FallbackConfig is the secondary provider readings go to while Anthropic is failing
+type FallbackConfig struct {
+	URL   string
+	Keys  []string
+	Model string
+	// Provider tags the frames of readings answered by the fallback
+	Provider string
+	// Anthropic is considered down when at least MinErrors of its calls in the last Window failed,
+	// at the outage error rate of the status page
+	Window    time.Duration
+	MinErrors int64
+	// AlertTopicARN is the SNS topic ops are alerted on when readings fail over, no alert if empty
+	AlertTopicARN string
+}
+
+// Enabled reports whether a fallback provider is configured
+func (f FallbackConfig) Enabled() bool {
+	return f.URL != "" && len(f.Keys) > 0 && f.Model != ""
+}
+
+// loadFallbackConfig reads the fallback provider settings into cfg
+func loadFallbackConfig(cfg *Config) error {
+	cfg.Fallback = FallbackConfig{
+		URL:           os.Getenv(envFallbackURL),
+		Keys:          parseList(os.Getenv(envFallbackKey)),
+		Model:         os.Getenv(envFallbackModel),
+		Provider:      os.Getenv(envFallbackProvider),
+		Window:        defaultFallbackWindow,
+		MinErrors:     defaultFallbackMinErrors,
+		AlertTopicARN: os.Getenv(envOpsAlertTopic),
+	}
+	if cfg.Fallback.Provider == "" {
+		cfg.Fallback.Provider = defaultFallbackProvider
+	}
+
+	if window := os.Getenv(envFallbackWindow); window != "" {
+		duration, err := time.ParseDuration(window)
+		if err != nil || duration < health.BucketSize {
+			return fmt.Errorf("invalid duration in environment variable %s, at least %s: %q", envFallbackWindow, health.BucketSize, window)
+		}
+		cfg.Fallback.Window = duration
+	}
+
+	if minErrors := os.Getenv(envFallbackMinErrors); minErrors != "" {
+		value, err := strconv.ParseInt(minErrors, 10, 64)
+		if err != nil || value < 1 {
+			return fmt.Errorf("invalid error count in environment variable %s: %q", envFallbackMinErrors, minErrors)
+		}
+		cfg.Fallback.MinErrors = value
+	}
+	return nil
+}
+
+// withFallback returns the config with the fallback provider in place of Anthropic.
+// Model overrides and second opinions name Anthropic models, so they don't apply to the fallback.
+func (c Config) withFallback() Config {
+	c.AnthropicURL = c.Fallback.URL
+	c.AnthropicKeys = c.Fallback.Keys
+	c.AnthropicModel = c.Fallback.Model
+	c.ModelOverrides = nil
+	c.SecondOpinionModels = nil
+	return c
+}
+
+// anthropicCounts sums Anthropic's call outcomes over the fallback window
+func anthropicCounts(ctx context.Context, config Config, client *dynamodb.Client) (health.Counts, error) {
+	var counts health.Counts
+	paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+		TableName:              aws.String(config.HealthTable),
+		KeyConditionExpression: aws.String("#component = :component AND #bucket >= :start"),
+		ExpressionAttributeNames: map[string]string{
+			"#component": health.AttrComponent,
+			"#bucket":    health.AttrBucket,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":component": &types.AttributeValueMemberS{Value: health.ComponentAnthropic},
+			":start":     &types.AttributeValueMemberN{Value: strconv.FormatInt(health.Bucket(time.Now().Add(-config.Fallback.Window)), 10)},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return counts, fmt.Errorf("failed to query Anthropic health: %w", err)
+		}
+		for _, item := range page.Items {
+			counts.OK += getNumberAttribute(item, health.AttrOK)
+			counts.Errors += getNumberAttribute(item, health.AttrErrors)
+		}
+	}
+	return counts, nil
+}
+
+// chooseProvider returns the config and name of the provider a reading goes to: Anthropic, or the fallback
+// while Anthropic is down. Without readable health counts the reading goes to Anthropic.
+func chooseProvider(ctx context.Context, config Config, client *dynamodb.Client) (Config, string) {
+	if !config.Fallback.Enabled() {
+		return config, providerAnthropic
+	}
+	counts, err := anthropicCounts(ctx, config, client)
+	if err != nil {
+		logFrom(ctx).Warn("Can't check Anthropic health, not failing over", "error", err)
+		return config, providerAnthropic
+	}
+	if counts.Errors < config.Fallback.MinErrors || counts.ErrorRate() < health.DefaultThresholds.Outage {
+		return config, providerAnthropic
+	}
+	logFrom(ctx).Warn("Anthropic is failing, failing over", "errors", counts.Errors, "calls", counts.Total(), "window", config.Fallback.Window.String(), "provider", config.Fallback.Provider)
+	alertFailover(ctx, config, client, counts)
+	return config.withFallback(), config.Fallback.Provider
+}
+
+// alertFailover tells ops that readings fail over, once per window across all containers.
+// Failures are logged only, the reading goes on either way.
+func alertFailover(ctx context.Context, config Config, client *dynamodb.Client, counts health.Counts) {
+	if config.Fallback.AlertTopicARN == "" {
+		return
+	}
+	now := time.Now()
+	window := now.Truncate(config.Fallback.Window)
+	_, err := client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(config.HealthTable),
+		Item: map[string]types.AttributeValue{
+			health.AttrComponent: &types.AttributeValueMemberS{Value: failoverComponent},
+			health.AttrBucket:    &types.AttributeValueMemberN{Value: strconv.FormatInt(window.Unix(), 10)},
+			health.AttrExpiresAt: &types.AttributeValueMemberN{Value: strconv.FormatInt(health.ExpiresAt(now), 10)},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(#component)"),
+		ExpressionAttributeNames: map[string]string{
+			"#component": health.AttrComponent,
+		},
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return
+	}
+	if err != nil {
+		logFrom(ctx).Warn("Can't record failover alert", "error", err)
+		return
+	}
+
+	// SNS isn't a dependency of the AWS SDK v2 modules yet, so this uses the v1 client like the other lambdas
+	sess, err := session.NewSession()
+	if err != nil {
+		logFrom(ctx).Warn("Can't alert ops about the failover", "error", err)
+		return
+	}
+	_, err = sns.New(sess).PublishWithContext(ctx, &sns.PublishInput{
+		TopicArn: awsV1.String(config.Fallback.AlertTopicARN),
+		Subject:  awsV1.String("Anthropic proxy failed over to " + config.Fallback.Provider),
+		Message: awsV1.String(fmt.Sprintf("Anthropic failed %d of %d calls in the last %s. Readings go to %s (%s) until its error rate drops.",
+			counts.Errors, counts.Total(), config.Fallback.Window, config.Fallback.Provider, config.Fallback.Model)),
+	})
+	if err != nil {
+		logFrom(ctx).Warn("Can't alert ops about the failover", "error", err)
+	}
+}
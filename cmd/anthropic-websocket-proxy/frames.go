@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/auth"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/connlimit"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/quota"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestid"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/validation"
+)
+
+const (
+	frameTypeDelta = "delta"
+	frameTypeDone  = "done"
+	frameTypeBusy  = "busy"
+	frameTypeUsage = "usage"
+	frameTypeError = "error"
+	// frameTypeAccountSuspended is sent instead of a response when the user is suspended or banned
+	frameTypeAccountSuspended = "account_suspended"
+	// frameTypeQuotaExceeded is sent instead of a response when the quota policy refuses the request,
+	// or after it when the balance ran out before the reading could be charged
+	frameTypeQuotaExceeded = "quota_exceeded"
+	// frameTypeReconnect is sent by connections-drain before it closes connections of an older deployment
+	frameTypeReconnect = "reconnect"
+	// frameTypeCancelled ends a reading the client stopped with a stop action
+	frameTypeCancelled = "cancelled"
+	// frameTypeThrottled refuses a message over the connection's size or rate limit, see pkg/connlimit
+	frameTypeThrottled = connlimit.FrameType
+
+	maxPostAttempts  = 3
+	postRetryBackoff = 100 * time.Millisecond
+)
+
+// Frame is a single message sent to the websocket client.
+// Seq increases by one for every frame on a connection, so clients can detect gaps.
+// Frames with Seq 0 are sent outside the sequence, e.g. busy replies while another request owns the connection.
+type Frame struct {
+	Seq  int64  `json:"seq"`
+	Type string `json:"type"`
+	// Text is base64 of the compressed text when Encoding is set
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	// Model identifies the model that produced a delta or usage frame
+	Model string `json:"model,omitempty"`
+	// Provider identifies the provider that answered the reading, anthropic unless it failed over
+	Provider string `json:"provider,omitempty"`
+	// RequestID identifies the request the frame belongs to, for matching client reports with logs
+	RequestID string `json:"request_id,omitempty"`
+	// Card is set on card frames of structured readings
+	Card *CardMeaning `json:"card,omitempty"`
+	// Usage is set on usage frames, sent right before the done frame
+	Usage *Usage `json:"usage,omitempty"`
+	// Key is set on key frames of end-to-end encrypted connections
+	Key *WrappedKey `json:"key,omitempty"`
+	// Ciphertext replaces Text and Card on end-to-end encrypted connections, see SealedPayload
+	Ciphertext string `json:"ciphertext,omitempty"`
+	// ContinuationToken is set on truncated frames, a request with it resumes the response
+	ContinuationToken string `json:"continuation_token,omitempty"`
+	// Quota is set on quota_exceeded frames
+	Quota *quota.Decision `json:"quota,omitempty"`
+	// Suspension is set on account_suspended frames
+	Suspension *auth.Suspension `json:"suspension,omitempty"`
+	// Errors lists the invalid request fields on error frames
+	Errors validation.Errors `json:"errors,omitempty"`
+	// Throttle is set on throttled frames
+	Throttle *connlimit.Throttle `json:"throttle,omitempty"`
+}
+
+// FrameSender posts sequenced frames to a single connection, one at a time and in order
+type FrameSender struct {
+	client       WebSocketClient
+	connectionID string
+	seq          int64
+	// sealer encrypts frame payloads on end-to-end encrypted connections, nil otherwise
+	sealer *frameSealer
+	// compression compresses large frame texts, encrypted frames are never compressed
+	compression string
+	// provider tags every frame of the reading, see Frame.Provider
+	provider string
+	// Deltas are coalesced into one frame until flushBytes of text are buffered, Flush is called
+	// or another frame is sent. Every delta is sent right away with flushBytes 0.
+	flushBytes   int
+	pendingModel string
+	pendingText  strings.Builder
+}
+
+// newFrameSender returns a FrameSender continuing after the last sequence number sent on the connection
+func newFrameSender(client WebSocketClient, connectionID string, lastSeq int64) *FrameSender {
+	return &FrameSender{
+		client:       client,
+		connectionID: connectionID,
+		seq:          lastSeq,
+	}
+}
+
+// Seq returns the sequence number of the last frame sent
+func (s *FrameSender) Seq() int64 {
+	return s.seq
+}
+
+// SendDelta buffers a text delta of model, sending the buffered text once it reaches flushBytes.
+// Buffered text of another model is sent first, so the deltas of each model stay in order.
+func (s *FrameSender) SendDelta(ctx context.Context, model string, text string) error {
+	if s.pendingText.Len() > 0 && model != s.pendingModel {
+		err := s.Flush(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	s.pendingModel = model
+	s.pendingText.WriteString(text)
+	if s.pendingText.Len() < s.flushBytes {
+		return nil
+	}
+	return s.Flush(ctx)
+}
+
+// Flush sends the buffered delta text, if any
+func (s *FrameSender) Flush(ctx context.Context) error {
+	if s.pendingText.Len() == 0 {
+		return nil
+	}
+	frame := Frame{Type: frameTypeDelta, Model: s.pendingModel, Text: s.pendingText.String()}
+	s.pendingText.Reset()
+	return s.post(ctx, frame)
+}
+
+// Send flushes the buffered delta text and sends frame after it
+func (s *FrameSender) Send(ctx context.Context, frame Frame) error {
+	err := s.Flush(ctx)
+	if err != nil {
+		return err
+	}
+	return s.post(ctx, frame)
+}
+
+// post assigns the next sequence number to frame and posts it, retrying transient failures
+// before returning so later frames can't overtake it
+func (s *FrameSender) post(ctx context.Context, frame Frame) error {
+	// The seq is assigned first, encrypted frames authenticate it
+	frame.Seq = s.seq + 1
+	if s.sealer != nil {
+		sealed, err := s.sealer.sealFrame(frame)
+		if err != nil {
+			return err
+		}
+		frame = sealed
+	} else {
+		compressed, err := compressFrame(frame, s.compression)
+		if err != nil {
+			return err
+		}
+		frame = compressed
+	}
+	frame.RequestID = requestid.FromContext(ctx)
+	frame.Provider = s.provider
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return fmt.Errorf("failed to marshal frame: %w", err)
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = sendWebSocketMessage(ctx, s.client, s.connectionID, string(data))
+		if err == nil {
+			s.seq = frame.Seq
+			return nil
+		}
+		if attempt >= maxPostAttempts || !isRetryablePostError(err) {
+			return err
+		}
+
+		select {
+		case <-time.After(postRetryBackoff * time.Duration(1<<(attempt-1))):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// sendUnsequencedFrame posts a frame with Seq 0 without touching the connection sequence
+func sendUnsequencedFrame(ctx context.Context, client WebSocketClient, connectionID string, frame Frame) error {
+	frame.Seq = 0
+	frame.RequestID = requestid.FromContext(ctx)
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return fmt.Errorf("failed to marshal frame: %w", err)
+	}
+	return sendWebSocketMessage(ctx, client, connectionID, string(data))
+}
+
+// isGoneError reports whether a send failed because the client disconnected
+func isGoneError(err error) bool {
+	var gone *types.GoneException
+	return errors.As(err, &gone)
+}
+
+// isRetryablePostError reports whether a PostToConnection error is worth retrying.
+// A gone or forbidden connection and an oversized payload will fail again.
+func isRetryablePostError(err error) bool {
+	var gone *types.GoneException
+	var forbidden *types.ForbiddenException
+	var tooLarge *types.PayloadTooLargeException
+	return !errors.As(err, &gone) && !errors.As(err, &forbidden) && !errors.As(err, &tooLarge)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+)
+
+// endlessAnthropic streams deltas until its request is cancelled, which closes the returned channel
+func endlessAnthropic(t *testing.T) (*httptest.Server, <-chan struct{}) {
+	t.Helper()
+	cancelled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":10}}}\n\n")
+		for {
+			fmt.Fprint(w, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"delta\":{\"type\":\"text_delta\",\"text\":\"The Tower \"}}\n\n")
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				close(cancelled)
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, cancelled
+}
+
+func TestIsGoneError(t *testing.T) {
+	gone := &types.GoneException{Message: aws.String("gone")}
+	if !isGoneError(fmt.Errorf("failed to send: %w", gone)) {
+		t.Error("wrapped GoneException isn't gone")
+	}
+	if isGoneError(&types.ForbiddenException{Message: aws.String("forbidden")}) || isGoneError(errors.New("timeout")) {
+		t.Error("other send errors are gone")
+	}
+	if isRetryablePostError(gone) {
+		t.Error("GoneException is retried")
+	}
+}
+
+func TestHandleSendMessageCancelsCallsWhenClientIsGone(t *testing.T) {
+	anthropic, cancelled := endlessAnthropic(t)
+	setTestConfig(t, anthropic)
+	t.Setenv(envAnthropicKey, t.Name())
+	dynamo := newFakeDynamoDB(t, readingResponses(5))
+	wsClient := newTestWebSocketClient(t)
+	wsClient.goneAfter = 2
+
+	done := make(chan events.APIGatewayProxyResponse, 1)
+	go func() {
+		response, _ := handleSendMessage(context.Background(), testEvent("sendmessage", readingBody))
+		done <- response
+	}()
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Anthropic request wasn't cancelled after the client was gone")
+	}
+	var response events.APIGatewayProxyResponse
+	select {
+	case response = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler didn't return after the client was gone")
+	}
+
+	if response.StatusCode != http.StatusGone {
+		t.Errorf("status = %d, want %d: %s", response.StatusCode, http.StatusGone, response.Body)
+	}
+	if frames := wsClient.Frames(t); len(frames) != 2 {
+		t.Errorf("posted %d frames, want the 2 sent before the client was gone", len(frames))
+	}
+	// The broken-off call is recorded as interrupted and not charged
+	puts := dynamo.Calls("PutItem", defaultUsageTable)
+	if len(puts) != 1 || attr(puts[0], "interrupted", "BOOL") != true {
+		t.Errorf("usage = %+v, want one interrupted record", puts)
+	}
+	if charges := dynamo.Calls("UpdateItem", users.TableName); len(charges) != 0 {
+		t.Errorf("interrupted reading was charged %d times", len(charges))
+	}
+}
+
+func TestFrameSenderCoalescesDeltas(t *testing.T) {
+	ctx := context.Background()
+	client := &fakeWebSocketClient{}
+	sender := newFrameSender(client, testConnectionID, 0)
+	sender.flushBytes = 10
+
+	// Each step sends a delta, ticks the flush interval or sends another frame, and lists the frames posted by then
+	steps := []struct {
+		name   string
+		send   func() error
+		frames []Frame
+	}{
+		{"below the threshold", func() error { return sender.SendDelta(ctx, "opus", "The ") }, nil},
+		{"still below", func() error { return sender.SendDelta(ctx, "opus", "Tow") }, nil},
+		{"reaches the threshold", func() error { return sender.SendDelta(ctx, "opus", "er ") }, []Frame{
+			{Seq: 1, Type: frameTypeDelta, Model: "opus", Text: "The Tower "},
+		}},
+		{"buffered again", func() error { return sender.SendDelta(ctx, "opus", "means") }, nil},
+		{"interval ticks", func() error { return sender.Flush(ctx) }, []Frame{
+			{Seq: 2, Type: frameTypeDelta, Model: "opus", Text: "means"},
+		}},
+		{"interval ticks with nothing buffered", func() error { return sender.Flush(ctx) }, nil},
+		{"another model", func() error {
+			err := sender.SendDelta(ctx, "opus", " change")
+			if err != nil {
+				return err
+			}
+			return sender.SendDelta(ctx, "haiku", "Upheaval")
+		}, []Frame{
+			{Seq: 3, Type: frameTypeDelta, Model: "opus", Text: " change"},
+		}},
+		{"final flush before done", func() error { return sender.Send(ctx, Frame{Type: frameTypeDone}) }, []Frame{
+			{Seq: 4, Type: frameTypeDelta, Model: "haiku", Text: "Upheaval"},
+			{Seq: 5, Type: frameTypeDone},
+		}},
+	}
+	posted := 0
+	for _, step := range steps {
+		err := step.send()
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		frames := client.Frames(t)[posted:]
+		posted += len(frames)
+		if len(frames) != len(step.frames) {
+			t.Fatalf("%s: posted %+v, want %+v", step.name, frames, step.frames)
+		}
+		for i, frame := range frames {
+			want := step.frames[i]
+			if frame.Seq != want.Seq || frame.Type != want.Type || frame.Model != want.Model || frame.Text != want.Text {
+				t.Errorf("%s: posted %+v, want %+v", step.name, frame, want)
+			}
+		}
+	}
+}
+
+func TestFrameSenderWithoutCoalescing(t *testing.T) {
+	client := &fakeWebSocketClient{}
+	sender := newFrameSender(client, testConnectionID, 0)
+	for _, text := range []string{"The", " Tower"} {
+		err := sender.SendDelta(context.Background(), "opus", text)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	frames := client.Frames(t)
+	if len(frames) != 2 || frames[0].Text != "The" || frames[1].Text != " Tower" {
+		t.Errorf("frames = %+v, want every delta on its own", frames)
+	}
+}
+
+func TestHandleSendMessageCoalescesDeltas(t *testing.T) {
+	setTestConfig(t, anthropicServer(t, http.StatusOK, streamOf("The", " Tower", " means", " change")))
+	t.Setenv(envAnthropicKey, t.Name())
+	// The interval never fires, the deltas are only sent by the flush before the usage frame
+	t.Setenv(envDeltaFlushInterval, "1h")
+	newFakeDynamoDB(t, readingResponses(5))
+	wsClient := newTestWebSocketClient(t)
+
+	response, _ := handleSendMessage(context.Background(), testEvent("sendmessage", readingBody))
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", response.StatusCode, response.Body)
+	}
+	frames := wsClient.Frames(t)
+	if got := frameTypes(frames); !slices.Equal(got, []string{frameTypeDelta, frameTypeUsage, frameTypeDone}) {
+		t.Fatalf("frames = %v", got)
+	}
+	if frames[0].Text != "The Tower means change" {
+		t.Errorf("delta = %q", frames[0].Text)
+	}
+}
+
+func TestHandleSendMessageFlushesDeltasOnTick(t *testing.T) {
+	ticks := make(chan time.Time)
+	previousTicker := newFlushTicker
+	newFlushTicker = func(interval time.Duration) (<-chan time.Time, func()) {
+		return ticks, func() {}
+	}
+	t.Cleanup(func() { newFlushTicker = previousTicker })
+
+	// The call ticks once between its deltas. The handler takes the tick only once it has buffered every
+	// delta sent before it, and flushes before it reads the next one.
+	previousCall := callModel
+	callModel = func(ctx context.Context, config Config, req Request, model string, connectionID string, textChan chan<- Delta, doneChan chan<- Usage) error {
+		textChan <- Delta{Model: model, Text: "The"}
+		textChan <- Delta{Model: model, Text: " Tower"}
+		for len(textChan) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+		select {
+		case ticks <- time.Now():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		textChan <- Delta{Model: model, Text: " means"}
+		textChan <- Delta{Model: model, Text: " change"}
+		doneChan <- Usage{Model: model, InputTokens: 10, OutputTokens: 20, TotalTokens: 30}
+		return nil
+	}
+	t.Cleanup(func() { callModel = previousCall })
+	setTestConfig(t, unreachableAnthropic(t))
+	newFakeDynamoDB(t, readingResponses(5))
+	wsClient := newTestWebSocketClient(t)
+
+	response, _ := handleSendMessage(context.Background(), testEvent("sendmessage", readingBody))
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", response.StatusCode, response.Body)
+	}
+	frames := wsClient.Frames(t)
+	if got := frameTypes(frames); !slices.Equal(got, []string{frameTypeDelta, frameTypeDelta, frameTypeUsage, frameTypeDone}) {
+		t.Fatalf("frames = %v", got)
+	}
+	// The tick ends the first frame, the flush before the usage frame ends the second
+	if frames[0].Text != "The Tower" || frames[1].Text != " means change" {
+		t.Errorf("deltas = %q, %q", frames[0].Text, frames[1].Text)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/health"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/validation"
+)
+
+// providerFailed reports whether a failed call counts against Anthropic's health.
+// Requests Anthropic rejected as invalid and readings that failed validation are not its fault.
+func providerFailed(err error) bool {
+	var streamErr *StreamError
+	var apiErr *AnthropicError
+	var readingErrs validation.Errors
+	switch {
+	case errors.As(err, &streamErr):
+		return true
+	case errors.As(err, &apiErr):
+		return apiErr.ClientStatus() == http.StatusBadGateway
+	case errors.As(err, &readingErrs):
+		return false
+	default:
+		return true
+	}
+}
+
+// recordLLMHealth counts the outcome of a reading for the status page, and for the failover decision
+// if Anthropic answered it. Failures are logged only, the status page is best effort.
+func recordLLMHealth(ctx context.Context, config Config, client *dynamodb.Client, provider string, failed bool) {
+	recordHealth(ctx, config, client, health.ComponentLLM, failed)
+	if provider == providerAnthropic {
+		recordHealth(ctx, config, client, health.ComponentAnthropic, failed)
+	}
+}
+
+// recordHealth counts an outcome of the component in the current bucket
+func recordHealth(ctx context.Context, config Config, client *dynamodb.Client, component string, failed bool) {
+	now := time.Now()
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(config.HealthTable),
+		Key: map[string]types.AttributeValue{
+			health.AttrComponent: &types.AttributeValueMemberS{Value: component},
+			health.AttrBucket:    &types.AttributeValueMemberN{Value: strconv.FormatInt(health.Bucket(now), 10)},
+		},
+		UpdateExpression: aws.String("ADD #count :one SET #expires = :expires"),
+		ExpressionAttributeNames: map[string]string{
+			"#count":   health.CounterAttr(failed),
+			"#expires": health.AttrExpiresAt,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":     &types.AttributeValueMemberN{Value: "1"},
+			":expires": &types.AttributeValueMemberN{Value: strconv.FormatInt(health.ExpiresAt(now), 10)},
+		},
+	})
+	if err != nil {
+		logFrom(ctx).Warn("Can't record health", "component", component, "error", err)
+	}
+}
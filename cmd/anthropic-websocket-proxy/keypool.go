@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultKeyCooldown is used when a 429 response has no retry-after header
+const defaultKeyCooldown = 30 * time.Second
+
+// poolKey is one Anthropic API key with its usage in this container
+type poolKey struct {
+	key           string
+	uses          int64
+	throttled     int64
+	cooldownUntil time.Time
+}
+
+// KeyPool spreads Anthropic calls over several API keys, picking the least used key that isn't cooling down after a 429
+type KeyPool struct {
+	mu   sync.Mutex
+	keys []*poolKey
+}
+
+var (
+	// keyPools are shared between warm invocations so throttled keys stay in cooldown, one per provider
+	keyPools   = make(map[string]*KeyPool)
+	keyPoolsMu sync.Mutex
+)
+
+// getKeyPool returns the container's key pool for the configured keys, created on first use
+func getKeyPool(keys []string) *KeyPool {
+	keyPoolsMu.Lock()
+	defer keyPoolsMu.Unlock()
+	id := strings.Join(keys, ",")
+	pool, ok := keyPools[id]
+	if !ok {
+		pool = newKeyPool(keys)
+		keyPools[id] = pool
+	}
+	return pool
+}
+
+func newKeyPool(keys []string) *KeyPool {
+	pool := &KeyPool{}
+	for _, key := range keys {
+		pool.keys = append(pool.keys, &poolKey{key: key})
+	}
+	return pool
+}
+
+// parseList splits a comma-separated list such as the API keys, dropping empty entries
+func parseList(list string) []string {
+	var keys []string
+	for _, key := range strings.Split(list, ",") {
+		key = strings.TrimSpace(key)
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Size returns the number of keys in the pool
+func (p *KeyPool) Size() int {
+	return len(p.keys)
+}
+
+// Acquire returns the least used key that isn't cooling down.
+// If every key is cooling down, the one that recovers first is returned rather than failing the request.
+func (p *KeyPool) Acquire(now time.Time) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var best *poolKey
+	for _, candidate := range p.keys {
+		if best == nil {
+			best = candidate
+			continue
+		}
+		bestCooling := now.Before(best.cooldownUntil)
+		candidateCooling := now.Before(candidate.cooldownUntil)
+		switch {
+		case bestCooling && !candidateCooling:
+			best = candidate
+		case bestCooling && candidateCooling && candidate.cooldownUntil.Before(best.cooldownUntil):
+			best = candidate
+		case !bestCooling && !candidateCooling && candidate.uses < best.uses:
+			best = candidate
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	best.uses++
+	return best.key
+}
+
+// Throttled puts key into cooldown after a 429 response, for as long as the retry-after header asks
+func (p *KeyPool) Throttled(ctx context.Context, key string, header http.Header, now time.Time) {
+	cooldown := defaultKeyCooldown
+	if seconds, err := strconv.Atoi(header.Get("retry-after")); err == nil && seconds > 0 {
+		cooldown = time.Duration(seconds) * time.Second
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, candidate := range p.keys {
+		if candidate.key == key {
+			candidate.throttled++
+			candidate.cooldownUntil = now.Add(cooldown)
+			// Log a key prefix only, never the whole key
+			logFrom(ctx).Warn("Anthropic key throttled", "key_prefix", key[:min(len(key), 12)], "throttled", candidate.throttled, "cooldown", cooldown.String())
+		}
+	}
+}
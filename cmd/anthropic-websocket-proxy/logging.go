@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+const (
+	// envLogLevel is debug, info, warn or error. Request and response content is only logged at debug.
+	envLogLevel     = "LOG_LEVEL"
+	defaultLogLevel = slog.LevelInfo
+)
+
+type loggerKey struct{}
+
+// parseLogLevel returns the level named by value, the default level if value is empty or unknown
+func parseLogLevel(value string) slog.Level {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(strings.TrimSpace(value)))
+	if value == "" || err != nil {
+		return defaultLogLevel
+	}
+	return level
+}
+
+// newLogger returns a JSON logger writing lines at level or above to w
+func newLogger(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}))
+}
+
+// withLogger returns a context carrying logger, see logFrom
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// logFrom returns the logger of the request ctx belongs to, with its connection, route and request id attributes.
+// Outside of a request it returns the default logger.
+func logFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// withUser returns a context whose logger tags every line with the user
+func withUser(ctx context.Context, userHash string) context.Context {
+	if userHash == "" {
+		return ctx
+	}
+	return withLogger(ctx, logFrom(ctx).With(userAttr(userHash)))
+}
+
+// userAttr returns the user_hash log attribute. The hash is hashed again, so log lines of a user can be
+// grouped but not joined with USERS.
+func userAttr(userHash string) slog.Attr {
+	sum := sha256.Sum256([]byte(userHash))
+	return slog.String("user_hash", hex.EncodeToString(sum[:8]))
+}
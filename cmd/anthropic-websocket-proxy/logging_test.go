@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// captureLogs makes the default logger write JSON lines at level to the returned builder for the rest of the test
+func captureLogs(t *testing.T, level slog.Level) *strings.Builder {
+	t.Helper()
+	var logs strings.Builder
+	previous := slog.Default()
+	slog.SetDefault(newLogger(&logs, level))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &logs
+}
+
+// logEntries decodes the captured JSON lines
+func logEntries(t *testing.T, logs string) []map[string]any {
+	t.Helper()
+	var entries []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(logs), "\n") {
+		var entry map[string]any
+		err := json.Unmarshal([]byte(line), &entry)
+		if err != nil {
+			t.Fatalf("log line %q isn't JSON: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestParseLogLevel(t *testing.T) {
+	tests := map[string]slog.Level{
+		"":        defaultLogLevel,
+		"debug":   slog.LevelDebug,
+		"WARN":    slog.LevelWarn,
+		" error ": slog.LevelError,
+		"verbose": defaultLogLevel,
+	}
+	for value, want := range tests {
+		if level := parseLogLevel(value); level != want {
+			t.Errorf("parseLogLevel(%q) = %v, want %v", value, level, want)
+		}
+	}
+}
+
+func TestHandleRequestLogsWithoutContent(t *testing.T) {
+	question := "Will I find the lost ring of my grandmother?"
+	answer := "The Star promises hope"
+	body := `{"prompt_template": "PROMPTS_TEST", "messages": [{"role": "user", "content": "` + question + `"}]}`
+
+	tests := []struct {
+		name  string
+		level slog.Level
+		// content is whether the question and answer may appear in the logs
+		content bool
+	}{
+		{"info", slog.LevelInfo, false},
+		{"debug", slog.LevelDebug, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, anthropicServer(t, http.StatusOK, streamOf(answer)))
+			t.Setenv(envAnthropicKey, t.Name())
+			newFakeDynamoDB(t, readingResponses(5))
+			newTestWebSocketClient(t)
+			logs := captureLogs(t, tt.level)
+
+			response, _ := handleRequest(context.Background(), testEvent("sendmessage", body))
+			if response.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d: %s", response.StatusCode, response.Body)
+			}
+
+			output := logs.String()
+			if hasContent := strings.Contains(output, question) || strings.Contains(output, answer); hasContent != tt.content {
+				t.Errorf("content logged = %v, want %v:\n%s", hasContent, tt.content, output)
+			}
+			// Every line of the request can be found by its connection, route and request id
+			for _, entry := range logEntries(t, output) {
+				if entry["connection_id"] != testConnectionID || entry["route_key"] != "sendmessage" || entry["request_id"] != "request-1" {
+					t.Errorf("log line without request attributes: %v", entry)
+				}
+			}
+		})
+	}
+}
+
+func TestUserAttrHashesTheUser(t *testing.T) {
+	attr := userAttr(testUserHash)
+	if attr.Key != "user_hash" || attr.Value.String() == testUserHash || len(attr.Value.String()) != 16 {
+		t.Errorf("userAttr() = %v", attr)
+	}
+	if userAttr(testUserHash).Value.String() != attr.Value.String() {
+		t.Error("userAttr() isn't stable, a user's lines can't be grouped")
+	}
+}
+
+func TestReadAnthropicErrorLogsWithTheRequest(t *testing.T) {
+	var logs strings.Builder
+	ctx := withLogger(context.Background(), newLogger(&logs, slog.LevelInfo).With("connection_id", testConnectionID))
+	server := anthropicServer(t, http.StatusBadGateway, "upstream connect error")
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	readAnthropicError(ctx, resp)
+	entries := logEntries(t, logs.String())
+	if len(entries) != 1 || entries[0]["connection_id"] != testConnectionID {
+		t.Errorf("logged %v, want one line of the request", entries)
+	}
+}
@@ -5,27 +5,96 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsConfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/archive"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/auth"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/connlimit"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/flags"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/health"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/prompts"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/quota"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestbody"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestid"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/softconfig"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/validation"
 )
 
 const (
 	defaultAnthropicModel   = "claude-3-5-sonnet-2024062"
 	defaultAnthropicVersion = "2023-06-01"
+	defaultResponseCacheTTL = 24 * time.Hour
+	defaultMaxTokens        = 1024
 	connectRouteKey         = "$connect"
 	disconnectRouteKey      = "$disconnect"
 	envAnthropicURL         = "ANTHROPIC_URL"
 	envAnthropicKey         = "ANTHROPIC_KEY"
 	envAnthropicModel       = "ANTHROPIC_MODEL"
 	envAnthropicVersion     = "ANTHROPIC_VERSION"
+	envResponseCacheTable   = "RESPONSE_CACHE_TABLE"
+	envResponseCacheTTL     = "RESPONSE_CACHE_TTL"
+	envWSCallbackURL        = "WS_CALLBACK_URL"
+	envAnthropicProxyURL    = "ANTHROPIC_PROXY_URL"
+	envAnthropicModelMap    = "ANTHROPIC_MODEL_MAP"
+	envPricingTable         = "PRICING_TABLE"
+	envUsageTable           = "USAGE_TABLE"
+	envSecondOpinionModels  = "ANTHROPIC_SECOND_OPINION_MODELS"
+	envDeploymentVersion    = "DEPLOYMENT_VERSION"
+	envConnectionsTable     = "WS_CONNECTIONS_TABLE"
+	envAuthTable            = "AUTH_TABLE"
+	envUsersTable           = "USERS_TABLE"
+	envStreamLineLimit      = "ANTHROPIC_STREAM_LINE_LIMIT"
+	envMaxTokensLimit       = "MAX_TOKENS_LIMIT"
+	envClampGeneration      = "CLAMP_GENERATION_PARAMS"
+	envMergeMessages        = "MERGE_CONSECUTIVE_MESSAGES"
+	envAnthropicHTTPTimeout = "ANTHROPIC_HTTP_TIMEOUT"
+	envConnectionTTL        = "WS_CONNECTION_TTL"
+	defaultConnectionsTable = "WS_CONNECTIONS"
+	defaultAuthTable        = "AUTH"
+	awsDomainSuffix         = ".amazonaws.com"
+	flagResponseCache       = "enable_response_cache"
+	// defaultStreamLineLimit is the longest SSE line accepted, large system prompts come back in message_start
+	defaultStreamLineLimit = 1024 * 1024
+	streamBufferSize       = 64 * 1024
+	defaultMaxTokensLimit  = 4096
+	maxTemperature         = 1.0
+	// defaultAnthropicHTTPTimeout leaves room for Anthropic to queue the request before it starts streaming
+	defaultAnthropicHTTPTimeout = 60 * time.Second
+	// defaultConnectionTTL matches the longest API Gateway websocket connection
+	defaultConnectionTTL = 2 * time.Hour
+	// actionStop cancels the reading streaming on the connection
+	actionStop = "stop"
+	// Deltas are coalesced into frames of defaultDeltaFlushBytes, or what arrived within defaultDeltaFlushInterval
+	envDeltaFlushBytes        = "DELTA_FLUSH_BYTES"
+	envDeltaFlushInterval     = "DELTA_FLUSH_INTERVAL"
+	defaultDeltaFlushBytes    = 512
+	defaultDeltaFlushInterval = 150 * time.Millisecond
+	// Requests with more messages or longer messages are rejected before any input tokens are spent
+	envMaxMessages         = "MAX_MESSAGES"
+	envMaxMessageChars     = "MAX_MESSAGE_CHARS"
+	defaultMaxMessages     = 40
+	defaultMaxMessageChars = 8000
 )
 
 type Message struct {
@@ -34,8 +103,38 @@ type Message struct {
 }
 
 type Request struct {
+	// Action is empty for a new reading, or actionStop to cancel the reading streaming on the connection
+	Action         string    `json:"action,omitempty"`
 	PromptTemplate string    `json:"prompt_template"`
 	Messages       []Message `json:"messages"`
+	NoCache        bool      `json:"no_cache,omitempty"`
+	// TemplateParams renders the system prompt as a text/template with these values, see prompts.Render
+	TemplateParams map[string]interface{} `json:"template_params,omitempty"`
+	// SecondOpinion names a second model to stream the same prompt from in parallel
+	SecondOpinion string `json:"second_opinion,omitempty"`
+	// Structured asks for the reading as card, summary and advice frames instead of prose
+	Structured bool `json:"structured,omitempty"`
+	// ContinuationToken resumes a truncated response, the prompt and messages come from the stored continuation
+	ContinuationToken string `json:"continuation_token,omitempty"`
+	// ConversationID continues a stored conversation, messages then holds only the new user message
+	ConversationID string `json:"conversation_id,omitempty"`
+	// Reset clears the stored history of ConversationID before the new message, if any
+	Reset bool `json:"reset,omitempty"`
+	// MaxTokens and Temperature override the defaults within the limits of the config, see validateGeneration
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+
+	// encrypted is set for connections with end-to-end encryption, their content is neither cached nor logged
+	encrypted bool
+}
+
+// Delta is a piece of response text from one model, the complete reading in structured mode,
+// or the continuation of a response that hit max_tokens
+type Delta struct {
+	Model        string
+	Text         string
+	Reading      *Reading
+	Continuation *Continuation
 }
 
 type AnthropicResponse struct {
@@ -60,15 +159,96 @@ type AnthropicRequest struct {
 	MaxTokens   int                `json:"max_tokens"`
 	Messages    []AnthropicMessage `json:"messages"`
 	Stream      bool               `json:"stream,omitempty"`
-	Temperature float64            `json:"temperature,omitempty"`
+	Temperature *float64           `json:"temperature,omitempty"`
 	System      string             `json:"system,omitempty"`
+	Tools       []Tool             `json:"tools,omitempty"`
+	ToolChoice  *ToolChoice        `json:"tool_choice,omitempty"`
+}
+
+// quotaPolicy decides whether users may make a request and refills their balance, loaded once in main
+var quotaPolicy = quota.DefaultPolicy()
+
+// featureFlags is shared between warm invocations so the flags table isn't scanned on every message
+var featureFlags = flags.NewStore(os.Getenv(flags.EnvTableName), flags.DefaultTTL)
+
+// runtimeConfig overrides the reloadable settings from the runtime config table between warm invocations
+var runtimeConfig = softconfig.NewStore(os.Getenv(softconfig.EnvTableName), softconfig.DefaultInterval, reloadable)
+
+// reloadable reports whether a setting may be changed through the runtime config table. Secrets, endpoints
+// and table names are only changed by a deploy.
+func reloadable(name string) bool {
+	switch name {
+	case prompts.EnvAllowlist, envAnthropicModelMap, envMaxTokensLimit, envDeltaFlushBytes, envDeltaFlushInterval,
+		envFallbackWindow, envFallbackMinErrors, archive.EnvSampleRate, connlimit.EnvMaxMessageBytes, connlimit.EnvMessagesPerMinute,
+		envMaxMessages, envMaxMessageChars:
+		return true
+	}
+	return strings.HasPrefix(name, prompts.Prefix)
+}
+
+// ModelOverride sets the model and max tokens for one prompt template
+type ModelOverride struct {
+	Model     string `json:"model"`
+	MaxTokens int    `json:"max_tokens"`
 }
 
 type Config struct {
-	AnthropicURL     string
-	AnthropicKey     string
-	AnthropicModel   string
-	AnthropicVersion string
+	AnthropicURL string
+	// AnthropicKeys are used in rotation, ANTHROPIC_KEY may hold a comma-separated list
+	AnthropicKeys      []string
+	AnthropicModel     string
+	AnthropicVersion   string
+	ResponseCacheTable string
+	ResponseCacheTTL   time.Duration
+	WSCallbackURL      string
+	// AnthropicProxyURL is an egress proxy used only for Anthropic calls, so the AWS SDK clients
+	// can keep using VPC endpoints (configured with the standard AWS_ENDPOINT_URL_<SERVICE> variables)
+	AnthropicProxyURL *url.URL
+	// ModelOverrides maps prompt templates to a cheaper or more capable model than the default,
+	// e.g. {"INDEED_PROMPT": {"model": "claude-3-haiku-20240307", "max_tokens": 512}}
+	ModelOverrides map[string]ModelOverride
+	PricingTable   string
+	UsageTable     string
+	// SecondOpinionModels are the models clients may ask for a second opinion from, none if empty
+	SecondOpinionModels []string
+	// ContinuationTable stores the context of truncated responses until the client resumes them
+	ContinuationTable string
+	// ConnectionsTable, AuthTable and UsersTable let stacks sharing an account use their own tables
+	ConnectionsTable string
+	AuthTable        string
+	UsersTable       string
+	// Retry applies to throttled, overloaded and dropped calls before the response starts streaming
+	Retry RetryPolicy
+	// StreamLineLimit is the longest line accepted from the Anthropic event stream, in bytes
+	StreamLineLimit int
+	// ConversationsTable stores multi-turn histories, capped at ConversationMaxMessages messages
+	ConversationsTable      string
+	ConversationMaxMessages int
+	// MaxTokensLimit is the highest max_tokens a client may ask for. With ClampGeneration, out of range
+	// max_tokens and temperature are clamped instead of rejected.
+	MaxTokensLimit  int
+	ClampGeneration bool
+	// HealthTable counts reading outcomes for the status page, see pkg/health
+	HealthTable string
+	// MergeMessages repairs consecutive messages with the same role instead of rejecting them
+	MergeMessages bool
+	// AnthropicHTTPTimeout bounds connecting to Anthropic and waiting for its response headers
+	AnthropicHTTPTimeout time.Duration
+	// ConnectionTTL is how long a WS_CONNECTIONS item outlives its connection if $disconnect never runs
+	ConnectionTTL time.Duration
+	// Archive samples readings of consenting users to S3, see pkg/archive
+	Archive archive.Config
+	// Fallback takes the readings while Anthropic is failing
+	Fallback FallbackConfig
+	// DeltaFlushBytes and DeltaFlushInterval bound how long deltas are buffered before they are posted,
+	// 0 bytes posts every delta on its own
+	DeltaFlushBytes    int
+	DeltaFlushInterval time.Duration
+	// ConnectionLimits cap the size and rate of the messages a connection sends
+	ConnectionLimits connlimit.Limits
+	// MaxMessages and MaxMessageChars cap the messages of a request, 0 is no limit
+	MaxMessages     int
+	MaxMessageChars int
 }
 
 // createResponse creates an API Gateway response with a specified message and status code
@@ -93,13 +273,28 @@ func createResponse(message string, statusCode int, headers map[string]string) (
 // loadConfig loads configuration from environment variables
 func loadConfig() (Config, error) {
 	cfg := Config{
-		AnthropicURL:     os.Getenv(envAnthropicURL),
-		AnthropicKey:     os.Getenv(envAnthropicKey),
-		AnthropicModel:   os.Getenv(envAnthropicModel),
-		AnthropicVersion: os.Getenv(envAnthropicVersion),
+		AnthropicURL:        os.Getenv(envAnthropicURL),
+		AnthropicKeys:       parseList(os.Getenv(envAnthropicKey)),
+		AnthropicModel:      os.Getenv(envAnthropicModel),
+		AnthropicVersion:    os.Getenv(envAnthropicVersion),
+		ResponseCacheTable:  os.Getenv(envResponseCacheTable),
+		ResponseCacheTTL:    defaultResponseCacheTTL,
+		WSCallbackURL:       os.Getenv(envWSCallbackURL),
+		PricingTable:        os.Getenv(envPricingTable),
+		UsageTable:          os.Getenv(envUsageTable),
+		SecondOpinionModels: parseList(os.Getenv(envSecondOpinionModels)),
+		ContinuationTable:   os.Getenv(envContinuationTable),
+		ConnectionsTable:    os.Getenv(envConnectionsTable),
+		AuthTable:           os.Getenv(envAuthTable),
+		UsersTable:          os.Getenv(envUsersTable),
+		StreamLineLimit:     defaultStreamLineLimit,
+		MaxTokensLimit:      defaultMaxTokensLimit,
+		ClampGeneration:     os.Getenv(envClampGeneration) == "true",
+		HealthTable:         health.Table(os.Getenv(health.EnvTable)),
+		MergeMessages:       os.Getenv(envMergeMessages) == "true",
 	}
 
-	if cfg.AnthropicKey == "" {
+	if len(cfg.AnthropicKeys) == 0 {
 		return cfg, fmt.Errorf("OpenAI API key not found in environment variable OPENAI_API_KEY")
 	}
 
@@ -111,104 +306,1018 @@ func loadConfig() (Config, error) {
 		cfg.AnthropicVersion = defaultAnthropicVersion
 	}
 
+	if cfg.PricingTable == "" {
+		cfg.PricingTable = defaultPricingTable
+	}
+
+	if cfg.UsageTable == "" {
+		cfg.UsageTable = defaultUsageTable
+	}
+
+	if cfg.ContinuationTable == "" {
+		cfg.ContinuationTable = defaultContinuationTable
+	}
+
+	if cfg.ConnectionsTable == "" {
+		cfg.ConnectionsTable = defaultConnectionsTable
+	}
+
+	if cfg.AuthTable == "" {
+		cfg.AuthTable = defaultAuthTable
+	}
+
+	if cfg.UsersTable == "" {
+		cfg.UsersTable = users.TableName
+	}
+
+	// Staging runs must not touch production usage, see pkg/testmode
+	cfg.PricingTable = testmode.Table(cfg.PricingTable)
+	cfg.UsageTable = testmode.Table(cfg.UsageTable)
+	cfg.ContinuationTable = testmode.Table(cfg.ContinuationTable)
+	cfg.ConnectionsTable = testmode.Table(cfg.ConnectionsTable)
+	cfg.AuthTable = testmode.Table(cfg.AuthTable)
+	cfg.UsersTable = testmode.Table(cfg.UsersTable)
+	if cfg.ResponseCacheTable != "" {
+		cfg.ResponseCacheTable = testmode.Table(cfg.ResponseCacheTable)
+	}
+
 	if cfg.AnthropicURL == "" {
 		return cfg, fmt.Errorf("API Gateway Endpoint not found in environment variable API_GW_ENDPOINT")
 	}
 
+	if proxyURL := os.Getenv(envAnthropicProxyURL); proxyURL != "" {
+		parsed, err := url.Parse(proxyURL)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid URL in environment variable %s: %w", envAnthropicProxyURL, err)
+		}
+		cfg.AnthropicProxyURL = parsed
+	}
+
+	if modelMap := os.Getenv(envAnthropicModelMap); modelMap != "" {
+		err := json.Unmarshal([]byte(modelMap), &cfg.ModelOverrides)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid JSON in environment variable %s: %w", envAnthropicModelMap, err)
+		}
+	}
+
+	if limit := os.Getenv(envStreamLineLimit); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < streamBufferSize {
+			return cfg, fmt.Errorf("invalid size in environment variable %s, at least %d bytes: %q", envStreamLineLimit, streamBufferSize, limit)
+		}
+		cfg.StreamLineLimit = value
+	}
+
+	if limit := os.Getenv(envMaxTokensLimit); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 {
+			return cfg, fmt.Errorf("invalid token count in environment variable %s: %q", envMaxTokensLimit, limit)
+		}
+		cfg.MaxTokensLimit = value
+	}
+
+	err := loadConversationConfig(&cfg)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.Archive, err = archive.LoadFromEnv()
+	if err != nil {
+		return cfg, err
+	}
+
+	err = loadFallbackConfig(&cfg)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.ConnectionLimits, err = connlimit.LoadFromEnv()
+	if err != nil {
+		return cfg, err
+	}
+
+	retry, err := loadRetryPolicy()
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Retry = retry
+
+	cfg.AnthropicHTTPTimeout = defaultAnthropicHTTPTimeout
+	if timeout := os.Getenv(envAnthropicHTTPTimeout); timeout != "" {
+		duration, err := time.ParseDuration(timeout)
+		if err != nil || duration <= 0 {
+			return cfg, fmt.Errorf("invalid duration in environment variable %s: %q", envAnthropicHTTPTimeout, timeout)
+		}
+		cfg.AnthropicHTTPTimeout = duration
+	}
+
+	cfg.ConnectionTTL = defaultConnectionTTL
+	if ttl := os.Getenv(envConnectionTTL); ttl != "" {
+		duration, err := time.ParseDuration(ttl)
+		if err != nil || duration <= 0 {
+			return cfg, fmt.Errorf("invalid duration in environment variable %s: %q", envConnectionTTL, ttl)
+		}
+		cfg.ConnectionTTL = duration
+	}
+
+	cfg.DeltaFlushBytes = defaultDeltaFlushBytes
+	if limit := os.Getenv(envDeltaFlushBytes); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 0 {
+			return cfg, fmt.Errorf("invalid size in environment variable %s: %q", envDeltaFlushBytes, limit)
+		}
+		cfg.DeltaFlushBytes = value
+	}
+
+	cfg.DeltaFlushInterval = defaultDeltaFlushInterval
+	if interval := os.Getenv(envDeltaFlushInterval); interval != "" {
+		duration, err := time.ParseDuration(interval)
+		if err != nil || duration <= 0 {
+			return cfg, fmt.Errorf("invalid duration in environment variable %s: %q", envDeltaFlushInterval, interval)
+		}
+		cfg.DeltaFlushInterval = duration
+	}
+
+	if ttl := os.Getenv(envResponseCacheTTL); ttl != "" {
+		duration, err := time.ParseDuration(ttl)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid duration in environment variable %s: %w", envResponseCacheTTL, err)
+		}
+		cfg.ResponseCacheTTL = duration
+	}
+
+	cfg.MaxMessages = defaultMaxMessages
+	if limit := os.Getenv(envMaxMessages); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 0 {
+			return cfg, fmt.Errorf("invalid message count in environment variable %s: %q", envMaxMessages, limit)
+		}
+		cfg.MaxMessages = value
+	}
+
+	cfg.MaxMessageChars = defaultMaxMessageChars
+	if limit := os.Getenv(envMaxMessageChars); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 0 {
+			return cfg, fmt.Errorf("invalid character count in environment variable %s: %q", envMaxMessageChars, limit)
+		}
+		cfg.MaxMessageChars = value
+	}
+
 	return cfg, nil
 }
 
 func handleRequest(ctx context.Context, event events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	ctx = requestid.NewContext(ctx, event.RequestContext.RequestID)
+	// Every line of the request carries the connection, route and request id, the user is added once it is known
+	ctx = withLogger(ctx, slog.Default().With(
+		"connection_id", event.RequestContext.ConnectionID,
+		"route_key", event.RequestContext.RouteKey,
+		"request_id", event.RequestContext.RequestID,
+	))
+	// loadConfig reads the environment on every message, so reloaded settings apply right away.
+	// A change loadConfig rejects is rolled back.
+	err := runtimeConfig.Apply(ctx, func() error {
+		_, err := loadConfig()
+		return err
+	})
+	if err != nil {
+		logFrom(ctx).Warn("Can't apply runtime config", "error", err)
+	}
 	switch event.RequestContext.RouteKey {
 	case connectRouteKey:
-		return handleConnect(event)
+		return handleConnect(ctx, event)
 	case disconnectRouteKey:
-		return handleDisconnect(event)
+		return handleDisconnect(ctx, event)
 	default:
 		return handleSendMessage(ctx, event)
 	}
 }
 
-func handleConnect(event events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
-	fmt.Printf("Client connected: %s", event.RequestContext.ConnectionID)
-	return createResponse("Connected successfully", http.StatusOK, map[string]string{"Sec-WebSocket-Protocol": event.Headers["Sec-WebSocket-Protocol"]})
+func handleConnect(ctx context.Context, event events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logFrom(ctx).Info("Client connected")
+
+	config, err := loadConfig()
+	if err != nil {
+		return createResponse(fmt.Sprintf("Error loading config: %v", err), http.StatusInternalServerError, nil)
+	}
+
+	dbClient, err := newDynamoDBClient(ctx)
+	if err != nil {
+		return createResponse(fmt.Sprintf("Failed to create DynamoDB client: %v", err), http.StatusInternalServerError, nil)
+	}
+
+	// Every connection belongs to a user, the quota check and the charge of a reading depend on it
+	protocolHeader, ok := auth.GetHeader(event.Headers, auth.ProtocolHeader)
+	if !ok {
+		logFrom(ctx).Info("Rejecting connection without auth key")
+		return createResponse("Unauthorized", http.StatusUnauthorized, nil)
+	}
+	_, authKey := auth.SelectProtocol(protocolHeader)
+	var snapshot PlanSnapshot
+	snapshot.UserHash, err = getUserHashFromAuth(ctx, dbClient, config.AuthTable, authKey)
+	if errors.Is(err, errUnknownAuthKey) {
+		logFrom(ctx).Info("Rejecting connection with unknown auth key")
+		return createResponse("Unauthorized", http.StatusUnauthorized, nil)
+	}
+	if err != nil {
+		return createResponse(fmt.Sprintf("Failed to resolve user: %v", err), http.StatusInternalServerError, nil)
+	}
+
+	// Snapshot the user's plan so messages don't have to read USERS. A failure only costs a USERS read later.
+	loaded, err := loadPlanSnapshot(ctx, dbClient, config.UsersTable, snapshot.UserHash)
+	if err != nil {
+		logFrom(ctx).Warn("Can't load plan snapshot", "error", err)
+	} else {
+		snapshot = loaded
+	}
+	ctx = withUser(ctx, snapshot.UserHash)
+	// Frames can't be sent before the handshake completes, connections that are already open get an account_suspended frame
+	if suspension, blocked := snapshot.Suspension(time.Now()); blocked {
+		logFrom(ctx).Info("Rejecting blocked user", "status", suspension.Status, "reason", suspension.Reason)
+		return createResponse("Account suspended", http.StatusForbidden, nil)
+	}
+
+	// The deployment version lets connections-drain close connections opened against an older protocol
+	connection := Connection{Plan: snapshot, DeploymentVersion: os.Getenv(envDeploymentVersion)}
+
+	// Clients that want end-to-end encryption send their public key, content frames are then encrypted for it
+	if encoded := event.QueryStringParameters[e2eeQueryParam]; encoded != "" {
+		connection.ClientKey, err = parseClientKey(encoded)
+		if err != nil {
+			return createResponse(fmt.Sprintf("Invalid encryption key: %v", err), http.StatusBadRequest, nil)
+		}
+	}
+	connection.Compression, err = parseCompression(event.QueryStringParameters[compressionQueryParam])
+	if err != nil {
+		return createResponse(err.Error(), http.StatusBadRequest, nil)
+	}
+
+	err = storeConnectionInDynamoDB(ctx, dbClient, config.ConnectionsTable, event.RequestContext.ConnectionID, connection, config.ConnectionTTL)
+	if err != nil {
+		return createResponse(fmt.Sprintf("Failed to store connection: %v", err), http.StatusInternalServerError, nil)
+	}
+
+	return createResponse("Connected successfully", http.StatusOK, auth.ResponseHeaders(event.Headers))
 	//return createResponse("Connected successfully", http.StatusOK)
 }
 
-func handleDisconnect(event events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
-	fmt.Printf("Client disconnected: %s", event.RequestContext.ConnectionID)
-	return createResponse("Disconnected successfully", http.StatusOK, map[string]string{"Sec-WebSocket-Protocol": event.Headers["Sec-WebSocket-Protocol"]})
+func handleDisconnect(ctx context.Context, event events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logFrom(ctx).Info("Client disconnected")
+
+	config, err := loadConfig()
+	if err != nil {
+		return createResponse(fmt.Sprintf("Error loading config: %v", err), http.StatusInternalServerError, nil)
+	}
+
+	dbClient, err := newDynamoDBClient(ctx)
+	if err != nil {
+		return createResponse(fmt.Sprintf("Failed to create DynamoDB client: %v", err), http.StatusInternalServerError, nil)
+	}
+
+	err = removeConnectionFromDynamoDB(ctx, dbClient, config.ConnectionsTable, event.RequestContext.ConnectionID)
+	if err != nil {
+		return createResponse(fmt.Sprintf("Failed to remove connection: %v", err), http.StatusInternalServerError, nil)
+	}
+
+	return createResponse("Disconnected successfully", http.StatusOK, auth.ResponseHeaders(event.Headers))
 }
 
 func handleSendMessage(ctx context.Context, event events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
-	fmt.Printf("event.Resource: %v\n", event.Resource)
-	fmt.Printf("event.Path: %v\n", event.Path)
-	fmt.Printf("event.HTTPMethod: %v\n", event.HTTPMethod)
-	fmt.Printf("event.Body: %v\n", event.Body)
-	fmt.Printf("event.RequestContext: %v\n", event.RequestContext)
-	fmt.Printf("event.RequestContext.RouteKey: %v\n", event.RequestContext.RouteKey)
+	// The body isn't logged, it may belong to an end-to-end encrypted connection
+	logFrom(ctx).Info("Message received", "body_bytes", len(event.Body))
+	logFrom(ctx).Debug("Request context", "request_context", event.RequestContext)
+
+	config, err := loadConfig()
+	if err != nil {
+		return createResponse(fmt.Sprintf("Error loading config: %v", err), http.StatusInternalServerError, nil)
+	}
+
+	// Binary frames arrive base64 encoded
+	body, err := requestbody.DecodeBase64(event.Body, event.IsBase64Encoded)
+	if err != nil {
+		return createResponse(fmt.Sprintf("Error decoding request body: %s", err), http.StatusBadRequest, nil)
+	}
+
+	callbackURL := websocketCallbackURL(config, event.RequestContext.DomainName, event.RequestContext.Stage)
+	wsClient, err := newWebSocketClient(ctx, callbackURL)
+	if err != nil {
+		return createResponse(fmt.Sprintf("Failed to create WebSocket client: %v", err), http.StatusInternalServerError, nil)
+	}
+
+	if throttle, tooLarge := config.ConnectionLimits.CheckSize(len(body)); tooLarge {
+		return throttledResponse(ctx, wsClient, event.RequestContext.ConnectionID, throttle, http.StatusRequestEntityTooLarge)
+	}
 
 	// Parse the incoming request
 	var req Request
-	err := json.Unmarshal([]byte(event.Body), &req)
+	err = json.Unmarshal(body, &req)
 	if err != nil {
 		return createResponse(fmt.Sprintf("Error parsing request JSON: %s", err), http.StatusBadRequest, nil)
 	}
+	setMessageType(ctx, req.PromptTemplate)
 
-	// Create a channel to receive text blocks
-	textChan := make(chan string)
-	errorChan := make(chan error, 1)
-	doneChan := make(chan struct{})
+	// A stop arrives while the reading it cancels holds the connection, so it skips the in-flight check
+	if req.Action == actionStop {
+		return handleStop(ctx, config, wsClient, event.RequestContext.ConnectionID)
+	}
 
-	go func() {
-		defer close(textChan)
-		err := callAnthropicAPI(req, textChan, doneChan)
+	dbClient, err := newDynamoDBClient(ctx)
+	if err != nil {
+		return createResponse(fmt.Sprintf("Failed to create DynamoDB client: %v", err), http.StatusInternalServerError, nil)
+	}
+
+	// Every other message counts against the connection's rate limit, whether it turns into a reading or not
+	if config.ConnectionLimits.MessagesPerMinute > 0 {
+		now := time.Now()
+		allowed, err := countMessage(ctx, dbClient, config.ConnectionsTable, event.RequestContext.ConnectionID, config.ConnectionLimits.MessagesPerMinute, now)
 		if err != nil {
-			errorChan <- err
+			logFrom(ctx).Warn("Can't count message, not rate limiting it", "error", err)
+		} else if !allowed {
+			return throttledResponse(ctx, wsClient, event.RequestContext.ConnectionID, config.ConnectionLimits.RateLimited(now), http.StatusTooManyRequests)
+		}
+	}
+
+	if config.MergeMessages {
+		req.Messages = mergeConsecutiveMessages(req.Messages)
+	}
+	// Tell the client which fields are invalid instead of failing the whole request opaquely
+	validationErrs := validateRequest(ctx, req, config)
+	if len(validationErrs) > 0 {
+		err = sendUnsequencedFrame(ctx, wsClient, event.RequestContext.ConnectionID, Frame{Type: frameTypeError, Text: "Validation failed", Errors: validationErrs})
+		if err != nil {
+			return createResponse(fmt.Sprintf("Failed to send WebSocket message: %v", err), http.StatusInternalServerError, nil)
+		}
+		return createResponse(fmt.Sprintf("Invalid request: %v", validationErrs), http.StatusBadRequest, nil)
+	}
+
+	// Only one request may stream to a connection at a time
+	connectionID := event.RequestContext.ConnectionID
+	acquired, err := markRequestInFlight(ctx, dbClient, config.ConnectionsTable, connectionID)
+	if errors.Is(err, errConnectionGone) {
+		err = sendUnsequencedFrame(ctx, wsClient, connectionID, Frame{Type: frameTypeError, Text: "Connection expired, please reconnect"})
+		if err != nil {
+			logFrom(ctx).Error("Failed to send WebSocket message", "error", err)
+		}
+		err = closeWebSocketConnection(ctx, wsClient, connectionID)
+		if err != nil {
+			logFrom(ctx).Error("Failed to close WebSocket connection", "error", err)
+		}
+		return createResponse("Connection is gone", http.StatusGone, nil)
+	}
+	if err != nil {
+		return createResponse(fmt.Sprintf("Failed to mark request in flight: %v", err), http.StatusInternalServerError, nil)
+	}
+	if !acquired {
+		err = sendUnsequencedFrame(ctx, wsClient, connectionID, Frame{Type: frameTypeBusy, Text: "Another request is in progress on this connection"})
+		if err != nil {
+			return createResponse(fmt.Sprintf("Failed to send WebSocket message: %v", err), http.StatusInternalServerError, nil)
+		}
+		return createResponse("Connection busy", http.StatusConflict, nil)
+	}
+	defer func() {
+		err := clearRequestInFlight(ctx, dbClient, config.ConnectionsTable, connectionID)
+		if err != nil {
+			logFrom(ctx).Warn("Can't clear request in flight", "error", err)
 		}
-		close(errorChan)
 	}()
 
-	wsClient, err := createWebSocketClient(ctx, event.RequestContext.DomainName, event.RequestContext.Stage)
+	// Continue the connection's frame sequence and store where this request left off
+	connection, err := getConnection(ctx, dbClient, config.ConnectionsTable, connectionID)
 	if err != nil {
-		return createResponse(fmt.Sprintf("Failed to create WebSocket client: %v", err), http.StatusInternalServerError, nil)
+		logFrom(ctx).Warn("Can't load connection sequence, starting from 0", "error", err)
+	}
+	startSeq := connection.Seq
+
+	plan, err := getConnectionPlan(ctx, config, dbClient, connectionID, connection.Plan)
+	if err != nil {
+		logFrom(ctx).Warn("Can't load plan snapshot", "error", err)
+	}
+	// A message the user can't be resolved for is refused, it couldn't be checked against or charged to a balance
+	if plan.UserHash == "" {
+		err = sendUnsequencedFrame(ctx, wsClient, connectionID, Frame{Type: frameTypeError, Text: "Can't identify the user of this connection, please reconnect"})
+		if err != nil {
+			logFrom(ctx).Error("Failed to send WebSocket message", "error", err)
+		}
+		err = closeWebSocketConnection(ctx, wsClient, connectionID)
+		if err != nil {
+			logFrom(ctx).Error("Failed to close WebSocket connection", "error", err)
+		}
+		return createResponse("Unknown user", http.StatusUnauthorized, nil)
+	}
+	ctx = withUser(ctx, plan.UserHash)
+	logFrom(ctx).Debug("Plan loaded", "plan", plan.Plan, "remaining_requests", plan.RemainingRequests)
+	if suspension, blocked := plan.Suspension(time.Now()); blocked {
+		err = sendUnsequencedFrame(ctx, wsClient, connectionID, Frame{Type: frameTypeAccountSuspended, Text: "Account suspended", Suspension: &suspension})
+		if err != nil {
+			logFrom(ctx).Error("Failed to send WebSocket message", "error", err)
+		}
+		err = closeWebSocketConnection(ctx, wsClient, connectionID)
+		if err != nil {
+			logFrom(ctx).Error("Failed to close WebSocket connection", "error", err)
+		}
+		return createResponse("Account suspended", http.StatusForbidden, nil)
+	}
+	// A conversation continues from the stored history, which only the server can change
+	var conversation Conversation
+	if req.ConversationID != "" {
+		if len(connection.ClientKey) > 0 {
+			err = sendUnsequencedFrame(ctx, wsClient, connectionID, Frame{Type: frameTypeError, Text: "Conversations need an unencrypted connection"})
+			if err != nil {
+				logFrom(ctx).Error("Failed to send WebSocket message", "error", err)
+			}
+			return createResponse("Conversation not available", http.StatusBadRequest, nil)
+		}
+		if req.Reset {
+			err = deleteConversation(ctx, dbClient, config.ConversationsTable, plan.UserHash, req.ConversationID)
+			if err != nil {
+				return createResponse(fmt.Sprintf("Failed to reset conversation: %v", err), http.StatusInternalServerError, nil)
+			}
+			if len(req.Messages) == 0 {
+				err = sendUnsequencedFrame(ctx, wsClient, connectionID, Frame{Type: frameTypeDone})
+				if err != nil {
+					logFrom(ctx).Error("Failed to send WebSocket message", "error", err)
+				}
+				return createResponse("Conversation reset", http.StatusOK, auth.ResponseHeaders(event.Headers))
+			}
+		} else {
+			conversation, err = getConversation(ctx, dbClient, config.ConversationsTable, plan.UserHash, req.ConversationID)
+			if err != nil {
+				return createResponse(fmt.Sprintf("Failed to load conversation: %v", err), http.StatusInternalServerError, nil)
+			}
+		}
+	}
+	// question is the new message of a conversation, stored with the answer once the reading is done
+	var question Message
+	if req.ConversationID != "" {
+		question = req.Messages[0]
+		req.Messages = append(append([]Message{}, conversation.Messages...), question)
+	}
+
+	// The balance is checked before Anthropic is called, read fresh from USERS since the snapshot can be minutes old
+	remaining, err := getRemainingRequests(ctx, dbClient, config.UsersTable, plan.UserHash)
+	if err != nil {
+		logFrom(ctx).Warn("Can't load remaining requests, using the plan snapshot", "error", err)
+	} else {
+		plan.RemainingRequests = remaining
+	}
+	// A second opinion is charged as a reading of its own, the balance has to cover both
+	calls := 1
+	if req.SecondOpinion != "" {
+		calls = 2
+	}
+	decision := quotaPolicy.DecideCost(plan.User(), quotaPolicy.Cost(calls), time.Now())
+	if !decision.Allowed {
+		logFrom(ctx).Info("Refusing request", "reason", decision.Reason)
+		text := "Quota exceeded"
+		if decision.Reason == quota.ReasonExhausted {
+			text = "No tokens remaining"
+		}
+		err = sendUnsequencedFrame(ctx, wsClient, connectionID, Frame{Type: frameTypeQuotaExceeded, Text: text, Quota: &decision})
+		if err != nil {
+			logFrom(ctx).Error("Failed to send WebSocket message", "error", err)
+		}
+		err = closeWebSocketConnection(ctx, wsClient, connectionID)
+		if err != nil {
+			logFrom(ctx).Error("Failed to close WebSocket connection", "error", err)
+		}
+		return createResponse(text, http.StatusPaymentRequired, nil)
+	}
+
+	// A continuation resumes the truncated response with the same prompt and model, without a second opinion
+	resumeModel := ""
+	if req.ContinuationToken != "" {
+		continuation, found, err := takeContinuation(ctx, dbClient, config.ContinuationTable, req.ContinuationToken, plan.UserHash)
+		if err != nil {
+			return createResponse(fmt.Sprintf("Failed to load continuation: %v", err), http.StatusInternalServerError, nil)
+		}
+		if !found {
+			err = sendUnsequencedFrame(ctx, wsClient, connectionID, Frame{Type: frameTypeError, Text: "Continuation token is invalid or expired"})
+			if err != nil {
+				logFrom(ctx).Error("Failed to send WebSocket message", "error", err)
+			}
+			return createResponse("Invalid continuation token", http.StatusBadRequest, nil)
+		}
+		req.PromptTemplate = continuation.PromptTemplate
+		req.TemplateParams = continuation.TemplateParams
+		req.Messages = continuation.Messages
+		req.SecondOpinion = ""
+		req.Structured = false
+		resumeModel = continuation.Model
+		setMessageType(ctx, req.PromptTemplate)
+	}
+
+	// Readings fail over to the fallback provider while Anthropic is down, without a second opinion
+	config, provider := chooseProvider(ctx, config, dbClient)
+	if provider != providerAnthropic {
+		req.SecondOpinion = ""
+		resumeModel = ""
+	}
+
+	sender := newFrameSender(wsClient, connectionID, startSeq)
+	sender.compression = connection.Compression
+	sender.provider = provider
+	sender.flushBytes = config.DeltaFlushBytes
+	if len(connection.ClientKey) > 0 {
+		sealer, keyFrame, err := newFrameSealer(connection.ClientKey)
+		if err != nil {
+			return createResponse(fmt.Sprintf("Failed to set up encryption: %v", err), http.StatusInternalServerError, nil)
+		}
+		err = sender.Send(ctx, keyFrame)
+		if err != nil {
+			return createResponse(fmt.Sprintf("Failed to send WebSocket message: %v", err), http.StatusInternalServerError, nil)
+		}
+		sender.sealer = sealer
+		req.encrypted = true
+	}
+	// Sampled readings of users who consented are archived, encrypted ones never are
+	var archivePurposes []string
+	if !req.encrypted && config.Archive.Sampled(requestid.FromContext(ctx)) {
+		archivePurposes, err = getArchiveConsent(ctx, dbClient, config.UsersTable, plan.UserHash)
+		if err != nil {
+			logFrom(ctx).Warn("Can't load archive consent, the reading isn't archived", "error", err)
+		}
+	}
+	sequenceSaved := false
+	saveSequence := func() {
+		if sequenceSaved {
+			return
+		}
+		sequenceSaved = true
+		err := saveConnectionSequence(ctx, dbClient, config.ConnectionsTable, connectionID, startSeq, sender.Seq())
+		if err != nil {
+			logFrom(ctx).Warn("Can't save connection sequence", "error", err)
+		}
+	}
+	defer saveSequence()
+	// closeConnection ends the reading. The sequence has to be saved first, the $disconnect handler
+	// removes the connection record.
+	closeConnection := func() error {
+		saveSequence()
+		return closeWebSocketConnection(ctx, wsClient, event.RequestContext.ConnectionID)
+	}
+	// recordInterrupted records the usage of a call that broke off. Anthropic bills those tokens,
+	// so they are recorded without charging the user.
+	recordInterrupted := func(err error) {
+		var streamErr *StreamError
+		if errors.As(err, &streamErr) && streamErr.Usage.TotalTokens > 0 {
+			usage := streamErr.Usage
+			usage.Interrupted = true
+			// The suffix keeps it apart from the usage of a second opinion that finished
+			recordUsage(ctx, config, dbClient, requestid.FromContext(ctx)+"#interrupted", connectionID, plan.UserHash, usage)
+		}
+	}
+	// failCall reports a failed call and closes the connection, the client retries on a new one
+	failCall := func(err error) (events.APIGatewayProxyResponse, error) {
+		if providerFailed(err) {
+			recordLLMHealth(ctx, config, dbClient, provider, true)
+		}
+		recordInterrupted(err)
+		response, responseErr := failedCallResponse(ctx, sender, err)
+		closeErr := closeConnection()
+		if closeErr != nil {
+			logFrom(ctx).Error("Failed to close WebSocket connection", "error", closeErr)
+		}
+		return response, responseErr
+	}
+
+	// The default model always runs, a second opinion streams in parallel with its frames tagged by model
+	models := []string{resumeModel}
+	if req.SecondOpinion != "" {
+		models = append(models, req.SecondOpinion)
+	}
+
+	// Create a channel to receive text blocks
+	textChan := make(chan Delta)
+	errorChan := make(chan error, len(models))
+	doneChan := make(chan Usage, len(models))
+
+	// callCtx is cancelled when the client is gone, which tears down the Anthropic requests
+	callCtx, cancelCalls := context.WithCancel(ctx)
+	defer cancelCalls()
+
+	var wg sync.WaitGroup
+	for _, model := range models {
+		wg.Add(1)
+		go func(model string) {
+			defer wg.Done()
+			err := callModel(callCtx, config, req, model, connectionID, textChan, doneChan)
+			if err != nil {
+				errorChan <- err
+			}
+		}(model)
+	}
+	go func() {
+		wg.Wait()
+		close(textChan)
+		close(errorChan)
+	}()
+
+	finished := 0
+	// recordFinished records the usage of a finished call, the second opinion is recorded separately
+	recordFinished := func(usage Usage) Usage {
+		usageID := requestid.FromContext(ctx)
+		if finished > 0 {
+			usageID = fmt.Sprintf("%s#%d", usageID, finished)
+		}
+		finished++
+		return recordUsage(ctx, config, dbClient, usageID, connectionID, plan.UserHash, usage)
+	}
+	// chargeReading charges a finished reading once, with the combined cost of every model that answered it.
+	// A balance another reading exhausted in the meantime isn't overdrawn, the client is told instead.
+	chargeReading := func() {
+		recordLLMHealth(ctx, config, dbClient, provider, false)
+		cost := quotaPolicy.Cost(len(models))
+		err := decreaseRemainingRequests(ctx, dbClient, config.UsersTable, plan.UserHash, cost, quotaPolicy.ChargeFloor(cost))
+		var exhaustedErr *BalanceExhaustedError
+		switch {
+		case errors.As(err, &exhaustedErr):
+			logFrom(ctx).Info("Reading isn't charged", "error", err)
+			decision := quota.Decision{Reason: quota.ReasonExhausted, Cost: cost, Remaining: exhaustedErr.Remaining - cost}
+			err = sender.Send(ctx, Frame{Type: frameTypeQuotaExceeded, Text: "Balance exhausted", Quota: &decision})
+			if err != nil && !isGoneError(err) {
+				logFrom(ctx).Error("Failed to send WebSocket message", "error", err)
+			}
+		case err != nil:
+			logFrom(ctx).Error("Can't charge user", "error", err)
+		}
+	}
+	// clientGone cancels the calls once the client disconnected. The usage of the calls is still recorded,
+	// and the reading is only charged if every model had finished.
+	clientGone := func() (events.APIGatewayProxyResponse, error) {
+		logFrom(ctx).Info("Connection is gone, cancelling the Anthropic calls")
+		cancelCalls()
+		// The calls return promptly once cancelled, textChan and errorChan are closed after that
+		for range textChan {
+		}
+		for err := range errorChan {
+			recordInterrupted(err)
+		}
+		for len(doneChan) > 0 {
+			recordFinished(<-doneChan)
+		}
+		if finished == len(models) {
+			chargeReading()
+		}
+		return createResponse("Client disconnected", http.StatusGone, nil)
+	}
+	// outputSent is set once the client received part of the response, a stopped reading is charged then
+	outputSent := false
+	// cancelReading stops the calls after the client sent a stop action
+	cancelReading := func() (events.APIGatewayProxyResponse, error) {
+		logFrom(ctx).Info("Reading was stopped by the client")
+		cancelCalls()
+		for range textChan {
+		}
+		for err := range errorChan {
+			recordInterrupted(err)
+		}
+		for len(doneChan) > 0 {
+			recordFinished(<-doneChan)
+		}
+		if outputSent {
+			chargeReading()
+		}
+		err := sender.Send(ctx, Frame{Type: frameTypeCancelled})
+		if err != nil && !isGoneError(err) {
+			logFrom(ctx).Error("Failed to send WebSocket message", "error", err)
+		}
+		err = closeConnection()
+		if err != nil && !isGoneError(err) {
+			logFrom(ctx).Error("Failed to close WebSocket connection", "error", err)
+		}
+		return createResponse("Reading cancelled", http.StatusOK, auth.ResponseHeaders(event.Headers))
 	}
-	fmt.Printf("wsClient: %v\n", wsClient)
+	// answer collects the default model's response for the conversation history and the archive
+	var answer strings.Builder
+	var answerUsage Usage
+	// reportUsage records a finished call and sends the client its token usage and estimated cost
+	reportUsage := func(usage Usage) error {
+		usage = recordFinished(usage)
+		if req.SecondOpinion == "" || usage.Model != req.SecondOpinion {
+			answerUsage = usage
+		}
+		return sender.Send(ctx, Frame{Type: frameTypeUsage, Model: usage.Model, Usage: &usage})
+	}
+	// finishReading stores the turn, charges the reading and closes the connection once every model
+	// finished. Both the doneChan and the closed textChan path end up here, whichever the select picks first.
+	var (
+		finishOnce     sync.Once
+		finishResponse events.APIGatewayProxyResponse
+		finishErr      error
+	)
+	finishReading := func() (events.APIGatewayProxyResponse, error) {
+		finishOnce.Do(func() {
+			if req.ConversationID != "" && answer.Len() > 0 {
+				stored, err := storeConversation(ctx, dbClient, config.ConversationsTable, plan.UserHash, req.ConversationID, appendTurn(conversation, question, answer.String(), config.ConversationMaxMessages))
+				if err != nil {
+					logFrom(ctx).Warn("Can't store conversation", "error", err)
+				} else if !stored {
+					logFrom(ctx).Warn("Conversation changed during the reading, this turn isn't stored", "conversation_id", req.ConversationID)
+				}
+			}
+
+			chargeReading()
 
+			if len(archivePurposes) > 0 && answer.Len() > 0 {
+				record := newArchiveRecord(config.Archive, requestid.FromContext(ctx), plan.UserHash, archivePurposes, req, answer.String(), answerUsage, time.Now().Unix())
+				err := archiveReading(ctx, config.Archive, record)
+				if err != nil {
+					logFrom(ctx).Warn("Can't archive reading", "error", err)
+				}
+			}
+
+			err := sender.Send(ctx, Frame{Type: frameTypeDone})
+			if isGoneError(err) {
+				logFrom(ctx).Info("Connection is gone, the reading finished without the done frame")
+				finishResponse, finishErr = createResponse("Client disconnected", http.StatusGone, nil)
+				return
+			}
+			if err != nil {
+				finishResponse, finishErr = createResponse(fmt.Sprintf("Failed to send WebSocket message: %v", err), http.StatusInternalServerError, nil)
+				return
+			}
+
+			err = closeConnection()
+			if err != nil {
+				finishResponse, finishErr = createResponse(fmt.Sprintf("Failed to close WebSocket connection: %v", err), http.StatusInternalServerError, nil)
+				return
+			}
+			finishResponse, finishErr = createResponse("Message processing completed", http.StatusOK, auth.ResponseHeaders(event.Headers))
+		})
+		return finishResponse, finishErr
+	}
+	cancelTicker := time.NewTicker(cancelPollInterval)
+	defer cancelTicker.Stop()
+	// Buffered deltas are posted at least every flush interval, and before any other frame
+	flushTicks, stopFlushTicker := newFlushTicker(config.DeltaFlushInterval)
+	defer stopFlushTicker()
 	for {
 		select {
-		case text, ok := <-textChan:
-			fmt.Printf("text: %v\n", text)
-			if !ok {
-				return createResponse("Message processing completed", http.StatusOK, map[string]string{"Sec-WebSocket-Protocol": event.Headers["Sec-WebSocket-Protocol"]})
+		case <-flushTicks:
+			err = sender.Flush(ctx)
+			if isGoneError(err) {
+				return clientGone()
 			}
-			err = sendWebSocketMessage(ctx, wsClient, event.RequestContext.ConnectionID, text)
 			if err != nil {
 				return createResponse(fmt.Sprintf("Failed to send WebSocket message: %v", err), http.StatusInternalServerError, nil)
 			}
+		case <-cancelTicker.C:
+			stopped, err := cancelRequested(ctx, dbClient, config.ConnectionsTable, connectionID)
+			if err != nil {
+				logFrom(ctx).Warn("Can't check for a stop", "error", err)
+			}
+			if stopped {
+				return cancelReading()
+			}
+		case delta, ok := <-textChan:
+			if !req.encrypted {
+				logFrom(ctx).Debug("Delta received", "model", delta.Model, "text", delta.Text)
+			}
+			if !ok {
+				// textChan is closed after the calls returned, an error may still be waiting in the buffer
+				select {
+				case err := <-errorChan:
+					if err != nil {
+						return failCall(err)
+					}
+				default:
+				}
+				// The usage of the last calls may still be buffered, the reading isn't finished without it
+				for len(doneChan) > 0 {
+					err = reportUsage(<-doneChan)
+					if isGoneError(err) {
+						return clientGone()
+					}
+					if err != nil {
+						return createResponse(fmt.Sprintf("Failed to send WebSocket message: %v", err), http.StatusInternalServerError, nil)
+					}
+				}
+				if finished == len(models) {
+					return finishReading()
+				}
+				// A call returned without usage or error, the reading ends without being charged
+				logFrom(ctx).Warn("Not every call reported usage, the reading isn't charged", "finished", finished, "calls", len(models))
+				err = closeConnection()
+				if err != nil {
+					logFrom(ctx).Error("Failed to close WebSocket connection", "error", err)
+				}
+				return createResponse("Message processing completed", http.StatusOK, auth.ResponseHeaders(event.Headers))
+			}
+			if (req.ConversationID != "" || len(archivePurposes) > 0) && (req.SecondOpinion == "" || delta.Model != req.SecondOpinion) {
+				answer.WriteString(delta.Text)
+				if delta.Reading != nil {
+					reading, _ := json.Marshal(delta.Reading)
+					answer.Write(reading)
+				}
+			}
+			var frames []Frame
+			switch {
+			case delta.Reading != nil:
+				frames = readingFrames(delta.Model, *delta.Reading)
+			case delta.Continuation != nil:
+				frames = []Frame{truncatedFrame(ctx, config, dbClient, plan.UserHash, req.encrypted, delta)}
+			default:
+				err = sender.SendDelta(ctx, delta.Model, delta.Text)
+				if isGoneError(err) {
+					return clientGone()
+				}
+				if err != nil {
+					return createResponse(fmt.Sprintf("Failed to send WebSocket message: %v", err), http.StatusInternalServerError, nil)
+				}
+			}
+			for _, frame := range frames {
+				err = sender.Send(ctx, frame)
+				if isGoneError(err) {
+					return clientGone()
+				}
+				if err != nil {
+					return createResponse(fmt.Sprintf("Failed to send WebSocket message: %v", err), http.StatusInternalServerError, nil)
+				}
+			}
+			outputSent = true
 		case err := <-errorChan:
-			fmt.Printf("err: %v\n", err)
 			if err != nil {
-				return createResponse(fmt.Sprintf("Error calling Anthropic API: %v", err), http.StatusInternalServerError, nil)
+				return failCall(err)
+			}
+		case usage := <-doneChan:
+			err = reportUsage(usage)
+			if isGoneError(err) {
+				return clientGone()
 			}
-		case <-doneChan:
-			// Close the WebSocket connection
-			err = closeWebSocketConnection(ctx, wsClient, event.RequestContext.ConnectionID)
 			if err != nil {
-				return createResponse(fmt.Sprintf("Failed to close WebSocket connection: %v", err), http.StatusInternalServerError, nil)
+				return createResponse(fmt.Sprintf("Failed to send WebSocket message: %v", err), http.StatusInternalServerError, nil)
 			}
-			return createResponse("Message processing completed", http.StatusOK, map[string]string{"Sec-WebSocket-Protocol": event.Headers["Sec-WebSocket-Protocol"]})
+			if finished < len(models) {
+				continue
+			}
+			return finishReading()
 		case <-ctx.Done():
 			return createResponse("Request timeout", http.StatusGatewayTimeout, nil)
 		}
 	}
 }
 
+// throttledResponse refuses a message over the connection's limits with a throttled frame
+func throttledResponse(ctx context.Context, wsClient WebSocketClient, connectionID string, throttle connlimit.Throttle, status int) (events.APIGatewayProxyResponse, error) {
+	logFrom(ctx).Info("Throttling message", "reason", throttle.Reason)
+	err := sendUnsequencedFrame(ctx, wsClient, connectionID, Frame{Type: frameTypeThrottled, Text: "Too many or too large messages", Throttle: &throttle})
+	if err != nil {
+		logFrom(ctx).Error("Failed to send WebSocket message", "error", err)
+	}
+	return createResponse(fmt.Sprintf("Message throttled: %s", throttle.Reason), status, nil)
+}
+
+// handleStop flags the reading in flight on the connection as stopped. The invocation streaming it
+// notices within cancelPollInterval, cancels the Anthropic calls and sends the cancelled frame.
+func handleStop(ctx context.Context, config Config, wsClient WebSocketClient, connectionID string) (events.APIGatewayProxyResponse, error) {
+	dbClient, err := newDynamoDBClient(ctx)
+	if err != nil {
+		return createResponse(fmt.Sprintf("Failed to create DynamoDB client: %v", err), http.StatusInternalServerError, nil)
+	}
+	inFlight, err := requestCancel(ctx, dbClient, config.ConnectionsTable, connectionID)
+	if err != nil {
+		return createResponse(fmt.Sprintf("Failed to stop reading: %v", err), http.StatusInternalServerError, nil)
+	}
+	if !inFlight {
+		err = sendUnsequencedFrame(ctx, wsClient, connectionID, Frame{Type: frameTypeError, Text: "No reading in progress"})
+		if err != nil {
+			logFrom(ctx).Error("Failed to send WebSocket message", "error", err)
+		}
+		return createResponse("Nothing to stop", http.StatusConflict, nil)
+	}
+	return createResponse("Stop requested", http.StatusOK, nil)
+}
+
+// failedCallResponse sends the client a terminal error frame for a failed Anthropic call and fails the request
+func failedCallResponse(ctx context.Context, sender *FrameSender, err error) (events.APIGatewayProxyResponse, error) {
+	logFrom(ctx).Error("Anthropic call failed", "error", err)
+
+	status := http.StatusBadGateway
+	frame := Frame{Type: frameTypeError, Text: "Failed to get a response, please try again"}
+	var readingErrs validation.Errors
+	var streamErr *StreamError
+	var apiErr *AnthropicError
+	switch {
+	case errors.As(err, &readingErrs):
+		// Tell the client which parts of a structured reading the model got wrong
+		frame.Text = "Model returned an invalid reading"
+		frame.Errors = readingErrs
+	case errors.As(err, &streamErr):
+		// A response that broke off midway can't be retried, the client already shows part of it
+		frame.Text = "Response was interrupted, please try again"
+	case errors.As(err, &apiErr):
+		// Anthropic errors get a readable message and the status of whoever is at fault
+		frame.Text = apiErr.ClientMessage()
+		status = apiErr.ClientStatus()
+	}
+
+	sendErr := sender.Send(ctx, frame)
+	if sendErr != nil {
+		logFrom(ctx).Error("Failed to send WebSocket message", "error", sendErr)
+	}
+	return createResponse(fmt.Sprintf("Error calling Anthropic API: %v", err), status, nil)
+}
+
+// validateRequest checks the client request before anything is sent to Anthropic
+func validateRequest(ctx context.Context, req Request, config Config) validation.Errors {
+	var validationErrs validation.Errors
+	if req.Action != "" {
+		validationErrs.OneOf("action", req.Action, actionStop)
+	}
+	validateGeneration(&validationErrs, req, config)
+	// The prompt and messages of a continuation are stored with it
+	if req.ContinuationToken != "" {
+		if req.ConversationID != "" {
+			validationErrs.Add("conversation_id", validation.RuleFormat, "conversation_id can't be combined with continuation_token")
+		}
+		return validationErrs
+	}
+	// A reset without a message only clears the history
+	if req.ConversationID != "" && req.Reset && len(req.Messages) == 0 {
+		return validationErrs
+	}
+	// The history of a conversation is stored, the client only sends the new question
+	if req.ConversationID != "" && (len(req.Messages) != 1 || req.Messages[0].Role != "user") {
+		validationErrs.Add("messages", validation.RuleFormat, "messages must contain exactly one user message in a conversation")
+	}
+	validationErrs.Required("prompt_template", req.PromptTemplate)
+	if req.PromptTemplate != "" && !prompts.Allowed(req.PromptTemplate) {
+		logFrom(ctx).Info("Rejected prompt template, it is not allowlisted", "prompt_template", req.PromptTemplate)
+		validationErrs.Add("prompt_template", validation.RuleOneOf, fmt.Sprintf("unknown prompt template %s", req.PromptTemplate))
+	}
+	if len(req.TemplateParams) > 0 {
+		_, err := renderSystemPrompt(req)
+		if err != nil && !errors.Is(err, prompts.ErrNotAllowed) && !errors.Is(err, prompts.ErrNotFound) {
+			validationErrs.Add("template_params", validation.RuleFormat, err.Error())
+		}
+	}
+	if len(req.Messages) == 0 {
+		validationErrs.Add("messages", validation.RuleRequired, "messages must contain at least one message")
+	}
+	validationErrs.Max("messages", len(req.Messages), config.MaxMessages, "messages")
+	for i, msg := range req.Messages {
+		field := fmt.Sprintf("messages[%d]", i)
+		validationErrs.OneOf(field+".role", msg.Role, "user", "assistant")
+		validationErrs.Required(field+".content", msg.Content)
+		validationErrs.Max(field+".content", utf8.RuneCountInString(msg.Content), config.MaxMessageChars, "characters")
+		// Anthropic rejects conversations that don't start with the user or don't alternate roles
+		switch {
+		case i == 0 && msg.Role == "assistant":
+			validationErrs.Add(field+".role", validation.RuleFormat, "the first message must be from the user")
+		case i > 0 && msg.Role == req.Messages[i-1].Role:
+			validationErrs.Add(field+".role", validation.RuleFormat, "roles must alternate between user and assistant")
+		}
+	}
+	if req.SecondOpinion != "" && !slices.Contains(config.SecondOpinionModels, req.SecondOpinion) {
+		validationErrs.Add("second_opinion", validation.RuleOneOf, "second_opinion must be one of: "+strings.Join(config.SecondOpinionModels, ", "))
+	}
+	return validationErrs
+}
+
+// mergeConsecutiveMessages joins consecutive messages with the same role into one, so clients that
+// send e.g. two user messages in a row still produce a conversation Anthropic accepts
+func mergeConsecutiveMessages(messages []Message) []Message {
+	var merged []Message
+	for _, msg := range messages {
+		if last := len(merged) - 1; last >= 0 && merged[last].Role == msg.Role {
+			merged[last].Content += "\n\n" + msg.Content
+			continue
+		}
+		merged = append(merged, msg)
+	}
+	return merged
+}
+
+// validateGeneration checks the client's max_tokens and temperature, unless the config clamps them
+func validateGeneration(validationErrs *validation.Errors, req Request, config Config) {
+	if config.ClampGeneration {
+		return
+	}
+	if req.MaxTokens != nil && (*req.MaxTokens < 1 || *req.MaxTokens > config.MaxTokensLimit) {
+		validationErrs.Add("max_tokens", validation.RuleFormat, fmt.Sprintf("max_tokens must be between 1 and %d", config.MaxTokensLimit))
+	}
+	if req.Temperature != nil && (*req.Temperature < 0 || *req.Temperature > maxTemperature) {
+		validationErrs.Add("temperature", validation.RuleFormat, fmt.Sprintf("temperature must be between 0 and %g", maxTemperature))
+	}
+}
+
+// applyGeneration sets the client's max_tokens and temperature on the Anthropic request, clamped to the allowed range
+func applyGeneration(anthropicReq *AnthropicRequest, req Request, config Config) {
+	if req.MaxTokens != nil {
+		anthropicReq.MaxTokens = max(1, min(*req.MaxTokens, config.MaxTokensLimit))
+	}
+	if req.Temperature != nil {
+		temperature := max(0, min(*req.Temperature, maxTemperature))
+		anthropicReq.Temperature = &temperature
+	}
+}
+
 // NewAnthropicRequest creates a new AnthropicRequest with default values
 func NewAnthropicRequest(model string, system string, messages []AnthropicMessage) *AnthropicRequest {
 	return &AnthropicRequest{
 		Model:     model,
-		MaxTokens: 1024,
+		MaxTokens: defaultMaxTokens,
 		Messages:  messages,
 		Stream:    true,
 		System:    system,
@@ -229,134 +1338,400 @@ func ConvertToAnthropicRequest(req Request, model string, system string) *Anthro
 	return NewAnthropicRequest(model, system, messages)
 }
 
-func callAnthropicAPI(req Request, textChan chan<- string, doneChan chan<- struct{}) error {
-
-	config, err := loadConfig()
-	if err != nil {
-		return fmt.Errorf("error loading config: %w", err)
+// renderSystemPrompt returns the system prompt of req, rendered with its template params if it has any
+func renderSystemPrompt(req Request) (string, error) {
+	systemPrompt, err := prompts.Lookup(req.PromptTemplate)
+	if err != nil || len(req.TemplateParams) == 0 {
+		return systemPrompt, err
 	}
-	fmt.Printf("config: %v\n", config)
+	return prompts.Render(systemPrompt, req.TemplateParams)
+}
+
+// callModel runs one model's call of a reading, tests replace it to control how the calls finish
+var callModel = callAnthropicAPI
+
+// newFlushTicker starts the ticks of the delta flush interval and returns them with the function stopping
+// them, tests replace it to tick by hand
+var newFlushTicker = func(interval time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(interval)
+	return ticker.C, ticker.Stop
+}
+
+// callAnthropicAPI streams the response to req into textChan and reports the usage on doneChan.
+// It either reports usage and returns nil or returns an error, never both.
+// model replaces the configured model, e.g. for a second opinion, unless it is empty.
+func callAnthropicAPI(ctx context.Context, config Config, req Request, model string, connectionID string, textChan chan<- Delta, doneChan chan<- Usage) error {
 
 	anthropicURL := config.AnthropicURL
-	anthropicAPIKey := config.AnthropicKey
 	anthropicModel := config.AnthropicModel
 	anthropicVersion := config.AnthropicVersion
-	systemPrompt := os.Getenv(req.PromptTemplate)
-	if systemPrompt == "" {
-		fmt.Printf("system prompt [%s] was not found", req.PromptTemplate)
+	systemPrompt, err := renderSystemPrompt(req)
+	if err != nil {
+		logFrom(ctx).Warn("System prompt is not available", "prompt_template", req.PromptTemplate, "error", err)
+	}
+
+	// Use the model configured for this prompt template, if any
+	override, hasOverride := config.ModelOverrides[req.PromptTemplate]
+	if hasOverride && override.Model != "" {
+		anthropicModel = override.Model
+	}
+	if model != "" {
+		anthropicModel = model
 	}
 
 	anthropicReq := ConvertToAnthropicRequest(req, anthropicModel, systemPrompt)
+	if hasOverride && override.MaxTokens > 0 {
+		anthropicReq.MaxTokens = override.MaxTokens
+	}
+	applyGeneration(anthropicReq, req, config)
+	if req.Structured {
+		enableStructuredOutput(anthropicReq)
+	}
+
+	// sendDelta passes a delta on unless the call was cancelled, the handler stops reading textChan then
+	sendDelta := func(delta Delta) error {
+		select {
+		case textChan <- delta:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// sendReading validates the reading tool input and passes it on, structured responses are cached as that JSON
+	sendReading := func(input string) error {
+		reading, err := parseReading(input)
+		if err != nil {
+			return err
+		}
+		return sendDelta(Delta{Model: anthropicModel, Reading: &reading})
+	}
+
+	// logContent logs request and response content, except for end-to-end encrypted connections
+	logContent := func(msg string, args ...any) {
+		if !req.encrypted {
+			logFrom(ctx).Debug(msg, args...)
+		}
+	}
 
 	requestBody, err := MarshalRequest(anthropicReq)
 	if err != nil {
 		return fmt.Errorf("failed to marshal request: %w", err)
 	}
-	fmt.Printf("requestBody: %v\n", requestBody)
+	logContent("Anthropic request", "body", string(requestBody))
 
-	httpReq, err := http.NewRequest("POST", anthropicURL, bytes.NewReader(requestBody))
-	if err != nil {
-		return fmt.Errorf("failed to create HTTP request: %w", err)
+	// Serve identical requests from the response cache unless the client asked to bypass it.
+	// Encrypted content is never cached, the cache stores plaintext.
+	var cache *ResponseCache
+	if !req.encrypted && featureFlags.Enabled(ctx, flagResponseCache, connectionID, true) {
+		cache, err = newResponseCache(ctx, config)
+		if err != nil {
+			logFrom(ctx).Warn("Response cache disabled", "error", err)
+		}
 	}
+	cacheKey := responseCacheKey(requestBody)
+	if cache != nil && !req.NoCache {
+		cached, found, err := cache.Get(ctx, cacheKey)
+		if err != nil {
+			logFrom(ctx).Warn("Response cache lookup failed", "error", err)
+		}
+		if found {
+			logFrom(ctx).Info("Serving response from cache", "cache_key", cacheKey)
+			if req.Structured {
+				err := sendReading(cached)
+				if err != nil {
+					return err
+				}
+			} else {
+				err := sendDelta(Delta{Model: anthropicModel, Text: cached})
+				if err != nil {
+					return err
+				}
+			}
+			doneChan <- Usage{Model: anthropicModel, Cached: true}
+			return nil
+		}
+	}
+	var fullResponse strings.Builder
 
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("X-API-Key", anthropicAPIKey)
-	httpReq.Header.Set("anthropic-version", anthropicVersion)
-
-	client := &http.Client{}
-	resp, err := client.Do(httpReq)
+	resp, err := sendAnthropicRequest(ctx, config, anthropicURL, anthropicVersion, requestBody)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
+	// The default 64KB line limit is too small for long deltas and large message_start events
 	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, streamBufferSize), config.StreamLineLimit)
 	var currentEvent string
+	usage := Usage{Model: anthropicModel}
+	var stopReason string
 
 	for scanner.Scan() {
 		line := scanner.Text()
-		fmt.Printf("line: %v\n", line)
+		logContent("Anthropic stream line", "line", line)
 		if strings.HasPrefix(line, "event: ") {
 			currentEvent = strings.TrimPrefix(line, "event: ")
-			fmt.Printf("currentEvent: %v\n", currentEvent)
+			logFrom(ctx).Debug("Anthropic stream event", "event", currentEvent)
 		} else if strings.HasPrefix(line, "data: ") {
 			data := strings.TrimPrefix(line, "data: ")
-			fmt.Printf("data: %v\n", data)
 			var eventData map[string]interface{}
 			err := json.Unmarshal([]byte(data), &eventData)
 			if err != nil {
-				return err
+				return &StreamError{Err: err, Usage: usage}
 			}
-			fmt.Printf("eventData: %v\n", eventData)
 
 			switch currentEvent {
 			case "message_start":
-				fmt.Println("Message started")
+				logFrom(ctx).Debug("Message started")
+				updateUsage(&usage, eventData)
 			case "content_block_start":
-				fmt.Println("Content block started")
+				logFrom(ctx).Debug("Content block started")
 			case "ping":
-				fmt.Println("Received ping")
+				logFrom(ctx).Debug("Received ping")
 			case "content_block_delta":
 				if delta, ok := eventData["delta"].(map[string]interface{}); ok {
 					if textDelta, ok := delta["text"].(string); ok {
-						textChan <- textDelta
-						fmt.Println("[" + textDelta + "]")
+						err := sendDelta(Delta{Model: anthropicModel, Text: textDelta})
+						if err != nil {
+							return &StreamError{Err: err, Usage: usage}
+						}
+						fullResponse.WriteString(textDelta)
+					}
+					// The reading tool input streams as partial JSON, it is only complete at message_stop
+					if partialJSON, ok := delta["partial_json"].(string); ok {
+						fullResponse.WriteString(partialJSON)
 					}
 				}
 			case "content_block_stop":
-				fmt.Println("Content block stopped")
+				logFrom(ctx).Debug("Content block stopped")
+			case "error":
+				// Anthropic reports overloads that happen mid-response as an error event, the stream ends with it
+				apiErr := anthropicErrorFromEvent(eventData)
+				logFrom(ctx).Warn("Anthropic stream failed", "error", apiErr)
+				return &StreamError{Err: apiErr, Usage: usage}
 			case "message_delta":
-				fmt.Println("Received message delta")
+				logFrom(ctx).Debug("Received message delta")
+				updateUsage(&usage, eventData)
+				if delta, ok := eventData["delta"].(map[string]interface{}); ok {
+					if reason, ok := delta["stop_reason"].(string); ok {
+						stopReason = reason
+					}
+				}
 			case "message_stop":
-				fmt.Println("Message stopped")
-				close(doneChan) // Signal completion
+				logFrom(ctx).Debug("Message stopped")
+				if req.Structured {
+					err := sendReading(fullResponse.String())
+					if err != nil {
+						return err
+					}
+				}
+				// A response cut off at max_tokens can be resumed, and isn't cached since it is incomplete.
+				// A truncated structured reading fails validation above instead.
+				truncated := stopReason == stopReasonMaxTokens
+				if truncated {
+					err := sendDelta(Delta{Model: anthropicModel, Continuation: &Continuation{
+						PromptTemplate: req.PromptTemplate,
+						TemplateParams: req.TemplateParams,
+						Model:          anthropicModel,
+						Messages:       appendAssistantText(req.Messages, fullResponse.String()),
+					}})
+					if err != nil {
+						return &StreamError{Err: err, Usage: usage}
+					}
+				}
+				if cache != nil && !truncated {
+					err := cache.Put(ctx, cacheKey, anthropicModel, fullResponse.String())
+					if err != nil {
+						logFrom(ctx).Error("Failed to cache response", "error", err)
+					}
+				}
+				doneChan <- usage // Signal completion
 				return nil
 			default:
-				fmt.Printf("Unhandled event type: %s", currentEvent)
+				logFrom(ctx).Warn("Unhandled event type", "event", currentEvent)
 			}
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		return err
+		return &StreamError{Err: err, Usage: usage}
 	}
 
-	return nil
+	// Every call ends with either usage on doneChan or an error, a stream cut before message_stop is an error
+	return &StreamError{Err: io.ErrUnexpectedEOF, Usage: usage}
 }
 
-func createWebSocketClient(ctx context.Context, domainName, stage string) (*apigatewaymanagementapi.Client, error) {
+// sendAnthropicRequest posts the request and returns the response once it is ready to stream.
+// Throttled keys are rotated out right away. Overloads, throttling of every key and dropped connections
+// are retried with backoff within config.Retry, nothing has reached the client at that point.
+func sendAnthropicRequest(ctx context.Context, config Config, anthropicURL, anthropicVersion string, requestBody []byte) (*http.Response, error) {
+	keyPool := getKeyPool(config.AnthropicKeys)
+	client := getAnthropicHTTPClient(config)
+	budgetEnd := time.Now().Add(config.Retry.Budget)
+	freshKeys := keyPool.Size()
+	retries := 0
+	// lastErr is the last throttled or overloaded response, so callers see why the retries gave up
+	var lastErr *AnthropicError
+
+	for attempt := 1; ; attempt++ {
+		apiKey := keyPool.Acquire(time.Now())
+		httpReq, err := http.NewRequestWithContext(ctx, "POST", anthropicURL, bytes.NewReader(requestBody))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+		}
+
+		httpReq.Header.Set("Content-Type", "application/json")
+		httpReq.Header.Set("X-API-Key", apiKey)
+		httpReq.Header.Set("anthropic-version", anthropicVersion)
+
+		resp, err := client.Do(httpReq)
+		switch {
+		case err != nil && !retryableError(err):
+			return nil, err
+		case err != nil:
+			logFrom(ctx).Warn("Anthropic connection failed", "attempt", attempt, "error", err)
+			lastErr = nil
+		case resp.StatusCode == http.StatusOK:
+			return resp, nil
+		case !retryableStatus(resp.StatusCode):
+			apiErr := readAnthropicError(ctx, resp)
+			resp.Body.Close()
+			logFrom(ctx).Warn("Anthropic request failed", "error", apiErr)
+			return nil, apiErr
+		default:
+			lastErr = readAnthropicError(ctx, resp)
+			logFrom(ctx).Warn("Anthropic call failed, retrying", "status", resp.StatusCode, "attempt", attempt, "error", lastErr.Message)
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusTooManyRequests {
+				keyPool.Throttled(ctx, apiKey, resp.Header, time.Now())
+				// Another key may not be throttled, try it without waiting
+				freshKeys--
+				if freshKeys > 0 && attempt < config.Retry.MaxAttempts {
+					continue
+				}
+			}
+		}
+
+		if attempt >= config.Retry.MaxAttempts || !waitForRetry(ctx, backoff(retries+1), budgetEnd) {
+			logFrom(ctx).Error("Giving up on Anthropic", "attempts", attempt)
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, fmt.Errorf("anthropic call failed after %d attempts: %w", attempt, err)
+		}
+		retries++
+	}
+}
+
+// recordUsage prices the usage with the PRICING table and stores it in USAGE.
+// Failures are logged only, a missing price or usage record shouldn't fail a finished reading.
+func recordUsage(ctx context.Context, config Config, dbClient *dynamodb.Client, requestID string, connectionID string, userHash string, usage Usage) Usage {
+	pricing, found, err := getModelPricing(ctx, dbClient, config.PricingTable, usage.Model)
+	if err != nil {
+		logFrom(ctx).Warn("Can't load model pricing", "error", err)
+	} else if !found {
+		logFrom(ctx).Warn("No pricing configured for model", "model", usage.Model)
+	} else {
+		usage.EstimatedCost = estimateCost(usage, pricing)
+	}
+
+	err = storeUsage(ctx, dbClient, config.UsageTable, requestID, connectionID, userHash, usage)
+	if err != nil {
+		logFrom(ctx).Warn("Can't store usage", "error", err)
+	}
+	return usage
+}
+
+// websocketCallbackURL returns the connection management endpoint for the API.
+// WS_CALLBACK_URL wins if set. Custom domains map the stage through the API mapping, usually to the root,
+// so the stage is only appended for the default execute-api domain.
+func websocketCallbackURL(config Config, domainName, stage string) string {
+	if config.WSCallbackURL != "" {
+		return strings.TrimSuffix(config.WSCallbackURL, "/")
+	}
+	if !strings.HasSuffix(domainName, awsDomainSuffix) {
+		return fmt.Sprintf("https://%s", domainName)
+	}
+	return fmt.Sprintf("https://%s/%s", domainName, stage)
+}
+
+var (
+	// anthropicClient is shared between warm invocations so idle connections to Anthropic are reused
+	anthropicClient     *http.Client
+	anthropicClientOnce sync.Once
+)
+
+// getAnthropicHTTPClient returns the container's HTTP client for Anthropic calls, created on first use
+func getAnthropicHTTPClient(config Config) *http.Client {
+	anthropicClientOnce.Do(func() {
+		anthropicClient = newAnthropicHTTPClient(config)
+	})
+	return anthropicClient
+}
+
+// newAnthropicHTTPClient returns the HTTP client for Anthropic calls, routed through the egress proxy if one is configured.
+// The timeout covers connecting and waiting for the response headers, not the streamed body, which the context bounds.
+func newAnthropicHTTPClient(config Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.AnthropicProxyURL != nil {
+		transport.Proxy = http.ProxyURL(config.AnthropicProxyURL)
+	}
+	transport.DialContext = (&net.Dialer{Timeout: config.AnthropicHTTPTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = config.AnthropicHTTPTimeout
+	transport.ResponseHeaderTimeout = config.AnthropicHTTPTimeout
+	return &http.Client{Transport: transport}
+}
+
+// WebSocketClient is the part of the API Gateway management API the proxy posts frames and closes connections with.
+// *apigatewaymanagementapi.Client implements it, tests can drive the handlers with a fake.
+type WebSocketClient interface {
+	PostToConnection(ctx context.Context, params *apigatewaymanagementapi.PostToConnectionInput, optFns ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.PostToConnectionOutput, error)
+	DeleteConnection(ctx context.Context, params *apigatewaymanagementapi.DeleteConnectionInput, optFns ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.DeleteConnectionOutput, error)
+}
+
+// newWebSocketClient returns the client for the callback URL of a connection's domain and stage
+var newWebSocketClient = createWebSocketClient
+
+func createWebSocketClient(ctx context.Context, callbackURL string) (WebSocketClient, error) {
 	cfg, err := awsConfig.LoadDefaultConfig(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load AWS config: %v", err)
 	}
 
 	client := apigatewaymanagementapi.NewFromConfig(cfg, func(o *apigatewaymanagementapi.Options) {
-		//		o.EndpointResolverV2 = apigatewaymanagementapi.EndpointResolverV2FromURL(fmt.Sprintf("https://%s/%s", domainName, stage))
-		fmt.Printf("URL: https://%s/%s", domainName, stage)
-		o.BaseEndpoint = aws.String(fmt.Sprintf("https://%s/%s", domainName, stage))
+		o.BaseEndpoint = aws.String(callbackURL)
 	})
 
 	return client, nil
 }
 
-func closeWebSocketConnection(ctx context.Context, client *apigatewaymanagementapi.Client, connectionID string) error {
+func closeWebSocketConnection(ctx context.Context, client WebSocketClient, connectionID string) error {
 	_, err := client.DeleteConnection(ctx, &apigatewaymanagementapi.DeleteConnectionInput{
 		ConnectionId: aws.String(connectionID),
 	})
 	return err
 }
 
-func sendWebSocketMessage(ctx context.Context, client *apigatewaymanagementapi.Client, connectionID string, message string) error {
+func sendWebSocketMessage(ctx context.Context, client WebSocketClient, connectionID string, message string) error {
 	_, err := client.PostToConnection(ctx, &apigatewaymanagementapi.PostToConnectionInput{
 		ConnectionId: aws.String(connectionID),
 		Data:         []byte(message),
 	})
 	if err != nil {
-		fmt.Printf("sendWebSocketMessage: Failed to send WebSocket message: %v", err)
+		logFrom(ctx).Warn("Failed to post to connection", "error", err)
 	}
 	return err
 }
 
 func main() {
-	lambda.Start(handleRequest)
+	slog.SetDefault(newLogger(os.Stdout, parseLogLevel(os.Getenv(envLogLevel))))
+
+	var err error
+	quotaPolicy, err = quota.LoadFromEnv()
+	if err != nil {
+		slog.Error("Failed to load quota policy", "error", err)
+		os.Exit(1)
+	}
+	lambda.Start(withRouteMetrics(handleRequest))
 }
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/auth"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+)
+
+const (
+	// planSnapshotTTL bounds how stale a snapshot can get if the USERS stream processor misses an update
+	planSnapshotTTL = 5 * time.Minute
+)
+
+// PlanSnapshot is a copy of the user's plan and balance kept on the WS_CONNECTIONS item,
+// so messages don't need a USERS read before the quota check
+type PlanSnapshot struct {
+	UserHash          string
+	Plan              string
+	RemainingRequests int64
+	TrialExpiresAt    int64
+	// Status, BanReason and BanExpiresAt copy the user's suspension, see users.User.Blocked
+	Status       string
+	BanReason    string
+	BanExpiresAt int64
+	// LoadedAt is the unix time the snapshot was read from USERS, 0 if it was invalidated
+	LoadedAt int64
+}
+
+// Stale reports whether the snapshot has to be reloaded from USERS
+func (s PlanSnapshot) Stale(now time.Time) bool {
+	return s.LoadedAt == 0 || now.Unix()-s.LoadedAt >= int64(planSnapshotTTL/time.Second)
+}
+
+// Attributes returns the WS_CONNECTIONS attributes holding the snapshot
+func (s PlanSnapshot) Attributes() map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"user_hash":               &types.AttributeValueMemberS{Value: s.UserHash},
+		"plan":                    &types.AttributeValueMemberS{Value: s.Plan},
+		"plan_remaining_requests": &types.AttributeValueMemberN{Value: strconv.FormatInt(s.RemainingRequests, 10)},
+		"plan_trial_expires_at":   &types.AttributeValueMemberN{Value: strconv.FormatInt(s.TrialExpiresAt, 10)},
+		"plan_loaded_at":          &types.AttributeValueMemberN{Value: strconv.FormatInt(s.LoadedAt, 10)},
+		"ban_status":              &types.AttributeValueMemberS{Value: s.Status},
+		"ban_reason":              &types.AttributeValueMemberS{Value: s.BanReason},
+		"ban_expires_at":          &types.AttributeValueMemberN{Value: strconv.FormatInt(s.BanExpiresAt, 10)},
+	}
+}
+
+// User returns the parts of the user held in the snapshot
+func (s PlanSnapshot) User() users.User {
+	return users.User{
+		UserHash:          s.UserHash,
+		Plan:              s.Plan,
+		RemainingRequests: s.RemainingRequests,
+		TrialExpiresAt:    s.TrialExpiresAt,
+		Status:            s.Status,
+		BanReason:         s.BanReason,
+		BanExpiresAt:      s.BanExpiresAt,
+	}
+}
+
+// Suspension returns the user's suspension, and false if the user may send messages
+func (s PlanSnapshot) Suspension(now time.Time) (auth.Suspension, bool) {
+	return auth.CheckUser(s.User(), now)
+}
+
+// planSnapshotFromItem reads the snapshot attributes of a WS_CONNECTIONS item
+func planSnapshotFromItem(item map[string]types.AttributeValue) PlanSnapshot {
+	var snapshot PlanSnapshot
+	if attr, ok := item["user_hash"].(*types.AttributeValueMemberS); ok {
+		snapshot.UserHash = attr.Value
+	}
+	if attr, ok := item["plan"].(*types.AttributeValueMemberS); ok {
+		snapshot.Plan = attr.Value
+	}
+	snapshot.RemainingRequests = getNumberAttribute(item, "plan_remaining_requests")
+	snapshot.TrialExpiresAt = getNumberAttribute(item, "plan_trial_expires_at")
+	snapshot.LoadedAt = getNumberAttribute(item, "plan_loaded_at")
+	if attr, ok := item["ban_status"].(*types.AttributeValueMemberS); ok {
+		snapshot.Status = attr.Value
+	}
+	if attr, ok := item["ban_reason"].(*types.AttributeValueMemberS); ok {
+		snapshot.BanReason = attr.Value
+	}
+	snapshot.BanExpiresAt = getNumberAttribute(item, "ban_expires_at")
+	return snapshot
+}
+
+// getNumberAttribute returns a numeric attribute, or 0 if it is missing or not an integer
+func getNumberAttribute(item map[string]types.AttributeValue, name string) int64 {
+	attr, ok := item[name].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0
+	}
+	value, err := strconv.ParseInt(attr.Value, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return value
+}
+
+// errUnknownAuthKey is returned for an auth key that doesn't resolve to a user
+var errUnknownAuthKey = errors.New("auth key has no user")
+
+// getUserHashFromAuth resolves the user behind an auth key. Legacy plaintext keys are moved to the hashed
+// form by cmd/auth-keys-migrate, so only the hashed key is looked up.
+func getUserHashFromAuth(ctx context.Context, client *dynamodb.Client, tableName string, authKey string) (string, error) {
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"key": &types.AttributeValueMemberS{Value: auth.HashKey(authKey)},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get auth key: %w", err)
+	}
+
+	userHashAttr, ok := result.Item["user_hash"].(*types.AttributeValueMemberS)
+	if !ok {
+		return "", errUnknownAuthKey
+	}
+	return userHashAttr.Value, nil
+}
+
+// getRemainingRequests reads the user's balance from USERS, including a legacy token balance that hasn't been migrated
+func getRemainingRequests(ctx context.Context, client *dynamodb.Client, tableName string, userHash string) (int64, error) {
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			users.AttrUserHash: &types.AttributeValueMemberS{Value: userHash},
+		},
+		ProjectionExpression: aws.String("#requests, #tokens"),
+		ExpressionAttributeNames: map[string]string{
+			"#requests": users.AttrRemainingRequests,
+			"#tokens":   users.AttrLegacyRemainingTokens,
+		},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get remaining requests: %w", err)
+	}
+	if result.Item == nil {
+		return 0, fmt.Errorf("user %s not found", userHash)
+	}
+
+	user := users.User{RemainingRequests: getNumberAttribute(result.Item, users.AttrRemainingRequests)}
+	if _, ok := result.Item[users.AttrLegacyRemainingTokens]; ok {
+		legacyTokens := getNumberAttribute(result.Item, users.AttrLegacyRemainingTokens)
+		user.LegacyRemainingTokens = &legacyTokens
+	}
+	return user.Balance(), nil
+}
+
+// BalanceExhaustedError is returned by decreaseRemainingRequests when the balance can't cover the charge,
+// usually because another reading of the same user was charged after the quota check
+type BalanceExhaustedError struct {
+	UserHash string
+	// Remaining is the balance the charge was refused on
+	Remaining int64
+}
+
+func (e *BalanceExhaustedError) Error() string {
+	return fmt.Sprintf("balance of user %s exhausted with %d requests remaining", e.UserHash, e.Remaining)
+}
+
+// decreaseRemainingRequests charges the user for a finished reading. The charge is refused with a
+// BalanceExhaustedError if it would take the balance below floor, see quota.Policy.ChargeFloor.
+// Users with an unmigrated legacy token balance are charged unconditionally, their balance is spread
+// over two attributes.
+func decreaseRemainingRequests(ctx context.Context, client *dynamodb.Client, tableName string, userHash string, amount int64, floor int64) error {
+	condition := "attribute_exists(#user) AND (#requests >= :floor OR attribute_exists(#tokens)"
+	if floor <= 0 {
+		// A missing balance counts as 0
+		condition += " OR attribute_not_exists(#requests)"
+	}
+	condition += ")"
+
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			users.AttrUserHash: &types.AttributeValueMemberS{Value: userHash},
+		},
+		UpdateExpression:    aws.String("SET #requests = if_not_exists(#requests, :zero) - :decr"),
+		ConditionExpression: aws.String(condition),
+		ExpressionAttributeNames: map[string]string{
+			"#user":     users.AttrUserHash,
+			"#requests": users.AttrRemainingRequests,
+			"#tokens":   users.AttrLegacyRemainingTokens,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":decr":  &types.AttributeValueMemberN{Value: strconv.FormatInt(amount, 10)},
+			":zero":  &types.AttributeValueMemberN{Value: "0"},
+			":floor": &types.AttributeValueMemberN{Value: strconv.FormatInt(floor, 10)},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		if conditionErr.Item == nil {
+			return fmt.Errorf("user %s not found", userHash)
+		}
+		return &BalanceExhaustedError{UserHash: userHash, Remaining: getNumberAttribute(conditionErr.Item, users.AttrRemainingRequests)}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to decrease remaining requests: %w", err)
+	}
+	return nil
+}
+
+// refillUser adds the plan refill to the user's balance. The condition on the last refill time keeps
+// concurrent loads from refilling twice, the loser returns a ConditionalCheckFailedException.
+func refillUser(ctx context.Context, client *dynamodb.Client, tableName string, user users.User, amount int64, now time.Time) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			users.AttrUserHash: &types.AttributeValueMemberS{Value: user.UserHash},
+		},
+		UpdateExpression:    aws.String("SET #requests = if_not_exists(#requests, :zero) + :amount, #refilled = :now"),
+		ConditionExpression: aws.String("attribute_not_exists(#refilled)"),
+		ExpressionAttributeNames: map[string]string{
+			"#requests": users.AttrRemainingRequests,
+			"#refilled": users.AttrLastRefillAt,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":zero":   &types.AttributeValueMemberN{Value: "0"},
+			":amount": &types.AttributeValueMemberN{Value: strconv.FormatInt(amount, 10)},
+			":now":    &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	}
+	if user.LastRefillAt != 0 {
+		input.ConditionExpression = aws.String("#refilled = :last")
+		input.ExpressionAttributeValues[":last"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(user.LastRefillAt, 10)}
+	}
+	_, err := client.UpdateItem(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to refill user: %w", err)
+	}
+	return nil
+}
+
+// loadPlanSnapshot reads the user's plan and balance from USERS, applying a due plan refill first
+func loadPlanSnapshot(ctx context.Context, client *dynamodb.Client, tableName string, userHash string) (PlanSnapshot, error) {
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			users.AttrUserHash: &types.AttributeValueMemberS{Value: userHash},
+		},
+	})
+	if err != nil {
+		return PlanSnapshot{}, fmt.Errorf("failed to get user: %w", err)
+	}
+	if result.Item == nil {
+		return PlanSnapshot{}, fmt.Errorf("user %s not found", userHash)
+	}
+
+	user := users.User{
+		UserHash:          userHash,
+		RemainingRequests: getNumberAttribute(result.Item, users.AttrRemainingRequests),
+		TrialExpiresAt:    getNumberAttribute(result.Item, "trial_expires_at"),
+		CreatedAt:         getNumberAttribute(result.Item, "created_at"),
+		LastRefillAt:      getNumberAttribute(result.Item, users.AttrLastRefillAt),
+	}
+	if attr, ok := result.Item[users.AttrLegacyRemainingTokens].(*types.AttributeValueMemberN); ok {
+		legacyTokens, err := strconv.ParseInt(attr.Value, 10, 64)
+		if err == nil {
+			user.LegacyRemainingTokens = &legacyTokens
+		}
+	}
+	if attr, ok := result.Item["plan"].(*types.AttributeValueMemberS); ok {
+		user.Plan = attr.Value
+	}
+	if attr, ok := result.Item[users.AttrStatus].(*types.AttributeValueMemberS); ok {
+		user.Status = attr.Value
+	}
+	if attr, ok := result.Item[users.AttrBanReason].(*types.AttributeValueMemberS); ok {
+		user.BanReason = attr.Value
+	}
+
+	now := time.Now()
+	if amount, due := quotaPolicy.Refill(user, now); due {
+		err := refillUser(ctx, client, tableName, user, amount, now)
+		var conditionErr *types.ConditionalCheckFailedException
+		switch {
+		case errors.As(err, &conditionErr):
+			// Another invocation refilled the user first, its snapshot reload will pick up the new balance
+			logFrom(ctx).Info("User was refilled concurrently")
+		case err != nil:
+			logFrom(ctx).Warn("Can't refill user", "error", err)
+		default:
+			logFrom(ctx).Info("Refilled user", "amount", amount)
+			user.RemainingRequests += amount
+		}
+	}
+
+	return PlanSnapshot{
+		UserHash:          userHash,
+		Plan:              user.Plan,
+		RemainingRequests: user.Balance(),
+		TrialExpiresAt:    user.TrialExpiresAt,
+		Status:            user.Status,
+		BanReason:         user.BanReason,
+		BanExpiresAt:      getNumberAttribute(result.Item, users.AttrBanExpiresAt),
+		LoadedAt:          now.Unix(),
+	}, nil
+}
+
+// savePlanSnapshot replaces the snapshot on an existing connection record
+func savePlanSnapshot(ctx context.Context, client *dynamodb.Client, tableName string, connectionID string, snapshot PlanSnapshot) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"connection_id": &types.AttributeValueMemberS{Value: connectionID},
+		},
+		UpdateExpression:    aws.String("SET #plan = :plan, plan_remaining_requests = :remaining, plan_trial_expires_at = :trial, plan_loaded_at = :loaded, ban_status = :status, ban_reason = :reason, ban_expires_at = :banExpires"),
+		ConditionExpression: aws.String("attribute_exists(connection_id)"),
+		ExpressionAttributeNames: map[string]string{
+			"#plan": "plan",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":plan":       &types.AttributeValueMemberS{Value: snapshot.Plan},
+			":remaining":  &types.AttributeValueMemberN{Value: strconv.FormatInt(snapshot.RemainingRequests, 10)},
+			":trial":      &types.AttributeValueMemberN{Value: strconv.FormatInt(snapshot.TrialExpiresAt, 10)},
+			":loaded":     &types.AttributeValueMemberN{Value: strconv.FormatInt(snapshot.LoadedAt, 10)},
+			":status":     &types.AttributeValueMemberS{Value: snapshot.Status},
+			":reason":     &types.AttributeValueMemberS{Value: snapshot.BanReason},
+			":banExpires": &types.AttributeValueMemberN{Value: strconv.FormatInt(snapshot.BanExpiresAt, 10)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save plan snapshot: %w", err)
+	}
+	return nil
+}
+
+// getConnectionPlan returns the connection's plan snapshot, reloading it from USERS if it is stale
+func getConnectionPlan(ctx context.Context, config Config, client *dynamodb.Client, connectionID string, snapshot PlanSnapshot) (PlanSnapshot, error) {
+	if snapshot.UserHash == "" {
+		return snapshot, errors.New("connection has no user")
+	}
+	if !snapshot.Stale(time.Now()) {
+		return snapshot, nil
+	}
+
+	fresh, err := loadPlanSnapshot(ctx, client, config.UsersTable, snapshot.UserHash)
+	if err != nil {
+		return snapshot, err
+	}
+	err = savePlanSnapshot(ctx, client, config.ConnectionsTable, connectionID, fresh)
+	if err != nil {
+		// The fresh snapshot is still good for this message
+		logFrom(ctx).Warn("Can't save plan snapshot", "error", err)
+	}
+	return fresh, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+)
+
+// conditionFailedWith is a failed condition that returns the old item, as ReturnValuesOnConditionCheckFailure asks for
+const conditionFailedWith = `{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException","message":"The conditional request failed","Item":{"user_hash":{"S":"user-1"},"remaining_requests":{"N":"0"}}}`
+
+func TestDecreaseRemainingRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		// exhausted is whether the error is a BalanceExhaustedError, remaining the balance it was refused on
+		err       bool
+		exhausted bool
+		remaining int64
+	}{
+		{name: "charged", response: "{}"},
+		{name: "exhausted by a race", response: conditionFailedWith, err: true, exhausted: true, remaining: 0},
+		{name: "missing user", response: conditionFailed, err: true},
+		{name: "DynamoDB failure", response: internalError, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dynamo := newFakeDynamoDB(t, map[string]string{"UpdateItem " + users.TableName: tt.response})
+			client, err := newDynamoDBClient(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = decreaseRemainingRequests(context.Background(), client, users.TableName, testUserHash, 2, 2)
+			if (err != nil) != tt.err {
+				t.Fatalf("error = %v, want error %v", err, tt.err)
+			}
+			var exhaustedErr *BalanceExhaustedError
+			if errors.As(err, &exhaustedErr) != tt.exhausted {
+				t.Fatalf("error = %v, want exhausted %v", err, tt.exhausted)
+			}
+			if tt.exhausted && exhaustedErr.Remaining != tt.remaining {
+				t.Errorf("remaining = %d, want %d", exhaustedErr.Remaining, tt.remaining)
+			}
+
+			calls := dynamo.Calls("UpdateItem", users.TableName)
+			if len(calls) != 1 {
+				t.Fatalf("UpdateItem called %d times", len(calls))
+			}
+			values := calls[0].Input["ExpressionAttributeValues"].(map[string]any)
+			if values[":decr"].(map[string]any)["N"] != "2" || values[":floor"].(map[string]any)["N"] != "2" {
+				t.Errorf("charged with %+v", values)
+			}
+			if calls[0].Input["ConditionExpression"] != "attribute_exists(#user) AND (#requests >= :floor OR attribute_exists(#tokens))" {
+				t.Errorf("condition = %v", calls[0].Input["ConditionExpression"])
+			}
+		})
+	}
+}
+
+func TestDecreaseRemainingRequestsWithOverdraft(t *testing.T) {
+	dynamo := newFakeDynamoDB(t, nil)
+	client, err := newDynamoDBClient(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A floor at or below 0 also lets a user without a balance attribute go into the overdraft
+	err = decreaseRemainingRequests(context.Background(), client, users.TableName, testUserHash, 1, -2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	condition := dynamo.Calls("UpdateItem", users.TableName)[0].Input["ConditionExpression"]
+	if condition != "attribute_exists(#user) AND (#requests >= :floor OR attribute_exists(#tokens) OR attribute_not_exists(#requests))" {
+		t.Errorf("condition = %v", condition)
+	}
+}
+
+func TestHandleSendMessageChargeRefusedByRace(t *testing.T) {
+	setTestConfig(t, anthropicServer(t, http.StatusOK, streamOf("The Tower")))
+	t.Setenv(envAnthropicKey, t.Name())
+	responses := readingResponses(5)
+	// Another reading spent the balance between the quota check and the charge
+	responses["UpdateItem "+users.TableName] = conditionFailedWith
+	newFakeDynamoDB(t, responses)
+	wsClient := newTestWebSocketClient(t)
+
+	response, _ := handleSendMessage(context.Background(), testEvent("sendmessage", readingBody))
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", response.StatusCode, response.Body)
+	}
+	frames := wsClient.Frames(t)
+	want := []string{frameTypeDelta, frameTypeUsage, frameTypeQuotaExceeded, frameTypeDone}
+	if got := frameTypes(frames); !slices.Equal(got, want) {
+		t.Fatalf("frames = %v, want %v", got, want)
+	}
+	if quota := frames[2].Quota; quota == nil || quota.Remaining != -1 {
+		t.Errorf("quota_exceeded frame = %+v", frames[2])
+	}
+}
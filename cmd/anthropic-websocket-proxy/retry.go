@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultMaxAttempts  = 4
+	defaultRetryBudget  = 20 * time.Second
+	retryBaseDelay      = 250 * time.Millisecond
+	retryMaxDelay       = 4 * time.Second
+	envMaxAttempts      = "ANTHROPIC_MAX_ATTEMPTS"
+	envRetryBudget      = "ANTHROPIC_RETRY_BUDGET"
+	statusOverloaded    = 529
+	errorBodyLimitBytes = 4096
+)
+
+// RetryPolicy bounds how often and for how long a call is retried before any of the response is streamed
+type RetryPolicy struct {
+	MaxAttempts int
+	// Budget is the total time spent waiting between attempts, it is cut short by the context deadline
+	Budget time.Duration
+}
+
+// StreamError is a failure after the response started streaming. The client already has part of the
+// response, so it isn't retried and the client is told instead.
+type StreamError struct {
+	Err error
+	// Usage holds the tokens counted before the stream broke off
+	Usage Usage
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("response stream interrupted: %v", e.Err)
+}
+
+func (e *StreamError) Unwrap() error {
+	return e.Err
+}
+
+// loadRetryPolicy reads the retry settings, falling back to the defaults
+func loadRetryPolicy() (RetryPolicy, error) {
+	policy := RetryPolicy{MaxAttempts: defaultMaxAttempts, Budget: defaultRetryBudget}
+
+	if attempts := os.Getenv(envMaxAttempts); attempts != "" {
+		value, err := strconv.Atoi(attempts)
+		if err != nil || value < 1 {
+			return policy, fmt.Errorf("invalid attempt count in environment variable %s: %q", envMaxAttempts, attempts)
+		}
+		policy.MaxAttempts = value
+	}
+
+	if budget := os.Getenv(envRetryBudget); budget != "" {
+		duration, err := time.ParseDuration(budget)
+		if err != nil {
+			return policy, fmt.Errorf("invalid duration in environment variable %s: %w", envRetryBudget, err)
+		}
+		policy.Budget = duration
+	}
+
+	return policy, nil
+}
+
+// retryableStatus reports whether Anthropic asked us to come back later
+func retryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == statusOverloaded
+}
+
+// retryableError reports whether the request failed on a dropped connection rather than a bad request
+func retryableError(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// backoff returns the wait before the given retry, exponential with full jitter
+func backoff(retry int) time.Duration {
+	delay := retryBaseDelay << min(retry-1, 10)
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// waitForRetry sleeps before the next attempt. It returns false without waiting if the remaining budget
+// or the context deadline doesn't leave room for the wait.
+func waitForRetry(ctx context.Context, delay time.Duration, budgetEnd time.Time) bool {
+	wakeAt := time.Now().Add(delay)
+	if wakeAt.After(budgetEnd) {
+		return false
+	}
+	if deadline, ok := ctx.Deadline(); ok && wakeAt.After(deadline) {
+		return false
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// AnthropicError is a non-200 response from Anthropic, decoded from its error envelope
+type AnthropicError struct {
+	StatusCode int
+	Type       string
+	Message    string
+}
+
+func (e *AnthropicError) Error() string {
+	return fmt.Sprintf("anthropic returned status %d (%s): %s", e.StatusCode, e.Type, e.Message)
+}
+
+// ClientStatus is the status the websocket request fails with. Requests Anthropic rejected as invalid
+// are the client's fault, anything else is an upstream failure.
+func (e *AnthropicError) ClientStatus() int {
+	switch e.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return e.StatusCode
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// ClientMessage is the error text shown to the user. Authentication and permission errors concern our
+// API keys, so their details stay in the logs.
+func (e *AnthropicError) ClientMessage() string {
+	switch e.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return e.Message
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "The AI service is misconfigured, please try again later"
+	default:
+		return "The AI service is unavailable, please try again later"
+	}
+}
+
+// readAnthropicError decodes the error envelope of a non-200 response,
+// e.g. {"type":"error","error":{"type":"invalid_request_error","message":"..."}}
+func readAnthropicError(ctx context.Context, resp *http.Response) *AnthropicError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, errorBodyLimitBytes))
+	apiErr := &AnthropicError{StatusCode: resp.StatusCode, Type: "unknown_error", Message: http.StatusText(resp.StatusCode)}
+
+	var envelope struct {
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		logFrom(ctx).Warn("Anthropic error response isn't JSON", "body", string(body))
+		return apiErr
+	}
+	if envelope.Error.Type != "" {
+		apiErr.Type = envelope.Error.Type
+	}
+	if envelope.Error.Message != "" {
+		apiErr.Message = envelope.Error.Message
+	}
+	return apiErr
+}
+
+// anthropicErrorFromEvent decodes the payload of an error event in the response stream.
+// The response status was already 200, so the status is derived from the error type.
+func anthropicErrorFromEvent(eventData map[string]interface{}) *AnthropicError {
+	apiErr := &AnthropicError{StatusCode: http.StatusInternalServerError, Type: "unknown_error", Message: "stream error"}
+	details, ok := eventData["error"].(map[string]interface{})
+	if !ok {
+		return apiErr
+	}
+	if errorType, ok := details["type"].(string); ok {
+		apiErr.Type = errorType
+	}
+	if message, ok := details["message"].(string); ok {
+		apiErr.Message = message
+	}
+	if apiErr.Type == "overloaded_error" {
+		apiErr.StatusCode = statusOverloaded
+	}
+	return apiErr
+}
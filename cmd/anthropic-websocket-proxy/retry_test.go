@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyAnthropic answers with the given statuses in turn and 200 after them. A status of 0 drops the
+// connection without a response.
+func flakyAnthropic(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1))
+		if n > len(statuses) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			return
+		}
+		switch status := statuses[n-1]; status {
+		case 0:
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.Close()
+		default:
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"type":"error","error":{"type":"status_%d","message":"failed with %d"}}`, status, status)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// retryTestConfig returns a config with its own key pool that retries attempts times
+func retryTestConfig(t *testing.T, server *httptest.Server, attempts int) Config {
+	t.Helper()
+	setTestConfig(t, server)
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.AnthropicKeys = []string{t.Name()}
+	config.Retry = RetryPolicy{MaxAttempts: attempts, Budget: 10 * time.Second}
+	return config
+}
+
+func TestSendAnthropicRequestRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		attempts int
+		// status is the status of the returned AnthropicError, 0 for success
+		status   int
+		requests int32
+	}{
+		{"succeeds at once", nil, 4, 0, 1},
+		{"overloaded twice", []int{statusOverloaded, statusOverloaded}, 4, 0, 3},
+		{"throttled then overloaded", []int{http.StatusTooManyRequests, statusOverloaded}, 4, 0, 3},
+		{"connection reset", []int{0}, 4, 0, 2},
+		{"overloaded past the attempts", []int{statusOverloaded, statusOverloaded, statusOverloaded}, 3, statusOverloaded, 3},
+		{"bad request isn't retried", []int{http.StatusBadRequest}, 4, http.StatusBadRequest, 1},
+		{"server error isn't retried", []int{http.StatusInternalServerError}, 4, http.StatusInternalServerError, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := flakyAnthropic(t, tt.statuses...)
+			config := retryTestConfig(t, server, tt.attempts)
+
+			resp, err := sendAnthropicRequest(context.Background(), config, server.URL, defaultAnthropicVersion, []byte("{}"))
+			if resp != nil {
+				resp.Body.Close()
+			}
+			if tt.status == 0 && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.status != 0 {
+				var apiErr *AnthropicError
+				if !errors.As(err, &apiErr) || apiErr.StatusCode != tt.status {
+					t.Fatalf("error = %v, want status %d", err, tt.status)
+				}
+			}
+			if got := requests.Load(); got != tt.requests {
+				t.Errorf("requests = %d, want %d", got, tt.requests)
+			}
+		})
+	}
+}
+
+func TestSendAnthropicRequestRespectsDeadline(t *testing.T) {
+	server, requests := flakyAnthropic(t, statusOverloaded, statusOverloaded, statusOverloaded)
+	config := retryTestConfig(t, server, 4)
+
+	// No backoff fits before the deadline, so the first failure is final
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Millisecond))
+	defer cancel()
+	start := time.Now()
+	_, err := sendAnthropicRequest(ctx, config, server.URL, defaultAnthropicVersion, []byte("{}"))
+	if err == nil {
+		t.Fatal("request succeeded past the deadline")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("gave up after %v", elapsed)
+	}
+	if got := requests.Load(); got > 1 {
+		t.Errorf("requests = %d, want at most 1", got)
+	}
+}
+
+func TestWaitForRetryBudget(t *testing.T) {
+	if waitForRetry(context.Background(), time.Second, time.Now()) {
+		t.Error("waited past the retry budget")
+	}
+	if !waitForRetry(context.Background(), time.Millisecond, time.Now().Add(time.Second)) {
+		t.Error("didn't wait within the retry budget")
+	}
+	for retry := 1; retry <= 20; retry++ {
+		if delay := backoff(retry); delay < 0 || delay > retryMaxDelay {
+			t.Errorf("backoff(%d) = %v", retry, delay)
+		}
+	}
+}
+
+func TestLoadRetryPolicy(t *testing.T) {
+	policy, err := loadRetryPolicy()
+	if err != nil || policy != (RetryPolicy{MaxAttempts: defaultMaxAttempts, Budget: defaultRetryBudget}) {
+		t.Fatalf("default policy = %+v, %v", policy, err)
+	}
+
+	t.Setenv(envMaxAttempts, "2")
+	t.Setenv(envRetryBudget, "5s")
+	policy, err = loadRetryPolicy()
+	if err != nil || policy != (RetryPolicy{MaxAttempts: 2, Budget: 5 * time.Second}) {
+		t.Fatalf("configured policy = %+v, %v", policy, err)
+	}
+
+	t.Setenv(envMaxAttempts, "0")
+	_, err = loadRetryPolicy()
+	if err == nil {
+		t.Error("zero attempts loaded without error")
+	}
+}
+
+func TestCallAnthropicAPIDoesNotRetryOnceStreaming(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":10}}}\n\n")
+		fmt.Fprint(w, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"delta\":{\"type\":\"text_delta\",\"text\":\"The Tower\"}}\n\n")
+		// The stream ends without message_stop, as if the connection dropped
+	}))
+	t.Cleanup(server.Close)
+	config := retryTestConfig(t, server, 4)
+
+	textChan := make(chan Delta, 10)
+	doneChan := make(chan Usage, 1)
+	req := Request{PromptTemplate: "PROMPTS_TEST", Messages: []Message{{Role: "user", Content: "Draw a card"}}}
+	err := callAnthropicAPI(context.Background(), config, req, "", testConnectionID, textChan, doneChan)
+
+	var streamErr *StreamError
+	if !errors.As(err, &streamErr) {
+		t.Fatalf("error = %v, want a StreamError", err)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("requests = %d, the interrupted stream was retried", got)
+	}
+	if len(textChan) != 1 || len(doneChan) != 0 {
+		t.Errorf("got %d deltas and %d usages, want the one delta sent before the drop", len(textChan), len(doneChan))
+	}
+}
+
+func TestReadAnthropicError(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		errorType  string
+		message    string
+		clientCode int
+	}{
+		{"invalid request", http.StatusBadRequest, `{"type":"error","error":{"type":"invalid_request_error","message":"max_tokens: too large"}}`, "invalid_request_error", "max_tokens: too large", http.StatusBadRequest},
+		{"authentication error", http.StatusUnauthorized, `{"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`, "authentication_error", "invalid x-api-key", http.StatusBadGateway},
+		{"not JSON", http.StatusBadGateway, "upstream connect error", "unknown_error", http.StatusText(http.StatusBadGateway), http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			recorder.WriteHeader(tt.status)
+			recorder.WriteString(tt.body)
+
+			apiErr := readAnthropicError(context.Background(), recorder.Result())
+			if apiErr.StatusCode != tt.status || apiErr.Type != tt.errorType || apiErr.Message != tt.message {
+				t.Errorf("readAnthropicError() = %+v", apiErr)
+			}
+			if apiErr.ClientStatus() != tt.clientCode {
+				t.Errorf("ClientStatus() = %d, want %d", apiErr.ClientStatus(), tt.clientCode)
+			}
+		})
+	}
+}
+
+func TestAnthropicErrorFromEvent(t *testing.T) {
+	overloaded := anthropicErrorFromEvent(map[string]interface{}{
+		"type":  "error",
+		"error": map[string]interface{}{"type": "overloaded_error", "message": "Overloaded"},
+	})
+	if overloaded.StatusCode != statusOverloaded || overloaded.Type != "overloaded_error" || overloaded.Message != "Overloaded" {
+		t.Errorf("overloaded event = %+v", overloaded)
+	}
+
+	malformed := anthropicErrorFromEvent(map[string]interface{}{"type": "error"})
+	if malformed.StatusCode != http.StatusInternalServerError || malformed.Type != "unknown_error" {
+		t.Errorf("malformed event = %+v", malformed)
+	}
+}
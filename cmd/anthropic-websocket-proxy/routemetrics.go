@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/metrics"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/prompts"
+)
+
+const (
+	outcomeOK              = "ok"
+	outcomeValidationError = "validation_error"
+	outcomeQuota           = "quota"
+	outcomeSuspended       = "suspended"
+	outcomeBusy            = "busy"
+	outcomeProviderError   = "provider_error"
+	outcomeTimeout         = "timeout"
+	outcomeClientGone      = "client_gone"
+	outcomeError           = "error"
+
+	messageTypeNone    = "none"
+	messageTypeUnknown = "unknown"
+)
+
+type routeInfoKey struct{}
+
+// routeInfo is filled in by the handlers with what the metrics wrapper can't see from the event
+type routeInfo struct {
+	messageType string
+}
+
+// setMessageType records the prompt template of a message, e.g. INDEED_PROMPT becomes indeed_request.
+// Templates that aren't allowlisted or set are reported as unknown so clients can't create arbitrary metrics.
+func setMessageType(ctx context.Context, promptTemplate string) {
+	info, ok := ctx.Value(routeInfoKey{}).(*routeInfo)
+	if !ok {
+		return
+	}
+	if _, err := prompts.Lookup(promptTemplate); err != nil {
+		info.messageType = messageTypeUnknown
+		return
+	}
+	info.messageType = strings.ToLower(strings.TrimSuffix(promptTemplate, "_PROMPT")) + "_request"
+}
+
+// outcomeFromStatus maps the status codes the handlers return to a metrics outcome
+func outcomeFromStatus(statusCode int) string {
+	switch {
+	case statusCode == http.StatusOK:
+		return outcomeOK
+	case statusCode == http.StatusBadRequest:
+		return outcomeValidationError
+	case statusCode == http.StatusPaymentRequired || statusCode == http.StatusTooManyRequests:
+		return outcomeQuota
+	case statusCode == http.StatusForbidden:
+		return outcomeSuspended
+	case statusCode == http.StatusConflict:
+		return outcomeBusy
+	case statusCode == http.StatusBadGateway:
+		return outcomeProviderError
+	case statusCode == http.StatusGatewayTimeout:
+		return outcomeTimeout
+	case statusCode == http.StatusGone:
+		return outcomeClientGone
+	default:
+		return outcomeError
+	}
+}
+
+// withRouteMetrics emits the count and latency of every invocation by route key, message type and outcome
+func withRouteMetrics(handler func(context.Context, events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error)) func(context.Context, events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return func(ctx context.Context, event events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		start := time.Now()
+		info := &routeInfo{messageType: messageTypeNone}
+		response, err := handler(context.WithValue(ctx, routeInfoKey{}, info), event)
+
+		metrics.Emit(map[string]string{
+			"Route":       event.RequestContext.RouteKey,
+			"MessageType": info.messageType,
+			"Outcome":     outcomeFromStatus(response.StatusCode),
+		},
+			metrics.Metric{Name: "Requests", Unit: metrics.UnitCount, Value: 1},
+			metrics.Metric{Name: "Latency", Unit: metrics.UnitMilliseconds, Value: float64(time.Since(start).Milliseconds())},
+		)
+		return response, err
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+)
+
+// stalledAnthropic sends head and then holds the stream open until the request is cancelled
+func stalledAnthropic(t *testing.T, head string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, head)
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+			t.Error("Anthropic request wasn't cancelled")
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHandleSendMessageStopped(t *testing.T) {
+	messageStart := "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":10}}}\n\n"
+	delta := "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"delta\":{\"type\":\"text_delta\",\"text\":\"The Tower\"}}\n\n"
+
+	tests := []struct {
+		name   string
+		head   string
+		frames []string
+		// charged is whether the reading is charged, only output the client received is
+		charged bool
+	}{
+		{"before the first delta", messageStart, []string{frameTypeCancelled}, false},
+		{"mid-stream", messageStart + delta, []string{frameTypeDelta, frameTypeCancelled}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, stalledAnthropic(t, tt.head))
+			t.Setenv(envAnthropicKey, t.Name())
+			responses := readingResponses(5)
+			// The stop action set cancel_requested, which the reading finds on its first check
+			responses["GetItem "+defaultConnectionsTable] = fmt.Sprintf(`{"Item": {
+				"connection_id": {"S": %q},
+				"seq": {"N": "0"},
+				"user_hash": {"S": %q},
+				"plan_remaining_requests": {"N": "5"},
+				"plan_loaded_at": {"N": "%d"},
+				"cancel_requested": {"N": "%d"}
+			}}`, testConnectionID, testUserHash, time.Now().Unix(), time.Now().Unix())
+			dynamo := newFakeDynamoDB(t, responses)
+			wsClient := newTestWebSocketClient(t)
+
+			response, _ := handleSendMessage(context.Background(), testEvent("sendmessage", readingBody))
+			if response.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d: %s", response.StatusCode, response.Body)
+			}
+			if got := frameTypes(wsClient.Frames(t)); !slices.Equal(got, tt.frames) {
+				t.Errorf("frames = %v, want %v", got, tt.frames)
+			}
+			if len(wsClient.deleted) != 1 {
+				t.Errorf("connection closed %d times, want once", len(wsClient.deleted))
+			}
+			if charges := dynamo.Calls("UpdateItem", users.TableName); len(charges) == 1 != tt.charged {
+				t.Errorf("charged %d times, want charged %v", len(charges), tt.charged)
+			}
+			// Anthropic bills the cancelled call, so its usage is recorded either way
+			puts := dynamo.Calls("PutItem", defaultUsageTable)
+			if len(puts) != 1 || attr(puts[0], "interrupted", "BOOL") != true {
+				t.Errorf("usage = %+v, want one interrupted record", puts)
+			}
+		})
+	}
+}
+
+func TestHandleStop(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		status   int
+		// frames is how many frames the client gets, the reading itself answers a stop that went through
+		frames int
+	}{
+		{"reading in flight", "{}", http.StatusOK, 0},
+		{"nothing in flight", conditionFailed, http.StatusConflict, 1},
+		{"DynamoDB failure", internalError, http.StatusInternalServerError, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, unreachableAnthropic(t))
+			dynamo := newFakeDynamoDB(t, map[string]string{"UpdateItem " + defaultConnectionsTable: tt.response})
+			wsClient := newTestWebSocketClient(t)
+
+			response, _ := handleSendMessage(context.Background(), testEvent("sendmessage", `{"action": "stop"}`))
+			if response.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d: %s", response.StatusCode, tt.status, response.Body)
+			}
+			calls := dynamo.Calls("UpdateItem", defaultConnectionsTable)
+			if len(calls) != 1 || calls[0].Input["UpdateExpression"] != "SET cancel_requested = :now" {
+				t.Errorf("updates = %+v, want cancel_requested set", calls)
+			}
+			if frames := wsClient.Frames(t); len(frames) != tt.frames {
+				t.Errorf("frames = %+v, want %d", frames, tt.frames)
+			}
+			if len(wsClient.deleted) != 0 {
+				t.Error("a stop closed the connection")
+			}
+		})
+	}
+}
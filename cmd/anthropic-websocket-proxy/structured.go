@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/validation"
+)
+
+const (
+	frameTypeCard    = "card"
+	frameTypeSummary = "summary"
+	frameTypeAdvice  = "advice"
+
+	// readingToolName is the tool the model is forced to call in structured mode, its input is the reading
+	readingToolName = "record_reading"
+)
+
+// readingToolSchema is the JSON schema of the reading the model has to return in structured mode
+var readingToolSchema = json.RawMessage(`{
+	"type": "object",
+	"properties": {
+		"cards": {
+			"type": "array",
+			"items": {
+				"type": "object",
+				"properties": {
+					"card": {"type": "string", "description": "Name of the card"},
+					"position": {"type": "string", "description": "Position of the card in the spread"},
+					"meaning": {"type": "string", "description": "Meaning of the card in this position"}
+				},
+				"required": ["card", "meaning"]
+			}
+		},
+		"summary": {"type": "string", "description": "Overall interpretation of the spread"},
+		"advice": {"type": "string", "description": "Advice for the querent"}
+	},
+	"required": ["cards", "summary", "advice"]
+}`)
+
+// Tool is a tool definition in an Anthropic request
+type Tool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+// ToolChoice forces the model to call a specific tool
+type ToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// CardMeaning is the interpretation of one card
+type CardMeaning struct {
+	Card     string `json:"card"`
+	Position string `json:"position,omitempty"`
+	Meaning  string `json:"meaning"`
+}
+
+// Reading is the structured interpretation of a spread
+type Reading struct {
+	Cards   []CardMeaning `json:"cards"`
+	Summary string        `json:"summary"`
+	Advice  string        `json:"advice"`
+}
+
+// enableStructuredOutput makes the model answer with a reading through the reading tool instead of prose
+func enableStructuredOutput(anthropicReq *AnthropicRequest) {
+	anthropicReq.Tools = []Tool{{
+		Name:        readingToolName,
+		Description: "Record the interpretation of the tarot spread",
+		InputSchema: readingToolSchema,
+	}}
+	anthropicReq.ToolChoice = &ToolChoice{Type: "tool", Name: readingToolName}
+}
+
+// parseReading decodes the reading tool input and checks it against the schema's required fields
+func parseReading(input string) (Reading, error) {
+	var reading Reading
+	err := json.Unmarshal([]byte(input), &reading)
+	if err != nil {
+		return reading, fmt.Errorf("model returned an invalid reading: %w", err)
+	}
+
+	var validationErrs validation.Errors
+	if len(reading.Cards) == 0 {
+		validationErrs.Add("cards", validation.RuleRequired, "cards must contain at least one card")
+	}
+	for i, card := range reading.Cards {
+		validationErrs.Required(fmt.Sprintf("cards[%d].card", i), card.Card)
+		validationErrs.Required(fmt.Sprintf("cards[%d].meaning", i), card.Meaning)
+	}
+	validationErrs.Required("summary", reading.Summary)
+	validationErrs.Required("advice", reading.Advice)
+	return reading, validationErrs.Err()
+}
+
+// readingFrames turns a reading into the typed frames sent to the client, cards first
+func readingFrames(model string, reading Reading) []Frame {
+	frames := make([]Frame, 0, len(reading.Cards)+2)
+	for i := range reading.Cards {
+		frames = append(frames, Frame{Type: frameTypeCard, Model: model, Card: &reading.Cards[i]})
+	}
+	frames = append(frames,
+		Frame{Type: frameTypeSummary, Model: model, Text: reading.Summary},
+		Frame{Type: frameTypeAdvice, Model: model, Text: reading.Advice},
+	)
+	return frames
+}
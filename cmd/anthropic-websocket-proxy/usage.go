@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+)
+
+const (
+	defaultPricingTable = "PRICING"
+	defaultUsageTable   = "USAGE"
+	tokensPerPriceUnit  = 1000000
+)
+
+// Usage is the token usage reported by Anthropic for one request
+type Usage struct {
+	Model        string `json:"model"`
+	InputTokens  int64  `json:"input_tokens"`
+	OutputTokens int64  `json:"output_tokens"`
+	TotalTokens  int64  `json:"total_tokens"`
+	// EstimatedCost is in USD, 0 if the model has no price in the PRICING table
+	EstimatedCost float64 `json:"estimated_cost"`
+	Cached        bool    `json:"cached,omitempty"`
+	// Interrupted marks usage of a response that broke off before message_stop
+	Interrupted bool `json:"interrupted,omitempty"`
+}
+
+// ModelPricing holds the USD rates per million tokens for one model
+type ModelPricing struct {
+	InputPrice  float64
+	OutputPrice float64
+}
+
+// updateUsage reads the token counts from a message_start or message_delta event.
+// message_start carries the input tokens, message_delta the cumulative output tokens.
+func updateUsage(usage *Usage, eventData map[string]interface{}) {
+	usageData, ok := eventData["usage"].(map[string]interface{})
+	if message, isStart := eventData["message"].(map[string]interface{}); isStart {
+		usageData, ok = message["usage"].(map[string]interface{})
+	}
+	if !ok {
+		return
+	}
+
+	if inputTokens, ok := usageData["input_tokens"].(float64); ok {
+		usage.InputTokens = int64(inputTokens)
+	}
+	if outputTokens, ok := usageData["output_tokens"].(float64); ok {
+		usage.OutputTokens = int64(outputTokens)
+	}
+	usage.TotalTokens = usage.InputTokens + usage.OutputTokens
+}
+
+// getModelPricing loads the rates of a model from the PRICING table, returning false if the model has no price
+func getModelPricing(ctx context.Context, client *dynamodb.Client, tableName string, model string) (ModelPricing, bool, error) {
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"model": &types.AttributeValueMemberS{Value: model},
+		},
+	})
+	if err != nil {
+		return ModelPricing{}, false, fmt.Errorf("failed to get model pricing: %w", err)
+	}
+	if result.Item == nil {
+		return ModelPricing{}, false, nil
+	}
+
+	var pricing ModelPricing
+	if attr, ok := result.Item["input_price"].(*types.AttributeValueMemberN); ok {
+		pricing.InputPrice, err = strconv.ParseFloat(attr.Value, 64)
+		if err != nil {
+			return ModelPricing{}, false, fmt.Errorf("invalid input_price for model %s: %w", model, err)
+		}
+	}
+	if attr, ok := result.Item["output_price"].(*types.AttributeValueMemberN); ok {
+		pricing.OutputPrice, err = strconv.ParseFloat(attr.Value, 64)
+		if err != nil {
+			return ModelPricing{}, false, fmt.Errorf("invalid output_price for model %s: %w", model, err)
+		}
+	}
+	return pricing, true, nil
+}
+
+// estimateCost returns the USD cost of the usage at the given rates
+func estimateCost(usage Usage, pricing ModelPricing) float64 {
+	return (float64(usage.InputTokens)*pricing.InputPrice + float64(usage.OutputTokens)*pricing.OutputPrice) / tokensPerPriceUnit
+}
+
+// storeUsage records the usage of one request in the USAGE table. userHash is empty if the connection has no known user.
+func storeUsage(ctx context.Context, client *dynamodb.Client, tableName string, requestID string, connectionID string, userHash string, usage Usage) error {
+	item := map[string]types.AttributeValue{
+		"request_id":     &types.AttributeValueMemberS{Value: requestID},
+		"connection_id":  &types.AttributeValueMemberS{Value: connectionID},
+		"model":          &types.AttributeValueMemberS{Value: usage.Model},
+		"input_tokens":   &types.AttributeValueMemberN{Value: strconv.FormatInt(usage.InputTokens, 10)},
+		"output_tokens":  &types.AttributeValueMemberN{Value: strconv.FormatInt(usage.OutputTokens, 10)},
+		"estimated_cost": &types.AttributeValueMemberN{Value: strconv.FormatFloat(usage.EstimatedCost, 'f', -1, 64)},
+		"cached":         &types.AttributeValueMemberBOOL{Value: usage.Cached},
+		"created_at":     &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+	}
+	if userHash != "" {
+		item["user_hash"] = &types.AttributeValueMemberS{Value: userHash}
+	}
+	if usage.Interrupted {
+		item["interrupted"] = &types.AttributeValueMemberBOOL{Value: true}
+	}
+	if testmode.Enabled() {
+		item[testmode.AttrTestRecord] = &types.AttributeValueMemberBOOL{Value: true}
+	}
+
+	_, err := client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store usage: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// usageStream reports its input tokens on message_start and the cumulative output tokens on two
+// message_delta events, the way Anthropic does for a long answer
+const usageStream = "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":25,\"output_tokens\":1}}}\n\n" +
+	"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"delta\":{\"type\":\"text_delta\",\"text\":\"The Tower\"}}\n\n" +
+	"event: message_delta\ndata: {\"type\":\"message_delta\",\"usage\":{\"output_tokens\":3}}\n\n" +
+	"event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"},\"usage\":{\"output_tokens\":42}}\n\n" +
+	"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n"
+
+// attr returns the value of one attribute of a PutItem item
+func attr(call fakeDynamoCall, name, kind string) any {
+	value, ok := call.Input["Item"].(map[string]any)[name].(map[string]any)
+	if !ok {
+		return nil
+	}
+	return value[kind]
+}
+
+func TestUpdateUsage(t *testing.T) {
+	var usage Usage
+	updateUsage(&usage, map[string]interface{}{
+		"type":    "message_start",
+		"message": map[string]interface{}{"usage": map[string]interface{}{"input_tokens": 25.0, "output_tokens": 1.0}},
+	})
+	updateUsage(&usage, map[string]interface{}{"type": "message_delta", "usage": map[string]interface{}{"output_tokens": 42.0}})
+	updateUsage(&usage, map[string]interface{}{"type": "message_delta"})
+	if usage != (Usage{InputTokens: 25, OutputTokens: 42, TotalTokens: 67}) {
+		t.Errorf("usage = %+v", usage)
+	}
+}
+
+func TestEstimateCost(t *testing.T) {
+	cost := estimateCost(Usage{InputTokens: 1000000, OutputTokens: 2000000}, ModelPricing{InputPrice: 3, OutputPrice: 15})
+	if cost != 33 {
+		t.Errorf("cost = %v, want 33", cost)
+	}
+}
+
+func TestHandleSendMessageRecordsUsage(t *testing.T) {
+	pricing := `{"Item": {"model": {"S": "claude"}, "input_price": {"N": "3"}, "output_price": {"N": "15"}}}`
+
+	tests := []struct {
+		name   string
+		stream string
+		// putUsage is the USAGE PutItem response, status the status the reading ends with
+		putUsage string
+		status   int
+		// requestID is the suffix of the usage record's request_id, "" for the plain request id
+		requestID   string
+		input       string
+		output      string
+		cost        string
+		interrupted bool
+	}{
+		{
+			name:   "finished stream",
+			stream: usageStream,
+			status: http.StatusOK,
+			input:  "25",
+			output: "42",
+			cost:   "0.000705",
+		},
+		{
+			name:     "usage not stored",
+			stream:   usageStream,
+			putUsage: internalError,
+			status:   http.StatusOK,
+			input:    "25",
+			output:   "42",
+			cost:     "0.000705",
+		},
+		{
+			name:        "interrupted stream",
+			stream:      strings.Split(usageStream, "event: message_delta")[0],
+			status:      http.StatusBadGateway,
+			requestID:   "#interrupted",
+			input:       "25",
+			output:      "1",
+			cost:        "0.00009",
+			interrupted: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, anthropicServer(t, http.StatusOK, tt.stream))
+			t.Setenv(envAnthropicKey, t.Name())
+			responses := readingResponses(5)
+			responses["GetItem "+defaultPricingTable] = pricing
+			if tt.putUsage != "" {
+				responses["PutItem "+defaultUsageTable] = tt.putUsage
+			}
+			dynamo := newFakeDynamoDB(t, responses)
+			wsClient := newTestWebSocketClient(t)
+
+			response, _ := handleSendMessage(context.Background(), testEvent("sendmessage", readingBody))
+			if response.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d: %s", response.StatusCode, tt.status, response.Body)
+			}
+			if tt.status == http.StatusOK {
+				frames := wsClient.Frames(t)
+				if last := frames[len(frames)-1]; last.Type != frameTypeDone {
+					t.Errorf("reading ended with %+v", last)
+				}
+			}
+
+			puts := dynamo.Calls("PutItem", defaultUsageTable)
+			if len(puts) != 1 {
+				t.Fatalf("usage stored %d times", len(puts))
+			}
+			put := puts[0]
+			if requestID, _ := attr(put, "request_id", "S").(string); !strings.HasSuffix(requestID, tt.requestID) || (tt.requestID == "" && strings.Contains(requestID, "#")) {
+				t.Errorf("request_id = %q, want suffix %q", requestID, tt.requestID)
+			}
+			if input := attr(put, "input_tokens", "N"); input != tt.input {
+				t.Errorf("input_tokens = %v, want %s", input, tt.input)
+			}
+			if output := attr(put, "output_tokens", "N"); output != tt.output {
+				t.Errorf("output_tokens = %v, want %s", output, tt.output)
+			}
+			if cost := attr(put, "estimated_cost", "N"); cost != tt.cost {
+				t.Errorf("estimated_cost = %v, want %s", cost, tt.cost)
+			}
+			if userHash := attr(put, "user_hash", "S"); userHash != testUserHash {
+				t.Errorf("user_hash = %v", userHash)
+			}
+			if connectionID := attr(put, "connection_id", "S"); connectionID != testConnectionID {
+				t.Errorf("connection_id = %v", connectionID)
+			}
+			if attr(put, "model", "S") == "" || attr(put, "created_at", "N") == nil {
+				t.Errorf("usage has no model or timestamp: %+v", put.Input["Item"])
+			}
+			if interrupted := attr(put, "interrupted", "BOOL") == true; interrupted != tt.interrupted {
+				t.Errorf("interrupted = %v, want %v", interrupted, tt.interrupted)
+			}
+		})
+	}
+}
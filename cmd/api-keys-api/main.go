@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/auth"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/ipfilter"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestbody"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestid"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/validation"
+)
+
+const (
+	authTableName = "AUTH"
+	// userIndex is the AUTH GSI with user_hash as partition key. Listing keys reads the API key attributes
+	// from it, so it has to project them (or ALL).
+	userIndex = "user_hash-index"
+
+	apiKeysPath      = "/users/me/api-keys"
+	defaultMaxKeys   = 10
+	maxKeyNameLength = 64
+	envMaxKeys       = "MAX_API_KEYS"
+)
+
+// CreateRequest is the body of POST /users/me/api-keys
+type CreateRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// RateLimit is the number of uses per minute, auth.DefaultRateLimit if 0
+	RateLimit int64 `json:"rate_limit"`
+}
+
+// APIKey describes an API key without the key itself
+type APIKey struct {
+	KeyID      string   `json:"key_id"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	RateLimit  int64    `json:"rate_limit"`
+	CreatedAt  int64    `json:"created_at"`
+	LastUsedAt int64    `json:"last_used_at,omitempty"`
+	RevokedAt  int64    `json:"revoked_at,omitempty"`
+}
+
+// CreatedKey is returned once when the key is created, only its hash is stored
+type CreatedKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+func createResponse(statusCode int, body string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Body:       body,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
+
+// getMaxKeys reads how many active API keys a user may have from MAX_API_KEYS
+func getMaxKeys() int {
+	value := os.Getenv(envMaxKeys)
+	if value == "" {
+		return defaultMaxKeys
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 {
+		fmt.Printf("Invalid %s %q, using default\n", envMaxKeys, value)
+		return defaultMaxKeys
+	}
+	return limit
+}
+
+// getUserHashFromSession resolves the user behind the bearer auth key, returning an empty hash if the key is
+// unknown. API keys can't manage API keys, a leaked key must not be able to mint new ones.
+func getUserHashFromSession(dynamoClient *dynamodb.DynamoDB, request events.APIGatewayProxyRequest) (string, error) {
+	authKey, ok := auth.BearerToken(request.Headers)
+	if !ok {
+		return "", nil
+	}
+	result, err := dynamoClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(testmode.Table(authTableName)),
+		Key: map[string]*dynamodb.AttributeValue{
+			"key": {S: aws.String(auth.HashKey(authKey))},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get auth key: %w", err)
+	}
+	if result.Item == nil || result.Item["user_hash"] == nil {
+		return "", nil
+	}
+	if expiresAt := result.Item[auth.AttrKeyExpiresAt]; expiresAt != nil && auth.KeyExpired(aws.StringValue(expiresAt.N), time.Now()) {
+		return "", nil
+	}
+	if keyType := result.Item[auth.AttrKeyType]; keyType != nil && auth.IsAPIKey(aws.StringValue(keyType.S)) {
+		return "", nil
+	}
+	// Support impersonating the user can't manage the user's credentials
+	if keyType := result.Item[auth.AttrKeyType]; keyType != nil && auth.IsImpersonation(aws.StringValue(keyType.S)) {
+		return "", nil
+	}
+	return aws.StringValue(result.Item["user_hash"].S), nil
+}
+
+// getNumber reads a numeric attribute, returning 0 if it is missing or malformed
+func getNumber(item map[string]*dynamodb.AttributeValue, name string) int64 {
+	attr, ok := item[name]
+	if !ok || attr.N == nil {
+		return 0
+	}
+	value, err := strconv.ParseInt(*attr.N, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return value
+}
+
+// getString reads a string attribute, returning "" if it is missing
+func getString(item map[string]*dynamodb.AttributeValue, name string) string {
+	attr, ok := item[name]
+	if !ok {
+		return ""
+	}
+	return aws.StringValue(attr.S)
+}
+
+// apiKeyFromItem reads the description of an API key from its AUTH item
+func apiKeyFromItem(item map[string]*dynamodb.AttributeValue) APIKey {
+	key := APIKey{
+		KeyID:      getString(item, auth.AttrKeyID),
+		Name:       getString(item, auth.AttrKeyName),
+		RateLimit:  getNumber(item, auth.AttrRateLimit),
+		CreatedAt:  getNumber(item, auth.AttrCreatedAt),
+		LastUsedAt: getNumber(item, auth.AttrLastUsedAt),
+		RevokedAt:  getNumber(item, auth.AttrRevokedAt),
+	}
+	if scopes, ok := item[auth.AttrScopes]; ok {
+		key.Scopes = aws.StringValueSlice(scopes.SS)
+	}
+	sort.Strings(key.Scopes)
+	return key
+}
+
+// queryAPIKeys returns the AUTH items of the user's API keys, revoked ones included
+func queryAPIKeys(dynamoClient *dynamodb.DynamoDB, userHash string) ([]map[string]*dynamodb.AttributeValue, error) {
+	var items []map[string]*dynamodb.AttributeValue
+	err := dynamoClient.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(testmode.Table(authTableName)),
+		IndexName:              aws.String(userIndex),
+		KeyConditionExpression: aws.String("user_hash = :user_hash"),
+		FilterExpression:       aws.String("#type = :api"),
+		ExpressionAttributeNames: map[string]*string{
+			"#type": aws.String(auth.AttrKeyType),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":user_hash": {S: aws.String(userHash)},
+			":api":       {S: aws.String(auth.KeyTypeAPI)},
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		items = append(items, page.Items...)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query API keys: %w", err)
+	}
+	return items, nil
+}
+
+// validateCreateRequest checks the name, scopes and rate limit of a new key
+func validateCreateRequest(createReq CreateRequest) validation.Errors {
+	var validationErrs validation.Errors
+	validationErrs.Required("name", createReq.Name)
+	if len(createReq.Name) > maxKeyNameLength {
+		validationErrs.Add("name", validation.RuleFormat, fmt.Sprintf("name must be at most %d characters", maxKeyNameLength))
+	}
+	if len(createReq.Scopes) == 0 {
+		validationErrs.Add("scopes", validation.RuleRequired, "at least one scope is required")
+	}
+	for _, scope := range createReq.Scopes {
+		validationErrs.OneOf("scopes", scope, auth.Scopes...)
+	}
+	if createReq.RateLimit < 0 || createReq.RateLimit > auth.MaxRateLimit {
+		validationErrs.Add("rate_limit", validation.RuleFormat, fmt.Sprintf("rate_limit must be at most %d uses per minute", auth.MaxRateLimit))
+	}
+	return validationErrs
+}
+
+func createAPIKey(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var createReq CreateRequest
+	err := json.Unmarshal([]byte(request.Body), &createReq)
+	if err != nil {
+		fmt.Printf("failed to unmarshal request: %v", err)
+		return createResponse(http.StatusBadRequest, "Invalid request body"), nil
+	}
+	createReq.Name = strings.TrimSpace(createReq.Name)
+
+	validationErrs := validateCreateRequest(createReq)
+	if err := validationErrs.Err(); err != nil {
+		fmt.Printf("invalid API key request: %v\n", err)
+		return createResponse(http.StatusUnprocessableEntity, validationErrs.Body()), nil
+	}
+	if createReq.RateLimit == 0 {
+		createReq.RateLimit = auth.DefaultRateLimit
+	}
+
+	dynamoClient := dynamodb.New(session.Must(session.NewSession()))
+	userHash, err := getUserHashFromSession(dynamoClient, request)
+	if err != nil {
+		fmt.Printf("failed to resolve user: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to resolve user"), nil
+	}
+	if userHash == "" {
+		return createResponse(http.StatusUnauthorized, "Invalid auth key"), nil
+	}
+
+	items, err := queryAPIKeys(dynamoClient, userHash)
+	if err != nil {
+		fmt.Printf("failed to list API keys: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to list API keys"), nil
+	}
+	active := 0
+	for _, item := range items {
+		if item[auth.AttrRevokedAt] == nil {
+			active++
+		}
+	}
+	if active >= getMaxKeys() {
+		return createResponse(http.StatusConflict, fmt.Sprintf("At most %d API keys can be active, revoke one first", getMaxKeys())), nil
+	}
+
+	key, keyID, err := auth.NewAPIKey()
+	if err != nil {
+		fmt.Printf("failed to generate API key: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to generate API key"), nil
+	}
+
+	created := CreatedKey{
+		APIKey: APIKey{
+			KeyID:     keyID,
+			Name:      createReq.Name,
+			Scopes:    dedupe(createReq.Scopes),
+			RateLimit: createReq.RateLimit,
+			CreatedAt: time.Now().Unix(),
+		},
+		Key: key,
+	}
+	item := map[string]*dynamodb.AttributeValue{
+		"key":              {S: aws.String(auth.HashKey(key))},
+		"user_hash":        {S: aws.String(userHash)},
+		auth.AttrKeyType:   {S: aws.String(auth.KeyTypeAPI)},
+		auth.AttrKeyID:     {S: aws.String(keyID)},
+		auth.AttrKeyName:   {S: aws.String(created.Name)},
+		auth.AttrScopes:    {SS: aws.StringSlice(created.Scopes)},
+		auth.AttrRateLimit: {N: aws.String(strconv.FormatInt(created.RateLimit, 10))},
+		auth.AttrCreatedAt: {N: aws.String(strconv.FormatInt(created.CreatedAt, 10))},
+	}
+	if testmode.Enabled() {
+		item[testmode.AttrTestRecord] = &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+	}
+	_, err = dynamoClient.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(testmode.Table(authTableName)),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(#key)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#key": aws.String("key"),
+		},
+	})
+	if err != nil {
+		fmt.Printf("failed to store API key: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to store API key"), nil
+	}
+	fmt.Printf("Created API key %s for user %s with scopes %v\n", keyID, userHash, created.Scopes)
+
+	jsonResponse, err := json.Marshal(created)
+	if err != nil {
+		fmt.Printf("failed to marshal response: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to create response"), nil
+	}
+	return createResponse(http.StatusCreated, string(jsonResponse)), nil
+}
+
+func listAPIKeys(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	dynamoClient := dynamodb.New(session.Must(session.NewSession()))
+	userHash, err := getUserHashFromSession(dynamoClient, request)
+	if err != nil {
+		fmt.Printf("failed to resolve user: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to resolve user"), nil
+	}
+	if userHash == "" {
+		return createResponse(http.StatusUnauthorized, "Invalid auth key"), nil
+	}
+
+	items, err := queryAPIKeys(dynamoClient, userHash)
+	if err != nil {
+		fmt.Printf("failed to list API keys: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to list API keys"), nil
+	}
+	keys := make([]APIKey, 0, len(items))
+	for _, item := range items {
+		keys = append(keys, apiKeyFromItem(item))
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt > keys[j].CreatedAt })
+
+	jsonResponse, err := json.Marshal(keys)
+	if err != nil {
+		fmt.Printf("failed to marshal response: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to create response"), nil
+	}
+	return createResponse(http.StatusOK, string(jsonResponse)), nil
+}
+
+// revokeAPIKey revokes a key of the user by its public id. The key is kept for the list with revoked_at set,
+// and expires_at makes every lambda checking AUTH keys reject it.
+func revokeAPIKey(request events.APIGatewayProxyRequest, keyID string) (events.APIGatewayProxyResponse, error) {
+	dynamoClient := dynamodb.New(session.Must(session.NewSession()))
+	userHash, err := getUserHashFromSession(dynamoClient, request)
+	if err != nil {
+		fmt.Printf("failed to resolve user: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to resolve user"), nil
+	}
+	if userHash == "" {
+		return createResponse(http.StatusUnauthorized, "Invalid auth key"), nil
+	}
+
+	items, err := queryAPIKeys(dynamoClient, userHash)
+	if err != nil {
+		fmt.Printf("failed to list API keys: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to list API keys"), nil
+	}
+	var hashedKey *dynamodb.AttributeValue
+	for _, item := range items {
+		if getString(item, auth.AttrKeyID) == keyID {
+			hashedKey = item["key"]
+		}
+	}
+	if hashedKey == nil {
+		return createResponse(http.StatusNotFound, "API key not found"), nil
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	_, err = dynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(testmode.Table(authTableName)),
+		Key:                 map[string]*dynamodb.AttributeValue{"key": hashedKey},
+		UpdateExpression:    aws.String("SET #revoked = :now, #expires = :now"),
+		ConditionExpression: aws.String("user_hash = :user_hash AND attribute_not_exists(#revoked)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#revoked": aws.String(auth.AttrRevokedAt),
+			"#expires": aws.String(auth.AttrKeyExpiresAt),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now":       {N: aws.String(now)},
+			":user_hash": {S: aws.String(userHash)},
+		},
+	})
+	var conditionErr *dynamodb.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return createResponse(http.StatusOK, `{"message":"API key already revoked"}`), nil
+	}
+	if err != nil {
+		fmt.Printf("failed to revoke API key: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to revoke API key"), nil
+	}
+	fmt.Printf("Revoked API key %s of user %s\n", keyID, userHash)
+	return createResponse(http.StatusOK, `{"message":"API key revoked"}`), nil
+}
+
+// dedupe returns the values without duplicates, sorted
+func dedupe(values []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+func main() {
+	filter, err := ipfilter.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load IP filter configuration: %v", err)
+		os.Exit(1)
+	}
+	limits, err := requestbody.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load body limits: %v", err)
+		os.Exit(1)
+	}
+	lambda.Start(requestid.Middleware(ipfilter.Middleware(filter, requestbody.Middleware(limits, handleRequest))))
+}
+
+// handleRequest routes API key management requests, which need a session key from the OTP login
+func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Remove trailing slash from path if present
+	path := strings.TrimSuffix(request.Path, "/")
+
+	switch {
+	case request.HTTPMethod == "POST" && path == apiKeysPath:
+		return createAPIKey(request)
+	case request.HTTPMethod == "GET" && path == apiKeysPath:
+		return listAPIKeys(request)
+	case request.HTTPMethod == "DELETE" && strings.HasPrefix(path, apiKeysPath+"/"):
+		return revokeAPIKey(request, strings.TrimPrefix(path, apiKeysPath+"/"))
+	default:
+		return createResponse(http.StatusNotFound, "Not Found"), fmt.Errorf("unknown endpoint: %s %s", request.HTTPMethod, request.Path)
+	}
+}
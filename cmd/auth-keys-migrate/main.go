@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/auth"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+)
+
+const (
+	defaultTableName = "AUTH"
+)
+
+// MigrationEvent is the payload the migration is invoked with
+type MigrationEvent struct {
+	DryRun bool `json:"dry_run"`
+}
+
+// MigrationResult summarizes a migration run
+type MigrationResult struct {
+	Scanned  int `json:"scanned"`
+	Migrated int `json:"migrated"`
+	Skipped  int `json:"skipped"`
+}
+
+// migrateKey moves an AUTH item from the plaintext key to its hash. Both writes happen in one transaction,
+// so a key is never lost or left in both forms. If the hashed item already exists, the plaintext one is
+// only deleted.
+func migrateKey(ctx context.Context, client *dynamodb.Client, tableName string, authKey string, item map[string]types.AttributeValue) error {
+	hashed := make(map[string]types.AttributeValue, len(item))
+	for name, value := range item {
+		hashed[name] = value
+	}
+	hashed["key"] = &types.AttributeValueMemberS{Value: auth.HashKey(authKey)}
+	names := map[string]string{"#key": "key"}
+	plaintextKey := map[string]types.AttributeValue{
+		"key": &types.AttributeValueMemberS{Value: authKey},
+	}
+
+	_, err := client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Put: &types.Put{
+				TableName:                aws.String(tableName),
+				Item:                     hashed,
+				ConditionExpression:      aws.String("attribute_not_exists(#key)"),
+				ExpressionAttributeNames: names,
+			}},
+			{Delete: &types.Delete{
+				TableName:                aws.String(tableName),
+				Key:                      plaintextKey,
+				ConditionExpression:      aws.String("attribute_exists(#key)"),
+				ExpressionAttributeNames: names,
+			}},
+		},
+	})
+	var cancelledErr *types.TransactionCanceledException
+	if !errors.As(err, &cancelledErr) {
+		return err
+	}
+	reasons := cancelledErr.CancellationReasons
+	if len(reasons) == 0 || aws.ToString(reasons[0].Code) != "ConditionalCheckFailed" {
+		return err
+	}
+
+	_, err = client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key:       plaintextKey,
+	})
+	return err
+}
+
+// HandleRequest moves every AUTH item still stored under a plaintext key to the hashed key, see pkg/auth.
+// It is safe to rerun.
+func HandleRequest(ctx context.Context, event MigrationEvent) (MigrationResult, error) {
+	var result MigrationResult
+
+	tableName := os.Getenv("AUTH_TABLE_NAME")
+	if tableName == "" {
+		tableName = defaultTableName
+	}
+	tableName = testmode.Table(tableName)
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return result, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	client := dynamodb.NewFromConfig(cfg)
+
+	paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{
+		TableName: aws.String(tableName),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return result, fmt.Errorf("failed to scan %s: %w", tableName, err)
+		}
+
+		for _, item := range page.Items {
+			result.Scanned++
+
+			// Only the legacy key format is migrated, hashed keys stay where they are
+			key, ok := item["key"].(*types.AttributeValueMemberS)
+			if !ok || !auth.IsLegacyKey(key.Value) {
+				continue
+			}
+			userHash, _ := item["user_hash"].(*types.AttributeValueMemberS)
+			if userHash == nil {
+				fmt.Printf("Skipping legacy key without user\n")
+				result.Skipped++
+				continue
+			}
+			fmt.Printf("Migrating legacy key of user %s\n", userHash.Value)
+
+			if event.DryRun {
+				continue
+			}
+
+			err = migrateKey(ctx, client, tableName, key.Value, item)
+			if err != nil {
+				return result, fmt.Errorf("failed to migrate key of user %s: %w", userHash.Value, err)
+			}
+			result.Migrated++
+		}
+	}
+
+	fmt.Printf("Migration result: %+v\n", result)
+	return result, nil
+}
+
+func main() {
+	lambda.Start(HandleRequest)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/ipfilter"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestbody"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestid"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/shedding"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/validation"
+)
+
+// Ban is a suspended or banned user
+type Ban struct {
+	UserHash string `json:"user_hash" dynamodbav:"user_hash"`
+	Status   string `json:"status" dynamodbav:"status"`
+	Reason   string `json:"reason,omitempty" dynamodbav:"ban_reason,omitempty"`
+	// ExpiresAt is the unix time a suspension ends, bans have none
+	ExpiresAt int64 `json:"expires_at,omitempty" dynamodbav:"ban_expires_at,omitempty"`
+}
+
+func createResponse(statusCode int, body string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Body:       body,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
+
+// validateBan checks a ban request. Suspensions need an expiry in the future, bans last until they are lifted.
+func validateBan(ban Ban, now time.Time) validation.Errors {
+	var validationErrs validation.Errors
+	validationErrs.Required("user_hash", ban.UserHash)
+	validationErrs.OneOf("status", ban.Status, users.StatusSuspended, users.StatusBanned)
+	validationErrs.Required("reason", ban.Reason)
+	switch {
+	case ban.Status == users.StatusSuspended && ban.ExpiresAt <= now.Unix():
+		validationErrs.Add("expires_at", validation.RuleRequired, "expires_at must be a unix time in the future for suspensions")
+	case ban.Status == users.StatusBanned && ban.ExpiresAt != 0:
+		validationErrs.Add("expires_at", validation.RuleFormat, "bans don't expire, use a suspension instead")
+	}
+	return validationErrs
+}
+
+func listBans(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	dynamoClient := dynamodb.New(session.Must(session.NewSession()))
+
+	var items []map[string]*dynamodb.AttributeValue
+	err := dynamoClient.ScanPages(&dynamodb.ScanInput{
+		TableName:            aws.String(users.Table()),
+		FilterExpression:     aws.String("attribute_exists(#status)"),
+		ProjectionExpression: aws.String("user_hash, #status, ban_reason, ban_expires_at"),
+		ExpressionAttributeNames: map[string]*string{
+			"#status": aws.String(users.AttrStatus),
+		},
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		items = append(items, page.Items...)
+		return true
+	})
+	if err != nil {
+		fmt.Printf("failed to scan users: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to load bans"), nil
+	}
+
+	bans := []Ban{}
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &bans)
+	if err != nil {
+		fmt.Printf("failed to unmarshal bans: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to load bans"), nil
+	}
+
+	jsonResponse, err := json.Marshal(bans)
+	if err != nil {
+		fmt.Printf("failed to marshal response: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to create response"), nil
+	}
+	return createResponse(http.StatusOK, string(jsonResponse)), nil
+}
+
+func setBan(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var ban Ban
+	err := json.Unmarshal([]byte(request.Body), &ban)
+	if err != nil {
+		fmt.Printf("failed to unmarshal request: %v", err)
+		return createResponse(http.StatusBadRequest, "Invalid request body"), nil
+	}
+
+	validationErrs := validateBan(ban, time.Now())
+	if err := validationErrs.Err(); err != nil {
+		fmt.Printf("invalid ban: %v\n", err)
+		return createResponse(http.StatusUnprocessableEntity, validationErrs.Body()), nil
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(users.Table()),
+		Key: map[string]*dynamodb.AttributeValue{
+			users.AttrUserHash: {S: aws.String(ban.UserHash)},
+		},
+		ConditionExpression: aws.String("attribute_exists(user_hash)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#status": aws.String(users.AttrStatus),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":status": {S: aws.String(ban.Status)},
+			":reason": {S: aws.String(ban.Reason)},
+		},
+	}
+	if ban.ExpiresAt > 0 {
+		input.UpdateExpression = aws.String("SET #status = :status, ban_reason = :reason, ban_expires_at = :expires")
+		input.ExpressionAttributeValues[":expires"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(ban.ExpiresAt, 10))}
+	} else {
+		input.UpdateExpression = aws.String("SET #status = :status, ban_reason = :reason REMOVE ban_expires_at")
+	}
+
+	dynamoClient := dynamodb.New(session.Must(session.NewSession()))
+	_, err = dynamoClient.UpdateItem(input)
+	var conditionErr *dynamodb.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return createResponse(http.StatusNotFound, "User not found"), nil
+	}
+	if err != nil {
+		fmt.Printf("failed to store ban: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to store ban"), nil
+	}
+	fmt.Printf("%s user %s: %s\n", ban.Status, ban.UserHash, ban.Reason)
+
+	jsonResponse, err := json.Marshal(ban)
+	if err != nil {
+		fmt.Printf("failed to marshal response: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to create response"), nil
+	}
+	return createResponse(http.StatusOK, string(jsonResponse)), nil
+}
+
+func liftBan(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userHash := request.QueryStringParameters["user_hash"]
+	if userHash == "" {
+		return createResponse(http.StatusBadRequest, "Missing user_hash"), nil
+	}
+
+	dynamoClient := dynamodb.New(session.Must(session.NewSession()))
+	_, err := dynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(users.Table()),
+		Key: map[string]*dynamodb.AttributeValue{
+			users.AttrUserHash: {S: aws.String(userHash)},
+		},
+		UpdateExpression:    aws.String("REMOVE #status, ban_reason, ban_expires_at"),
+		ConditionExpression: aws.String("attribute_exists(user_hash)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#status": aws.String(users.AttrStatus),
+		},
+	})
+	var conditionErr *dynamodb.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return createResponse(http.StatusNotFound, "User not found"), nil
+	}
+	if err != nil {
+		fmt.Printf("failed to lift ban: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to lift ban"), nil
+	}
+	fmt.Printf("lifted ban of user %s\n", userHash)
+
+	return createResponse(http.StatusOK, `{"message":"Ban lifted"}`), nil
+}
+
+func main() {
+	filter, err := ipfilter.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load IP filter configuration: %v", err)
+		os.Exit(1)
+	}
+	shedder, err := shedding.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load latency budgets: %v", err)
+		os.Exit(1)
+	}
+	limits, err := requestbody.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load body limits: %v", err)
+		os.Exit(1)
+	}
+	handler := ipfilter.Middleware(filter, requestbody.Middleware(limits, handleRequest))
+	lambda.Start(requestid.Middleware(shedding.Middleware(shedder, handler)))
+}
+
+// handleRequest routes admin ban requests, access is restricted with IAM auth on the API Gateway route
+func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Remove trailing slash from path if present
+	path := strings.TrimSuffix(request.Path, "/")
+
+	switch {
+	case request.HTTPMethod == "GET" && path == "/admin/bans":
+		return listBans(request)
+	case request.HTTPMethod == "PUT" && path == "/admin/bans":
+		return setBan(request)
+	case request.HTTPMethod == "DELETE" && path == "/admin/bans":
+		return liftBan(request)
+	default:
+		return createResponse(http.StatusNotFound, "Not Found"), fmt.Errorf("unknown endpoint: %s %s", request.HTTPMethod, request.Path)
+	}
+}
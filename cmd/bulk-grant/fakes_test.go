@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const testBucket = "grants"
+
+// fakeObjectVersion is one version of an S3 object
+type fakeObjectVersion struct {
+	ID   string
+	ETag string
+	Body string
+}
+
+// fakeS3Call is one request the fake S3 received
+type fakeS3Call struct {
+	Method    string
+	Key       string
+	VersionID string
+}
+
+// fakeDynamoCall is one request the fake DynamoDB received
+type fakeDynamoCall struct {
+	Operation string
+	Input     map[string]any
+}
+
+// fakeAWS serves S3 and the DynamoDB JSON protocol on one endpoint
+type fakeAWS struct {
+	mu sync.Mutex
+	// objects maps a key of testBucket to its versions, the last one is the latest
+	objects map[string][]fakeObjectVersion
+	// dynamo maps an operation to its responses in turn, the last one repeats. Operations without a
+	// response get {}.
+	dynamo      map[string][]string
+	s3Calls     []fakeS3Call
+	dynamoCalls []fakeDynamoCall
+}
+
+// newTestGranter returns a granter whose clients talk to fake
+func newTestGranter(t *testing.T, fake *fakeAWS) *Granter {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(fake.serveHTTP))
+	t.Cleanup(server.Close)
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(server.URL),
+		Credentials:      credentials.NewStaticCredentials("test", "test", ""),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	}))
+	return &Granter{
+		dynamoClient: dynamodb.New(sess),
+		s3Client:     s3.New(sess),
+		grantsTable:  defaultGrantsTable,
+	}
+}
+
+func (f *fakeAWS) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if target := r.Header.Get("X-Amz-Target"); target != "" {
+		f.serveDynamoDB(w, r, strings.TrimPrefix(target, "DynamoDB_20120810."))
+		return
+	}
+	f.serveS3(w, r)
+}
+
+func (f *fakeAWS) serveDynamoDB(w http.ResponseWriter, r *http.Request, operation string) {
+	var input map[string]any
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.dynamoCalls = append(f.dynamoCalls, fakeDynamoCall{Operation: operation, Input: input})
+	body := "{}"
+	if responses := f.dynamo[operation]; len(responses) > 0 {
+		body = responses[0]
+		if len(responses) > 1 {
+			f.dynamo[operation] = responses[1:]
+		}
+	}
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	if strings.Contains(body, `"__type"`) {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	io.WriteString(w, body)
+}
+
+func (f *fakeAWS) serveS3(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/"+testBucket+"/")
+	versionID := r.URL.Query().Get("versionId")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.s3Calls = append(f.s3Calls, fakeS3Call{Method: r.Method, Key: key, VersionID: versionID})
+
+	if r.Method == http.MethodPut {
+		io.Copy(io.Discard, r.Body)
+		return
+	}
+	versions := f.objects[key]
+	if len(versions) == 0 {
+		s3Error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	version := versions[len(versions)-1]
+	if versionID != "" {
+		found := false
+		for _, v := range versions {
+			if v.ID == versionID {
+				version, found = v, true
+			}
+		}
+		if !found {
+			s3Error(w, http.StatusNotFound, "NoSuchVersion")
+			return
+		}
+	}
+	w.Header().Set("ETag", version.ETag)
+	if version.ID != "" {
+		w.Header().Set("X-Amz-Version-Id", version.ID)
+	}
+	io.WriteString(w, version.Body)
+}
+
+// s3Error writes an S3 error response
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// S3Calls returns the S3 requests received so far
+func (f *fakeAWS) S3Calls() []fakeS3Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeS3Call{}, f.s3Calls...)
+}
+
+// DynamoCalls returns the requests of one operation received so far
+func (f *fakeAWS) DynamoCalls(operation string) []fakeDynamoCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var calls []fakeDynamoCall
+	for _, call := range f.dynamoCalls {
+		if call.Operation == operation {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+)
+
+const (
+	// The grants table has job_id as partition key and row as number sort key
+	envGrantsTable     = "BULK_GRANTS_TABLE"
+	defaultGrantsTable = "BULK_GRANTS"
+	// envMaxTokens caps a single grant, so a typo in a manifest can't hand out a fortune
+	envMaxTokens     = "BULK_GRANT_MAX_TOKENS"
+	defaultMaxTokens = 10000
+
+	// jobRow is the row of the job item, manifest rows are numbered from 1
+	jobRow = 0
+	// deadlineMargin is the time left when a run stops. The message is redelivered and the job resumes.
+	deadlineMargin = 30 * time.Second
+
+	jobStatusRunning   = "running"
+	jobStatusCompleted = "completed"
+	jobStatusFailed    = "failed"
+	rowStatusGranted   = "granted"
+	rowStatusFailed    = "failed"
+	rowStatusDryRun    = "would_grant"
+)
+
+// errResume is returned when a run stops before the end of the manifest
+var errResume = errors.New("job not finished, resuming on redelivery")
+
+// GrantJob is the body of a queue message starting or resuming a job
+type GrantJob struct {
+	// JobID makes the job idempotent, a manifest sent again under the same id isn't granted twice
+	JobID  string `json:"job_id"`
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	// DryRun checks the manifest and writes the report without granting anything
+	DryRun bool `json:"dry_run"`
+}
+
+// Job is the progress item of a job
+type Job struct {
+	JobID         string `dynamodbav:"job_id"`
+	Row           int    `dynamodbav:"row"`
+	Bucket        string `dynamodbav:"bucket"`
+	Key           string `dynamodbav:"key"`
+	Status        string `dynamodbav:"status"`
+	Total         int    `dynamodbav:"total"`
+	NextRow       int    `dynamodbav:"next_row"`
+	Granted       int    `dynamodbav:"granted"`
+	Failed        int    `dynamodbav:"failed"`
+	GrantedTokens int64  `dynamodbav:"granted_tokens"`
+	// ManifestVersion and ManifestETag pin the manifest the job started with, a resumed job reads that
+	// version. The version is empty if the bucket isn't versioned.
+	ManifestVersion string `dynamodbav:"manifest_version,omitempty"`
+	ManifestETag    string `dynamodbav:"manifest_etag,omitempty"`
+	ReportKey       string `dynamodbav:"report_key,omitempty"`
+	// Error is why a failed job stopped
+	Error      string `dynamodbav:"error,omitempty"`
+	CreatedAt  int64  `dynamodbav:"created_at"`
+	UpdatedAt  int64  `dynamodbav:"updated_at"`
+	TestRecord bool   `dynamodbav:"test_record,omitempty"`
+}
+
+// RowResult is the outcome of one manifest row, kept as the audit record of the grant
+type RowResult struct {
+	JobID      string `dynamodbav:"job_id"`
+	Row        int    `dynamodbav:"row"`
+	UserHash   string `dynamodbav:"user_hash"`
+	Tokens     int64  `dynamodbav:"tokens"`
+	Reason     string `dynamodbav:"reason"`
+	Status     string `dynamodbav:"status"`
+	Error      string `dynamodbav:"error,omitempty"`
+	CreatedAt  int64  `dynamodbav:"created_at"`
+	TestRecord bool   `dynamodbav:"test_record,omitempty"`
+}
+
+// Granter applies the grants of a job
+type Granter struct {
+	dynamoClient *dynamodb.DynamoDB
+	s3Client     *s3.S3
+	grantsTable  string
+	maxTokens    int64
+}
+
+// grantsTable returns the table the job progress and grant records go to
+func grantsTable() string {
+	tableName := os.Getenv(envGrantsTable)
+	if tableName == "" {
+		tableName = defaultGrantsTable
+	}
+	return testmode.Table(tableName)
+}
+
+// loadMaxTokens reads the per-grant limit, 0 is no limit
+func loadMaxTokens() (int64, error) {
+	value := os.Getenv(envMaxTokens)
+	if value == "" {
+		return defaultMaxTokens, nil
+	}
+	maxTokens, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || maxTokens < 0 {
+		return 0, fmt.Errorf("invalid token count in environment variable %s: %q", envMaxTokens, value)
+	}
+	return maxTokens, nil
+}
+
+// Manifest is a parsed manifest with the S3 version it was read at
+type Manifest struct {
+	Grants  []Grant
+	RowErrs []error
+	// VersionID is empty if the bucket isn't versioned
+	VersionID string
+	ETag      string
+}
+
+// readManifest downloads and parses a manifest, the given version or the latest one if versionID is empty
+func (g *Granter) readManifest(ctx context.Context, bucket string, key string, versionID string) (Manifest, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	obj, err := g.s3Client.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to get manifest s3://%s/%s: %w", bucket, key, err)
+	}
+	defer obj.Body.Close()
+	body, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	grants, rowErrs, err := parseManifest(key, body)
+	if err != nil {
+		return Manifest{}, err
+	}
+	return Manifest{Grants: grants, RowErrs: rowErrs, VersionID: aws.StringValue(obj.VersionId), ETag: aws.StringValue(obj.ETag)}, nil
+}
+
+// startJob creates the job item pinned to the manifest version, or loads it when the job was started before
+func (g *Granter) startJob(ctx context.Context, grantJob GrantJob, manifest Manifest) (Job, error) {
+	now := time.Now().Unix()
+	job := Job{
+		JobID:           grantJob.JobID,
+		Row:             jobRow,
+		Bucket:          grantJob.Bucket,
+		Key:             grantJob.Key,
+		Status:          jobStatusRunning,
+		Total:           len(manifest.Grants),
+		NextRow:         1,
+		ManifestVersion: manifest.VersionID,
+		ManifestETag:    manifest.ETag,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+		TestRecord:      testmode.Enabled(),
+	}
+	item, err := dynamodbattribute.MarshalMap(job)
+	if err != nil {
+		return job, fmt.Errorf("failed to marshal job: %w", err)
+	}
+	_, err = g.dynamoClient.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(g.grantsTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(job_id)"),
+	})
+	var conditionErr *dynamodb.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return g.loadJob(ctx, grantJob.JobID)
+	}
+	if err != nil {
+		return job, fmt.Errorf("failed to store job: %w", err)
+	}
+	return job, nil
+}
+
+// loadJob reads the job item
+func (g *Granter) loadJob(ctx context.Context, jobID string) (Job, error) {
+	job, found, err := g.findJob(ctx, jobID)
+	if err == nil && !found {
+		err = fmt.Errorf("job %s not found", jobID)
+	}
+	return job, err
+}
+
+// findJob reads the job item, returning false if the job wasn't started yet
+func (g *Granter) findJob(ctx context.Context, jobID string) (Job, bool, error) {
+	var job Job
+	result, err := g.dynamoClient.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(g.grantsTable),
+		Key:            rowKey(jobID, jobRow),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return job, false, fmt.Errorf("failed to get job: %w", err)
+	}
+	if result.Item == nil {
+		return job, false, nil
+	}
+	err = dynamodbattribute.UnmarshalMap(result.Item, &job)
+	if err != nil {
+		return job, false, fmt.Errorf("failed to unmarshal job: %w", err)
+	}
+	return job, true, nil
+}
+
+// failJob stops a running job for good, redeliveries of its message end without granting anything
+func (g *Granter) failJob(ctx context.Context, job Job, reason string) error {
+	_, err := g.dynamoClient.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(g.grantsTable),
+		Key:                 rowKey(job.JobID, jobRow),
+		UpdateExpression:    aws.String("SET #status = :failed, #error = :reason, updated_at = :now"),
+		ConditionExpression: aws.String("#status = :running"),
+		ExpressionAttributeNames: map[string]*string{
+			"#status": aws.String("status"),
+			"#error":  aws.String("error"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":failed":  {S: aws.String(jobStatusFailed)},
+			":running": {S: aws.String(jobStatusRunning)},
+			":reason":  {S: aws.String(reason)},
+			":now":     {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+		},
+	})
+	var conditionErr *dynamodb.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		// Another delivery finished or failed the job first
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fail job: %w", err)
+	}
+	fmt.Printf("Job %s failed at row %d of %d: %s\n", job.JobID, job.NextRow, job.Total, reason)
+	return nil
+}
+
+// rowKey returns the key of a row of the grants table
+func rowKey(jobID string, row int) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"job_id": {S: aws.String(jobID)},
+		"row":    {N: aws.String(strconv.Itoa(row))},
+	}
+}
+
+// advanceJob returns the update moving the job cursor past row. The condition on next_row keeps
+// two deliveries of the same message from applying a row twice.
+func (g *Granter) advanceJob(jobID string, row int, counter string, tokens int64) *dynamodb.TransactWriteItem {
+	return &dynamodb.TransactWriteItem{Update: &dynamodb.Update{
+		TableName:           aws.String(g.grantsTable),
+		Key:                 rowKey(jobID, jobRow),
+		UpdateExpression:    aws.String("SET next_row = :next, updated_at = :now ADD #counter :one, granted_tokens :tokens"),
+		ConditionExpression: aws.String("next_row = :row"),
+		ExpressionAttributeNames: map[string]*string{
+			"#counter": aws.String(counter),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":row":    {N: aws.String(strconv.Itoa(row))},
+			":next":   {N: aws.String(strconv.Itoa(row + 1))},
+			":now":    {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+			":one":    {N: aws.String("1")},
+			":tokens": {N: aws.String(strconv.FormatInt(tokens, 10))},
+		},
+	}}
+}
+
+// applyRow grants one row. The balance update, the grant record and the job cursor are written in one
+// transaction, so a row is granted exactly once however often the job is resumed.
+// It returns false if another delivery of the job moved the cursor first.
+func (g *Granter) applyRow(ctx context.Context, jobID string, row int, grant Grant, rowErr error) (bool, error) {
+	result := RowResult{
+		JobID:      jobID,
+		Row:        row,
+		UserHash:   grant.UserHash(),
+		Tokens:     grant.Tokens,
+		Reason:     grant.Reason,
+		Status:     rowStatusGranted,
+		CreatedAt:  time.Now().Unix(),
+		TestRecord: testmode.Enabled(),
+	}
+	if rowErr == nil {
+		rowErr = grant.Validate(g.maxTokens)
+	}
+	if rowErr != nil {
+		return g.failRow(ctx, result, rowErr)
+	}
+
+	item, err := dynamodbattribute.MarshalMap(result)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal grant: %w", err)
+	}
+	_, err = g.dynamoClient.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{Update: &dynamodb.Update{
+				TableName: aws.String(users.Table()),
+				Key: map[string]*dynamodb.AttributeValue{
+					users.AttrUserHash: {S: aws.String(result.UserHash)},
+				},
+				UpdateExpression:    aws.String("SET #requests = if_not_exists(#requests, :zero) + :tokens"),
+				ConditionExpression: aws.String("attribute_exists(user_hash)"),
+				ExpressionAttributeNames: map[string]*string{
+					"#requests": aws.String(users.AttrRemainingRequests),
+				},
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":zero":   {N: aws.String("0")},
+					":tokens": {N: aws.String(strconv.FormatInt(grant.Tokens, 10))},
+				},
+			}},
+			{Put: &dynamodb.Put{
+				TableName:           aws.String(g.grantsTable),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(job_id)"),
+			}},
+			g.advanceJob(jobID, row, "granted", grant.Tokens),
+		},
+	})
+	var cancelledErr *dynamodb.TransactionCanceledException
+	if errors.As(err, &cancelledErr) {
+		reasons := cancelledErr.CancellationReasons
+		if len(reasons) > 0 && aws.StringValue(reasons[0].Code) == "ConditionalCheckFailed" {
+			return g.failRow(ctx, result, errors.New("user not found"))
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to grant row %d: %w", row, err)
+	}
+	return true, nil
+}
+
+// failRow records a row that isn't granted and moves the job cursor past it
+func (g *Granter) failRow(ctx context.Context, result RowResult, rowErr error) (bool, error) {
+	result.Status = rowStatusFailed
+	result.Error = rowErr.Error()
+	item, err := dynamodbattribute.MarshalMap(result)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal grant: %w", err)
+	}
+	_, err = g.dynamoClient.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{Put: &dynamodb.Put{
+				TableName:           aws.String(g.grantsTable),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(job_id)"),
+			}},
+			g.advanceJob(result.JobID, result.Row, "failed", 0),
+		},
+	})
+	var cancelledErr *dynamodb.TransactionCanceledException
+	if errors.As(err, &cancelledErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to record row %d: %w", result.Row, err)
+	}
+	return true, nil
+}
+
+// runJob grants the manifest rows from where the job left off, then writes the report.
+// A resumed job reads the manifest version it started with, and fails if the manifest changed under it.
+func (g *Granter) runJob(ctx context.Context, grantJob GrantJob) error {
+	if grantJob.DryRun {
+		manifest, err := g.readManifest(ctx, grantJob.Bucket, grantJob.Key, "")
+		if err != nil {
+			return err
+		}
+		return g.dryRun(ctx, grantJob, manifest.Grants, manifest.RowErrs)
+	}
+
+	job, found, err := g.findJob(ctx, grantJob.JobID)
+	if err != nil {
+		return err
+	}
+	var manifest Manifest
+	if !found {
+		manifest, err = g.readManifest(ctx, grantJob.Bucket, grantJob.Key, "")
+		if err != nil {
+			return err
+		}
+		job, err = g.startJob(ctx, grantJob, manifest)
+		if err != nil {
+			return err
+		}
+	}
+	switch job.Status {
+	case jobStatusCompleted:
+		fmt.Printf("Job %s is already completed, report at s3://%s/%s\n", job.JobID, job.Bucket, job.ReportKey)
+		return nil
+	case jobStatusFailed:
+		fmt.Printf("Job %s failed before: %s\n", job.JobID, job.Error)
+		return nil
+	}
+	if job.Bucket != grantJob.Bucket || job.Key != grantJob.Key {
+		return fmt.Errorf("job %s was started with s3://%s/%s", job.JobID, job.Bucket, job.Key)
+	}
+
+	// The manifest read above is only the job's own if this delivery started the job
+	if manifest.ETag == "" || manifest.ETag != job.ManifestETag || manifest.VersionID != job.ManifestVersion {
+		manifest, err = g.readManifest(ctx, job.Bucket, job.Key, job.ManifestVersion)
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && (awsErr.Code() == s3.ErrCodeNoSuchKey || awsErr.Code() == "NoSuchVersion") {
+			return g.failJob(ctx, job, fmt.Sprintf("manifest was deleted since the job started: %v", err))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Jobs started before the ETag was stored can't be checked
+	if job.ManifestETag != "" && manifest.ETag != job.ManifestETag {
+		return g.failJob(ctx, job, fmt.Sprintf("manifest changed since the job started, ETag %s is now %s", job.ManifestETag, manifest.ETag))
+	}
+	grants, rowErrs := manifest.Grants, manifest.RowErrs
+	if len(grants) != job.Total {
+		return g.failJob(ctx, job, fmt.Sprintf("manifest has %d rows, the job started with %d", len(grants), job.Total))
+	}
+
+	row := job.NextRow
+	for row <= len(grants) {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < deadlineMargin {
+			fmt.Printf("Job %s stopped at row %d of %d\n", job.JobID, row, len(grants))
+			return errResume
+		}
+		applied, err := g.applyRow(ctx, job.JobID, row, grants[row-1], rowErrs[row-1])
+		if err != nil {
+			return err
+		}
+		if applied {
+			row++
+			continue
+		}
+		// Another delivery of the job is running, continue after the rows it applied
+		job, err = g.loadJob(ctx, job.JobID)
+		if err != nil {
+			return err
+		}
+		row = job.NextRow
+	}
+
+	return g.finishJob(ctx, job.JobID)
+}
+
+func main() {
+	maxTokens, err := loadMaxTokens()
+	if err != nil {
+		fmt.Printf("Failed to load grant limit: %v", err)
+		os.Exit(1)
+	}
+	sess := session.Must(session.NewSession())
+	granter := &Granter{
+		dynamoClient: dynamodb.New(sess),
+		s3Client:     s3.New(sess),
+		grantsTable:  grantsTable(),
+		maxTokens:    maxTokens,
+	}
+	lambda.Start(granter.HandleRequest)
+}
+
+// HandleRequest runs the jobs of the queue messages. A job that isn't finished is reported as a batch
+// item failure, so the queue redelivers it after the visibility timeout and it resumes where it stopped.
+// Malformed messages are dropped, a redelivery wouldn't parse either.
+func (g *Granter) HandleRequest(ctx context.Context, event events.SQSEvent) (events.SQSEventResponse, error) {
+	var response events.SQSEventResponse
+	for _, message := range event.Records {
+		var job GrantJob
+		err := json.Unmarshal([]byte(message.Body), &job)
+		if err == nil && (job.JobID == "" || job.Bucket == "" || job.Key == "") {
+			err = errors.New("job_id, bucket and key are required")
+		}
+		if err != nil {
+			fmt.Printf("Dropping invalid grant job %s: %v\n", message.MessageId, err)
+			continue
+		}
+
+		err = g.runJob(ctx, job)
+		if err != nil {
+			fmt.Printf("Grant job %s: %v\n", job.JobID, err)
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: message.MessageId})
+		}
+	}
+	return response, nil
+}
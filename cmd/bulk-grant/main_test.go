@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const testManifestKey = "campaigns/may.json"
+
+// jobItem is the GetItem response of a job with no rows
+func jobItem(status, versionID, eTag string) string {
+	return fmt.Sprintf(`{"Item": {
+		"job_id": {"S": "job-1"},
+		"row": {"N": "0"},
+		"bucket": {"S": %q},
+		"key": {"S": %q},
+		"status": {"S": %q},
+		"total": {"N": "0"},
+		"next_row": {"N": "1"},
+		"manifest_version": {"S": %q},
+		"manifest_etag": {"S": %q}
+	}}`, testBucket, testManifestKey, status, versionID, eTag)
+}
+
+// jobStatus returns the status the job was last updated to, "" if it wasn't
+func jobStatus(fake *fakeAWS) string {
+	status := ""
+	for _, call := range fake.DynamoCalls("UpdateItem") {
+		values, _ := call.Input["ExpressionAttributeValues"].(map[string]any)
+		for _, name := range []string{":completed", ":failed"} {
+			if value, ok := values[name].(map[string]any); ok {
+				status = value["S"].(string)
+			}
+		}
+	}
+	return status
+}
+
+func TestHandleRequestDropsMalformedMessages(t *testing.T) {
+	fake := &fakeAWS{}
+	granter := newTestGranter(t, fake)
+
+	response, err := granter.HandleRequest(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "not-json", Body: "grant everyone"},
+		{MessageId: "no-key", Body: `{"job_id": "job-1", "bucket": "grants"}`},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.BatchItemFailures) != 0 {
+		t.Errorf("malformed messages are redelivered: %+v", response.BatchItemFailures)
+	}
+	if calls := fake.S3Calls(); len(calls) != 0 {
+		t.Errorf("malformed messages read %+v", calls)
+	}
+}
+
+func TestHandleRequestPinsTheManifestVersion(t *testing.T) {
+	versions := []fakeObjectVersion{
+		{ID: "v1", ETag: `"e1"`, Body: "[]"},
+		{ID: "v2", ETag: `"e2"`, Body: "[]"},
+	}
+
+	tests := []struct {
+		name    string
+		objects []fakeObjectVersion
+		// jobs are the GetItem responses for the job in turn
+		jobs []string
+		// reads are the version ids of the manifest reads, "" for the latest
+		reads  []string
+		status string
+		report bool
+	}{
+		{
+			name:    "new job",
+			objects: versions,
+			jobs:    []string{"{}", jobItem(jobStatusRunning, "v2", `"e2"`)},
+			reads:   []string{""},
+			status:  jobStatusCompleted,
+			report:  true,
+		},
+		{
+			name:    "resumed job reads its version",
+			objects: versions,
+			jobs:    []string{jobItem(jobStatusRunning, "v1", `"e1"`)},
+			reads:   []string{"v1"},
+			status:  jobStatusCompleted,
+			report:  true,
+		},
+		{
+			name:    "unversioned manifest changed",
+			objects: []fakeObjectVersion{{ETag: `"e2"`, Body: "[]"}},
+			jobs:    []string{jobItem(jobStatusRunning, "", `"e1"`)},
+			reads:   []string{""},
+			status:  jobStatusFailed,
+		},
+		{
+			name:    "pinned version deleted",
+			objects: versions,
+			jobs:    []string{jobItem(jobStatusRunning, "v0", `"e0"`)},
+			reads:   []string{"v0"},
+			status:  jobStatusFailed,
+		},
+		{
+			name:    "failed job",
+			objects: versions,
+			jobs:    []string{jobItem(jobStatusFailed, "v1", `"e1"`)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeAWS{
+				objects: map[string][]fakeObjectVersion{testManifestKey: tt.objects},
+				dynamo:  map[string][]string{"GetItem": tt.jobs},
+			}
+			granter := newTestGranter(t, fake)
+
+			body := fmt.Sprintf(`{"job_id": "job-1", "bucket": %q, "key": %q}`, testBucket, testManifestKey)
+			response, err := granter.HandleRequest(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+				{MessageId: "message-1", Body: body},
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(response.BatchItemFailures) != 0 {
+				t.Errorf("job is redelivered: %+v", response.BatchItemFailures)
+			}
+
+			var reads []string
+			report := false
+			for _, call := range fake.S3Calls() {
+				switch call.Method {
+				case http.MethodGet:
+					reads = append(reads, call.VersionID)
+				case http.MethodPut:
+					report = true
+				}
+			}
+			if !slices.Equal(reads, tt.reads) {
+				t.Errorf("read manifest versions %q, want %q", reads, tt.reads)
+			}
+			if report != tt.report {
+				t.Errorf("report written = %v, want %v", report, tt.report)
+			}
+			if status := jobStatus(fake); status != tt.status {
+				t.Errorf("job status = %q, want %q", status, tt.status)
+			}
+
+			if tt.name == "new job" {
+				puts := fake.DynamoCalls("PutItem")
+				if len(puts) != 1 {
+					t.Fatalf("job created %d times", len(puts))
+				}
+				item := puts[0].Input["Item"].(map[string]any)
+				if version := item["manifest_version"].(map[string]any)["S"]; version != "v2" {
+					t.Errorf("manifest_version = %v, want v2", version)
+				}
+				if eTag := item["manifest_etag"].(map[string]any)["S"]; eTag != `"e2"` {
+					t.Errorf("manifest_etag = %v", eTag)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+)
+
+// userHashPattern matches the hex SHA-256 user hashes of users.HashIdentifier
+var userHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Grant is one manifest row
+type Grant struct {
+	// User is a user hash, or the email address or phone number the user signs in with
+	User   string `json:"user"`
+	Tokens int64  `json:"tokens"`
+	Reason string `json:"reason"`
+}
+
+// UserHash returns the hash of the granted user
+func (g Grant) UserHash() string {
+	user := strings.TrimSpace(g.User)
+	if userHashPattern.MatchString(user) {
+		return user
+	}
+	return users.HashIdentifier(user)
+}
+
+// Validate checks a row against the per-grant limit
+func (g Grant) Validate(maxTokens int64) error {
+	switch {
+	case strings.TrimSpace(g.User) == "":
+		return errors.New("user is required")
+	case g.Tokens <= 0:
+		return errors.New("tokens must be positive")
+	case maxTokens > 0 && g.Tokens > maxTokens:
+		return fmt.Errorf("tokens must be at most %d", maxTokens)
+	case strings.TrimSpace(g.Reason) == "":
+		return errors.New("reason is required")
+	}
+	return nil
+}
+
+// parseManifest reads a JSON array of grants, or a CSV with a user,tokens,reason header.
+// Rows that can't be parsed keep their place with the parse error, so row numbers match the manifest.
+func parseManifest(key string, body []byte) ([]Grant, []error, error) {
+	if strings.HasSuffix(strings.ToLower(key), ".json") {
+		var grants []Grant
+		err := json.Unmarshal(body, &grants)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid JSON manifest: %w", err)
+		}
+		return grants, make([]error, len(grants)), nil
+	}
+	return parseCSVManifest(body)
+}
+
+// parseCSVManifest reads a CSV manifest, the columns may come in any order
+func parseCSVManifest(body []byte) ([]Grant, []error, error) {
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid CSV manifest header: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"user", "tokens", "reason"} {
+		if _, ok := columns[name]; !ok {
+			return nil, nil, fmt.Errorf("CSV manifest has no %s column", name)
+		}
+	}
+
+	var grants []Grant
+	var rowErrs []error
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid CSV manifest: %w", err)
+		}
+		field := func(name string) string {
+			if i := columns[name]; i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		grant := Grant{User: field("user"), Reason: field("reason")}
+		var rowErr error
+		grant.Tokens, err = strconv.ParseInt(field("tokens"), 10, 64)
+		if err != nil {
+			rowErr = fmt.Errorf("invalid tokens %q", field("tokens"))
+		}
+		grants = append(grants, grant)
+		rowErrs = append(rowErrs, rowErr)
+	}
+	return grants, rowErrs, nil
+}
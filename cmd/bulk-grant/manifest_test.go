@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseManifest(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    string
+		body   string
+		grants []Grant
+		// rowErrs lists which rows keep a parse error
+		rowErrs []bool
+		err     bool
+	}{
+		{
+			name:    "JSON",
+			key:     "may.JSON",
+			body:    `[{"user": "a@example.com", "tokens": 5, "reason": "promo"}]`,
+			grants:  []Grant{{User: "a@example.com", Tokens: 5, Reason: "promo"}},
+			rowErrs: []bool{false},
+		},
+		{
+			name: "CSV in any column order",
+			key:  "may.csv",
+			body: "Reason, user, tokens\npromo, a@example.com, 5\nrefund, b@example.com, many\n",
+			grants: []Grant{
+				{User: "a@example.com", Tokens: 5, Reason: "promo"},
+				{User: "b@example.com", Reason: "refund"},
+			},
+			rowErrs: []bool{false, true},
+		},
+		{
+			name:    "CSV short row",
+			key:     "may.csv",
+			body:    "user,tokens,reason\na@example.com,5\n",
+			grants:  []Grant{{User: "a@example.com", Tokens: 5}},
+			rowErrs: []bool{false},
+		},
+		{name: "CSV without a column", key: "may.csv", body: "user,tokens\na@example.com,5\n", err: true},
+		{name: "invalid JSON", key: "may.json", body: `{"user": "a@example.com"}`, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grants, rowErrs, err := parseManifest(tt.key, []byte(tt.body))
+			if (err != nil) != tt.err {
+				t.Fatalf("error = %v, want error %v", err, tt.err)
+			}
+			if len(grants) != len(tt.grants) || len(rowErrs) != len(grants) {
+				t.Fatalf("parsed %+v with errors %v", grants, rowErrs)
+			}
+			for i := range grants {
+				if grants[i] != tt.grants[i] {
+					t.Errorf("row %d = %+v, want %+v", i+1, grants[i], tt.grants[i])
+				}
+				if (rowErrs[i] != nil) != tt.rowErrs[i] {
+					t.Errorf("row %d error = %v", i+1, rowErrs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGrantValidate(t *testing.T) {
+	tests := []struct {
+		grant Grant
+		err   string
+	}{
+		{Grant{User: "a@example.com", Tokens: 100, Reason: "promo"}, ""},
+		{Grant{User: " ", Tokens: 100, Reason: "promo"}, "user is required"},
+		{Grant{User: "a@example.com", Tokens: 0, Reason: "promo"}, "tokens must be positive"},
+		{Grant{User: "a@example.com", Tokens: 101, Reason: "promo"}, "tokens must be at most 100"},
+		{Grant{User: "a@example.com", Tokens: 100}, "reason is required"},
+	}
+	for _, tt := range tests {
+		err := tt.grant.Validate(100)
+		if (err == nil && tt.err != "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("Validate(%+v) = %v, want %q", tt.grant, err, tt.err)
+		}
+	}
+}
+
+func TestGrantUserHash(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	if got := (Grant{User: " " + hash + " "}).UserHash(); got != hash {
+		t.Errorf("UserHash() of a hash = %q", got)
+	}
+	if got := (Grant{User: "a@example.com"}).UserHash(); got == "a@example.com" || !userHashPattern.MatchString(got) {
+		t.Errorf("UserHash() of an email = %q", got)
+	}
+}
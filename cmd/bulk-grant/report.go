@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+)
+
+// reportKey returns the key of the report next to the manifest, e.g. campaigns/may.csv.report.csv
+func reportKey(manifestKey string, dryRun bool) string {
+	if dryRun {
+		return manifestKey + ".dry-run.csv"
+	}
+	return manifestKey + ".report.csv"
+}
+
+// writeReport uploads the row results as CSV
+func (g *Granter) writeReport(ctx context.Context, bucket string, key string, results []RowResult) error {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write([]string{"row", "user_hash", "tokens", "status", "error", "reason"})
+	for _, result := range results {
+		writer.Write([]string{
+			strconv.Itoa(result.Row),
+			result.UserHash,
+			strconv.FormatInt(result.Tokens, 10),
+			result.Status,
+			result.Error,
+			result.Reason,
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+
+	_, err := g.s3Client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(buf.Bytes()),
+		ContentType: aws.String("text/csv"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload report s3://%s/%s: %w", bucket, key, err)
+	}
+	return nil
+}
+
+// finishJob writes the report of the recorded rows and marks the job completed
+func (g *Granter) finishJob(ctx context.Context, jobID string) error {
+	job, err := g.loadJob(ctx, jobID)
+	if err != nil {
+		return err
+	}
+
+	var results []RowResult
+	var unmarshalErr error
+	err = g.dynamoClient.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(g.grantsTable),
+		KeyConditionExpression: aws.String("job_id = :job_id AND #row > :job_row"),
+		ExpressionAttributeNames: map[string]*string{
+			"#row": aws.String("row"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":job_id":  {S: aws.String(jobID)},
+			":job_row": {N: aws.String(strconv.Itoa(jobRow))},
+		},
+		ConsistentRead: aws.Bool(true),
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		var pageResults []RowResult
+		unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &pageResults)
+		results = append(results, pageResults...)
+		return unmarshalErr == nil
+	})
+	if err == nil {
+		err = unmarshalErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load rows of job %s: %w", jobID, err)
+	}
+
+	key := reportKey(job.Key, false)
+	err = g.writeReport(ctx, job.Bucket, key, results)
+	if err != nil {
+		return err
+	}
+
+	_, err = g.dynamoClient.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(g.grantsTable),
+		Key:              rowKey(jobID, jobRow),
+		UpdateExpression: aws.String("SET #status = :completed, report_key = :report, updated_at = :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#status": aws.String("status"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":completed": {S: aws.String(jobStatusCompleted)},
+			":report":    {S: aws.String(key)},
+			":now":       {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete job: %w", err)
+	}
+	fmt.Printf("Job %s completed: %d granted (%d tokens), %d failed, report at s3://%s/%s\n",
+		jobID, job.Granted, job.GrantedTokens, job.Failed, job.Bucket, key)
+	return nil
+}
+
+// dryRun checks every row and that its user exists, and writes the report without granting anything
+func (g *Granter) dryRun(ctx context.Context, grantJob GrantJob, grants []Grant, rowErrs []error) error {
+	results := make([]RowResult, len(grants))
+	for i, grant := range grants {
+		result := RowResult{
+			Row:      i + 1,
+			UserHash: grant.UserHash(),
+			Tokens:   grant.Tokens,
+			Reason:   grant.Reason,
+			Status:   rowStatusDryRun,
+		}
+		rowErr := rowErrs[i]
+		if rowErr == nil {
+			rowErr = grant.Validate(g.maxTokens)
+		}
+		if rowErr == nil {
+			item, err := g.dynamoClient.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+				TableName: aws.String(users.Table()),
+				Key: map[string]*dynamodb.AttributeValue{
+					users.AttrUserHash: {S: aws.String(result.UserHash)},
+				},
+				ProjectionExpression: aws.String(users.AttrUserHash),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to get user of row %d: %w", i+1, err)
+			}
+			if item.Item == nil {
+				rowErr = fmt.Errorf("user not found")
+			}
+		}
+		if rowErr != nil {
+			result.Status = rowStatusFailed
+			result.Error = rowErr.Error()
+		}
+		results[i] = result
+	}
+
+	key := reportKey(grantJob.Key, true)
+	err := g.writeReport(ctx, grantJob.Bucket, key, results)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Dry run of job %s checked %d rows, report at s3://%s/%s\n", grantJob.JobID, len(results), grantJob.Bucket, key)
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	apigwTypes "github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+)
+
+const (
+	defaultConnectionsTable = "WS_CONNECTIONS"
+	frameTypeReconnect      = "reconnect"
+	// inFlightTimeout matches the proxy, older in_flight flags belong to crashed invocations
+	inFlightTimeout = 15 * time.Minute
+)
+
+// DrainEvent is the payload the drain is invoked with. Version defaults to DEPLOYMENT_VERSION.
+type DrainEvent struct {
+	Version string `json:"version"`
+	DryRun  bool   `json:"dry_run"`
+}
+
+// DrainResult summarizes a drain run
+type DrainResult struct {
+	Scanned int `json:"scanned"`
+	Drained int `json:"drained"`
+	// Busy connections are streaming a response, they are left alone so the run can be repeated later
+	Busy int `json:"busy"`
+	Gone int `json:"gone"`
+}
+
+// reconnectFrame is the unsequenced frame asking the client to open a new connection
+type reconnectFrame struct {
+	Seq     int64  `json:"seq"`
+	Type    string `json:"type"`
+	Version string `json:"version"`
+}
+
+// isBusy reports whether a request is streaming on the connection
+func isBusy(item map[string]types.AttributeValue, now time.Time) bool {
+	attr, ok := item["in_flight"].(*types.AttributeValueMemberN)
+	if !ok {
+		return false
+	}
+	inFlight, err := strconv.ParseInt(attr.Value, 10, 64)
+	return err == nil && inFlight >= now.Add(-inFlightTimeout).Unix()
+}
+
+// drainConnection asks the client to reconnect and closes the connection. The $disconnect route removes the record.
+func drainConnection(ctx context.Context, client *apigatewaymanagementapi.Client, connectionID string, frame []byte) error {
+	_, err := client.PostToConnection(ctx, &apigatewaymanagementapi.PostToConnectionInput{
+		ConnectionId: aws.String(connectionID),
+		Data:         frame,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.DeleteConnection(ctx, &apigatewaymanagementapi.DeleteConnectionInput{
+		ConnectionId: aws.String(connectionID),
+	})
+	return err
+}
+
+// HandleRequest closes the websocket connections opened by a deployment other than the current one
+func HandleRequest(ctx context.Context, event DrainEvent) (DrainResult, error) {
+	var result DrainResult
+
+	version := event.Version
+	if version == "" {
+		version = os.Getenv("DEPLOYMENT_VERSION")
+	}
+	if version == "" {
+		return result, errors.New("no version in the event and DEPLOYMENT_VERSION is not set")
+	}
+	callbackURL := strings.TrimSuffix(os.Getenv("WS_CALLBACK_URL"), "/")
+	if callbackURL == "" {
+		return result, errors.New("WS_CALLBACK_URL is not set")
+	}
+	tableName := os.Getenv("WS_CONNECTIONS_TABLE")
+	if tableName == "" {
+		tableName = defaultConnectionsTable
+	}
+	tableName = testmode.Table(tableName)
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return result, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	dbClient := dynamodb.NewFromConfig(cfg)
+	wsClient := apigatewaymanagementapi.NewFromConfig(cfg, func(o *apigatewaymanagementapi.Options) {
+		o.BaseEndpoint = aws.String(callbackURL)
+	})
+
+	frame, err := json.Marshal(reconnectFrame{Type: frameTypeReconnect, Version: version})
+	if err != nil {
+		return result, fmt.Errorf("failed to marshal frame: %w", err)
+	}
+
+	// Connections without a version were opened before versions were recorded, so they are stale too
+	paginator := dynamodb.NewScanPaginator(dbClient, &dynamodb.ScanInput{
+		TableName:            aws.String(tableName),
+		FilterExpression:     aws.String("attribute_not_exists(#version) OR #version <> :version"),
+		ProjectionExpression: aws.String("connection_id, #version, in_flight"),
+		ExpressionAttributeNames: map[string]string{
+			"#version": "deployment_version",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":version": &types.AttributeValueMemberS{Value: version},
+		},
+	})
+	now := time.Now()
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return result, fmt.Errorf("failed to scan %s: %w", tableName, err)
+		}
+
+		for _, item := range page.Items {
+			result.Scanned++
+
+			connectionID, ok := item["connection_id"].(*types.AttributeValueMemberS)
+			if !ok {
+				continue
+			}
+			if isBusy(item, now) {
+				fmt.Printf("Connection %s is busy, skipping\n", connectionID.Value)
+				result.Busy++
+				continue
+			}
+			if event.DryRun {
+				fmt.Printf("Would drain connection %s\n", connectionID.Value)
+				continue
+			}
+
+			err = drainConnection(ctx, wsClient, connectionID.Value, frame)
+			var gone *apigwTypes.GoneException
+			if errors.As(err, &gone) {
+				// The client is already gone but $disconnect never cleaned up after it
+				_, err = dbClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+					TableName: aws.String(tableName),
+					Key: map[string]types.AttributeValue{
+						"connection_id": connectionID,
+					},
+				})
+				if err != nil {
+					fmt.Printf("Failed to remove stale connection %s: %v\n", connectionID.Value, err)
+				}
+				result.Gone++
+				continue
+			}
+			if err != nil {
+				fmt.Printf("Failed to drain connection %s: %v\n", connectionID.Value, err)
+				continue
+			}
+			result.Drained++
+		}
+	}
+
+	fmt.Printf("Drain result: %+v\n", result)
+	return result, nil
+}
+
+func main() {
+	lambda.Start(HandleRequest)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	maxWriteBatch       = 25 // BatchWriteItem limit
+	scanPageSize        = 100
+	defaultBatchDelay   = 200 * time.Millisecond
+	maxUnprocessedTries = 5
+)
+
+// retentionPolicy describes which items of a table expire. Items without the time attribute are never deleted.
+type retentionPolicy struct {
+	table       string
+	keys        []string
+	timeAttr    string
+	envDays     string
+	defaultDays int
+}
+
+var policies = []retentionPolicy{
+	{table: "OTP", keys: []string{"Identifier", "CreatedAt"}, timeAttr: "CreatedAt", envDays: "JANITOR_OTP_RETENTION_DAYS", defaultDays: 1},
+	{table: "AUTH", keys: []string{"key"}, timeAttr: "created_at", envDays: "JANITOR_AUTH_RETENTION_DAYS", defaultDays: 90},
+	{table: "USAGE", keys: []string{"request_id"}, timeAttr: "created_at", envDays: "JANITOR_USAGE_RETENTION_DAYS", defaultDays: 365},
+}
+
+// getRetention reads the retention window of a policy from its environment variable
+func (p retentionPolicy) getRetention() (time.Duration, error) {
+	days := p.defaultDays
+	if value := os.Getenv(p.envDays); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return 0, fmt.Errorf("invalid %s: %q", p.envDays, value)
+		}
+		days = parsed
+	}
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// getBatchDelay reads the pause between delete batches from JANITOR_BATCH_DELAY_MS, which keeps the janitor
+// from eating the write capacity the lambdas need
+func getBatchDelay() (time.Duration, error) {
+	value := os.Getenv("JANITOR_BATCH_DELAY_MS")
+	if value == "" {
+		return defaultBatchDelay, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("invalid JANITOR_BATCH_DELAY_MS: %q", value)
+	}
+	return time.Duration(parsed) * time.Millisecond, nil
+}
+
+// deleteBatch deletes up to maxWriteBatch items, retrying the items DynamoDB didn't process
+func deleteBatch(ctx context.Context, client *dynamodb.DynamoDB, table string, keys []map[string]*dynamodb.AttributeValue) error {
+	requests := make([]*dynamodb.WriteRequest, len(keys))
+	for i, key := range keys {
+		requests[i] = &dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{Key: key}}
+	}
+
+	pending := map[string][]*dynamodb.WriteRequest{table: requests}
+	for attempt := 1; len(pending) > 0; attempt++ {
+		if attempt > maxUnprocessedTries {
+			return fmt.Errorf("%d deletes still unprocessed after %d attempts", len(pending[table]), maxUnprocessedTries)
+		}
+		result, err := client.BatchWriteItemWithContext(ctx, &dynamodb.BatchWriteItemInput{RequestItems: pending})
+		if err != nil {
+			return err
+		}
+		pending = result.UnprocessedItems
+		if len(pending) > 0 {
+			time.Sleep(time.Duration(attempt) * defaultBatchDelay)
+		}
+	}
+	return nil
+}
+
+// purgeTable deletes the items of a table that are older than the policy's retention window
+func purgeTable(ctx context.Context, client *dynamodb.DynamoDB, policy retentionPolicy, batchDelay time.Duration) (int, error) {
+	retention, err := policy.getRetention()
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-retention).Unix()
+	fmt.Printf("Purging %s items with %s before %d\n", policy.table, policy.timeAttr, cutoff)
+
+	names := map[string]*string{"#time": aws.String(policy.timeAttr)}
+	projection := ""
+	for i, key := range policy.keys {
+		placeholder := fmt.Sprintf("#key%d", i)
+		names[placeholder] = aws.String(key)
+		if projection != "" {
+			projection += ", "
+		}
+		projection += placeholder
+	}
+
+	var batch []map[string]*dynamodb.AttributeValue
+	deleted := 0
+	var deleteErr error
+	flush := func() bool {
+		deleteErr = deleteBatch(ctx, client, policy.table, batch)
+		if deleteErr != nil {
+			return false
+		}
+		deleted += len(batch)
+		batch = nil
+		time.Sleep(batchDelay)
+		return true
+	}
+
+	err = client.ScanPagesWithContext(ctx, &dynamodb.ScanInput{
+		TableName:                aws.String(policy.table),
+		FilterExpression:         aws.String("#time < :cutoff"),
+		ProjectionExpression:     aws.String(projection),
+		ExpressionAttributeNames: names,
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":cutoff": {N: aws.String(strconv.FormatInt(cutoff, 10))},
+		},
+		Limit: aws.Int64(scanPageSize),
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			batch = append(batch, item)
+			if len(batch) == maxWriteBatch && !flush() {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return deleted, fmt.Errorf("failed to scan %s: %w", policy.table, err)
+	}
+	if deleteErr != nil {
+		return deleted, fmt.Errorf("failed to delete from %s: %w", policy.table, deleteErr)
+	}
+	if len(batch) > 0 && !flush() {
+		return deleted, fmt.Errorf("failed to delete from %s: %w", policy.table, deleteErr)
+	}
+	return deleted, nil
+}
+
+// HandleRequest enforces the retention policies of the OTP, AUTH and USAGE tables.
+// It is meant to run on an EventBridge schedule. A failing table doesn't stop the others.
+func HandleRequest(ctx context.Context) error {
+	batchDelay, err := getBatchDelay()
+	if err != nil {
+		return err
+	}
+
+	client := dynamodb.New(session.Must(session.NewSession()))
+
+	var failed []string
+	for _, policy := range policies {
+		deleted, err := purgeTable(ctx, client, policy, batchDelay)
+		fmt.Printf("Purged %d items from %s\n", deleted, policy.table)
+		if err != nil {
+			fmt.Printf("Failed to purge %s: %v\n", policy.table, err)
+			failed = append(failed, policy.table)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to purge tables: %v", failed)
+	}
+	return nil
+}
+
+func main() {
+	lambda.Start(HandleRequest)
+}
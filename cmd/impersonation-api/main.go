@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/auth"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/ipfilter"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestbody"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestid"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/shedding"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/validation"
+)
+
+const (
+	authTableName = "AUTH"
+	// The audit table has key_id as partition key
+	envAuditTable     = "IMPERSONATION_AUDIT_TABLE_NAME"
+	defaultAuditTable = "IMPERSONATION_AUDIT"
+
+	impersonationsPath = "/admin/impersonations"
+)
+
+// ImpersonationRequest is the body of POST /admin/impersonations
+type ImpersonationRequest struct {
+	UserHash string `json:"user_hash"`
+	Mode     string `json:"mode"`
+	// Reason is kept in the audit record, e.g. the support ticket being debugged
+	Reason string `json:"reason"`
+	// TTL is the number of seconds the key works, auth.DefaultImpersonationTTL if 0
+	TTL int64 `json:"ttl"`
+}
+
+// Impersonation is returned once when the key is issued, only its hash is stored
+type Impersonation struct {
+	AuthKey   string `json:"auth_key"`
+	KeyID     string `json:"key_id"`
+	UserHash  string `json:"user_hash"`
+	Mode      string `json:"mode"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// AuditRecord is the IMPERSONATION_AUDIT item of an issued key
+type AuditRecord struct {
+	KeyID     string `dynamodbav:"key_id"`
+	UserHash  string `dynamodbav:"user_hash"`
+	Mode      string `dynamodbav:"mode"`
+	Reason    string `dynamodbav:"reason"`
+	IssuedBy  string `dynamodbav:"issued_by"`
+	SourceIP  string `dynamodbav:"source_ip"`
+	RequestID string `dynamodbav:"request_id"`
+	CreatedAt int64  `dynamodbav:"created_at"`
+	ExpiresAt int64  `dynamodbav:"expires_at"`
+	// RevokedAt and RevokedBy are set when the key is revoked before it expires
+	RevokedAt  int64  `dynamodbav:"revoked_at,omitempty"`
+	RevokedBy  string `dynamodbav:"revoked_by,omitempty"`
+	TestRecord bool   `dynamodbav:"test_record,omitempty"`
+}
+
+func createResponse(statusCode int, body string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Body:       body,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
+
+// auditTable returns the table the impersonation audit records go to
+func auditTable() string {
+	tableName := os.Getenv(envAuditTable)
+	if tableName == "" {
+		tableName = defaultAuditTable
+	}
+	return testmode.Table(tableName)
+}
+
+// adminARN returns the IAM ARN of the admin calling the endpoint
+func adminARN(request events.APIGatewayProxyRequest) string {
+	return request.RequestContext.Identity.UserArn
+}
+
+// validateImpersonation checks an impersonation request
+func validateImpersonation(impersonationReq ImpersonationRequest) validation.Errors {
+	var validationErrs validation.Errors
+	validationErrs.Required("user_hash", impersonationReq.UserHash)
+	validationErrs.OneOf("mode", impersonationReq.Mode, auth.ImpersonationReadOnly, auth.ImpersonationFull)
+	validationErrs.Required("reason", impersonationReq.Reason)
+	if impersonationReq.TTL < 0 || impersonationReq.TTL > int64(auth.MaxImpersonationTTL.Seconds()) {
+		validationErrs.Add("ttl", validation.RuleFormat, fmt.Sprintf("ttl must be at most %d seconds", int64(auth.MaxImpersonationTTL.Seconds())))
+	}
+	return validationErrs
+}
+
+// userExists reports whether the user has a USERS item
+func userExists(dynamoClient *dynamodb.DynamoDB, userHash string) (bool, error) {
+	result, err := dynamoClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(users.Table()),
+		Key: map[string]*dynamodb.AttributeValue{
+			users.AttrUserHash: {S: aws.String(userHash)},
+		},
+		ProjectionExpression: aws.String(users.AttrUserHash),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to get user: %w", err)
+	}
+	return result.Item != nil, nil
+}
+
+// startImpersonation issues an impersonation key for the user. The AUTH item and the audit record are written
+// in one transaction, so no key works without its audit record.
+func startImpersonation(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	issuedBy := adminARN(request)
+	if issuedBy == "" {
+		return createResponse(http.StatusForbidden, "Missing IAM identity"), nil
+	}
+
+	var impersonationReq ImpersonationRequest
+	err := json.Unmarshal([]byte(request.Body), &impersonationReq)
+	if err != nil {
+		fmt.Printf("failed to unmarshal request: %v", err)
+		return createResponse(http.StatusBadRequest, "Invalid request body"), nil
+	}
+
+	validationErrs := validateImpersonation(impersonationReq)
+	if err := validationErrs.Err(); err != nil {
+		fmt.Printf("invalid impersonation request: %v\n", err)
+		return createResponse(http.StatusUnprocessableEntity, validationErrs.Body()), nil
+	}
+
+	dynamoClient := dynamodb.New(session.Must(session.NewSession()))
+	exists, err := userExists(dynamoClient, impersonationReq.UserHash)
+	if err != nil {
+		fmt.Printf("failed to load user: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to load user"), nil
+	}
+	if !exists {
+		return createResponse(http.StatusNotFound, "User not found"), nil
+	}
+
+	key, keyID, err := auth.NewImpersonationKey()
+	if err != nil {
+		fmt.Printf("failed to generate impersonation key: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to generate impersonation key"), nil
+	}
+
+	ttl := auth.DefaultImpersonationTTL
+	if impersonationReq.TTL > 0 {
+		ttl = time.Duration(impersonationReq.TTL) * time.Second
+	}
+	now := time.Now()
+	expiresAt := now.Add(ttl).Unix()
+
+	// Store only the hash of the key, support gets the key itself once in the response
+	authItem := map[string]*dynamodb.AttributeValue{
+		"key":                      {S: aws.String(auth.HashKey(key))},
+		"user_hash":                {S: aws.String(impersonationReq.UserHash)},
+		auth.AttrKeyType:           {S: aws.String(auth.KeyTypeImpersonation)},
+		auth.AttrKeyID:             {S: aws.String(keyID)},
+		auth.AttrImpersonationMode: {S: aws.String(impersonationReq.Mode)},
+		auth.AttrImpersonatedBy:    {S: aws.String(issuedBy)},
+		auth.AttrCreatedAt:         {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+		auth.AttrKeyExpiresAt:      {N: aws.String(strconv.FormatInt(expiresAt, 10))},
+	}
+	if testmode.Enabled() {
+		authItem[testmode.AttrTestRecord] = &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+	}
+
+	audit, err := dynamodbattribute.MarshalMap(AuditRecord{
+		KeyID:      keyID,
+		UserHash:   impersonationReq.UserHash,
+		Mode:       impersonationReq.Mode,
+		Reason:     impersonationReq.Reason,
+		IssuedBy:   issuedBy,
+		SourceIP:   request.RequestContext.Identity.SourceIP,
+		RequestID:  request.RequestContext.RequestID,
+		CreatedAt:  now.Unix(),
+		ExpiresAt:  expiresAt,
+		TestRecord: testmode.Enabled(),
+	})
+	if err != nil {
+		fmt.Printf("failed to marshal audit record: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to create audit record"), nil
+	}
+
+	_, err = dynamoClient.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{Put: &dynamodb.Put{
+				TableName:           aws.String(testmode.Table(authTableName)),
+				Item:                authItem,
+				ConditionExpression: aws.String("attribute_not_exists(#key)"),
+				ExpressionAttributeNames: map[string]*string{
+					"#key": aws.String("key"),
+				},
+			}},
+			{Put: &dynamodb.Put{
+				TableName: aws.String(auditTable()),
+				Item:      audit,
+			}},
+		},
+	})
+	if err != nil {
+		fmt.Printf("failed to store impersonation key: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to store impersonation key"), nil
+	}
+	fmt.Printf("%s started %s impersonation %s of user %s until %d: %s\n", issuedBy, impersonationReq.Mode, keyID, impersonationReq.UserHash, expiresAt, impersonationReq.Reason)
+
+	jsonResponse, err := json.Marshal(Impersonation{
+		AuthKey:   key,
+		KeyID:     keyID,
+		UserHash:  impersonationReq.UserHash,
+		Mode:      impersonationReq.Mode,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		fmt.Printf("failed to marshal response: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to create response"), nil
+	}
+	return createResponse(http.StatusOK, string(jsonResponse)), nil
+}
+
+// endImpersonation revokes an impersonation key by its public id before it expires.
+// expires_at makes every lambda checking AUTH keys reject it, the audit record gets who revoked it.
+func endImpersonation(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	revokedBy := adminARN(request)
+	if revokedBy == "" {
+		return createResponse(http.StatusForbidden, "Missing IAM identity"), nil
+	}
+	keyID := request.QueryStringParameters["key_id"]
+	if keyID == "" {
+		return createResponse(http.StatusBadRequest, "Missing key_id"), nil
+	}
+
+	dynamoClient := dynamodb.New(session.Must(session.NewSession()))
+	result, err := dynamoClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(auditTable()),
+		Key: map[string]*dynamodb.AttributeValue{
+			"key_id": {S: aws.String(keyID)},
+		},
+	})
+	if err != nil {
+		fmt.Printf("failed to load audit record: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to load impersonation"), nil
+	}
+	if result.Item == nil {
+		return createResponse(http.StatusNotFound, "Impersonation not found"), nil
+	}
+	var record AuditRecord
+	err = dynamodbattribute.UnmarshalMap(result.Item, &record)
+	if err != nil {
+		fmt.Printf("failed to unmarshal audit record: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to load impersonation"), nil
+	}
+	now := time.Now().Unix()
+	if record.RevokedAt > 0 || record.ExpiresAt <= now {
+		return createResponse(http.StatusOK, `{"message":"Impersonation already ended"}`), nil
+	}
+
+	// The audit record doesn't hold the key hash, so the AUTH item is found through the user's keys
+	var hashedKey *dynamodb.AttributeValue
+	err = dynamoClient.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(testmode.Table(authTableName)),
+		IndexName:              aws.String("user_hash-index"),
+		KeyConditionExpression: aws.String("user_hash = :user_hash"),
+		FilterExpression:       aws.String("#key_id = :key_id"),
+		ExpressionAttributeNames: map[string]*string{
+			"#key_id": aws.String(auth.AttrKeyID),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":user_hash": {S: aws.String(record.UserHash)},
+			":key_id":    {S: aws.String(keyID)},
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		if len(page.Items) > 0 {
+			hashedKey = page.Items[0]["key"]
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		fmt.Printf("failed to query impersonation key: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to end impersonation"), nil
+	}
+
+	nowValue := strconv.FormatInt(now, 10)
+	transactItems := []*dynamodb.TransactWriteItem{
+		{Update: &dynamodb.Update{
+			TableName: aws.String(auditTable()),
+			Key: map[string]*dynamodb.AttributeValue{
+				"key_id": {S: aws.String(keyID)},
+			},
+			UpdateExpression:    aws.String("SET revoked_at = :now, revoked_by = :revoked_by"),
+			ConditionExpression: aws.String("attribute_not_exists(revoked_at)"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":now":        {N: aws.String(nowValue)},
+				":revoked_by": {S: aws.String(revokedBy)},
+			},
+		}},
+	}
+	if hashedKey != nil {
+		transactItems = append(transactItems, &dynamodb.TransactWriteItem{Update: &dynamodb.Update{
+			TableName:        aws.String(testmode.Table(authTableName)),
+			Key:              map[string]*dynamodb.AttributeValue{"key": hashedKey},
+			UpdateExpression: aws.String("SET #revoked = :now, #expires = :now"),
+			ExpressionAttributeNames: map[string]*string{
+				"#revoked": aws.String(auth.AttrRevokedAt),
+				"#expires": aws.String(auth.AttrKeyExpiresAt),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":now": {N: aws.String(nowValue)},
+			},
+		}})
+	}
+	_, err = dynamoClient.TransactWriteItems(&dynamodb.TransactWriteItemsInput{TransactItems: transactItems})
+	var cancelledErr *dynamodb.TransactionCanceledException
+	if errors.As(err, &cancelledErr) {
+		return createResponse(http.StatusOK, `{"message":"Impersonation already ended"}`), nil
+	}
+	if err != nil {
+		fmt.Printf("failed to end impersonation: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to end impersonation"), nil
+	}
+	fmt.Printf("%s ended impersonation %s of user %s\n", revokedBy, keyID, record.UserHash)
+	return createResponse(http.StatusOK, `{"message":"Impersonation ended"}`), nil
+}
+
+func main() {
+	filter, err := ipfilter.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load IP filter configuration: %v", err)
+		os.Exit(1)
+	}
+	shedder, err := shedding.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load latency budgets: %v", err)
+		os.Exit(1)
+	}
+	limits, err := requestbody.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load body limits: %v", err)
+		os.Exit(1)
+	}
+	handler := ipfilter.Middleware(filter, requestbody.Middleware(limits, handleRequest))
+	lambda.Start(requestid.Middleware(shedding.Middleware(shedder, handler)))
+}
+
+// handleRequest routes admin impersonation requests, access is restricted with IAM auth on the API Gateway route
+func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Remove trailing slash from path if present
+	path := strings.TrimSuffix(request.Path, "/")
+
+	switch {
+	case request.HTTPMethod == "POST" && path == impersonationsPath:
+		return startImpersonation(request)
+	case request.HTTPMethod == "DELETE" && path == impersonationsPath:
+		return endImpersonation(request)
+	default:
+		return createResponse(http.StatusNotFound, "Not Found"), fmt.Errorf("unknown endpoint: %s %s", request.HTTPMethod, request.Path)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/health"
+)
+
+// recordDelivery counts an OTP delivery outcome for the status page.
+// Failures are logged only, the status page is best effort.
+func recordDelivery(dynamoClient *dynamodb.DynamoDB, failed bool) {
+	now := time.Now()
+	_, err := dynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(health.Table(os.Getenv(health.EnvTable))),
+		Key: map[string]*dynamodb.AttributeValue{
+			health.AttrComponent: {S: aws.String(health.ComponentOTPDelivery)},
+			health.AttrBucket:    {N: aws.String(strconv.FormatInt(health.Bucket(now), 10))},
+		},
+		UpdateExpression: aws.String("ADD #count :one SET #expires = :expires"),
+		ExpressionAttributeNames: map[string]*string{
+			"#count":   aws.String(health.CounterAttr(failed)),
+			"#expires": aws.String(health.AttrExpiresAt),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one":     {N: aws.String("1")},
+			":expires": {N: aws.String(strconv.FormatInt(health.ExpiresAt(now), 10))},
+		},
+	})
+	if err != nil {
+		fmt.Printf("Can't record OTP delivery health: %v\n", err)
+	}
+}
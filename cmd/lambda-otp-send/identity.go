@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/auth"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/validation"
+)
+
+const (
+	authTableName = "AUTH"
+
+	// otpPurposeIdentityChange marks OTPs that lambda-otp-verify only accepts for an identifier change
+	otpPurposeIdentityChange = "identity_change"
+)
+
+// getUserHashFromAuth resolves the user behind the bearer auth key, returning an empty hash if the key is unknown
+func getUserHashFromAuth(dynamoClient *dynamodb.DynamoDB, request events.APIGatewayProxyRequest) (string, error) {
+	authKey, ok := auth.BearerToken(request.Headers)
+	if !ok {
+		return "", nil
+	}
+	result, err := dynamoClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(testmode.Table(authTableName)),
+		Key: map[string]*dynamodb.AttributeValue{
+			"key": {S: aws.String(auth.HashKey(authKey))},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get auth key: %w", err)
+	}
+	if result.Item == nil || result.Item["user_hash"] == nil {
+		return "", nil
+	}
+	if expiresAt := result.Item[auth.AttrKeyExpiresAt]; expiresAt != nil && auth.KeyExpired(aws.StringValue(expiresAt.N), time.Now()) {
+		return "", nil
+	}
+	// API keys are limited to their scopes, which don't cover this endpoint
+	if keyType := result.Item[auth.AttrKeyType]; keyType != nil && auth.IsAPIKey(aws.StringValue(keyType.S)) {
+		return "", nil
+	}
+	// Support impersonating the user can't change the user's login
+	if keyType := result.Item[auth.AttrKeyType]; keyType != nil && auth.IsImpersonation(aws.StringValue(keyType.S)) {
+		return "", nil
+	}
+	return aws.StringValue(result.Item["user_hash"].S), nil
+}
+
+// userExists reports whether USERS has a user with the hash
+func userExists(dynamoClient *dynamodb.DynamoDB, userHash string) (bool, error) {
+	result, err := dynamoClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(users.Table()),
+		Key: map[string]*dynamodb.AttributeValue{
+			users.AttrUserHash: {S: aws.String(userHash)},
+		},
+		ProjectionExpression: aws.String(users.AttrUserHash),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to load user: %w", err)
+	}
+	return result.Item != nil, nil
+}
+
+// sendIdentifierChangeOTP sends an OTP to the new phone number or email address of the logged in user.
+// The OTP is bound to the user, lambda-otp-verify moves the user to the new identifier once it is verified.
+func sendIdentifierChangeOTP(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var otpReq OTPRequest
+	err := json.Unmarshal([]byte(request.Body), &otpReq)
+	if err != nil {
+		return createResponse(http.StatusBadRequest, "Invalid request body"), fmt.Errorf("failed to unmarshal request: %w", err)
+	}
+
+	var validationErrs validation.Errors
+	validationErrs.Required("identifier", otpReq.Identifier)
+	validationErrs.OneOf("method", otpReq.Method, "sms", "email")
+	if err := validationErrs.Err(); err != nil {
+		return createResponse(http.StatusUnprocessableEntity, validationErrs.Body()), fmt.Errorf("invalid identifier change request: %w", err)
+	}
+
+	sess := newSession()
+	dynamoClient := dynamodb.New(sess)
+
+	userHash, err := getUserHashFromAuth(dynamoClient, request)
+	if err != nil {
+		return createResponse(http.StatusInternalServerError, "Failed to resolve auth key"), err
+	}
+	if userHash == "" {
+		return createResponse(http.StatusUnauthorized, "Unauthorized"), fmt.Errorf("identifier change without a valid auth key")
+	}
+
+	newHash := users.HashIdentifier(otpReq.Identifier)
+	if newHash == userHash {
+		return createResponse(http.StatusConflict, "Identifier is already tied to this account"), fmt.Errorf("user %s asked to change to its own identifier", userHash)
+	}
+	exists, err := userExists(dynamoClient, newHash)
+	if err != nil {
+		return createResponse(http.StatusInternalServerError, "Failed to check identifier"), err
+	}
+	if exists {
+		return createResponse(http.StatusConflict, "Identifier is already in use"), fmt.Errorf("identifier of user %s is already in use", newHash)
+	}
+
+	blocked, err := checkReputation(ctx, dynamoClient, request, otpReq)
+	if blocked != nil {
+		return *blocked, err
+	}
+
+	return deliverOTP(sess, dynamoClient, otpReq, map[string]*dynamodb.AttributeValue{
+		"Purpose":  {S: aws.String(otpPurposeIdentityChange)},
+		"UserHash": {S: aws.String(userHash)},
+	})
+}
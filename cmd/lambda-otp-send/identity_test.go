@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// fakeAuthTable answers every GetItem with item and records the operations it got
+func fakeAuthTable(t *testing.T, item string) func() []string {
+	t.Helper()
+	var mu sync.Mutex
+	var operations []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		mu.Lock()
+		operations = append(operations, strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810."))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		io.WriteString(w, item)
+	}))
+	t.Cleanup(server.Close)
+
+	previous := newSession
+	newSession = func() *session.Session {
+		return session.Must(session.NewSession(&aws.Config{
+			Region:      aws.String("us-east-1"),
+			Endpoint:    aws.String(server.URL),
+			Credentials: credentials.NewStaticCredentials("test", "test", ""),
+			MaxRetries:  aws.Int(0),
+		}))
+	}
+	t.Cleanup(func() { newSession = previous })
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, operations...)
+	}
+}
+
+func TestSendIdentifierChangeOTPRefusesKeys(t *testing.T) {
+	authItem := func(extra string) string {
+		return fmt.Sprintf(`{"Item": {"key": {"S": "hashed"}, "user_hash": {"S": "user-1"}%s}}`, extra)
+	}
+
+	tests := []struct {
+		name string
+		item string
+	}{
+		{"unknown key", "{}"},
+		{"API key", authItem(`, "key_type": {"S": "api"}`)},
+		{"impersonation key", authItem(`, "key_type": {"S": "impersonation"}`)},
+		{"expired key", authItem(`, "expires_at": {"N": "1"}`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			operations := fakeAuthTable(t, tt.item)
+
+			response, err := handleRequest(context.Background(), events.APIGatewayProxyRequest{
+				HTTPMethod: http.MethodPost,
+				Path:       "/identifier/send-otp",
+				Headers:    map[string]string{"Authorization": "Bearer key-1"},
+				Body:       `{"identifier": "+15550100", "method": "sms"}`,
+			})
+			if response.StatusCode != http.StatusUnauthorized || err == nil {
+				t.Errorf("status = %d, error = %v, want 401", response.StatusCode, err)
+			}
+			// Nothing past the auth key is read, so no OTP is stored or sent
+			if got := operations(); len(got) != 1 || got[0] != "GetItem" {
+				t.Errorf("DynamoDB operations = %v, want the auth key lookup only", got)
+			}
+		})
+	}
+}
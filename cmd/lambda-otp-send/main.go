@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"math/big"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -16,8 +17,16 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/ses"
 	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/captcha"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/ipfilter"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/mailer"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/reputation"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestbody"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestid"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/shedding"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/validation"
 )
 
 const (
@@ -27,6 +36,19 @@ const (
 type OTPRequest struct {
 	Identifier string `json:"identifier"`
 	Method     string `json:"method"`
+	// CaptchaToken is only needed when a previous request was answered with captcha_required
+	CaptchaToken string `json:"captcha_token,omitempty"`
+}
+
+// reputationConfig holds the risk thresholds, loaded once in main
+var reputationConfig reputation.Config
+
+// otpMailer sends the email OTPs, its sending identity is checked in main
+var otpMailer *mailer.Mailer
+
+// newSession creates the AWS session of a request, tests point it at a fake endpoint
+var newSession = func() *session.Session {
+	return session.Must(session.NewSession())
 }
 
 func createResponse(statusCode int, body string) events.APIGatewayProxyResponse {
@@ -47,7 +69,36 @@ func generateOTP() string {
 	return fmt.Sprintf("%06d", otp)
 }
 
-func sendOTP(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+// checkReputation records the OTP request and returns a response if the request is blocked.
+// A REPUTATION outage doesn't block signups.
+func checkReputation(ctx context.Context, dynamoClient *dynamodb.DynamoDB, request events.APIGatewayProxyRequest, otpReq OTPRequest) (*events.APIGatewayProxyResponse, error) {
+	sourceIP := request.RequestContext.Identity.SourceIP
+	store := reputation.NewStore(dynamoClient, reputationConfig)
+	decision, score, err := store.RecordOTPRequest(sourceIP, otpReq.Identifier, time.Now())
+	if err != nil {
+		fmt.Printf("Can't check reputation: %v\n", err)
+		return nil, nil
+	}
+	fmt.Printf("reputation score: %d, decision: %s\n", score, decision)
+
+	switch decision {
+	case reputation.DecisionDeny:
+		response := createResponse(http.StatusForbidden, `{"message":"Request denied"}`)
+		return &response, fmt.Errorf("OTP request denied with risk score %d", score)
+	case reputation.DecisionCaptcha:
+		solved, err := captcha.Verify(ctx, otpReq.CaptchaToken, sourceIP)
+		if err != nil {
+			fmt.Printf("Can't verify CAPTCHA: %v\n", err)
+		}
+		if !solved {
+			response := createResponse(http.StatusForbidden, `{"message":"CAPTCHA required","captcha_required":true}`)
+			return &response, fmt.Errorf("OTP request needs a CAPTCHA with risk score %d", score)
+		}
+	}
+	return nil, nil
+}
+
+func sendOTP(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	var otpReq OTPRequest
 	err := json.Unmarshal([]byte(request.Body), &otpReq)
 	if err != nil {
@@ -55,21 +106,45 @@ func sendOTP(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 	}
 	fmt.Printf("otpReq: %+v\n", otpReq)
 
+	var validationErrs validation.Errors
+	validationErrs.Required("identifier", otpReq.Identifier)
+	validationErrs.OneOf("method", otpReq.Method, "sms", "email")
+	if err := validationErrs.Err(); err != nil {
+		return createResponse(http.StatusUnprocessableEntity, validationErrs.Body()), fmt.Errorf("invalid OTP request: %w", err)
+	}
+
+	sess := newSession()
+	dynamoClient := dynamodb.New(sess)
+
+	blocked, err := checkReputation(ctx, dynamoClient, request, otpReq)
+	if blocked != nil {
+		return *blocked, err
+	}
+
+	return deliverOTP(sess, dynamoClient, otpReq, nil)
+}
+
+// deliverOTP stores a new OTP for the identifier with the extra attributes and sends it by SMS or email
+func deliverOTP(sess *session.Session, dynamoClient *dynamodb.DynamoDB, otpReq OTPRequest, attributes map[string]*dynamodb.AttributeValue) (events.APIGatewayProxyResponse, error) {
 	otp := generateOTP()
 	fmt.Printf("Generated OTP: %v\n", otp)
 
-	sess := session.Must(session.NewSession())
-
 	// Store OTP in DynamoDB
-	dynamoClient := dynamodb.New(sess)
-	_, err = dynamoClient.PutItem(&dynamodb.PutItemInput{
-		TableName: aws.String("OTP"),
-		Item: map[string]*dynamodb.AttributeValue{
-			"Identifier": {S: aws.String(otpReq.Identifier)},
-			"CreatedAt":  {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
-			"OTP":        {S: aws.String(otp)},
-			"Active":     {BOOL: aws.Bool(true)},
-		},
+	item := map[string]*dynamodb.AttributeValue{
+		"Identifier": {S: aws.String(otpReq.Identifier)},
+		"CreatedAt":  {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+		"OTP":        {S: aws.String(otp)},
+		"Active":     {BOOL: aws.Bool(true)},
+	}
+	for name, value := range attributes {
+		item[name] = value
+	}
+	if testmode.Enabled() {
+		item[testmode.AttrTestRecord] = &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+	}
+	_, err := dynamoClient.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(testmode.Table("OTP")),
+		Item:      item,
 	})
 	if err != nil {
 		return createResponse(http.StatusInternalServerError, "Failed to store OTP"), fmt.Errorf("failed to store OTP in DynamoDB: %w", err)
@@ -83,26 +158,11 @@ func sendOTP(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 			PhoneNumber: aws.String(otpReq.Identifier),
 		})
 	case "email":
-		sesClient := ses.New(sess)
-		_, err = sesClient.SendEmail(&ses.SendEmailInput{
-			Source: aws.String(defaultEmailAddress),
-			Destination: &ses.Destination{
-				ToAddresses: []*string{aws.String(otpReq.Identifier)},
-			},
-			Message: &ses.Message{
-				Subject: &ses.Content{
-					Data: aws.String("Your OTP"),
-				},
-				Body: &ses.Body{
-					Text: &ses.Content{
-						Data: aws.String(fmt.Sprintf("Your OTP is: %s", otp)),
-					},
-				},
-			},
-		})
+		err = otpMailer.Send(otpReq.Identifier, "Your OTP", fmt.Sprintf("Your OTP is: %s", otp))
 	default:
 		return createResponse(http.StatusBadRequest, "Invalid method"), fmt.Errorf("invalid OTP send method: %s", otpReq.Method)
 	}
+	recordDelivery(dynamoClient, err != nil)
 
 	if err != nil {
 		return createResponse(http.StatusInternalServerError, "Failed to send OTP"), fmt.Errorf("failed to send OTP: %w", err)
@@ -126,7 +186,34 @@ func sendOTP(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 }
 
 func main() {
-	lambda.Start(handleRequest)
+	filter, err := ipfilter.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load IP filter configuration: %v", err)
+		os.Exit(1)
+	}
+	shedder, err := shedding.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load latency budgets: %v", err)
+		os.Exit(1)
+	}
+	limits, err := requestbody.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load body limits: %v", err)
+		os.Exit(1)
+	}
+	reputationConfig, err = reputation.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load reputation configuration: %v", err)
+		os.Exit(1)
+	}
+	otpMailer = mailer.New(session.Must(session.NewSession()), defaultEmailAddress)
+	err = otpMailer.CheckIdentity()
+	if err != nil {
+		fmt.Printf("Can't send email OTPs: %v", err)
+		os.Exit(1)
+	}
+	handler := ipfilter.Middleware(filter, requestbody.Middleware(limits, handleRequest))
+	lambda.Start(requestid.Middleware(shedding.Middleware(shedder, handler)))
 }
 
 func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
@@ -137,7 +224,9 @@ func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (
 
 	switch {
 	case request.HTTPMethod == "POST" && path == "/send-otp":
-		return sendOTP(request)
+		return sendOTP(ctx, request)
+	case request.HTTPMethod == "POST" && path == "/identifier/send-otp":
+		return sendIdentifierChangeOTP(ctx, request)
 	default:
 		return createResponse(http.StatusNotFound, "Not Found"), fmt.Errorf("unknown endpoint: %s %s", request.HTTPMethod, request.Path)
 	}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/auth"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/validation"
+)
+
+const (
+	authTableName = "AUTH"
+	// userIndex is the AUTH and REFRESH_TOKENS GSI with user_hash as partition key
+	userIndex = "user_hash-index"
+
+	defaultIdentityChangesTable = "IDENTITY_CHANGES"
+	envIdentityChangesTable     = "IDENTITY_CHANGES_TABLE"
+
+	// otpPurposeIdentityChange marks OTPs lambda-otp-send issued for an identifier change
+	otpPurposeIdentityChange = "identity_change"
+)
+
+// getUserHashFromAuth resolves the user behind the bearer auth key, returning an empty hash if the key is unknown
+func getUserHashFromAuth(dynamoClient *dynamodb.DynamoDB, request events.APIGatewayProxyRequest) (string, error) {
+	authKey, ok := auth.BearerToken(request.Headers)
+	if !ok {
+		return "", nil
+	}
+	result, err := dynamoClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(testmode.Table(authTableName)),
+		Key: map[string]*dynamodb.AttributeValue{
+			"key": {S: aws.String(auth.HashKey(authKey))},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get auth key: %w", err)
+	}
+	if result.Item == nil || result.Item["user_hash"] == nil {
+		return "", nil
+	}
+	if expiresAt := result.Item[auth.AttrKeyExpiresAt]; expiresAt != nil && auth.KeyExpired(aws.StringValue(expiresAt.N), time.Now()) {
+		return "", nil
+	}
+	// API keys are limited to their scopes, which don't cover this endpoint
+	if keyType := result.Item[auth.AttrKeyType]; keyType != nil && auth.IsAPIKey(aws.StringValue(keyType.S)) {
+		return "", nil
+	}
+	// Support impersonating the user can't change the user's login
+	if keyType := result.Item[auth.AttrKeyType]; keyType != nil && auth.IsImpersonation(aws.StringValue(keyType.S)) {
+		return "", nil
+	}
+	return aws.StringValue(result.Item["user_hash"].S), nil
+}
+
+// identityChangesTable returns the table the identity-change audit records go to
+func identityChangesTable() string {
+	tableName := os.Getenv(envIdentityChangesTable)
+	if tableName == "" {
+		tableName = defaultIdentityChangesTable
+	}
+	return testmode.Table(tableName)
+}
+
+// identifierType returns whether the identifier is an email address or a phone number
+func identifierType(identifier string) string {
+	if strings.Contains(identifier, "@") {
+		return "email"
+	}
+	return "phone"
+}
+
+// moveUser copies the USERS item to the new user hash, removes the old one and writes the audit record
+// in one transaction, so the user is never lost or duplicated. It fails if the new hash already has a user.
+func moveUser(dynamoClient *dynamodb.DynamoDB, request events.APIGatewayProxyRequest, oldHash string, newHash string, identifier string) error {
+	result, err := dynamoClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(users.Table()),
+		Key: map[string]*dynamodb.AttributeValue{
+			users.AttrUserHash: {S: aws.String(oldHash)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load user: %w", err)
+	}
+	if result.Item == nil {
+		return fmt.Errorf("user %s not found", oldHash)
+	}
+
+	item := result.Item
+	item[users.AttrUserHash] = &dynamodb.AttributeValue{S: aws.String(newHash)}
+	if identifierType(identifier) == "email" {
+		item["notification_email"] = &dynamodb.AttributeValue{S: aws.String(strings.TrimSpace(identifier))}
+	}
+
+	audit, err := dynamodbattribute.MarshalMap(struct {
+		OldUserHash    string `dynamodbav:"old_user_hash"`
+		ChangedAt      int64  `dynamodbav:"changed_at"`
+		NewUserHash    string `dynamodbav:"new_user_hash"`
+		IdentifierType string `dynamodbav:"identifier_type"`
+		SourceIP       string `dynamodbav:"source_ip"`
+		RequestID      string `dynamodbav:"request_id"`
+		TestRecord     bool   `dynamodbav:"test_record,omitempty"`
+	}{
+		OldUserHash:    oldHash,
+		ChangedAt:      time.Now().Unix(),
+		NewUserHash:    newHash,
+		IdentifierType: identifierType(identifier),
+		SourceIP:       request.RequestContext.Identity.SourceIP,
+		RequestID:      request.RequestContext.RequestID,
+		TestRecord:     testmode.Enabled(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal identity change: %w", err)
+	}
+
+	_, err = dynamoClient.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{Put: &dynamodb.Put{
+				TableName:           aws.String(users.Table()),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(user_hash)"),
+			}},
+			{Delete: &dynamodb.Delete{
+				TableName: aws.String(users.Table()),
+				Key: map[string]*dynamodb.AttributeValue{
+					users.AttrUserHash: {S: aws.String(oldHash)},
+				},
+				ConditionExpression: aws.String("attribute_exists(user_hash)"),
+			}},
+			{Put: &dynamodb.Put{
+				TableName: aws.String(identityChangesTable()),
+				Item:      audit,
+			}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to move user: %w", err)
+	}
+	return nil
+}
+
+// repointUserHash moves every item of the old user hash in an AUTH-like table to the new one,
+// so logged in devices stay logged in. keyName is the table's partition key.
+func repointUserHash(dynamoClient *dynamodb.DynamoDB, tableName string, keyName string, oldHash string, newHash string) (int, error) {
+	repointed := 0
+	var queryErr error
+	err := dynamoClient.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String(userIndex),
+		KeyConditionExpression: aws.String("user_hash = :user_hash"),
+		ProjectionExpression:   aws.String("#key"),
+		ExpressionAttributeNames: map[string]*string{
+			"#key": aws.String(keyName),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":user_hash": {S: aws.String(oldHash)},
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			_, err := dynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
+				TableName:           aws.String(tableName),
+				Key:                 map[string]*dynamodb.AttributeValue{keyName: item[keyName]},
+				UpdateExpression:    aws.String("SET user_hash = :new"),
+				ConditionExpression: aws.String("user_hash = :old"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":new": {S: aws.String(newHash)},
+					":old": {S: aws.String(oldHash)},
+				},
+			})
+			var conditionErr *dynamodb.ConditionalCheckFailedException
+			if errors.As(err, &conditionErr) {
+				// The key was deleted or already moved in the meantime
+				continue
+			}
+			if err != nil {
+				queryErr = fmt.Errorf("failed to repoint %s: %w", tableName, err)
+				return false
+			}
+			repointed++
+		}
+		return true
+	})
+	if err != nil {
+		return repointed, fmt.Errorf("failed to query %s: %w", tableName, err)
+	}
+	return repointed, queryErr
+}
+
+// repointReferralCode moves the ownership of the user's referral code to the new user hash
+func repointReferralCode(dynamoClient *dynamodb.DynamoDB, code string, newHash string) error {
+	if code == "" {
+		return nil
+	}
+	_, err := dynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(testmode.Table(referralsTableName)),
+		Key: map[string]*dynamodb.AttributeValue{
+			"referral_code": {S: aws.String(code)},
+		},
+		UpdateExpression:    aws.String("SET owner_hash = :owner"),
+		ConditionExpression: aws.String("attribute_exists(referral_code)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner": {S: aws.String(newHash)},
+		},
+	})
+	return err
+}
+
+// verifyIdentifierChange checks the OTP sent to the new identifier and moves the user, its auth keys,
+// refresh tokens and referral code to the user hash of the new identifier
+func verifyIdentifierChange(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var verifyReq OTPVerifyRequest
+	err := json.Unmarshal([]byte(request.Body), &verifyReq)
+	if err != nil {
+		fmt.Printf("failed to unmarshal request: %v", err)
+		return createResponse(http.StatusBadRequest, "Invalid request body"), nil
+	}
+
+	var validationErrs validation.Errors
+	validationErrs.Required("identifier", verifyReq.Identifier)
+	validationErrs.OTP("otp", verifyReq.OTP)
+	if err := validationErrs.Err(); err != nil {
+		fmt.Printf("invalid identifier change request: %v\n", err)
+		return createResponse(http.StatusUnprocessableEntity, validationErrs.Body()), nil
+	}
+	sess := session.Must(session.NewSession())
+	dynamoClient := dynamodb.New(sess)
+
+	userHash, err := getUserHashFromAuth(dynamoClient, request)
+	if err != nil {
+		fmt.Printf("failed to resolve auth key: %v\n", err)
+		return createResponse(http.StatusInternalServerError, "Failed to resolve auth key"), nil
+	}
+	if userHash == "" {
+		return createResponse(http.StatusUnauthorized, "Unauthorized"), nil
+	}
+
+	otpItem, failed := consumeOTP(dynamoClient, request, verifyReq.Identifier, verifyReq.OTP, otpPurposeIdentityChange)
+	if failed != nil {
+		return *failed, nil
+	}
+	// The OTP is bound to the user who asked for the change
+	if otpItem["UserHash"] == nil || aws.StringValue(otpItem["UserHash"].S) != userHash {
+		fmt.Printf("identifier change OTP of %s was used by user %s\n", verifyReq.Identifier, userHash)
+		return createResponse(http.StatusForbidden, "OTP was issued to another user"), nil
+	}
+
+	user, found, err := loadUser(dynamoClient, userHash)
+	if err != nil {
+		fmt.Printf("failed to load user: %v\n", err)
+		return createResponse(http.StatusInternalServerError, "Failed to load user"), nil
+	}
+	if !found {
+		return createResponse(http.StatusNotFound, "User not found"), nil
+	}
+	if suspension, blocked := auth.CheckUser(user, time.Now()); blocked {
+		fmt.Printf("refusing identifier change of %s user: %s\n", suspension.Status, userHash)
+		return createResponse(http.StatusForbidden, "Account suspended"), nil
+	}
+
+	newHash := users.HashIdentifier(verifyReq.Identifier)
+	err = moveUser(dynamoClient, request, userHash, newHash, verifyReq.Identifier)
+	var canceledErr *dynamodb.TransactionCanceledException
+	if errors.As(err, &canceledErr) {
+		fmt.Printf("identifier change of user %s canceled: %v\n", userHash, err)
+		return createResponse(http.StatusConflict, "Identifier is already in use"), nil
+	}
+	if err != nil {
+		fmt.Printf("failed to change identifier of user %s: %v\n", userHash, err)
+		return createResponse(http.StatusInternalServerError, "Failed to change identifier"), nil
+	}
+	fmt.Printf("moved user %s to %s\n", userHash, newHash)
+
+	// The user has already moved, keys and tokens left behind stop working and their devices log in again
+	for tableName, keyName := range map[string]string{testmode.Table(authTableName): "key", refreshTokensTable(): "token_hash"} {
+		repointed, err := repointUserHash(dynamoClient, tableName, keyName, userHash, newHash)
+		if err != nil {
+			fmt.Printf("failed to repoint %s of user %s: %v\n", tableName, userHash, err)
+		}
+		fmt.Printf("repointed %d items in %s\n", repointed, tableName)
+	}
+
+	err = repointReferralCode(dynamoClient, user.ReferralCode, newHash)
+	if err != nil {
+		fmt.Printf("failed to repoint referral code %s: %v\n", user.ReferralCode, err)
+	}
+
+	jsonResponse, err := json.Marshal(struct {
+		Message string    `json:"message"`
+		User    *UserInfo `json:"user"`
+	}{
+		Message: "Identifier changed successfully",
+		User:    newUserInfo(user),
+	})
+	if err != nil {
+		fmt.Printf("failed to marshal response: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to create response"), nil
+	}
+	return createResponse(http.StatusOK, string(jsonResponse)), nil
+}
+
+// loadUser returns the USERS item, or false if the user doesn't exist
+func loadUser(dynamoClient *dynamodb.DynamoDB, userHash string) (users.User, bool, error) {
+	result, err := dynamoClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(users.Table()),
+		Key: map[string]*dynamodb.AttributeValue{
+			users.AttrUserHash: {S: aws.String(userHash)},
+		},
+	})
+	if err != nil {
+		return users.User{}, false, fmt.Errorf("failed to load user: %w", err)
+	}
+	if result.Item == nil {
+		return users.User{}, false, nil
+	}
+	var user users.User
+	err = dynamodbattribute.UnmarshalMap(result.Item, &user)
+	if err != nil {
+		return users.User{}, false, fmt.Errorf("failed to unmarshal user: %w", err)
+	}
+	return user, true, nil
+}
@@ -5,8 +5,10 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -16,14 +18,39 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/auth"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/ipfilter"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/quota"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/reputation"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestbody"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestid"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/shedding"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/validation"
 
 )
 
+const (
+	defaultTrialRequests = 3
+	defaultTrialDays     = 7
+)
+
 type OTPVerifyRequest struct {
-	Identifier string `json:"identifier"`
-	OTP        string `json:"otp"`
+	Identifier   string `json:"identifier"`
+	OTP          string `json:"otp"`
+	ReferralCode string `json:"referral_code,omitempty"`
+	// DeviceID is sent by apps that want to stay logged in, they get a refresh token bound to the device
+	DeviceID string `json:"device_id,omitempty"`
 }
 
+// reputationConfig holds the risk thresholds, loaded once in main
+var reputationConfig reputation.Config
+
+// quotaPolicy holds the plan refill rules reported to clients, loaded once in main
+var quotaPolicy = quota.DefaultPolicy()
+
 func createResponse(statusCode int, body string) events.APIGatewayProxyResponse {
 	return events.APIGatewayProxyResponse{
 		StatusCode: statusCode,
@@ -43,24 +70,132 @@ func generateAuthKey() (string, error) {
 	return base64.URLEncoding.EncodeToString(bytes), nil
 }
 
-func verifyOTP(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	var verifyReq OTPVerifyRequest
-	err := json.Unmarshal([]byte(request.Body), &verifyReq)
+// TrialInfo describes the trial of a user who is still on the trial plan
+type TrialInfo struct {
+	RemainingRequests int64 `json:"remaining_requests"`
+	ExpiresAt         int64 `json:"expires_at"`
+	Expired           bool  `json:"expired"`
+}
+
+// UserInfo is the user's balance and plan, returned on login so clients don't need to fetch the user separately
+type UserInfo struct {
+	Balance int64  `json:"balance"`
+	Plan    string `json:"plan,omitempty"`
+	// Refill is set if the plan tops up the balance periodically
+	Refill *RefillInfo `json:"refill,omitempty"`
+}
+
+// RefillInfo describes the next top-up of the user's plan
+type RefillInfo struct {
+	Amount       int64 `json:"amount"`
+	NextRefillAt int64 `json:"next_refill_at"`
+}
+
+// newUserInfo describes the user with the refill rules of the quota policy
+func newUserInfo(user users.User) *UserInfo {
+	info := &UserInfo{Balance: user.Balance(), Plan: user.Plan}
+	if next, ok := quotaPolicy.NextRefill(user); ok {
+		info.Refill = &RefillInfo{Amount: quotaPolicy.Plans[user.Plan].RefillAmount, NextRefillAt: next.Unix()}
+	}
+	return info
+}
+
+// getTrialConfig reads the trial size and length from TRIAL_REQUESTS and TRIAL_DAYS
+func getTrialConfig() (int64, time.Duration) {
+	requests := int64(defaultTrialRequests)
+	if value, err := strconv.ParseInt(os.Getenv("TRIAL_REQUESTS"), 10, 64); err == nil && value >= 0 {
+		requests = value
+	}
+	days := defaultTrialDays
+	if value, err := strconv.Atoi(os.Getenv("TRIAL_DAYS")); err == nil && value > 0 {
+		days = value
+	}
+	return requests, time.Duration(days) * 24 * time.Hour
+}
+
+// provisionUser creates a USERS item on the trial plan unless the user already exists, and returns the user.
+// The conditional put makes concurrent first logins safe.
+func provisionUser(dynamoClient *dynamodb.DynamoDB, userHash string, referredBy string) (users.User, bool, error) {
+	trialRequests, trialDuration := getTrialConfig()
+	user := users.NewTrialUser(userHash, trialRequests, trialDuration, time.Now())
+	user.ReferredBy = referredBy
+	user.TestRecord = testmode.Enabled()
+
+	item, err := dynamodbattribute.MarshalMap(user)
 	if err != nil {
-		fmt.Printf("failed to unmarshal request: %v", err)
-		return createResponse(http.StatusBadRequest, "Invalid request body"), nil
+		return users.User{}, false, fmt.Errorf("failed to marshal user: %w", err)
 	}
 
-	fmt.Printf("verifyReq: %+v\n", verifyReq)
-	sess := session.Must(session.NewSession())
-	dynamoClient := dynamodb.New(sess)
+	_, err = dynamoClient.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(users.Table()),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(user_hash)"),
+	})
+	if err == nil {
+		return user, true, nil
+	}
+
+	var conditionErr *dynamodb.ConditionalCheckFailedException
+	if !errors.As(err, &conditionErr) {
+		return users.User{}, false, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	// The user already exists, load it
+	result, err := dynamoClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(users.Table()),
+		Key: map[string]*dynamodb.AttributeValue{
+			users.AttrUserHash: {S: aws.String(userHash)},
+		},
+	})
+	if err != nil {
+		return users.User{}, false, fmt.Errorf("failed to load user: %w", err)
+	}
+	var existing users.User
+	err = dynamodbattribute.UnmarshalMap(result.Item, &existing)
+	if err != nil {
+		return users.User{}, false, fmt.Errorf("failed to unmarshal user: %w", err)
+	}
+	return existing, false, nil
+}
+
+// setNotificationEmail stores the address notifications are sent to
+func setNotificationEmail(dynamoClient *dynamodb.DynamoDB, userHash string, email string) error {
+	_, err := dynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(users.Table()),
+		Key: map[string]*dynamodb.AttributeValue{
+			users.AttrUserHash: {S: aws.String(userHash)},
+		},
+		UpdateExpression: aws.String("SET notification_email = :email"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":email": {S: aws.String(email)},
+		},
+	})
+	return err
+}
+
+// recordVerification feeds the verification outcome into the reputation score lambda-otp-send checks
+func recordVerification(dynamoClient *dynamodb.DynamoDB, request events.APIGatewayProxyRequest, identifier string, success bool) {
+	store := reputation.NewStore(dynamoClient, reputationConfig)
+	err := store.RecordVerification(request.RequestContext.Identity.SourceIP, identifier, success, time.Now())
+	if err != nil {
+		fmt.Printf("failed to record verification: %v\n", err)
+	}
+}
+
+// consumeOTP checks the latest active OTP of the identifier and deactivates it. It returns the OTP item,
+// or the response to send if the OTP is missing, wrong, expired or was issued for another purpose.
+func consumeOTP(dynamoClient *dynamodb.DynamoDB, request events.APIGatewayProxyRequest, identifier string, otp string, purpose string) (map[string]*dynamodb.AttributeValue, *events.APIGatewayProxyResponse) {
+	failure := func(statusCode int, body string) *events.APIGatewayProxyResponse {
+		response := createResponse(statusCode, body)
+		return &response
+	}
 
 	result, err := dynamoClient.Query(&dynamodb.QueryInput{
-		TableName:              aws.String("OTP"),
+		TableName:              aws.String(testmode.Table("OTP")),
 		KeyConditionExpression: aws.String("Identifier = :id"),
 		FilterExpression:       aws.String("Active = :active"),
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":id":     {S: aws.String(verifyReq.Identifier)},
+			":id":     {S: aws.String(identifier)},
 			":active": {BOOL: aws.Bool(true)},
 		},
 		ScanIndexForward: aws.Bool(false),
@@ -69,26 +204,37 @@ func verifyOTP(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRes
 
 	if err != nil {
 		fmt.Printf("failed to query DynamoDB: %v", err)
-		return createResponse(http.StatusInternalServerError, "Failed to retrieve OTP"), nil
+		return nil, failure(http.StatusInternalServerError, "Failed to retrieve OTP")
 	}
 
 	if len(result.Items) == 0 {
-		fmt.Printf("no OTP found for identifier: %s", verifyReq.Identifier)
-		return createResponse(http.StatusBadRequest, "No OTP found"), nil
+		fmt.Printf("no OTP found for identifier: %s", identifier)
+		return nil, failure(http.StatusBadRequest, "No OTP found")
+	}
+
+	// An OTP sent for an identifier change can't be used to log in, and the other way around
+	storedPurpose := ""
+	if attr := result.Items[0]["Purpose"]; attr != nil {
+		storedPurpose = aws.StringValue(attr.S)
+	}
+	if storedPurpose != purpose {
+		fmt.Printf("OTP for identifier %s was issued for %q, not %q", identifier, storedPurpose, purpose)
+		return nil, failure(http.StatusBadRequest, "No OTP found")
 	}
 
 	storedOTP := *result.Items[0]["OTP"].S
 
-	if verifyReq.OTP != storedOTP {
-		fmt.Printf("invalid OTP provided for identifier: %s", verifyReq.Identifier)
-		return createResponse(http.StatusBadRequest, "Invalid OTP"), nil
+	if otp != storedOTP {
+		fmt.Printf("invalid OTP provided for identifier: %s", identifier)
+		recordVerification(dynamoClient, request, identifier, false)
+		return nil, failure(http.StatusBadRequest, "Invalid OTP")
 	}
 
 	// Update Active to false
 	_, err = dynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
-		TableName: aws.String("OTP"),
+		TableName: aws.String(testmode.Table("OTP")),
 		Key: map[string]*dynamodb.AttributeValue{
-			"Identifier": {S: aws.String(verifyReq.Identifier)},
+			"Identifier": {S: aws.String(identifier)},
 		},
 		UpdateExpression: aws.String("SET Active = :active"),
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
@@ -97,42 +243,143 @@ func verifyOTP(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRes
 	})
 	if err != nil {
 		fmt.Printf("failed to set Active to false in DynamoDB: %v", err)
-		return createResponse(http.StatusInternalServerError, "Failed to deactivate OTP"), nil
+		return nil, failure(http.StatusInternalServerError, "Failed to deactivate OTP")
 	}
 
 	createdAt, _ := strconv.ParseInt(*result.Items[0]["CreatedAt"].N, 10, 64)
 
 	if time.Now().Unix()-createdAt > 300 { // OTP expires after 5 minutes
-		fmt.Printf("OTP expired for identifier: %s", verifyReq.Identifier)
-		return createResponse(http.StatusBadRequest, "OTP expired"), nil
+		fmt.Printf("OTP expired for identifier: %s", identifier)
+		recordVerification(dynamoClient, request, identifier, false)
+		return nil, failure(http.StatusBadRequest, "OTP expired")
 	}
 
-	// Generate new auth key
-	authKey, err := generateAuthKey()
+	recordVerification(dynamoClient, request, identifier, true)
+	return result.Items[0], nil
+}
+
+func verifyOTP(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var verifyReq OTPVerifyRequest
+	err := json.Unmarshal([]byte(request.Body), &verifyReq)
 	if err != nil {
-		fmt.Printf("failed to generate auth key: %v", err)
-		return createResponse(http.StatusInternalServerError, "Failed to generate auth key"), nil
+		fmt.Printf("failed to unmarshal request: %v", err)
+		return createResponse(http.StatusBadRequest, "Invalid request body"), nil
 	}
 
-	// Store auth key in DynamoDB
-	_, err = dynamoClient.PutItem(&dynamodb.PutItemInput{
-		TableName: aws.String("AUTH"),
-		Item: map[string]*dynamodb.AttributeValue{
-			"key": {S: aws.String(authKey)},
-		},
-	})
+	fmt.Printf("verifyReq: %+v\n", verifyReq)
+
+	var validationErrs validation.Errors
+	validationErrs.Required("identifier", verifyReq.Identifier)
+	validationErrs.OTP("otp", verifyReq.OTP)
+	if err := validationErrs.Err(); err != nil {
+		fmt.Printf("invalid verify request: %v\n", err)
+		return createResponse(http.StatusUnprocessableEntity, validationErrs.Body()), nil
+	}
+	sess := session.Must(session.NewSession())
+	dynamoClient := dynamodb.New(sess)
+
+	_, failed := consumeOTP(dynamoClient, request, verifyReq.Identifier, verifyReq.OTP, "")
+	if failed != nil {
+		return *failed, nil
+	}
+
+	// Create the user on first login
+	userHash := users.HashIdentifier(verifyReq.Identifier)
+
+	// An invalid referral code doesn't block the login, the user just isn't attributed
+	referredBy := ""
+	if verifyReq.ReferralCode != "" {
+		referredBy, err = validateReferralCode(dynamoClient, verifyReq.ReferralCode, userHash)
+		if err != nil {
+			fmt.Printf("ignoring referral code: %v\n", err)
+		}
+	}
+
+	user, created, err := provisionUser(dynamoClient, userHash, referredBy)
 	if err != nil {
-		fmt.Printf("failed to store auth key in DynamoDB: %v", err)
-		return createResponse(http.StatusInternalServerError, "Failed to store auth key"), nil
+		fmt.Printf("failed to provision user: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to provision user"), nil
+	}
+	// Suspended and banned users don't get new auth keys
+	if suspension, blocked := auth.CheckUser(user, time.Now()); blocked {
+		fmt.Printf("refusing login of %s user: %s\n", suspension.Status, userHash)
+		jsonResponse, err := json.Marshal(struct {
+			Message    string          `json:"message"`
+			Suspension auth.Suspension `json:"suspension"`
+		}{
+			Message:    "Account suspended",
+			Suspension: suspension,
+		})
+		if err != nil {
+			return createResponse(http.StatusForbidden, "Account suspended"), nil
+		}
+		return createResponse(http.StatusForbidden, string(jsonResponse)), nil
+	}
+	if created {
+		fmt.Printf("created trial user: %s\n", userHash)
+
+		err = createReferral(dynamoClient, user)
+		if err != nil {
+			fmt.Printf("failed to create referral code: %v\n", err)
+		}
+		if referredBy != "" {
+			err = recordReferralSignup(dynamoClient, referredBy)
+			if err != nil {
+				fmt.Printf("failed to record referral signup: %v\n", err)
+			}
+		}
+	}
+
+	// Remember the email address for notifications, phone logins have none
+	if strings.Contains(verifyReq.Identifier, "@") && user.NotificationEmail == "" {
+		err = setNotificationEmail(dynamoClient, userHash, strings.TrimSpace(verifyReq.Identifier))
+		if err != nil {
+			fmt.Printf("failed to store notification email: %v\n", err)
+		}
+	}
+
+	// Apps with a device ID get a short-lived auth key and a refresh token, others a key that doesn't expire
+	var issued Session
+	if verifyReq.DeviceID != "" {
+		issued, err = newSession(dynamoClient, userHash, verifyReq.DeviceID)
+		if err != nil {
+			fmt.Printf("failed to issue session: %v", err)
+			return createResponse(http.StatusInternalServerError, "Failed to store auth key"), nil
+		}
+	} else {
+		issued.AuthKey, err = generateAuthKey()
+		if err != nil {
+			fmt.Printf("failed to generate auth key: %v", err)
+			return createResponse(http.StatusInternalServerError, "Failed to generate auth key"), nil
+		}
+		err = storeAuthKey(dynamoClient, issued.AuthKey, userHash, 0)
+		if err != nil {
+			fmt.Printf("failed to store auth key in DynamoDB: %v", err)
+			return createResponse(http.StatusInternalServerError, "Failed to store auth key"), nil
+		}
 	}
 
 	// Return the new auth key
 	response := struct {
-		Message string `json:"message"`
-		AuthKey string `json:"auth_key"`
+		Message string     `json:"message"`
+		Session
+		NewUser      bool       `json:"new_user"`
+		User         *UserInfo  `json:"user"`
+		Trial        *TrialInfo `json:"trial,omitempty"`
+		ReferralCode string     `json:"referral_code,omitempty"`
 	}{
-		Message: "OTP verified successfully",
-		AuthKey: authKey,
+		Message:      "OTP verified successfully",
+		Session:      issued,
+		NewUser:      created,
+		User:         newUserInfo(user),
+		ReferralCode: user.ReferralCode,
+	}
+	if user.Plan == users.PlanTrial {
+		response.Trial = &TrialInfo{
+			RemainingRequests: user.RemainingRequests,
+			ExpiresAt:         user.TrialExpiresAt,
+			Expired:           user.TrialExpired(time.Now()),
+		}
 	}
 
 	jsonResponse, err := json.Marshal(response)
@@ -145,7 +392,33 @@ func verifyOTP(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRes
 }
 
 func main() {
-	lambda.Start(handleRequest)
+	filter, err := ipfilter.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load IP filter configuration: %v", err)
+		os.Exit(1)
+	}
+	shedder, err := shedding.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load latency budgets: %v", err)
+		os.Exit(1)
+	}
+	limits, err := requestbody.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load body limits: %v", err)
+		os.Exit(1)
+	}
+	reputationConfig, err = reputation.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load reputation configuration: %v", err)
+		os.Exit(1)
+	}
+	quotaPolicy, err = quota.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load quota policy: %v", err)
+		os.Exit(1)
+	}
+	handler := ipfilter.Middleware(filter, requestbody.Middleware(limits, handleRequest))
+	lambda.Start(requestid.Middleware(shedding.Middleware(shedder, handler)))
 }
 
 func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
@@ -157,6 +430,10 @@ func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (
 	switch {
 	case request.HTTPMethod == "POST" && path == "/verify-otp":
 		return verifyOTP(request)
+	case request.HTTPMethod == "POST" && path == "/auth/refresh":
+		return refreshSession(request)
+	case request.HTTPMethod == "POST" && path == "/identifier/verify-otp":
+		return verifyIdentifierChange(request)
 	default:
 		return createResponse(http.StatusNotFound, "Not Found"), fmt.Errorf("unknown endpoint: %s %s", request.HTTPMethod, request.Path)
 	}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+)
+
+const (
+	referralsTableName = "REFERRALS"
+)
+
+// createReferral registers the user's referral code in REFERRALS
+func createReferral(dynamoClient *dynamodb.DynamoDB, user users.User) error {
+	item := map[string]*dynamodb.AttributeValue{
+		"referral_code": {S: aws.String(user.ReferralCode)},
+		"owner_hash":    {S: aws.String(user.UserHash)},
+		"created_at":    {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+		"signups":       {N: aws.String("0")},
+		"fulfilled":     {N: aws.String("0")},
+	}
+	if testmode.Enabled() {
+		item[testmode.AttrTestRecord] = &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+	}
+	_, err := dynamoClient.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(testmode.Table(referralsTableName)),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(referral_code)"),
+	})
+	var conditionErr *dynamodb.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return fmt.Errorf("referral code %s already exists", user.ReferralCode)
+	}
+	return err
+}
+
+// validateReferralCode returns the normalized code if it belongs to another user
+func validateReferralCode(dynamoClient *dynamodb.DynamoDB, code string, userHash string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	result, err := dynamoClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(testmode.Table(referralsTableName)),
+		Key: map[string]*dynamodb.AttributeValue{
+			"referral_code": {S: aws.String(code)},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to look up referral code: %w", err)
+	}
+	if result.Item == nil {
+		return "", fmt.Errorf("unknown referral code: %s", code)
+	}
+	if aws.StringValue(result.Item["owner_hash"].S) == userHash {
+		return "", fmt.Errorf("users can't refer themselves")
+	}
+	return code, nil
+}
+
+// recordReferralSignup counts a new user signing up with the referral code.
+// Crediting both users happens once the referred user's first paid order is fulfilled.
+func recordReferralSignup(dynamoClient *dynamodb.DynamoDB, code string) error {
+	_, err := dynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(testmode.Table(referralsTableName)),
+		Key: map[string]*dynamodb.AttributeValue{
+			"referral_code": {S: aws.String(code)},
+		},
+		UpdateExpression: aws.String("ADD signups :one"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one": {N: aws.String("1")},
+		},
+	})
+	return err
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/auth"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/validation"
+)
+
+const (
+	defaultRefreshTokensTable = "REFRESH_TOKENS"
+	envRefreshTokensTable     = "REFRESH_TOKENS_TABLE"
+	defaultAuthKeyTTL         = time.Hour
+	defaultRefreshTokenTTL    = 90 * 24 * time.Hour
+)
+
+// RefreshRequest exchanges a refresh token for a new auth key
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+	DeviceID     string `json:"device_id"`
+}
+
+// Session is the auth key and refresh token issued to a device
+type Session struct {
+	AuthKey               string `json:"auth_key"`
+	AuthKeyExpiresAt      int64  `json:"auth_key_expires_at,omitempty"`
+	RefreshToken          string `json:"refresh_token,omitempty"`
+	RefreshTokenExpiresAt int64  `json:"refresh_token_expires_at,omitempty"`
+}
+
+// getSessionConfig reads the auth key and refresh token lifetimes from AUTH_KEY_TTL and REFRESH_TOKEN_TTL
+func getSessionConfig() (time.Duration, time.Duration) {
+	authKeyTTL := defaultAuthKeyTTL
+	if value, err := time.ParseDuration(os.Getenv("AUTH_KEY_TTL")); err == nil && value > 0 {
+		authKeyTTL = value
+	}
+	refreshTokenTTL := defaultRefreshTokenTTL
+	if value, err := time.ParseDuration(os.Getenv("REFRESH_TOKEN_TTL")); err == nil && value > 0 {
+		refreshTokenTTL = value
+	}
+	return authKeyTTL, refreshTokenTTL
+}
+
+// refreshTokensTable returns the REFRESH_TOKENS table name
+func refreshTokensTable() string {
+	tableName := os.Getenv(envRefreshTokensTable)
+	if tableName == "" {
+		tableName = defaultRefreshTokensTable
+	}
+	return testmode.Table(tableName)
+}
+
+// storeAuthKey stores the hash of a new auth key for the user. expiresAt is 0 for keys that don't expire.
+func storeAuthKey(dynamoClient *dynamodb.DynamoDB, authKey string, userHash string, expiresAt int64) error {
+	// Store only the hash of the auth key in DynamoDB, the client keeps the key itself
+	authItem := map[string]*dynamodb.AttributeValue{
+		"key":        {S: aws.String(auth.HashKey(authKey))},
+		"user_hash":  {S: aws.String(userHash)},
+		"created_at": {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+	}
+	if expiresAt > 0 {
+		authItem[auth.AttrKeyExpiresAt] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(expiresAt, 10))}
+	}
+	if testmode.Enabled() {
+		authItem[testmode.AttrTestRecord] = &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+	}
+	_, err := dynamoClient.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(testmode.Table(authTableName)),
+		Item:      authItem,
+	})
+	return err
+}
+
+// newSession issues a short-lived auth key and a refresh token bound to the device
+func newSession(dynamoClient *dynamodb.DynamoDB, userHash string, deviceID string) (Session, error) {
+	authKeyTTL, refreshTokenTTL := getSessionConfig()
+	now := time.Now()
+
+	var issued Session
+	var err error
+	issued.AuthKey, err = generateAuthKey()
+	if err != nil {
+		return issued, fmt.Errorf("failed to generate auth key: %w", err)
+	}
+	issued.RefreshToken, err = generateAuthKey()
+	if err != nil {
+		return issued, fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+	issued.AuthKeyExpiresAt = now.Add(authKeyTTL).Unix()
+	issued.RefreshTokenExpiresAt = now.Add(refreshTokenTTL).Unix()
+
+	err = storeAuthKey(dynamoClient, issued.AuthKey, userHash, issued.AuthKeyExpiresAt)
+	if err != nil {
+		return issued, fmt.Errorf("failed to store auth key: %w", err)
+	}
+
+	// Like auth keys, refresh tokens and device IDs are only stored hashed
+	item := map[string]*dynamodb.AttributeValue{
+		"token_hash":  {S: aws.String(auth.HashKey(issued.RefreshToken))},
+		"user_hash":   {S: aws.String(userHash)},
+		"device_hash": {S: aws.String(auth.HashKey(deviceID))},
+		"created_at":  {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+		"expires_at":  {N: aws.String(strconv.FormatInt(issued.RefreshTokenExpiresAt, 10))},
+	}
+	if testmode.Enabled() {
+		item[testmode.AttrTestRecord] = &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+	}
+	_, err = dynamoClient.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(refreshTokensTable()),
+		Item:      item,
+	})
+	if err != nil {
+		return issued, fmt.Errorf("failed to store refresh token: %w", err)
+	}
+	return issued, nil
+}
+
+// takeRefreshToken deletes the refresh token and returns its user, so every token is exchanged only once.
+// Tokens presented from another device are left alone and rejected. It returns an empty hash for invalid tokens.
+func takeRefreshToken(dynamoClient *dynamodb.DynamoDB, token string, deviceID string) (string, error) {
+	result, err := dynamoClient.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(refreshTokensTable()),
+		Key: map[string]*dynamodb.AttributeValue{
+			"token_hash": {S: aws.String(auth.HashKey(token))},
+		},
+		ConditionExpression: aws.String("device_hash = :device"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":device": {S: aws.String(auth.HashKey(deviceID))},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	})
+	var conditionErr *dynamodb.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to take refresh token: %w", err)
+	}
+	if result.Attributes == nil || result.Attributes["user_hash"] == nil {
+		return "", nil
+	}
+
+	// DynamoDB TTL deletes expired items lazily, so check the expiry here as well
+	if expiresAt := result.Attributes["expires_at"]; expiresAt != nil && auth.KeyExpired(aws.StringValue(expiresAt.N), time.Now()) {
+		return "", nil
+	}
+	return aws.StringValue(result.Attributes["user_hash"].S), nil
+}
+
+// refreshSession exchanges a refresh token for a new auth key and a new refresh token for the same device
+func refreshSession(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var refreshReq RefreshRequest
+	err := json.Unmarshal([]byte(request.Body), &refreshReq)
+	if err != nil {
+		fmt.Printf("failed to unmarshal request: %v", err)
+		return createResponse(http.StatusBadRequest, "Invalid request body"), nil
+	}
+
+	var validationErrs validation.Errors
+	validationErrs.Required("refresh_token", refreshReq.RefreshToken)
+	validationErrs.Required("device_id", refreshReq.DeviceID)
+	if err := validationErrs.Err(); err != nil {
+		fmt.Printf("invalid refresh request: %v\n", err)
+		return createResponse(http.StatusUnprocessableEntity, validationErrs.Body()), nil
+	}
+	sess := session.Must(session.NewSession())
+	dynamoClient := dynamodb.New(sess)
+
+	userHash, err := takeRefreshToken(dynamoClient, refreshReq.RefreshToken, refreshReq.DeviceID)
+	if err != nil {
+		fmt.Printf("failed to check refresh token: %v\n", err)
+		return createResponse(http.StatusInternalServerError, "Failed to check refresh token"), nil
+	}
+	if userHash == "" {
+		return createResponse(http.StatusUnauthorized, "Invalid or expired refresh token"), nil
+	}
+
+	user, found, err := loadUser(dynamoClient, userHash)
+	if err != nil {
+		fmt.Printf("failed to load user: %v\n", err)
+		return createResponse(http.StatusInternalServerError, "Failed to load user"), nil
+	}
+	if !found {
+		return createResponse(http.StatusUnauthorized, "Invalid or expired refresh token"), nil
+	}
+	// Suspended and banned users don't get new auth keys
+	if suspension, blocked := auth.CheckUser(user, time.Now()); blocked {
+		fmt.Printf("refusing refresh of %s user: %s\n", suspension.Status, userHash)
+		return createResponse(http.StatusForbidden, "Account suspended"), nil
+	}
+
+	issued, err := newSession(dynamoClient, userHash, refreshReq.DeviceID)
+	if err != nil {
+		fmt.Printf("failed to issue session: %v\n", err)
+		return createResponse(http.StatusInternalServerError, "Failed to issue auth key"), nil
+	}
+
+	jsonResponse, err := json.Marshal(struct {
+		Message string    `json:"message"`
+		User    *UserInfo `json:"user"`
+		Session
+	}{
+		Message: "Session refreshed successfully",
+		User:    newUserInfo(user),
+		Session: issued,
+	})
+	if err != nil {
+		fmt.Printf("failed to marshal response: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to create response"), nil
+	}
+	return createResponse(http.StatusOK, string(jsonResponse)), nil
+}
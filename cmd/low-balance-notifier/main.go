@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/mailer"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/notify"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+)
+
+const (
+	defaultEmailAddress = "notifications.otp@evacrane.com"
+	defaultThreshold    = 2
+)
+
+// getThreshold reads the balance at or below which users are notified from LOW_BALANCE_THRESHOLD
+func getThreshold() (int64, error) {
+	value := os.Getenv("LOW_BALANCE_THRESHOLD")
+	if value == "" {
+		return defaultThreshold, nil
+	}
+	threshold, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || threshold < 0 {
+		return 0, fmt.Errorf("invalid LOW_BALANCE_THRESHOLD: %q", value)
+	}
+	return threshold, nil
+}
+
+// getBalance reads remaining_requests from a stream image, returning false if it is missing
+func getBalance(image map[string]events.DynamoDBAttributeValue) (int64, bool) {
+	attr, ok := image[users.AttrRemainingRequests]
+	if !ok || attr.DataType() != events.DataTypeNumber {
+		return 0, false
+	}
+	balance, err := attr.Int64()
+	return balance, err == nil
+}
+
+// getPreferences reads the notifications map from a stream image
+func getPreferences(image map[string]events.DynamoDBAttributeValue) map[string]bool {
+	preferences := make(map[string]bool)
+	attr, ok := image["notifications"]
+	if !ok || attr.DataType() != events.DataTypeMap {
+		return preferences
+	}
+	for category, value := range attr.Map() {
+		if value.DataType() == events.DataTypeBoolean {
+			preferences[category] = value.Boolean()
+		}
+	}
+	return preferences
+}
+
+// crossedThreshold reports whether an update moved the balance from above the threshold to at or below it,
+// so users are emailed once per drop rather than on every request
+func crossedThreshold(record events.DynamoDBEventRecord, threshold int64) bool {
+	if record.EventName != string(events.DynamoDBOperationTypeModify) {
+		return false
+	}
+	oldBalance, oldOK := getBalance(record.Change.OldImage)
+	newBalance, newOK := getBalance(record.Change.NewImage)
+	return oldOK && newOK && oldBalance > threshold && newBalance <= threshold
+}
+
+// sendLowBalanceEmail emails the user, with a link to turn these emails off
+func sendLowBalanceEmail(m *mailer.Mailer, email string, userHash string, balance int64) error {
+	body := fmt.Sprintf("You have %d requests left.\n", balance)
+	secret := os.Getenv(notify.EnvUnsubscribeSecret)
+	baseURL := os.Getenv("UNSUBSCRIBE_BASE_URL")
+	if secret != "" && baseURL != "" {
+		body += fmt.Sprintf("\nTo stop receiving low balance emails, open %s\n", notify.UnsubscribeURL(baseURL, secret, userHash, notify.CategoryLowBalance))
+	}
+
+	return m.Send(email, "Your balance is running low", body)
+}
+
+// lowBalanceMailer is created in main, where its sending identity is checked
+var lowBalanceMailer *mailer.Mailer
+
+// HandleRequest consumes the USERS stream, which has to include old and new images,
+// and emails users whose balance dropped to the threshold if they haven't opted out
+func HandleRequest(ctx context.Context, event events.DynamoDBEvent) error {
+	threshold, err := getThreshold()
+	if err != nil {
+		return err
+	}
+
+	for _, record := range event.Records {
+		if !crossedThreshold(record, threshold) {
+			continue
+		}
+
+		image := record.Change.NewImage
+		userHash := image[users.AttrUserHash].String()
+		if !notify.Wants(getPreferences(image), notify.CategoryLowBalance) {
+			fmt.Printf("User %s opted out of low balance emails\n", userHash)
+			continue
+		}
+		emailAttr, ok := image["notification_email"]
+		if !ok || emailAttr.DataType() != events.DataTypeString {
+			fmt.Printf("User %s has no notification email\n", userHash)
+			continue
+		}
+
+		balance, _ := getBalance(image)
+		err := sendLowBalanceEmail(lowBalanceMailer, emailAttr.String(), userHash, balance)
+		if err != nil {
+			// Not retried, a repeated batch could email other users twice
+			fmt.Printf("Failed to send low balance email to user %s: %v\n", userHash, err)
+			continue
+		}
+		fmt.Printf("Sent low balance email to user %s\n", userHash)
+	}
+	return nil
+}
+
+func main() {
+	lowBalanceMailer = mailer.New(session.Must(session.NewSession()), defaultEmailAddress)
+	err := lowBalanceMailer.CheckIdentity()
+	if err != nil {
+		fmt.Printf("Can't send low balance emails: %v", err)
+		os.Exit(1)
+	}
+	lambda.Start(HandleRequest)
+}
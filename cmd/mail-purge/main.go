@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	defaultRetentionDays = 30
+	maxDeleteBatch       = 1000 // DeleteObjects limit
+)
+
+// getRetention reads the retention window from MAILPURGE_RETENTION_DAYS
+func getRetention() (time.Duration, error) {
+	days := defaultRetentionDays
+	if value := os.Getenv("MAILPURGE_RETENTION_DAYS"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return 0, fmt.Errorf("invalid MAILPURGE_RETENTION_DAYS: %q", value)
+		}
+		days = parsed
+	}
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// deleteBatch deletes up to maxDeleteBatch objects and returns how many were deleted
+func deleteBatch(client *s3.S3, bucket string, objects []*s3.ObjectIdentifier) (int, error) {
+	result, err := client.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String(bucket),
+		Delete: &s3.Delete{
+			Objects: objects,
+			Quiet:   aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, deleteErr := range result.Errors {
+		fmt.Printf("Failed to delete %s: %s\n", aws.StringValue(deleteErr.Key), aws.StringValue(deleteErr.Message))
+	}
+	return len(objects) - len(result.Errors), nil
+}
+
+// HandleRequest removes raw mail older than the retention window from the mail bucket.
+// It is meant to run on an EventBridge schedule.
+func HandleRequest(ctx context.Context) error {
+	bucket := os.Getenv("MAILREDIR_S3_BUCKET")
+	if bucket == "" {
+		return fmt.Errorf("mail bucket not found in environment variable MAILREDIR_S3_BUCKET")
+	}
+
+	retention, err := getRetention()
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-retention)
+	fmt.Printf("Purging objects in %s modified before %v\n", bucket, cutoff)
+
+	s3Client := s3.New(session.Must(session.NewSession()))
+
+	var batch []*s3.ObjectIdentifier
+	deleted := 0
+	var deleteErr error
+	err = s3Client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(os.Getenv("MAILPURGE_PREFIX")),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			if object.LastModified == nil || !object.LastModified.Before(cutoff) {
+				continue
+			}
+			batch = append(batch, &s3.ObjectIdentifier{Key: object.Key})
+			if len(batch) == maxDeleteBatch {
+				count, err := deleteBatch(s3Client, bucket, batch)
+				if err != nil {
+					deleteErr = err
+					return false
+				}
+				deleted += count
+				batch = nil
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", err)
+	}
+	if deleteErr != nil {
+		return fmt.Errorf("failed to delete objects: %w", deleteErr)
+	}
+
+	if len(batch) > 0 {
+		count, err := deleteBatch(s3Client, bucket, batch)
+		if err != nil {
+			return fmt.Errorf("failed to delete objects: %w", err)
+		}
+		deleted += count
+	}
+
+	fmt.Printf("Purged %d objects\n", deleted)
+	return nil
+}
+
+func main() {
+	lambda.Start(HandleRequest)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+const (
+	statusTagKey      = "mailredir-status"
+	statusProcessed   = "processed"
+	statusQuarantined = "quarantined"
+	statusSupport     = "support"
+)
+
+// archiveStatus maps the rule that handled an email to the status tag of its raw object
+func archiveStatus(matchedRule string) string {
+	switch matchedRule {
+	case ruleLoop, ruleThrottled:
+		return statusQuarantined
+	case ruleSupport:
+		return statusSupport
+	default:
+		return statusProcessed
+	}
+}
+
+// archiveRawEmail rewrites the raw email object in place with SSE-KMS and a status tag.
+// Bucket lifecycle rules filter on the tag to expire processed and quarantined mail on different schedules.
+func archiveRawEmail(client *s3.S3, bucket string, key string, status string) error {
+	input := &s3.CopyObjectInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(key),
+		CopySource:           aws.String(bucket + "/" + url.PathEscape(key)),
+		ServerSideEncryption: aws.String(s3.ServerSideEncryptionAwsKms),
+		Tagging:              aws.String(url.Values{statusTagKey: []string{status}}.Encode()),
+		TaggingDirective:     aws.String(s3.TaggingDirectiveReplace),
+		MetadataDirective:    aws.String(s3.MetadataDirectiveCopy),
+	}
+	// Without a key ID S3 uses the AWS managed aws/s3 key
+	if keyID := os.Getenv("MAILREDIR_KMS_KEY_ID"); keyID != "" {
+		input.SSEKMSKeyId = aws.String(keyID)
+	}
+
+	_, err := client.CopyObject(input)
+	if err != nil {
+		return fmt.Errorf("failed to archive raw email %s: %w", key, err)
+	}
+	return nil
+}
+
+// finishEmail publishes the summary of a handled email and archives its raw object.
+// Both steps only log failures, the email itself has already been handled.
+func finishEmail(snsClient *sns.SNS, s3Client *s3.S3, bucket string, summary MailSummary) {
+	publishMailSummary(snsClient, summary)
+
+	err := archiveRawEmail(s3Client, bucket, summary.MessageID, archiveStatus(summary.MatchedRule))
+	if err != nil {
+		fmt.Printf("%v\n", err)
+	}
+}
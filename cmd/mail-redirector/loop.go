@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DusanKasan/parsemail"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	defaultStateTable      = "MAIL_REDIRECTOR_STATE"
+	defaultLoopID          = "mail-redirector"
+	defaultSenderRateLimit = 20
+	senderRateWindow       = time.Hour
+	seenMessageTTL         = 24 * time.Hour
+)
+
+// LoopGuard detects mail loops and throttles senders using a small DynamoDB state table with TTL on expires_at
+type LoopGuard struct {
+	client          *dynamodb.DynamoDB
+	tableName       string
+	loopID          string
+	senderRateLimit int
+}
+
+// newLoopGuard reads the loop detection settings from the environment
+func newLoopGuard(client *dynamodb.DynamoDB) (*LoopGuard, error) {
+	guard := &LoopGuard{
+		client:          client,
+		tableName:       os.Getenv("MAILREDIR_STATE_TABLE"),
+		loopID:          os.Getenv("MAILREDIR_LOOP_ID"),
+		senderRateLimit: defaultSenderRateLimit,
+	}
+	if guard.tableName == "" {
+		guard.tableName = defaultStateTable
+	}
+	if guard.loopID == "" {
+		guard.loopID = defaultLoopID
+	}
+	if limit := os.Getenv("MAILREDIR_SENDER_RATE_LIMIT"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAILREDIR_SENDER_RATE_LIMIT: %w", err)
+		}
+		guard.senderRateLimit = value
+	}
+	return guard, nil
+}
+
+// hasLoopHeader checks if the email already went through this redirector
+func (g *LoopGuard) hasLoopHeader(email parsemail.Email) bool {
+	for _, value := range email.Header["X-Loop"] {
+		if strings.EqualFold(strings.TrimSpace(value), g.loopID) {
+			return true
+		}
+	}
+	return false
+}
+
+// addLoopHeader prepends our X-Loop header to the raw email before it is forwarded
+func (g *LoopGuard) addLoopHeader(rawEmail []byte) []byte {
+	return append([]byte("X-Loop: "+g.loopID+"\r\n"), rawEmail...)
+}
+
+// messageSeen checks if an email with the same Message-ID header was forwarded recently
+func (g *LoopGuard) messageSeen(messageID string) (bool, error) {
+	if messageID == "" {
+		return false, nil
+	}
+
+	result, err := g.client.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(g.tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"key": {S: aws.String("message#" + messageID)},
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to look up message ID: %w", err)
+	}
+	if result.Item == nil {
+		return false, nil
+	}
+
+	// DynamoDB TTL deletes expired items lazily
+	expiresAt, err := strconv.ParseInt(aws.StringValue(result.Item["expires_at"].N), 10, 64)
+	return err == nil && expiresAt > time.Now().Unix(), nil
+}
+
+// markMessageSeen records the Message-ID header of a forwarded email.
+// It is only called after a successful forward, so a retried invocation isn't mistaken for a loop.
+func (g *LoopGuard) markMessageSeen(messageID string) error {
+	if messageID == "" {
+		return nil
+	}
+
+	_, err := g.client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(g.tableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			"key":        {S: aws.String("message#" + messageID)},
+			"expires_at": {N: aws.String(strconv.FormatInt(time.Now().Add(seenMessageTTL).Unix(), 10))},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record message ID: %w", err)
+	}
+	return nil
+}
+
+// allowSender counts the email against the sender's hourly limit and returns false once the limit is exceeded
+func (g *LoopGuard) allowSender(sender string) (bool, error) {
+	if g.senderRateLimit <= 0 {
+		return true, nil
+	}
+
+	window := time.Now().Truncate(senderRateWindow)
+	result, err := g.client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(g.tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"key": {S: aws.String(fmt.Sprintf("sender#%s#%d", strings.ToLower(sender), window.Unix()))},
+		},
+		UpdateExpression: aws.String("ADD sent_count :one SET expires_at = :expires"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one":     {N: aws.String("1")},
+			":expires": {N: aws.String(strconv.FormatInt(window.Add(2*senderRateWindow).Unix(), 10))},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueUpdatedNew),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to count sender: %w", err)
+	}
+
+	count, err := strconv.Atoi(aws.StringValue(result.Attributes["sent_count"].N))
+	if err != nil {
+		return false, fmt.Errorf("invalid sender count: %w", err)
+	}
+	return count <= g.senderRateLimit, nil
+}
+
+// removeInboundAddresses drops destinations that are themselves handled by this redirector, forwarding to them would loop
+func removeInboundAddresses(addresses []string, emailMap map[string]string, supportAddresses map[string]bool) []string {
+	var filtered []string
+	for _, address := range addresses {
+		_, inbound := emailMap[address]
+		if inbound || supportAddresses[strings.ToLower(address)] {
+			fmt.Printf("Skipping destination that maps back into the redirector: %v\n", address)
+			continue
+		}
+		filtered = append(filtered, address)
+	}
+	return filtered
+}
@@ -14,7 +14,9 @@ import (
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
 
 )
 
@@ -34,7 +36,19 @@ func getEmailValue(email string, emailMap map[string]string) string {
 	return ""
 }
 
-func HandleRequest(event events.SimpleEmailEvent) error {
+// mailRedirector holds the clients and settings shared by every email of an invocation
+type mailRedirector struct {
+	s3Client         *s3.S3
+	dynamoClient     *dynamodb.DynamoDB
+	snsClient        *sns.SNS
+	mailBucket       string
+	emailMap         map[string]string
+	supportAddresses map[string]bool
+	loopGuard        *LoopGuard
+}
+
+// newMailRedirector reads the configuration and creates the AWS clients
+func newMailRedirector() (*mailRedirector, error) {
 	//Init the e-mail key-value map
 	emailMapJson := os.Getenv("MAILREDIR_EMAIL_MAP")
 	// Define a map to hold the parsed JSON
@@ -43,92 +57,210 @@ func HandleRequest(event events.SimpleEmailEvent) error {
 	// Unmarshal the JSON into the map
 	err := json.Unmarshal([]byte(emailMapJson), &emailMap)
 	if err != nil {
-		return fmt.Errorf("error while parsing EMAIL_MAP: %w", err)
+		return nil, fmt.Errorf("error while parsing EMAIL_MAP: %w", err)
 	}
 
-	mailBucket := os.Getenv("MAILREDIR_S3_BUCKET")
 	// Create AWS SDK configuration and clients
 	cfg := aws.NewConfig()
 	sess, err := session.NewSession(cfg)
 	if err != nil {
-		return fmt.Errorf("could not create session: %w", err)
+		return nil, fmt.Errorf("could not create session: %w", err)
+	}
+
+	dynamoClient := dynamodb.New(sess)
+	loopGuard, err := newLoopGuard(dynamoClient)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mailRedirector{
+		s3Client:         s3.New(sess),
+		dynamoClient:     dynamoClient,
+		snsClient:        sns.New(sess),
+		mailBucket:       os.Getenv("MAILREDIR_S3_BUCKET"),
+		emailMap:         emailMap,
+		supportAddresses: getSupportAddresses(),
+		loopGuard:        loopGuard,
+	}, nil
+}
+
+// HandleRequest processes SES notifications, or replays a single stored email when invoked with a ReplayEvent
+func HandleRequest(payload json.RawMessage) error {
+	redirector, err := newMailRedirector()
+	if err != nil {
+		return err
 	}
 
-	s3Client := s3.New(sess)
+	var replay ReplayEvent
+	err = json.Unmarshal(payload, &replay)
+	if err == nil && replay.ReplayMessageID != "" {
+		return redirector.replayEmail(replay)
+	}
+
+	var event events.SimpleEmailEvent
+	err = json.Unmarshal(payload, &event)
+	if err != nil {
+		return fmt.Errorf("failed to parse SES event: %w", err)
+	}
 
 	for _, record := range event.Records {
 		fmt.Printf("record.SES.Mail.MessageID: %v\n", record.SES.Mail.MessageID)
-		// Retrieve mail contents from S3
-		obj, err := s3Client.GetObject(&s3.GetObjectInput{
-			Bucket: aws.String(mailBucket),
-			Key:    aws.String(record.SES.Mail.MessageID),
-		})
+		err = redirector.processEmail(record.SES.Mail.MessageID, processOptions{})
 		if err != nil {
-			return fmt.Errorf("could not get object: %w", err)
+			return err
 		}
+	}
+
+	return nil
+}
+
+// processEmail fetches the raw email from S3 and forwards it, stores it as a support ticket or drops it
+func (r *mailRedirector) processEmail(messageID string, opts processOptions) error {
+	// Retrieve mail contents from S3
+	obj, err := r.s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(r.mailBucket),
+		Key:    aws.String(messageID),
+	})
+	if err != nil {
+		return fmt.Errorf("could not get object: %w", err)
+	}
+
+	rawEmail, err := io.ReadAll(obj.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("---MAIL PARSER---\n")
+
+	email, err := parsemail.Parse(bytes.NewReader(rawEmail)) // returns Email struct and error
+	if err != nil {
+		return fmt.Errorf("failed to parse email: %w", err)
+	}
 
-		rawEmail, err := io.ReadAll(obj.Body)
+	fmt.Printf("email.From: %v\n", email.From)
+	fmt.Printf("email.Subject: %v\n", email.Subject)
+	fmt.Printf("email.To: %v\n", email.To)
+
+	// Drop emails that already went through the redirector or were seen recently
+	if r.loopGuard.hasLoopHeader(email) {
+		fmt.Printf("Dropping email with our X-Loop header\n")
+		r.finish(opts, newMailSummary(messageID, email, ruleLoop, nil))
+		return nil
+	}
+	// A replayed email was usually forwarded before, so its Message-ID is expected to be known
+	if !opts.replay {
+		seen, err := r.loopGuard.messageSeen(email.MessageID)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
+		if seen {
+			fmt.Printf("Dropping email with recently seen Message-ID: %v\n", email.MessageID)
+			r.finish(opts, newMailSummary(messageID, email, ruleLoop, nil))
+			return nil
+		}
+	}
 
-		fmt.Printf("---MAIL PARSER---\n")
-
-		email, err := parsemail.Parse(bytes.NewReader(rawEmail)) // returns Email struct and error
+	// Emails to support addresses become support tickets instead of being forwarded
+	if isSupportEmail(email, r.supportAddresses) {
+		if opts.dryRun {
+			r.finish(opts, newMailSummary(messageID, email, ruleSupport, nil))
+			return nil
+		}
+		ticketID, err := storeSupportTicket(r.dynamoClient, messageID, email)
 		if err != nil {
-			return fmt.Errorf("failed to parse email: %w", err)
+			return fmt.Errorf("failed to store support ticket: %w", err)
 		}
+		fmt.Printf("Stored support ticket: %v\n", ticketID)
+		r.finish(opts, newMailSummary(messageID, email, ruleSupport, nil))
+		return nil
+	}
 
-		fmt.Printf("email.From: %v\n", email.From)
-		fmt.Printf("email.Subject: %v\n", email.Subject)
-		fmt.Printf("email.To: %v\n", email.To)
-
-		toAddressSlice := []string{}
-		for _, address := range email.To {
-			fmt.Printf("address.Address: %v\n", address.Address)
-			toAddress := getEmailValue(address.Address, emailMap)
-			if toAddress != "" {
-				fmt.Printf("Matched toAddress: %v\n", toAddress)
-				toAddressSlice = append(toAddressSlice, toAddress)
-			}
+	matchedRule := ruleEmailMap
+	toAddressSlice := []string{}
+	for _, address := range email.To {
+		fmt.Printf("address.Address: %v\n", address.Address)
+		toAddress := getEmailValue(address.Address, r.emailMap)
+		if toAddress != "" {
+			fmt.Printf("Matched toAddress: %v\n", toAddress)
+			toAddressSlice = append(toAddressSlice, toAddress)
 		}
+	}
 
-		if len(toAddressSlice) == 0 {
-			toAddress := os.Getenv("MAILREDIR_DEFAULT_TO")
-			fmt.Printf("No matches, using environment variable MAILREDIR_DEFAULT_TO: %v\n", toAddress)
-			if toAddress == "" {
-				toAddress = defaultToEmail
-				fmt.Printf("No environment variable, using default e-mail address: %v\n", toAddress)
-			}
-			toAddressSlice = []string{toAddress}
+	if len(toAddressSlice) == 0 {
+		matchedRule = ruleDefault
+		toAddress := os.Getenv("MAILREDIR_DEFAULT_TO")
+		fmt.Printf("No matches, using environment variable MAILREDIR_DEFAULT_TO: %v\n", toAddress)
+		if toAddress == "" {
+			toAddress = defaultToEmail
+			fmt.Printf("No environment variable, using default e-mail address: %v\n", toAddress)
 		}
+		toAddressSlice = []string{toAddress}
+	}
 
-		fmt.Printf("Final toAddressSlice: %v\n", toAddressSlice)
-		fmt.Printf("---MAIL PARSER---\n")
+	toAddressSlice = removeInboundAddresses(toAddressSlice, r.emailMap, r.supportAddresses)
+	if len(toAddressSlice) == 0 {
+		fmt.Printf("No destinations left after loop check, dropping email\n")
+		r.finish(opts, newMailSummary(messageID, email, ruleLoop, nil))
+		return nil
+	}
 
-		smtpServerHost := os.Getenv("MAILREDIR_SMTP_SERVER_HOST")
-		smtpServerPort := os.Getenv("MAILREDIR_SMTP_SERVER_PORT")
+	fmt.Printf("Final toAddressSlice: %v\n", toAddressSlice)
+	fmt.Printf("---MAIL PARSER---\n")
 
-		// Send the email via SMTP
-		err = smtp.SendMail(smtpServerHost+":"+smtpServerPort, nil, email.From[0].Address, toAddressSlice, rawEmail)
-		if err != nil {
-			return fmt.Errorf("failed to send e-mail: %w", err)
-		}
+	if opts.dryRun {
+		r.finish(opts, newMailSummary(messageID, email, matchedRule, toAddressSlice))
+		return nil
+	}
 
-		/* 			// Delete from bucket if everything worked
-		   			_, err = s3Client.DeleteObject(&s3.DeleteObjectInput{
-		   				Bucket: aws.String(mailBucket),
-		   				Key:    aws.String(record.SES.Mail.MessageID),
-		   			})
-		   			if err != nil {
-		   				return nil, fmt.Errorf("could not delete email from s3: %w", err)
-		   			}
-		*/
+	// Throttle runaway senders such as auto-responders so they can't exhaust the sending quota
+	allowed, err := r.loopGuard.allowSender(email.From[0].Address)
+	if err != nil {
+		return err
 	}
+	if !allowed {
+		fmt.Printf("Sender exceeded forwarding rate limit, dropping email: %v\n", email.From[0].Address)
+		r.finish(opts, newMailSummary(messageID, email, ruleThrottled, nil))
+		return nil
+	}
+
+	smtpServerHost := os.Getenv("MAILREDIR_SMTP_SERVER_HOST")
+	smtpServerPort := os.Getenv("MAILREDIR_SMTP_SERVER_PORT")
+
+	// Send the email via SMTP
+	err = smtp.SendMail(smtpServerHost+":"+smtpServerPort, nil, email.From[0].Address, toAddressSlice, r.loopGuard.addLoopHeader(rawEmail))
+	if err != nil {
+		return fmt.Errorf("failed to send e-mail: %w", err)
+	}
+
+	err = r.loopGuard.markMessageSeen(email.MessageID)
+	if err != nil {
+		fmt.Printf("Failed to record forwarded message: %v\n", err)
+	}
+
+	r.finish(opts, newMailSummary(messageID, email, matchedRule, toAddressSlice))
+
+	/* 			// Delete from bucket if everything worked
+	   			_, err = s3Client.DeleteObject(&s3.DeleteObjectInput{
+	   				Bucket: aws.String(mailBucket),
+	   				Key:    aws.String(record.SES.Mail.MessageID),
+	   			})
+	   			if err != nil {
+	   				return nil, fmt.Errorf("could not delete email from s3: %w", err)
+	   			}
+	*/
 
 	return nil
 }
 
+// finish publishes and archives a handled email, a dry run only prints the summary
+func (r *mailRedirector) finish(opts processOptions, summary MailSummary) {
+	if opts.dryRun {
+		fmt.Printf("Dry run, not publishing or archiving: %+v\n", summary)
+		return
+	}
+	finishEmail(r.snsClient, r.s3Client, r.mailBucket, summary)
+}
+
 func main() {
 	lambda.Start(HandleRequest)
 }
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+)
+
+// ReplayEvent invokes the redirector for one stored email instead of an SES notification,
+// e.g. {"replay_message_id": "...", "dry_run": true}
+type ReplayEvent struct {
+	ReplayMessageID string `json:"replay_message_id"`
+	// DryRun prints what would happen to the email without sending it or writing to DynamoDB, SNS or S3
+	DryRun bool `json:"dry_run"`
+}
+
+// processOptions changes how processEmail treats an email
+type processOptions struct {
+	// replay skips the recently seen check, the email is processed again on purpose
+	replay bool
+	dryRun bool
+}
+
+// replayEmail reprocesses a raw email already in the bucket with the current rules
+func (r *mailRedirector) replayEmail(event ReplayEvent) error {
+	fmt.Printf("Replaying message %v, dry run: %v\n", event.ReplayMessageID, event.DryRun)
+	err := r.processEmail(event.ReplayMessageID, processOptions{replay: true, dryRun: event.DryRun})
+	if err != nil {
+		return fmt.Errorf("failed to replay message %s: %w", event.ReplayMessageID, err)
+	}
+	return nil
+}
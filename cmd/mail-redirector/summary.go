@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/DusanKasan/parsemail"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+const (
+	ruleEmailMap  = "email_map"
+	ruleDefault   = "default"
+	ruleSupport   = "support"
+	ruleLoop      = "loop"
+	ruleThrottled = "throttled"
+)
+
+// MailSummary is published to MAILREDIR_SNS_TOPIC_ARN for every processed email
+type MailSummary struct {
+	MessageID   string   `json:"message_id"`
+	From        string   `json:"from"`
+	To          []string `json:"to"`
+	ForwardedTo []string `json:"forwarded_to,omitempty"`
+	Subject     string   `json:"subject"`
+	MatchedRule string   `json:"matched_rule"`
+	// OrderExtracted stays false until order emails are parsed, it is part of the schema for subscribers
+	OrderExtracted bool `json:"order_extracted"`
+}
+
+// newMailSummary collects the summary fields of a parsed email
+func newMailSummary(messageID string, email parsemail.Email, matchedRule string, forwardedTo []string) MailSummary {
+	summary := MailSummary{
+		MessageID:   messageID,
+		Subject:     email.Subject,
+		MatchedRule: matchedRule,
+		ForwardedTo: forwardedTo,
+	}
+	if len(email.From) > 0 {
+		summary.From = email.From[0].Address
+	}
+	for _, address := range email.To {
+		summary.To = append(summary.To, address.Address)
+	}
+	return summary
+}
+
+// publishMailSummary sends the summary to the SNS topic, if one is configured.
+// Failures are only logged, the email has already been handled at this point.
+func publishMailSummary(client *sns.SNS, summary MailSummary) {
+	topicArn := os.Getenv("MAILREDIR_SNS_TOPIC_ARN")
+	if topicArn == "" {
+		return
+	}
+
+	message, err := json.Marshal(summary)
+	if err != nil {
+		fmt.Printf("Failed to marshal mail summary: %v\n", err)
+		return
+	}
+
+	_, err = client.Publish(&sns.PublishInput{
+		TopicArn: aws.String(topicArn),
+		Message:  aws.String(string(message)),
+		MessageAttributes: map[string]*sns.MessageAttributeValue{
+			"matched_rule": {DataType: aws.String("String"), StringValue: aws.String(summary.MatchedRule)},
+		},
+	})
+	if err != nil {
+		fmt.Printf("Failed to publish mail summary: %v\n", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DusanKasan/parsemail"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	defaultSupportTable = "SUPPORT_TICKETS"
+)
+
+// replyPrefixes matches any run of reply/forward prefixes at the start of a subject
+var replyPrefixes = regexp.MustCompile(`(?i)^((re|fw|fwd|aw|sv)(\[\d+\])?\s*:\s*)+`)
+
+// getSupportAddresses returns the lowercased addresses from MAILREDIR_SUPPORT_ADDRESSES
+func getSupportAddresses() map[string]bool {
+	addresses := make(map[string]bool)
+	for _, address := range strings.Split(os.Getenv("MAILREDIR_SUPPORT_ADDRESSES"), ",") {
+		address = strings.ToLower(strings.TrimSpace(address))
+		if address != "" {
+			addresses[address] = true
+		}
+	}
+	return addresses
+}
+
+// isSupportEmail checks if any recipient of the email is a support address
+func isSupportEmail(email parsemail.Email, supportAddresses map[string]bool) bool {
+	for _, address := range append(email.To, email.Cc...) {
+		if supportAddresses[strings.ToLower(address.Address)] {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeSubject strips reply/forward prefixes and whitespace differences so replies thread with the original email
+func normalizeSubject(subject string) string {
+	subject = replyPrefixes.ReplaceAllString(strings.TrimSpace(subject), "")
+	return strings.ToLower(strings.Join(strings.Fields(subject), " "))
+}
+
+// getTicketID threads emails by sender and normalized subject
+func getTicketID(from string, subject string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(from) + "|" + normalizeSubject(subject)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// storeSupportTicket adds the email as a message to its SUPPORT_TICKETS thread
+func storeSupportTicket(client *dynamodb.DynamoDB, messageID string, email parsemail.Email) (string, error) {
+	tableName := os.Getenv("MAILREDIR_SUPPORT_TABLE")
+	if tableName == "" {
+		tableName = defaultSupportTable
+	}
+
+	from := ""
+	if len(email.From) > 0 {
+		from = email.From[0].Address
+	}
+
+	body := email.TextBody
+	if body == "" {
+		body = email.HTMLBody
+	}
+
+	ticketID := getTicketID(from, email.Subject)
+	_, err := client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			"ticket_id":   {S: aws.String(ticketID)},
+			"message_id":  {S: aws.String(messageID)},
+			"from":        {S: aws.String(from)},
+			"subject":     {S: aws.String(email.Subject)},
+			"body":        {S: aws.String(body)},
+			"received_at": {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+			"status":      {S: aws.String("open")},
+		},
+	})
+	return ticketID, err
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/auth"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/ipfilter"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/notify"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestbody"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestid"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/validation"
+)
+
+const (
+	authTableName = "AUTH"
+)
+
+// PreferencesResponse is returned by the /users/me/notifications endpoints, with the defaults applied
+type PreferencesResponse struct {
+	Email       string          `json:"email,omitempty"`
+	Preferences map[string]bool `json:"preferences"`
+}
+
+func createResponse(statusCode int, body string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Body:       body,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
+
+// getUserHashFromAuth resolves the user behind the bearer auth key, returning an empty hash if the key is unknown
+func getUserHashFromAuth(dynamoClient *dynamodb.DynamoDB, request events.APIGatewayProxyRequest) (string, error) {
+	authKey, ok := auth.BearerToken(request.Headers)
+	if !ok {
+		return "", nil
+	}
+	result, err := dynamoClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(testmode.Table(authTableName)),
+		Key: map[string]*dynamodb.AttributeValue{
+			"key": {S: aws.String(auth.HashKey(authKey))},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get auth key: %w", err)
+	}
+	if result.Item == nil || result.Item["user_hash"] == nil {
+		return "", nil
+	}
+	if expiresAt := result.Item[auth.AttrKeyExpiresAt]; expiresAt != nil && auth.KeyExpired(aws.StringValue(expiresAt.N), time.Now()) {
+		return "", nil
+	}
+	// API keys are limited to their scopes, which don't cover this endpoint
+	if keyType := result.Item[auth.AttrKeyType]; keyType != nil && auth.IsAPIKey(aws.StringValue(keyType.S)) {
+		return "", nil
+	}
+	// Impersonation keys are logged on every use, read-only ones can't change anything
+	if keyType := result.Item[auth.AttrKeyType]; keyType != nil && auth.IsImpersonation(aws.StringValue(keyType.S)) {
+		var mode, impersonatedBy string
+		if attr := result.Item[auth.AttrImpersonationMode]; attr != nil {
+			mode = aws.StringValue(attr.S)
+		}
+		if attr := result.Item[auth.AttrImpersonatedBy]; attr != nil {
+			impersonatedBy = aws.StringValue(attr.S)
+		}
+		fmt.Printf("%s impersonation by %s: %s %s\n", mode, impersonatedBy, request.HTTPMethod, request.Path)
+		if auth.ReadOnly(auth.KeyTypeImpersonation, mode) && !auth.SafeMethod(request.HTTPMethod) {
+			return "", nil
+		}
+	}
+	return aws.StringValue(result.Item["user_hash"].S), nil
+}
+
+// loadUser returns the USERS item, or false if the user doesn't exist
+func loadUser(dynamoClient *dynamodb.DynamoDB, userHash string) (users.User, bool, error) {
+	result, err := dynamoClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(users.Table()),
+		Key: map[string]*dynamodb.AttributeValue{
+			users.AttrUserHash: {S: aws.String(userHash)},
+		},
+	})
+	if err != nil {
+		return users.User{}, false, fmt.Errorf("failed to load user: %w", err)
+	}
+	if result.Item == nil {
+		return users.User{}, false, nil
+	}
+	var user users.User
+	err = dynamodbattribute.UnmarshalMap(result.Item, &user)
+	return user, true, err
+}
+
+// setPreferences stores explicit preferences in the notifications map of an existing user
+func setPreferences(dynamoClient *dynamodb.DynamoDB, userHash string, preferences map[string]bool) error {
+	key := map[string]*dynamodb.AttributeValue{
+		users.AttrUserHash: {S: aws.String(userHash)},
+	}
+
+	// Nested map paths can only be set once the map exists
+	_, err := dynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(users.Table()),
+		Key:                 key,
+		UpdateExpression:    aws.String("SET notifications = if_not_exists(notifications, :empty)"),
+		ConditionExpression: aws.String("attribute_exists(user_hash)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":empty": {M: map[string]*dynamodb.AttributeValue{}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	var assignments []string
+	names := map[string]*string{}
+	values := map[string]*dynamodb.AttributeValue{}
+	i := 0
+	for category, enabled := range preferences {
+		assignments = append(assignments, fmt.Sprintf("notifications.#c%d = :v%d", i, i))
+		names[fmt.Sprintf("#c%d", i)] = aws.String(category)
+		values[fmt.Sprintf(":v%d", i)] = &dynamodb.AttributeValue{BOOL: aws.Bool(enabled)}
+		i++
+	}
+	_, err = dynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(users.Table()),
+		Key:                       key,
+		UpdateExpression:          aws.String("SET " + strings.Join(assignments, ", ")),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	return err
+}
+
+// effectivePreferences returns every category with the user's choice or the default
+func effectivePreferences(user users.User) map[string]bool {
+	preferences := make(map[string]bool)
+	for category := range notify.Defaults {
+		preferences[category] = notify.Wants(user.Notifications, category)
+	}
+	return preferences
+}
+
+func unsubscribe(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userHash := request.QueryStringParameters["user"]
+	category := request.QueryStringParameters["category"]
+	token := request.QueryStringParameters["token"]
+
+	secret := os.Getenv(notify.EnvUnsubscribeSecret)
+	if secret == "" {
+		fmt.Printf("%s is not set\n", notify.EnvUnsubscribeSecret)
+		return createResponse(http.StatusInternalServerError, "Unsubscribe is not configured"), nil
+	}
+	if !notify.ValidCategory(category) || !notify.VerifyUnsubscribeToken(secret, userHash, category, token) {
+		return createResponse(http.StatusForbidden, "Invalid unsubscribe link"), nil
+	}
+
+	dynamoClient := dynamodb.New(session.Must(session.NewSession()))
+	err := setPreferences(dynamoClient, userHash, map[string]bool{category: false})
+	var conditionErr *dynamodb.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return createResponse(http.StatusNotFound, "User not found"), nil
+	}
+	if err != nil {
+		fmt.Printf("failed to unsubscribe: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to unsubscribe"), nil
+	}
+
+	return createResponse(http.StatusOK, fmt.Sprintf(`{"message":"Unsubscribed from %s emails"}`, category)), nil
+}
+
+func getPreferences(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	dynamoClient := dynamodb.New(session.Must(session.NewSession()))
+	userHash, err := getUserHashFromAuth(dynamoClient, request)
+	if err != nil {
+		fmt.Printf("failed to resolve user: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to resolve user"), nil
+	}
+	if userHash == "" {
+		return createResponse(http.StatusUnauthorized, "Invalid auth key"), nil
+	}
+
+	user, found, err := loadUser(dynamoClient, userHash)
+	if err != nil {
+		fmt.Printf("failed to load user: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to load user"), nil
+	}
+	if !found {
+		return createResponse(http.StatusNotFound, "User not found"), nil
+	}
+
+	return preferencesResponse(user)
+}
+
+func updatePreferences(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var preferences map[string]bool
+	err := json.Unmarshal([]byte(request.Body), &preferences)
+	if err != nil {
+		fmt.Printf("failed to unmarshal request: %v", err)
+		return createResponse(http.StatusBadRequest, "Invalid request body"), nil
+	}
+
+	var validationErrs validation.Errors
+	if len(preferences) == 0 {
+		validationErrs.Add("", validation.RuleRequired, "at least one preference is required")
+	}
+	for category := range preferences {
+		if !notify.ValidCategory(category) {
+			validationErrs.Add(category, validation.RuleOneOf, fmt.Sprintf("%s is not a notification category", category))
+		}
+	}
+	if err := validationErrs.Err(); err != nil {
+		fmt.Printf("invalid preferences: %v\n", err)
+		return createResponse(http.StatusUnprocessableEntity, validationErrs.Body()), nil
+	}
+
+	dynamoClient := dynamodb.New(session.Must(session.NewSession()))
+	userHash, err := getUserHashFromAuth(dynamoClient, request)
+	if err != nil {
+		fmt.Printf("failed to resolve user: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to resolve user"), nil
+	}
+	if userHash == "" {
+		return createResponse(http.StatusUnauthorized, "Invalid auth key"), nil
+	}
+
+	err = setPreferences(dynamoClient, userHash, preferences)
+	var conditionErr *dynamodb.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return createResponse(http.StatusNotFound, "User not found"), nil
+	}
+	if err != nil {
+		fmt.Printf("failed to store preferences: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to store preferences"), nil
+	}
+
+	user, _, err := loadUser(dynamoClient, userHash)
+	if err != nil {
+		fmt.Printf("failed to load user: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to load user"), nil
+	}
+	return preferencesResponse(user)
+}
+
+func preferencesResponse(user users.User) (events.APIGatewayProxyResponse, error) {
+	jsonResponse, err := json.Marshal(PreferencesResponse{
+		Email:       user.NotificationEmail,
+		Preferences: effectivePreferences(user),
+	})
+	if err != nil {
+		fmt.Printf("failed to marshal response: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to create response"), nil
+	}
+	return createResponse(http.StatusOK, string(jsonResponse)), nil
+}
+
+func main() {
+	filter, err := ipfilter.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load IP filter configuration: %v", err)
+		os.Exit(1)
+	}
+	limits, err := requestbody.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load body limits: %v", err)
+		os.Exit(1)
+	}
+	lambda.Start(requestid.Middleware(ipfilter.Middleware(filter, requestbody.Middleware(limits, handleRequest))))
+}
+
+// handleRequest routes notification preference requests
+func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Remove trailing slash from path if present
+	path := strings.TrimSuffix(request.Path, "/")
+
+	switch {
+	case request.HTTPMethod == "GET" && path == "/unsubscribe":
+		return unsubscribe(request)
+	case request.HTTPMethod == "GET" && path == "/users/me/notifications":
+		return getPreferences(request)
+	case request.HTTPMethod == "PUT" && path == "/users/me/notifications":
+		return updatePreferences(request)
+	default:
+		return createResponse(http.StatusNotFound, "Not Found"), fmt.Errorf("unknown endpoint: %s %s", request.HTTPMethod, request.Path)
+	}
+}
@@ -8,14 +8,21 @@ import (
 	"io"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/apigatewaymanagementapi"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/auth"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/connlimit"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/prompts"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestbody"
 
 )
 
@@ -23,6 +30,9 @@ const (
 	defaultModel          = "gpt-3.5-turbo"
 	statusCodeOK          = 200
 	statusCodeBadRequest  = 400
+	statusCodeConflict    = 409
+	statusCodeTooLarge    = 413
+	statusCodeThrottled   = 429
 	statusCodeServerError = 500
 	connectRouteKey       = "$connect"
 	disconnectRouteKey    = "$disconnect"
@@ -31,6 +41,9 @@ const (
 	responseTypeFull      = "full"
 	responseTypeStream    = "stream"
 	endStreamMessage      = "<END>"
+	busyMessage           = "<BUSY>"
+	inFlightTimeout       = 15 * time.Minute // maximum Lambda run time
+	defaultConnectionTTL  = 2 * time.Hour    // maximum API Gateway websocket connection duration
 )
 
 type chatMessage struct {
@@ -58,6 +71,10 @@ type Config struct {
 	OpenAIKey          string
 	OpenAIModel        string
 	APIGatewayEndpoint string
+	ConnectionsTable   string
+	ConnectionTTL      time.Duration
+	// ConnectionLimits cap the size and rate of the messages a connection sends, the rate needs ConnectionsTable
+	ConnectionLimits connlimit.Limits
 }
 
 var config Config // Global configuration variable
@@ -107,6 +124,7 @@ func loadConfig() (Config, error) {
 		OpenAIKey:          os.Getenv("OPENAI_API_KEY"),
 		OpenAIModel:        os.Getenv("OPENAI_MODEL"),
 		APIGatewayEndpoint: os.Getenv("API_GW_ENDPOINT"),
+		ConnectionsTable:   os.Getenv("WS_CONNECTIONS_TABLE"),
 	}
 
 	if cfg.OpenAIKey == "" {
@@ -121,6 +139,21 @@ func loadConfig() (Config, error) {
 		return cfg, fmt.Errorf("API Gateway Endpoint not found in environment variable API_GW_ENDPOINT")
 	}
 
+	cfg.ConnectionTTL = defaultConnectionTTL
+	if ttl := os.Getenv("WS_CONNECTION_TTL"); ttl != "" {
+		duration, err := time.ParseDuration(ttl)
+		if err != nil || duration <= 0 {
+			return cfg, fmt.Errorf("invalid duration in environment variable WS_CONNECTION_TTL: %q", ttl)
+		}
+		cfg.ConnectionTTL = duration
+	}
+
+	limits, err := connlimit.LoadFromEnv()
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ConnectionLimits = limits
+
 	return cfg, nil
 }
 
@@ -137,27 +170,66 @@ func Handler(ctx context.Context, request events.APIGatewayWebsocketProxyRequest
 	routeKey := request.RequestContext.RouteKey
 	switch routeKey {
 	case connectRouteKey, disconnectRouteKey:
-		return handleConnection(routeKey)
+		return handleConnection(routeKey, request.Headers)
 	default:
 		return handleRequest(request)
 	}
 }
 
-// handleConnection handles connection and disconnection events
-func handleConnection(routeKey string) (events.APIGatewayProxyResponse, error) {
-	return events.APIGatewayProxyResponse{StatusCode: statusCodeOK}, nil
+// handleConnection handles connection and disconnection events, echoing back the selected subprotocol if any
+func handleConnection(routeKey string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	return events.APIGatewayProxyResponse{StatusCode: statusCodeOK, Headers: auth.ResponseHeaders(headers)}, nil
 }
 
 // handleRequest handles requests other than connection/disconnection
 func handleRequest(request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
-	reqBody, err := parseRequestBody(request.Body)
+	// Binary frames arrive base64 encoded
+	body, err := requestbody.DecodeBase64(request.Body, request.IsBase64Encoded)
 	if err != nil {
-		return errorResponse(fmt.Sprintf("Error parsing request JSON: %s", err), statusCodeBadRequest)
+		return errorResponse(fmt.Sprintf("Error decoding request body: %s", err), statusCodeBadRequest)
 	}
 
 	apiGatewayClient := getAPIGatewayClient()
+	if throttle, tooLarge := config.ConnectionLimits.CheckSize(len(body)); tooLarge {
+		return throttledResponse(apiGatewayClient, request.RequestContext.ConnectionID, throttle, statusCodeTooLarge)
+	}
+
+	reqBody, err := parseRequestBody(string(body))
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Error parsing request JSON: %s", err), statusCodeBadRequest)
+	}
+
 	openAIReq := createOpenAIRequest(reqBody, apiGatewayClient, request.RequestContext.ConnectionID)
 
+	// Reject a second request while a response is still being sent on the same connection
+	if config.ConnectionsTable != "" {
+		dynamoClient := dynamodb.New(session.Must(session.NewSession()))
+		if config.ConnectionLimits.MessagesPerMinute > 0 {
+			now := time.Now()
+			allowed, err := countMessage(dynamoClient, request.RequestContext.ConnectionID, now)
+			if err != nil {
+				fmt.Printf("Can't count message, not rate limiting it: %v\n", err)
+			} else if !allowed {
+				return throttledResponse(apiGatewayClient, request.RequestContext.ConnectionID, config.ConnectionLimits.RateLimited(now), statusCodeThrottled)
+			}
+		}
+		acquired, err := markRequestInFlight(dynamoClient, request.RequestContext.ConnectionID)
+		if err != nil {
+			return errorResponse(fmt.Sprintf("Error marking request in flight: %s", err), statusCodeServerError)
+		}
+		if !acquired {
+			_, err = apiGatewayClient.PostToConnection(&apigatewaymanagementapi.PostToConnectionInput{
+				ConnectionId: aws.String(request.RequestContext.ConnectionID),
+				Data:         []byte(busyMessage),
+			})
+			if err != nil {
+				return errorResponse(fmt.Sprintf("Can't post busy message to websocket: %s", err), statusCodeServerError)
+			}
+			return errorResponse("Connection busy", statusCodeConflict)
+		}
+		defer clearRequestInFlight(dynamoClient, request.RequestContext.ConnectionID)
+	}
+
 	var handlerFunc func(openAIRequest) error
 	switch reqBody.ResponseType {
 	case "int":
@@ -179,6 +251,112 @@ func handleRequest(request events.APIGatewayWebsocketProxyRequest) (events.APIGa
 	return events.APIGatewayProxyResponse{StatusCode: statusCodeOK}, nil
 }
 
+// markRequestInFlight flags the connection as busy in the connections table.
+// It returns false if another request holds the flag and the flag is younger than the maximum Lambda run time.
+// The item gets an expires_at so DynamoDB TTL removes it if the invocation crashes before clearing it.
+func markRequestInFlight(client *dynamodb.DynamoDB, connectionID string) (bool, error) {
+	now := time.Now()
+	_, err := client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(config.ConnectionsTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"connection_id": {S: aws.String(connectionID)},
+		},
+		UpdateExpression:    aws.String("SET in_flight = :now, expires_at = :expires"),
+		ConditionExpression: aws.String("attribute_not_exists(in_flight) OR in_flight < :stale"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now":     {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+			":stale":   {N: aws.String(strconv.FormatInt(now.Add(-inFlightTimeout).Unix(), 10))},
+			":expires": {N: aws.String(strconv.FormatInt(now.Add(config.ConnectionTTL).Unix(), 10))},
+		},
+	})
+	var conditionErr *dynamodb.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// clearRequestInFlight removes the busy flag set by markRequestInFlight. The item keeps the message count
+// of the connection and is removed by DynamoDB TTL.
+func clearRequestInFlight(client *dynamodb.DynamoDB, connectionID string) {
+	_, err := client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(config.ConnectionsTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"connection_id": {S: aws.String(connectionID)},
+		},
+		UpdateExpression: aws.String("REMOVE in_flight"),
+	})
+	if err != nil {
+		fmt.Printf("Error clearing request in flight: %v\n", err)
+	}
+}
+
+// countMessage counts a message in the connection's current rate window and returns false once the connection
+// sent ConnectionLimits.MessagesPerMinute messages in the window
+func countMessage(client *dynamodb.DynamoDB, connectionID string, now time.Time) (bool, error) {
+	key := map[string]*dynamodb.AttributeValue{
+		"connection_id": {S: aws.String(connectionID)},
+	}
+	names := map[string]*string{
+		"#window": aws.String(connlimit.AttrWindow),
+		"#count":  aws.String(connlimit.AttrCount),
+	}
+	values := map[string]*dynamodb.AttributeValue{
+		":window":  {N: aws.String(strconv.FormatInt(connlimit.WindowStart(now), 10))},
+		":one":     {N: aws.String("1")},
+		":limit":   {N: aws.String(strconv.FormatInt(config.ConnectionLimits.MessagesPerMinute, 10))},
+		":expires": {N: aws.String(strconv.FormatInt(now.Add(config.ConnectionTTL).Unix(), 10))},
+	}
+
+	// Count the message in the current window, or start a new window if the stored one is over
+	_, err := client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(config.ConnectionsTable),
+		Key:                       key,
+		UpdateExpression:          aws.String("SET #count = #count + :one, expires_at = :expires"),
+		ConditionExpression:       aws.String("#window = :window AND #count < :limit"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	var conditionErr *dynamodb.ConditionalCheckFailedException
+	if !errors.As(err, &conditionErr) {
+		return err == nil, err
+	}
+	// DynamoDB rejects unused expression values
+	delete(values, ":limit")
+	_, err = client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(config.ConnectionsTable),
+		Key:                       key,
+		UpdateExpression:          aws.String("SET #window = :window, #count = :one, expires_at = :expires"),
+		ConditionExpression:       aws.String("attribute_not_exists(#window) OR #window < :window"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	if errors.As(err, &conditionErr) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// throttledResponse refuses a message over the connection's limits with a throttled frame
+func throttledResponse(apiGatewayClient *apigatewaymanagementapi.ApiGatewayManagementApi, connectionID string, throttle connlimit.Throttle, statusCode int) (events.APIGatewayProxyResponse, error) {
+	fmt.Printf("Throttling message on connection %s: %s\n", connectionID, throttle.Reason)
+	data, err := json.Marshal(connlimit.Frame{Type: connlimit.FrameType, Throttle: throttle})
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Can't marshal throttle frame: %s", err), statusCodeServerError)
+	}
+	_, err = apiGatewayClient.PostToConnection(&apigatewaymanagementapi.PostToConnectionInput{
+		ConnectionId: aws.String(connectionID),
+		Data:         data,
+	})
+	if err != nil {
+		fmt.Printf("Can't post throttle frame to websocket: %v\n", err)
+	}
+	return errorResponse(fmt.Sprintf("Message throttled: %s", throttle.Reason), statusCode)
+}
+
 // parseRequestBody parses the request body from JSON to Request struct
 func parseRequestBody(body string) (Request, error) {
 	var reqBody Request
@@ -260,10 +438,11 @@ func initOpenAIRequest(promptEnvVariable string, chatMessages []chatMessage) (op
 		return openai.ChatCompletionResponse{}, fmt.Errorf("Can't get the OpenAI model: %v", err)
 	}
 
-	// Get the value of the promptEnvVariable environment variable to use as a system prompt in the API request
-	promptTemplate := os.Getenv(promptEnvVariable)
-	if promptTemplate == "" {
-		return openai.ChatCompletionResponse{}, fmt.Errorf("Prompt not found in the environment variable %s", promptEnvVariable)
+	// Get the value of the allowlisted promptEnvVariable environment variable to use as a system prompt in the API request
+	promptTemplate, err := prompts.Lookup(promptEnvVariable)
+	if err != nil {
+		fmt.Printf("rejected prompt template [%s]: %v\n", promptEnvVariable, err)
+		return openai.ChatCompletionResponse{}, fmt.Errorf("Can't use the prompt template: %v", err)
 	}
 
 	//Add prompt from environment variable as default system prompt
@@ -302,10 +481,11 @@ func initOpenAIStream(promptEnvVariable string, chatMessages []chatMessage) (*op
 		return nil, fmt.Errorf("Can't get the OpenAI model: %v", err)
 	}
 
-	// Get the value of the promptEnvVariable environment variable to use as a system prompt in the API request
-	promptTemplate := os.Getenv(promptEnvVariable)
-	if promptTemplate == "" {
-		return nil, fmt.Errorf("Prompt not found in the environment variable %s", promptEnvVariable)
+	// Get the value of the allowlisted promptEnvVariable environment variable to use as a system prompt in the API request
+	promptTemplate, err := prompts.Lookup(promptEnvVariable)
+	if err != nil {
+		fmt.Printf("rejected prompt template [%s]: %v\n", promptEnvVariable, err)
+		return nil, fmt.Errorf("Can't use the prompt template: %v", err)
 	}
 
 	//Add prompt from environment variable as default system prompt
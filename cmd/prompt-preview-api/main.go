@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/ipfilter"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/prompts"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestbody"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestid"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/shedding"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/validation"
+)
+
+const (
+	defaultAnthropicModel   = "claude-3-5-sonnet-2024062"
+	defaultAnthropicVersion = "2023-06-01"
+	// maxPreviewTokens caps preview calls, they are not billed to anyone
+	maxPreviewTokens = 256
+)
+
+// Message is a conversation message, the same shape the websocket proxies accept
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// PreviewRequest selects a template, either by the environment variable it is stored in or as draft text
+type PreviewRequest struct {
+	PromptTemplate string            `json:"prompt_template"`
+	TemplateText   string            `json:"template_text"`
+	Parameters     map[string]string `json:"parameters"`
+	Messages       []Message         `json:"messages"`
+	Run            bool              `json:"run"`
+	Model          string            `json:"model"`
+	MaxTokens      int               `json:"max_tokens"`
+}
+
+// PreviewResponse holds the rendered prompt and, if the request asked for it, the Anthropic response
+type PreviewResponse struct {
+	RenderedPrompt string        `json:"rendered_prompt"`
+	Missing        []string      `json:"missing_parameters,omitempty"`
+	Model          string        `json:"model,omitempty"`
+	Response       string        `json:"response,omitempty"`
+	Usage          *PreviewUsage `json:"usage,omitempty"`
+}
+
+// PreviewUsage is the token usage of the preview call
+type PreviewUsage struct {
+	InputTokens  int64 `json:"input_tokens"`
+	OutputTokens int64 `json:"output_tokens"`
+}
+
+func createResponse(statusCode int, body string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Body:       body,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
+
+// renderTemplate replaces {{name}} placeholders with parameters and returns the placeholders left without a value
+func renderTemplate(template string, parameters map[string]string) (string, []string) {
+	for name, value := range parameters {
+		template = strings.ReplaceAll(template, "{{"+name+"}}", value)
+	}
+
+	var missing []string
+	rest := template
+	for {
+		start := strings.Index(rest, "{{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(rest[start:], "}}")
+		if end < 0 {
+			break
+		}
+		missing = append(missing, rest[start+2:start+end])
+		rest = rest[start+end+2:]
+	}
+	return template, missing
+}
+
+// callAnthropic sends a single non-streamed request and returns the text of the response
+func callAnthropic(ctx context.Context, model string, system string, messages []Message, maxTokens int) (string, PreviewUsage, error) {
+	requestBody, err := json.Marshal(map[string]any{
+		"model":      model,
+		"max_tokens": maxTokens,
+		"system":     system,
+		"messages":   messages,
+	})
+	if err != nil {
+		return "", PreviewUsage{}, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", os.Getenv("ANTHROPIC_URL"), bytes.NewReader(requestBody))
+	if err != nil {
+		return "", PreviewUsage{}, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	version := os.Getenv("ANTHROPIC_VERSION")
+	if version == "" {
+		version = defaultAnthropicVersion
+	}
+	// ANTHROPIC_KEY may hold a comma-separated key pool, the preview only needs the first key
+	apiKey, _, _ := strings.Cut(os.Getenv("ANTHROPIC_KEY"), ",")
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("X-API-Key", strings.TrimSpace(apiKey))
+	httpReq.Header.Set("anthropic-version", version)
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return "", PreviewUsage{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", PreviewUsage{}, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", PreviewUsage{}, fmt.Errorf("anthropic returned %d: %s", resp.StatusCode, body)
+	}
+
+	var anthropicResp struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+		Usage PreviewUsage `json:"usage"`
+	}
+	err = json.Unmarshal(body, &anthropicResp)
+	if err != nil {
+		return "", PreviewUsage{}, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	var text strings.Builder
+	for _, block := range anthropicResp.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+	return text.String(), anthropicResp.Usage, nil
+}
+
+func previewPrompt(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var previewReq PreviewRequest
+	err := json.Unmarshal([]byte(request.Body), &previewReq)
+	if err != nil {
+		fmt.Printf("failed to unmarshal request: %v", err)
+		return createResponse(http.StatusBadRequest, "Invalid request body"), nil
+	}
+
+	// Templates are stored in environment variables named after the prompt template, like in the proxies
+	template := previewReq.TemplateText
+	if template == "" && previewReq.PromptTemplate != "" {
+		template, err = prompts.Lookup(previewReq.PromptTemplate)
+		if err != nil {
+			fmt.Printf("rejected prompt template [%s]: %v\n", previewReq.PromptTemplate, err)
+		}
+	}
+
+	var validationErrs validation.Errors
+	if template == "" {
+		validationErrs.Add("prompt_template", validation.RuleRequired, "prompt_template must name an allowlisted stored template, or template_text must be set")
+	}
+	if previewReq.Run && len(previewReq.Messages) == 0 {
+		validationErrs.Add("messages", validation.RuleRequired, "messages must contain at least one message to run the prompt")
+	}
+	for i, msg := range previewReq.Messages {
+		validationErrs.OneOf(fmt.Sprintf("messages[%d].role", i), msg.Role, "user", "assistant")
+	}
+	if err := validationErrs.Err(); err != nil {
+		fmt.Printf("invalid preview request: %v\n", err)
+		return createResponse(http.StatusUnprocessableEntity, validationErrs.Body()), nil
+	}
+
+	rendered, missing := renderTemplate(template, previewReq.Parameters)
+	response := PreviewResponse{
+		RenderedPrompt: rendered,
+		Missing:        missing,
+	}
+
+	if previewReq.Run {
+		response.Model = previewReq.Model
+		if response.Model == "" {
+			response.Model = os.Getenv("ANTHROPIC_MODEL")
+		}
+		if response.Model == "" {
+			response.Model = defaultAnthropicModel
+		}
+		maxTokens := previewReq.MaxTokens
+		if maxTokens <= 0 || maxTokens > maxPreviewTokens {
+			maxTokens = maxPreviewTokens
+		}
+
+		text, usage, err := callAnthropic(ctx, response.Model, rendered, previewReq.Messages, maxTokens)
+		if err != nil {
+			fmt.Printf("failed to run prompt preview: %v\n", err)
+			return createResponse(http.StatusBadGateway, "Failed to run prompt"), nil
+		}
+		response.Response = text
+		response.Usage = &usage
+	}
+
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		fmt.Printf("failed to marshal response: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to create response"), nil
+	}
+
+	return createResponse(http.StatusOK, string(jsonResponse)), nil
+}
+
+func main() {
+	filter, err := ipfilter.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load IP filter configuration: %v", err)
+		os.Exit(1)
+	}
+	shedder, err := shedding.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load latency budgets: %v", err)
+		os.Exit(1)
+	}
+	limits, err := requestbody.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load body limits: %v", err)
+		os.Exit(1)
+	}
+	handler := ipfilter.Middleware(filter, requestbody.Middleware(limits, handleRequest))
+	lambda.Start(requestid.Middleware(shedding.Middleware(shedder, handler)))
+}
+
+// handleRequest routes admin prompt requests, access is restricted with IAM auth on the API Gateway route
+func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Remove trailing slash from path if present
+	path := strings.TrimSuffix(request.Path, "/")
+
+	switch {
+	case request.HTTPMethod == "POST" && path == "/admin/prompts/preview":
+		return previewPrompt(ctx, request)
+	default:
+		return createResponse(http.StatusNotFound, "Not Found"), fmt.Errorf("unknown endpoint: %s %s", request.HTTPMethod, request.Path)
+	}
+}
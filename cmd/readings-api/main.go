@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	awsLambda "github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/auth"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/prompts"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/quota"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestbody"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestid"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/validation"
+)
+
+const (
+	authTableName        = "AUTH"
+	defaultJobsTableName = "READING_JOBS"
+	envJobsTable         = "READING_JOBS_TABLE"
+	readingsPath         = "/readings"
+	// jobTTL is how long finished jobs can be fetched before DynamoDB TTL removes them
+	jobTTL = 7 * 24 * time.Hour
+
+	jobStatusPending   = "pending"
+	jobStatusRunning   = "running"
+	jobStatusCompleted = "completed"
+	jobStatusFailed    = "failed"
+)
+
+// quotaPolicy decides whether the user may start a reading and how much it costs
+var quotaPolicy = quota.DefaultPolicy()
+
+// Message is a message of the reading conversation, as the websocket proxy takes it
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// ReadingRequest is the body of POST /readings
+type ReadingRequest struct {
+	PromptTemplate string    `json:"prompt_template"`
+	Messages       []Message `json:"messages"`
+	// CallbackURL receives the finished job signed with the webhook secret, see pkg/webhook.
+	// Without it the client polls GET /readings/{job_id}.
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+
+// Job is a reading job as stored in READING_JOBS and returned to the client
+type Job struct {
+	JobID          string    `json:"job_id" dynamodbav:"job_id"`
+	UserHash       string    `json:"-" dynamodbav:"user_hash"`
+	Status         string    `json:"status" dynamodbav:"status"`
+	PromptTemplate string    `json:"prompt_template" dynamodbav:"prompt_template"`
+	Messages       []Message `json:"-" dynamodbav:"messages"`
+	CallbackURL    string    `json:"callback_url,omitempty" dynamodbav:"callback_url,omitempty"`
+	Text           string    `json:"text,omitempty" dynamodbav:"text,omitempty"`
+	Error          string    `json:"error,omitempty" dynamodbav:"error,omitempty"`
+	InputTokens    int64     `json:"input_tokens,omitempty" dynamodbav:"input_tokens,omitempty"`
+	OutputTokens   int64     `json:"output_tokens,omitempty" dynamodbav:"output_tokens,omitempty"`
+	CreatedAt      int64     `json:"created_at" dynamodbav:"created_at"`
+	CompletedAt    int64     `json:"completed_at,omitempty" dynamodbav:"completed_at,omitempty"`
+	// CallbackStatus is "delivered" or "failed" once the callback was attempted
+	CallbackStatus string `json:"callback_status,omitempty" dynamodbav:"callback_status,omitempty"`
+	ExpiresAt      int64  `json:"-" dynamodbav:"expires_at"`
+	TestRecord     bool   `json:"-" dynamodbav:"test_record,omitempty"`
+}
+
+// ReadingJob is the payload of the asynchronous invocation that runs a job
+type ReadingJob struct {
+	JobID string `json:"reading_job_id"`
+}
+
+func createResponse(statusCode int, body string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Body:       body,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
+
+// jobsTable returns the READING_JOBS table name
+func jobsTable() string {
+	tableName := os.Getenv(envJobsTable)
+	if tableName == "" {
+		tableName = defaultJobsTableName
+	}
+	return testmode.Table(tableName)
+}
+
+// getUserHashFromAuth resolves the user behind the bearer auth key, returning an empty hash if the key is unknown.
+// API keys need the chat scope.
+func getUserHashFromAuth(dynamoClient *dynamodb.DynamoDB, request events.APIGatewayProxyRequest) (string, error) {
+	authKey, ok := auth.BearerToken(request.Headers)
+	if !ok {
+		return "", nil
+	}
+	result, err := dynamoClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(testmode.Table(authTableName)),
+		Key: map[string]*dynamodb.AttributeValue{
+			"key": {S: aws.String(auth.HashKey(authKey))},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get auth key: %w", err)
+	}
+	if result.Item == nil || result.Item["user_hash"] == nil {
+		return "", nil
+	}
+	if expiresAt := result.Item[auth.AttrKeyExpiresAt]; expiresAt != nil && auth.KeyExpired(aws.StringValue(expiresAt.N), time.Now()) {
+		return "", nil
+	}
+	if keyType := result.Item[auth.AttrKeyType]; keyType != nil && auth.IsAPIKey(aws.StringValue(keyType.S)) {
+		var scopes []string
+		if attr := result.Item[auth.AttrScopes]; attr != nil {
+			scopes = aws.StringValueSlice(attr.SS)
+		}
+		if !auth.HasScope(scopes, auth.ScopeChat) {
+			return "", nil
+		}
+	}
+	// Impersonation keys are logged on every use, read-only ones can't change anything
+	if keyType := result.Item[auth.AttrKeyType]; keyType != nil && auth.IsImpersonation(aws.StringValue(keyType.S)) {
+		var mode, impersonatedBy string
+		if attr := result.Item[auth.AttrImpersonationMode]; attr != nil {
+			mode = aws.StringValue(attr.S)
+		}
+		if attr := result.Item[auth.AttrImpersonatedBy]; attr != nil {
+			impersonatedBy = aws.StringValue(attr.S)
+		}
+		fmt.Printf("%s impersonation by %s: %s %s\n", mode, impersonatedBy, request.HTTPMethod, request.Path)
+		if auth.ReadOnly(auth.KeyTypeImpersonation, mode) && !auth.SafeMethod(request.HTTPMethod) {
+			return "", nil
+		}
+	}
+	return aws.StringValue(result.Item["user_hash"].S), nil
+}
+
+// loadUser returns the USERS item, or false if the user doesn't exist
+func loadUser(dynamoClient *dynamodb.DynamoDB, userHash string) (users.User, bool, error) {
+	result, err := dynamoClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(users.Table()),
+		Key: map[string]*dynamodb.AttributeValue{
+			users.AttrUserHash: {S: aws.String(userHash)},
+		},
+	})
+	if err != nil {
+		return users.User{}, false, fmt.Errorf("failed to load user: %w", err)
+	}
+	if result.Item == nil {
+		return users.User{}, false, nil
+	}
+	var user users.User
+	err = dynamodbattribute.UnmarshalMap(result.Item, &user)
+	return user, true, err
+}
+
+// validCallbackURL reports whether the callback can be delivered to rawURL. Only https host names are
+// accepted, the addresses they resolve to are checked when the callback is delivered, see refuseInternalAddress.
+func validCallbackURL(rawURL string) bool {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Scheme != "https" || parsed.Hostname() == "" || parsed.User != nil {
+		return false
+	}
+	host := strings.ToLower(parsed.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") || strings.HasSuffix(host, ".internal") {
+		return false
+	}
+	return net.ParseIP(host) == nil
+}
+
+// validateReadingRequest checks the prompt template, messages and callback URL of a new job
+func validateReadingRequest(readingReq ReadingRequest) validation.Errors {
+	var validationErrs validation.Errors
+	validationErrs.Required("prompt_template", readingReq.PromptTemplate)
+	if readingReq.PromptTemplate != "" {
+		_, err := prompts.Lookup(readingReq.PromptTemplate)
+		if err != nil {
+			fmt.Printf("rejected prompt template [%s]: %v\n", readingReq.PromptTemplate, err)
+			validationErrs.Add("prompt_template", validation.RuleOneOf, fmt.Sprintf("unknown prompt template %s", readingReq.PromptTemplate))
+		}
+	}
+	if len(readingReq.Messages) == 0 {
+		validationErrs.Add("messages", validation.RuleRequired, "at least one message is required")
+	}
+	for i, message := range readingReq.Messages {
+		field := fmt.Sprintf("messages[%d]", i)
+		validationErrs.OneOf(field+".role", message.Role, "user", "assistant")
+		validationErrs.Required(field+".content", message.Content)
+	}
+	if len(readingReq.Messages) > 0 && readingReq.Messages[0].Role != "user" {
+		validationErrs.Add("messages[0].role", validation.RuleOneOf, "the first message must be from the user")
+	}
+	if readingReq.CallbackURL != "" && !validCallbackURL(readingReq.CallbackURL) {
+		validationErrs.Add("callback_url", validation.RuleFormat, "callback_url must be a public https URL")
+	}
+	return validationErrs
+}
+
+// startReading stores a pending job and runs it in an async invocation of this function,
+// the Anthropic call can take longer than API Gateway waits
+func startReading(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var readingReq ReadingRequest
+	err := json.Unmarshal([]byte(request.Body), &readingReq)
+	if err != nil {
+		fmt.Printf("failed to unmarshal request: %v", err)
+		return createResponse(http.StatusBadRequest, "Invalid request body"), nil
+	}
+
+	validationErrs := validateReadingRequest(readingReq)
+	if err := validationErrs.Err(); err != nil {
+		fmt.Printf("invalid reading request: %v\n", err)
+		return createResponse(http.StatusUnprocessableEntity, validationErrs.Body()), nil
+	}
+	if readingReq.CallbackURL != "" && os.Getenv(envCallbackSecret) == "" {
+		fmt.Printf("%s is not set\n", envCallbackSecret)
+		return createResponse(http.StatusInternalServerError, "Callbacks are not configured"), nil
+	}
+
+	sess := session.Must(session.NewSession())
+	dynamoClient := dynamodb.New(sess)
+	userHash, err := getUserHashFromAuth(dynamoClient, request)
+	if err != nil {
+		fmt.Printf("failed to resolve user: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to resolve user"), nil
+	}
+	if userHash == "" {
+		return createResponse(http.StatusUnauthorized, "Invalid auth key"), nil
+	}
+
+	// The reading is charged when it finishes, the balance is checked up front so jobs fail fast
+	user, found, err := loadUser(dynamoClient, userHash)
+	if err != nil {
+		fmt.Printf("failed to load user: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to load user"), nil
+	}
+	if !found {
+		return createResponse(http.StatusNotFound, "User not found"), nil
+	}
+	if suspension, blocked := auth.CheckUser(user, time.Now()); blocked {
+		body, _ := json.Marshal(suspension)
+		return createResponse(http.StatusForbidden, string(body)), nil
+	}
+	if decision := quotaPolicy.Decide(user, time.Now()); !decision.Allowed {
+		body, _ := json.Marshal(decision)
+		return createResponse(http.StatusPaymentRequired, string(body)), nil
+	}
+
+	jobID, err := newJobID()
+	if err != nil {
+		fmt.Printf("failed to generate job id: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to start reading"), nil
+	}
+	now := time.Now()
+	job := Job{
+		JobID:          jobID,
+		UserHash:       userHash,
+		Status:         jobStatusPending,
+		PromptTemplate: readingReq.PromptTemplate,
+		Messages:       readingReq.Messages,
+		CallbackURL:    readingReq.CallbackURL,
+		CreatedAt:      now.Unix(),
+		ExpiresAt:      now.Add(jobTTL).Unix(),
+		TestRecord:     testmode.Enabled(),
+	}
+	item, err := dynamodbattribute.MarshalMap(job)
+	if err != nil {
+		fmt.Printf("failed to marshal job: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to start reading"), nil
+	}
+	_, err = dynamoClient.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(jobsTable()),
+		Item:      item,
+	})
+	if err != nil {
+		fmt.Printf("failed to store job: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to start reading"), nil
+	}
+
+	payload, err := json.Marshal(ReadingJob{JobID: jobID})
+	if err != nil {
+		fmt.Printf("failed to marshal reading job: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to start reading"), nil
+	}
+	_, err = awsLambda.New(sess).Invoke(&awsLambda.InvokeInput{
+		FunctionName:   aws.String(os.Getenv("AWS_LAMBDA_FUNCTION_NAME")),
+		InvocationType: aws.String(awsLambda.InvocationTypeEvent),
+		Payload:        payload,
+	})
+	if err != nil {
+		fmt.Printf("failed to start reading job: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to start reading"), nil
+	}
+	fmt.Printf("Started reading job %s for user %s\n", jobID, userHash)
+
+	return jobResponse(http.StatusAccepted, job)
+}
+
+// getReading returns a job of the authenticated user
+func getReading(request events.APIGatewayProxyRequest, jobID string) (events.APIGatewayProxyResponse, error) {
+	dynamoClient := dynamodb.New(session.Must(session.NewSession()))
+	userHash, err := getUserHashFromAuth(dynamoClient, request)
+	if err != nil {
+		fmt.Printf("failed to resolve user: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to resolve user"), nil
+	}
+	if userHash == "" {
+		return createResponse(http.StatusUnauthorized, "Invalid auth key"), nil
+	}
+
+	job, found, err := loadJob(dynamoClient, jobID)
+	if err != nil {
+		fmt.Printf("failed to load job: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to load reading"), nil
+	}
+	// Other users' jobs are reported as missing, job ids aren't secrets
+	if !found || job.UserHash != userHash {
+		return createResponse(http.StatusNotFound, "Reading not found"), nil
+	}
+	return jobResponse(http.StatusOK, job)
+}
+
+func jobResponse(statusCode int, job Job) (events.APIGatewayProxyResponse, error) {
+	jsonResponse, err := json.Marshal(job)
+	if err != nil {
+		fmt.Printf("failed to marshal response: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to create response"), nil
+	}
+	return createResponse(statusCode, string(jsonResponse)), nil
+}
+
+// handleEvent serves both the API Gateway requests and the asynchronous jobs they start
+func handleEvent(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var readingJob ReadingJob
+	err := json.Unmarshal(payload, &readingJob)
+	if err == nil && readingJob.JobID != "" {
+		return nil, runJob(ctx, readingJob.JobID)
+	}
+
+	var request events.APIGatewayProxyRequest
+	err = json.Unmarshal(payload, &request)
+	if err != nil {
+		return nil, fmt.Errorf("unknown event: %w", err)
+	}
+	return apiHandler(ctx, request)
+}
+
+// apiHandler is handleRequest wrapped in the REST middlewares
+var apiHandler requestid.Handler
+
+func main() {
+	limits, err := requestbody.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load body limits: %v", err)
+		os.Exit(1)
+	}
+	quotaPolicy, err = quota.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load quota policy: %v", err)
+		os.Exit(1)
+	}
+	workerConfig, err = loadWorkerConfig()
+	if err != nil {
+		fmt.Printf("Failed to load configuration: %v", err)
+		os.Exit(1)
+	}
+	apiHandler = requestid.Middleware(requestbody.Middleware(limits, handleRequest))
+	lambda.Start(handleEvent)
+}
+
+// handleRequest routes async reading requests
+func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Remove trailing slash from path if present
+	path := strings.TrimSuffix(request.Path, "/")
+
+	switch {
+	case request.HTTPMethod == "POST" && path == readingsPath:
+		return startReading(request)
+	case request.HTTPMethod == "GET" && strings.HasPrefix(path, readingsPath+"/"):
+		return getReading(request, strings.TrimPrefix(path, readingsPath+"/"))
+	default:
+		return createResponse(http.StatusNotFound, "Not Found"), fmt.Errorf("unknown endpoint: %s %s", request.HTTPMethod, request.Path)
+	}
+}
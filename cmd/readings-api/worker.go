@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/prompts"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/webhook"
+)
+
+const (
+	defaultAnthropicModel   = "claude-3-5-sonnet-2024062"
+	defaultAnthropicVersion = "2023-06-01"
+	defaultMaxTokens        = 1024
+	envAnthropicURL         = "ANTHROPIC_URL"
+	envAnthropicKey         = "ANTHROPIC_KEY"
+	envAnthropicModel       = "ANTHROPIC_MODEL"
+	envAnthropicVersion     = "ANTHROPIC_VERSION"
+	// envCallbackSecret holds the HMAC key callbacks are signed with, see pkg/webhook
+	envCallbackSecret = "READINGS_CALLBACK_SECRET"
+
+	anthropicTimeout     = 5 * time.Minute
+	callbackTimeout      = 10 * time.Second
+	callbackAttempts     = 3
+	callbackRetryBackoff = 2 * time.Second
+	errorBodyLimitBytes  = 4096
+
+	callbackDelivered = "delivered"
+	callbackFailed    = "failed"
+)
+
+// WorkerConfig holds the Anthropic settings, the same variables the websocket proxy reads
+type WorkerConfig struct {
+	AnthropicURL     string
+	AnthropicKeys    []string
+	AnthropicModel   string
+	AnthropicVersion string
+	CallbackSecret   string
+}
+
+var workerConfig WorkerConfig
+
+// loadWorkerConfig reads the Anthropic settings from the environment
+func loadWorkerConfig() (WorkerConfig, error) {
+	cfg := WorkerConfig{
+		AnthropicURL:     os.Getenv(envAnthropicURL),
+		AnthropicModel:   os.Getenv(envAnthropicModel),
+		AnthropicVersion: os.Getenv(envAnthropicVersion),
+		CallbackSecret:   os.Getenv(envCallbackSecret),
+	}
+	for _, key := range strings.Split(os.Getenv(envAnthropicKey), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			cfg.AnthropicKeys = append(cfg.AnthropicKeys, key)
+		}
+	}
+	if len(cfg.AnthropicKeys) == 0 {
+		return cfg, fmt.Errorf("Anthropic API key not found in environment variable %s", envAnthropicKey)
+	}
+	if cfg.AnthropicURL == "" {
+		return cfg, fmt.Errorf("Anthropic URL not found in environment variable %s", envAnthropicURL)
+	}
+	if cfg.AnthropicModel == "" {
+		cfg.AnthropicModel = defaultAnthropicModel
+	}
+	if cfg.AnthropicVersion == "" {
+		cfg.AnthropicVersion = defaultAnthropicVersion
+	}
+	return cfg, nil
+}
+
+// newJobID returns a random job id
+func newJobID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return "job_" + hex.EncodeToString(id), nil
+}
+
+func jobKey(jobID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"job_id": {S: aws.String(jobID)},
+	}
+}
+
+// loadJob returns a job, or false if it doesn't exist or expired
+func loadJob(dynamoClient *dynamodb.DynamoDB, jobID string) (Job, bool, error) {
+	result, err := dynamoClient.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(jobsTable()),
+		Key:            jobKey(jobID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return Job{}, false, fmt.Errorf("failed to get job: %w", err)
+	}
+	if result.Item == nil {
+		return Job{}, false, nil
+	}
+	var job Job
+	err = dynamodbattribute.UnmarshalMap(result.Item, &job)
+	if err != nil {
+		return Job{}, false, fmt.Errorf("invalid job: %w", err)
+	}
+	// DynamoDB TTL deletes expired items lazily
+	if time.Now().Unix() > job.ExpiresAt {
+		return Job{}, false, nil
+	}
+	return job, true, nil
+}
+
+// claimJob moves a pending job to running. Lambda retries failed async invocations, the condition keeps
+// a retry from running a job twice. It returns false if the job isn't pending anymore.
+func claimJob(dynamoClient *dynamodb.DynamoDB, jobID string) (bool, error) {
+	_, err := dynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(jobsTable()),
+		Key:                 jobKey(jobID),
+		UpdateExpression:    aws.String("SET #status = :running"),
+		ConditionExpression: aws.String("#status = :pending"),
+		ExpressionAttributeNames: map[string]*string{
+			"#status": aws.String("status"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":running": {S: aws.String(jobStatusRunning)},
+			":pending": {S: aws.String(jobStatusPending)},
+		},
+	})
+	var conditionErr *dynamodb.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to claim job: %w", err)
+	}
+	return true, nil
+}
+
+// saveJob stores the outcome of a job
+func saveJob(dynamoClient *dynamodb.DynamoDB, job Job) error {
+	item, err := dynamodbattribute.MarshalMap(job)
+	if err != nil {
+		return fmt.Errorf("failed to marshal job: %w", err)
+	}
+	_, err = dynamoClient.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(jobsTable()),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store job: %w", err)
+	}
+	return nil
+}
+
+// anthropicResponse is the part of a non-streaming Messages API response the job keeps
+type anthropicResponse struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	Usage struct {
+		InputTokens  int64 `json:"input_tokens"`
+		OutputTokens int64 `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+// callAnthropic runs the reading without streaming, trying the next key if one is throttled or rejected
+func callAnthropic(ctx context.Context, config WorkerConfig, job Job) (anthropicResponse, error) {
+	var response anthropicResponse
+	// The template was checked when the job was created, but the allowlist may have changed since
+	systemPrompt, err := prompts.Lookup(job.PromptTemplate)
+	if err != nil {
+		return response, err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"model":      config.AnthropicModel,
+		"max_tokens": defaultMaxTokens,
+		"system":     systemPrompt,
+		"messages":   job.Messages,
+	})
+	if err != nil {
+		return response, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	client := &http.Client{Timeout: anthropicTimeout}
+	var lastErr error
+	for _, key := range config.AnthropicKeys {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.AnthropicURL, bytes.NewReader(body))
+		if err != nil {
+			return response, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("x-api-key", key)
+		req.Header.Set("anthropic-version", config.AnthropicVersion)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = fmt.Errorf("failed to call Anthropic: %w", err)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			errorBody, _ := io.ReadAll(io.LimitReader(resp.Body, errorBodyLimitBytes))
+			resp.Body.Close()
+			lastErr = fmt.Errorf("anthropic returned status %d: %s", resp.StatusCode, errorBody)
+			if resp.StatusCode == http.StatusBadRequest {
+				// The next key would get the same answer
+				return response, lastErr
+			}
+			continue
+		}
+		err = json.NewDecoder(resp.Body).Decode(&response)
+		resp.Body.Close()
+		if err != nil {
+			return response, fmt.Errorf("failed to decode response: %w", err)
+		}
+		return response, nil
+	}
+	return response, lastErr
+}
+
+// chargeUser charges a finished reading, unless the balance ran out since the job was accepted
+func chargeUser(dynamoClient *dynamodb.DynamoDB, userHash string) error {
+	cost := quotaPolicy.RequestCost
+	_, err := dynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(users.Table()),
+		Key:                 map[string]*dynamodb.AttributeValue{users.AttrUserHash: {S: aws.String(userHash)}},
+		UpdateExpression:    aws.String("SET #requests = if_not_exists(#requests, :zero) - :cost"),
+		ConditionExpression: aws.String("attribute_exists(#user) AND (#requests >= :floor OR attribute_exists(#tokens))"),
+		ExpressionAttributeNames: map[string]*string{
+			"#user":     aws.String(users.AttrUserHash),
+			"#requests": aws.String(users.AttrRemainingRequests),
+			"#tokens":   aws.String(users.AttrLegacyRemainingTokens),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":zero":  {N: aws.String("0")},
+			":cost":  {N: aws.String(strconv.FormatInt(cost, 10))},
+			":floor": {N: aws.String(strconv.FormatInt(quotaPolicy.ChargeFloor(cost), 10))},
+		},
+	})
+	var conditionErr *dynamodb.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		fmt.Printf("Reading of user %s isn't charged, the balance is exhausted\n", userHash)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to charge user: %w", err)
+	}
+	return nil
+}
+
+// errCallbackAddress is returned when a callback host resolves to an address that isn't public
+var errCallbackAddress = errors.New("callback address is not public")
+
+// refuseInternalAddress is the dialer Control of callbacks. It checks the resolved address, so a host name
+// that passed validCallbackURL can't reach loopback, VPC-private or link-local addresses such as the
+// instance metadata endpoint.
+func refuseInternalAddress(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errCallbackAddress, address)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("%w: %s", errCallbackAddress, address)
+	}
+	return nil
+}
+
+// newCallbackClient returns the client callbacks are delivered with
+func newCallbackClient() *http.Client {
+	dialer := &net.Dialer{Timeout: callbackTimeout, Control: refuseInternalAddress}
+	return &http.Client{
+		Timeout: callbackTimeout,
+		// No proxy, the dialer must see the callback host's own address
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: callbackTimeout,
+		},
+		// A redirect could point the callback anywhere, validCallbackURL only checked the first URL
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// deliverCallback POSTs the finished job to its callback URL, signed with the callback secret
+func deliverCallback(ctx context.Context, config WorkerConfig, job Job) error {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to marshal callback: %w", err)
+	}
+
+	client := newCallbackClient()
+	var lastErr error
+	for attempt := 1; attempt <= callbackAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(callbackRetryBackoff * time.Duration(attempt-1))
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.CallbackURL, bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("failed to create callback request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(webhook.SignatureHeader, webhook.Sign(config.CallbackSecret, time.Now(), body))
+
+		resp, err := client.Do(req)
+		if errors.Is(err, errCallbackAddress) {
+			return err
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		lastErr = fmt.Errorf("callback returned status %d", resp.StatusCode)
+		if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			break
+		}
+	}
+	return lastErr
+}
+
+// runJob performs a pending job, stores its outcome, charges it and delivers the callback
+func runJob(ctx context.Context, jobID string) error {
+	dynamoClient := dynamodb.New(session.Must(session.NewSession()))
+	claimed, err := claimJob(dynamoClient, jobID)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		fmt.Printf("Reading job %s already ran\n", jobID)
+		return nil
+	}
+	job, found, err := loadJob(dynamoClient, jobID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		fmt.Printf("Reading job %s expired\n", jobID)
+		return nil
+	}
+
+	response, err := callAnthropic(ctx, workerConfig, job)
+	job.CompletedAt = time.Now().Unix()
+	if err != nil {
+		fmt.Printf("Reading job %s failed: %v\n", jobID, err)
+		job.Status = jobStatusFailed
+		job.Error = "The AI service is unavailable, please try again later"
+	} else {
+		job.Status = jobStatusCompleted
+		for _, block := range response.Content {
+			if block.Type == "text" {
+				job.Text += block.Text
+			}
+		}
+		job.InputTokens = response.Usage.InputTokens
+		job.OutputTokens = response.Usage.OutputTokens
+	}
+
+	// Store the outcome first so polling clients see it even if the callback fails
+	err = saveJob(dynamoClient, job)
+	if err != nil {
+		return err
+	}
+	if job.Status == jobStatusCompleted {
+		err = chargeUser(dynamoClient, job.UserHash)
+		if err != nil {
+			fmt.Printf("Can't charge user %s: %v\n", job.UserHash, err)
+		}
+	}
+
+	if job.CallbackURL == "" {
+		return nil
+	}
+	err = deliverCallback(ctx, workerConfig, job)
+	job.CallbackStatus = callbackDelivered
+	if err != nil {
+		fmt.Printf("Can't deliver reading job %s: %v\n", jobID, err)
+		job.CallbackStatus = callbackFailed
+	}
+	return saveJob(dynamoClient, job)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRefuseInternalAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		refused bool
+	}{
+		{"93.184.216.34:443", false},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", false},
+		{"127.0.0.1:443", true},
+		{"[::1]:443", true},
+		{"10.0.12.7:443", true},
+		{"172.16.0.1:443", true},
+		{"192.168.1.1:443", true},
+		{"[fd00::1]:443", true},
+		{"169.254.169.254:80", true},
+		{"[fe80::1]:443", true},
+		{"0.0.0.0:443", true},
+		{"[::]:443", true},
+		{"example.com:443", true},
+	}
+	for _, tt := range tests {
+		err := refuseInternalAddress("tcp", tt.address, nil)
+		if errors.Is(err, errCallbackAddress) != tt.refused {
+			t.Errorf("refuseInternalAddress(%s) = %v, want refused %v", tt.address, err, tt.refused)
+		}
+	}
+}
+
+func TestDeliverCallbackRefusesHostResolvingToLoopback(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	t.Cleanup(server.Close)
+	// localhost passes as a host name here, it only resolves to the loopback server
+	callbackURL := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	start := time.Now()
+	err := deliverCallback(context.Background(), WorkerConfig{CallbackSecret: "secret"}, Job{JobID: "job-1", CallbackURL: callbackURL})
+	if !errors.Is(err, errCallbackAddress) {
+		t.Fatalf("error = %v, want the address refused", err)
+	}
+	if got := requests.Load(); got != 0 {
+		t.Errorf("callback server got %d requests", got)
+	}
+	if elapsed := time.Since(start); elapsed >= callbackRetryBackoff {
+		t.Errorf("refused address was retried for %v", elapsed)
+	}
+}
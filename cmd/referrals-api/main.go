@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/ipfilter"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestbody"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestid"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/shedding"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+)
+
+const (
+	defaultTableName = "REFERRALS"
+)
+
+// Referral is a user's referral code with its signup and fulfillment counters
+type Referral struct {
+	ReferralCode string `json:"referral_code" dynamodbav:"referral_code"`
+	OwnerHash    string `json:"owner_hash" dynamodbav:"owner_hash"`
+	CreatedAt    int64  `json:"created_at" dynamodbav:"created_at"`
+	Signups      int64  `json:"signups" dynamodbav:"signups"`
+	Fulfilled    int64  `json:"fulfilled" dynamodbav:"fulfilled"`
+}
+
+// ReferralStats aggregates the counters of all referral codes
+type ReferralStats struct {
+	Codes        int   `json:"codes"`
+	ActiveCodes  int   `json:"active_codes"`
+	TotalSignups int64 `json:"total_signups"`
+	Fulfilled    int64 `json:"fulfilled"`
+}
+
+func createResponse(statusCode int, body string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Body:       body,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
+
+func getTableName() string {
+	tableName := os.Getenv("REFERRALS_TABLE")
+	if tableName == "" {
+		tableName = defaultTableName
+	}
+	return testmode.Table(tableName)
+}
+
+// loadReferrals returns all referral codes
+func loadReferrals(client *dynamodb.DynamoDB) ([]Referral, error) {
+	var items []map[string]*dynamodb.AttributeValue
+	err := client.ScanPages(&dynamodb.ScanInput{
+		TableName: aws.String(getTableName()),
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		items = append(items, page.Items...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var referrals []Referral
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &referrals)
+	return referrals, err
+}
+
+// summarizeReferrals computes the totals and returns the codes with signups, best performing first
+func summarizeReferrals(referrals []Referral) (ReferralStats, []Referral) {
+	stats := ReferralStats{Codes: len(referrals)}
+	active := []Referral{}
+	for _, referral := range referrals {
+		stats.TotalSignups += referral.Signups
+		stats.Fulfilled += referral.Fulfilled
+		if referral.Signups > 0 {
+			stats.ActiveCodes++
+			active = append(active, referral)
+		}
+	}
+
+	sort.Slice(active, func(i, j int) bool {
+		if active[i].Fulfilled != active[j].Fulfilled {
+			return active[i].Fulfilled > active[j].Fulfilled
+		}
+		return active[i].Signups > active[j].Signups
+	})
+	return stats, active
+}
+
+func getReferralStats(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	sess := session.Must(session.NewSession())
+	dynamoClient := dynamodb.New(sess)
+
+	referrals, err := loadReferrals(dynamoClient)
+	if err != nil {
+		fmt.Printf("failed to load referrals: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to load referrals"), nil
+	}
+
+	stats, active := summarizeReferrals(referrals)
+	response := struct {
+		Stats     ReferralStats `json:"stats"`
+		Referrals []Referral    `json:"referrals"`
+	}{
+		Stats:     stats,
+		Referrals: active,
+	}
+
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		fmt.Printf("failed to marshal response: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to create response"), nil
+	}
+
+	return createResponse(http.StatusOK, string(jsonResponse)), nil
+}
+
+func main() {
+	filter, err := ipfilter.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load IP filter configuration: %v", err)
+		os.Exit(1)
+	}
+	shedder, err := shedding.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load latency budgets: %v", err)
+		os.Exit(1)
+	}
+	limits, err := requestbody.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load body limits: %v", err)
+		os.Exit(1)
+	}
+	handler := ipfilter.Middleware(filter, requestbody.Middleware(limits, handleRequest))
+	lambda.Start(requestid.Middleware(shedding.Middleware(shedder, handler)))
+}
+
+// handleRequest routes admin referral requests, access is restricted with IAM auth on the API Gateway route
+func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Remove trailing slash from path if present
+	path := strings.TrimSuffix(request.Path, "/")
+
+	switch {
+	case request.HTTPMethod == "GET" && path == "/admin/referrals":
+		return getReferralStats(request)
+	default:
+		return createResponse(http.StatusNotFound, "Not Found"), fmt.Errorf("unknown endpoint: %s %s", request.HTTPMethod, request.Path)
+	}
+}
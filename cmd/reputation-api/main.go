@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/ipfilter"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/reputation"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestbody"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestid"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/shedding"
+)
+
+// reputationConfig holds the risk thresholds, loaded once in main
+var reputationConfig reputation.Config
+
+// WindowScore is one window of a subject with its score
+type WindowScore struct {
+	reputation.Record
+	Score int `json:"score"`
+}
+
+// ReputationResponse is the current risk of a subject and its recent windows, newest first
+type ReputationResponse struct {
+	Subject  string              `json:"subject"`
+	Score    int                 `json:"score"`
+	Decision reputation.Decision `json:"decision"`
+	Windows  []WindowScore       `json:"windows"`
+}
+
+func createResponse(statusCode int, body string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Body:       body,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
+
+func getReputation(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var subject string
+	switch {
+	case request.QueryStringParameters["ip"] != "":
+		subject = reputation.IPSubject(request.QueryStringParameters["ip"])
+	case request.QueryStringParameters["identifier"] != "":
+		subject = reputation.IdentifierSubject(request.QueryStringParameters["identifier"])
+	default:
+		return createResponse(http.StatusBadRequest, "Missing ip or identifier"), nil
+	}
+
+	store := reputation.NewStore(dynamodb.New(session.Must(session.NewSession())), reputationConfig)
+	records, err := store.Get(subject)
+	if err != nil {
+		fmt.Printf("failed to load reputation: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to load reputation"), nil
+	}
+
+	response := ReputationResponse{Subject: subject, Windows: []WindowScore{}}
+	currentWindow := time.Now().Truncate(reputationConfig.Window).Unix()
+	for _, record := range records {
+		window := WindowScore{Record: record, Score: reputationConfig.Score(record)}
+		if record.WindowStart == currentWindow {
+			response.Score = window.Score
+		}
+		response.Windows = append(response.Windows, window)
+	}
+	response.Decision = reputationConfig.Decide(response.Score)
+
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		fmt.Printf("failed to marshal response: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to create response"), nil
+	}
+	return createResponse(http.StatusOK, string(jsonResponse)), nil
+}
+
+func main() {
+	filter, err := ipfilter.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load IP filter configuration: %v", err)
+		os.Exit(1)
+	}
+	shedder, err := shedding.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load latency budgets: %v", err)
+		os.Exit(1)
+	}
+	limits, err := requestbody.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load body limits: %v", err)
+		os.Exit(1)
+	}
+	reputationConfig, err = reputation.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load reputation configuration: %v", err)
+		os.Exit(1)
+	}
+	handler := ipfilter.Middleware(filter, requestbody.Middleware(limits, handleRequest))
+	lambda.Start(requestid.Middleware(shedding.Middleware(shedder, handler)))
+}
+
+// handleRequest routes admin reputation requests, access is restricted with IAM auth on the API Gateway route
+func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Remove trailing slash from path if present
+	path := strings.TrimSuffix(request.Path, "/")
+
+	switch {
+	case request.HTTPMethod == "GET" && path == "/admin/reputation":
+		return getReputation(request)
+	default:
+		return createResponse(http.StatusNotFound, "Not Found"), fmt.Errorf("unknown endpoint: %s %s", request.HTTPMethod, request.Path)
+	}
+}
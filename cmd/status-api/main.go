@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/health"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/ipfilter"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestbody"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestid"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/shedding"
+)
+
+const (
+	defaultWindow   = 15 * time.Minute
+	defaultCacheTTL = 30 * time.Second
+)
+
+// ComponentStatus is the health of one component over the window
+type ComponentStatus struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	ErrorRate float64 `json:"error_rate"`
+	Calls     int64   `json:"calls"`
+}
+
+// Status is the status page response
+type Status struct {
+	GeneratedAt   int64 `json:"generated_at"`
+	WindowMinutes int   `json:"window_minutes"`
+	// Status is the worst status of the components, unknown components count as operational
+	Status     string            `json:"status"`
+	Components []ComponentStatus `json:"components"`
+}
+
+// cachedStatus is shared between warm invocations, every page view of every user hits this endpoint
+var (
+	cacheMu      sync.Mutex
+	cachedStatus *Status
+)
+
+func createResponse(statusCode int, body string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Body:       body,
+		Headers: map[string]string{
+			"Content-Type":  "application/json",
+			"Cache-Control": fmt.Sprintf("max-age=%d", int(defaultCacheTTL.Seconds())),
+		},
+	}
+}
+
+// getWindow reads how far back the error rates look from STATUS_WINDOW
+func getWindow() time.Duration {
+	value := os.Getenv("STATUS_WINDOW")
+	if value == "" {
+		return defaultWindow
+	}
+	window, err := time.ParseDuration(value)
+	if err != nil || window < health.BucketSize {
+		fmt.Printf("Invalid STATUS_WINDOW %q, using default\n", value)
+		return defaultWindow
+	}
+	return window
+}
+
+// getNumber reads a numeric attribute, returning 0 if it is missing or malformed
+func getNumber(item map[string]*dynamodb.AttributeValue, name string) int64 {
+	attr, ok := item[name]
+	if !ok || attr.N == nil {
+		return 0
+	}
+	value, err := strconv.ParseInt(*attr.N, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return value
+}
+
+// getCounts sums the counters of a component since the given time
+func getCounts(ctx context.Context, client *dynamodb.DynamoDB, table string, component string, since time.Time) (health.Counts, error) {
+	var counts health.Counts
+	err := client.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(table),
+		KeyConditionExpression: aws.String("#component = :component AND #bucket >= :since"),
+		ExpressionAttributeNames: map[string]*string{
+			"#component": aws.String(health.AttrComponent),
+			"#bucket":    aws.String(health.AttrBucket),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":component": {S: aws.String(component)},
+			":since":     {N: aws.String(strconv.FormatInt(health.Bucket(since), 10))},
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			counts.OK += getNumber(item, health.AttrOK)
+			counts.Errors += getNumber(item, health.AttrErrors)
+		}
+		return true
+	})
+	if err != nil {
+		return counts, fmt.Errorf("failed to query %s health: %w", component, err)
+	}
+	return counts, nil
+}
+
+// computeStatus rates every component by its error rate over the window
+func computeStatus(ctx context.Context, client *dynamodb.DynamoDB, now time.Time) (Status, error) {
+	window := getWindow()
+	status := Status{
+		GeneratedAt:   now.Unix(),
+		WindowMinutes: int(window.Minutes()),
+		Status:        health.StatusOperational,
+	}
+
+	table := health.Table(os.Getenv(health.EnvTable))
+	for _, component := range health.Components {
+		counts, err := getCounts(ctx, client, table, component, now.Add(-window))
+		if err != nil {
+			return status, err
+		}
+		componentStatus := ComponentStatus{
+			Name:      component,
+			Status:    health.DefaultThresholds.Status(counts),
+			ErrorRate: counts.ErrorRate(),
+			Calls:     counts.Total(),
+		}
+		if health.Worse(componentStatus.Status, status.Status) {
+			status.Status = componentStatus.Status
+		}
+		status.Components = append(status.Components, componentStatus)
+	}
+	return status, nil
+}
+
+// getStatus returns the cached status if it is fresh enough, computing it otherwise
+func getStatus(ctx context.Context) (Status, error) {
+	now := time.Now()
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+
+	if cachedStatus != nil && now.Sub(time.Unix(cachedStatus.GeneratedAt, 0)) < defaultCacheTTL {
+		return *cachedStatus, nil
+	}
+
+	sess := session.Must(session.NewSession())
+	status, err := computeStatus(ctx, dynamodb.New(sess), now)
+	if err != nil {
+		return status, err
+	}
+	cachedStatus = &status
+	return status, nil
+}
+
+func getServiceStatus(ctx context.Context) (events.APIGatewayProxyResponse, error) {
+	status, err := getStatus(ctx)
+	if err != nil {
+		fmt.Printf("failed to compute status: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to compute status"), nil
+	}
+
+	jsonResponse, err := json.Marshal(status)
+	if err != nil {
+		fmt.Printf("failed to marshal response: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to create response"), nil
+	}
+
+	return createResponse(http.StatusOK, string(jsonResponse)), nil
+}
+
+func main() {
+	filter, err := ipfilter.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load IP filter configuration: %v", err)
+		os.Exit(1)
+	}
+	shedder, err := shedding.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load latency budgets: %v", err)
+		os.Exit(1)
+	}
+	limits, err := requestbody.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load body limits: %v", err)
+		os.Exit(1)
+	}
+	handler := ipfilter.Middleware(filter, requestbody.Middleware(limits, handleRequest))
+	lambda.Start(requestid.Middleware(shedding.Middleware(shedder, handler)))
+}
+
+// handleRequest routes status requests, the status is public so the frontend can show it before login
+func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Remove trailing slash from path if present
+	path := strings.TrimSuffix(request.Path, "/")
+
+	switch {
+	case request.HTTPMethod == "GET" && path == "/status":
+		return getServiceStatus(ctx)
+	default:
+		return createResponse(http.StatusNotFound, "Not Found"), fmt.Errorf("unknown endpoint: %s %s", request.HTTPMethod, request.Path)
+	}
+}
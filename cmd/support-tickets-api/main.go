@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/ipfilter"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestbody"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestid"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/shedding"
+)
+
+const (
+	defaultTableName = "SUPPORT_TICKETS"
+)
+
+// TicketMessage is a single email stored by mail-redirector in SUPPORT_TICKETS
+type TicketMessage struct {
+	TicketID   string `json:"ticket_id" dynamodbav:"ticket_id"`
+	MessageID  string `json:"message_id" dynamodbav:"message_id"`
+	From       string `json:"from" dynamodbav:"from"`
+	Subject    string `json:"subject" dynamodbav:"subject"`
+	Body       string `json:"body" dynamodbav:"body"`
+	ReceivedAt int64  `json:"received_at" dynamodbav:"received_at"`
+	Status     string `json:"status" dynamodbav:"status"`
+}
+
+// Ticket is a thread of messages sharing a ticket ID
+type Ticket struct {
+	TicketID     string          `json:"ticket_id"`
+	From         string          `json:"from"`
+	Subject      string          `json:"subject"`
+	LastActivity int64           `json:"last_activity"`
+	Messages     []TicketMessage `json:"messages"`
+}
+
+func createResponse(statusCode int, body string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Body:       body,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
+
+func getTableName() string {
+	tableName := os.Getenv("SUPPORT_TICKETS_TABLE")
+	if tableName == "" {
+		tableName = defaultTableName
+	}
+	return tableName
+}
+
+// loadMessages returns the messages of one ticket, or of all tickets if ticketID is empty
+func loadMessages(client *dynamodb.DynamoDB, ticketID string) ([]TicketMessage, error) {
+	var items []map[string]*dynamodb.AttributeValue
+	var err error
+
+	if ticketID != "" {
+		err = client.QueryPages(&dynamodb.QueryInput{
+			TableName:              aws.String(getTableName()),
+			KeyConditionExpression: aws.String("ticket_id = :id"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":id": {S: aws.String(ticketID)},
+			},
+		}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			items = append(items, page.Items...)
+			return true
+		})
+	} else {
+		err = client.ScanPages(&dynamodb.ScanInput{
+			TableName: aws.String(getTableName()),
+		}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+			items = append(items, page.Items...)
+			return true
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []TicketMessage
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &messages)
+	return messages, err
+}
+
+// groupTickets threads messages into tickets, most recently active first
+func groupTickets(messages []TicketMessage) []Ticket {
+	ticketMap := make(map[string]*Ticket)
+	for _, message := range messages {
+		ticket, ok := ticketMap[message.TicketID]
+		if !ok {
+			ticket = &Ticket{TicketID: message.TicketID, From: message.From, Subject: message.Subject}
+			ticketMap[message.TicketID] = ticket
+		}
+		ticket.Messages = append(ticket.Messages, message)
+		if message.ReceivedAt > ticket.LastActivity {
+			ticket.LastActivity = message.ReceivedAt
+		}
+	}
+
+	tickets := make([]Ticket, 0, len(ticketMap))
+	for _, ticket := range ticketMap {
+		sort.Slice(ticket.Messages, func(i, j int) bool {
+			return ticket.Messages[i].ReceivedAt < ticket.Messages[j].ReceivedAt
+		})
+		// Use the subject of the first email in the thread
+		ticket.Subject = ticket.Messages[0].Subject
+		tickets = append(tickets, *ticket)
+	}
+	sort.Slice(tickets, func(i, j int) bool {
+		return tickets[i].LastActivity > tickets[j].LastActivity
+	})
+	return tickets
+}
+
+func listTickets(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	sess := session.Must(session.NewSession())
+	dynamoClient := dynamodb.New(sess)
+
+	messages, err := loadMessages(dynamoClient, request.QueryStringParameters["ticket_id"])
+	if err != nil {
+		fmt.Printf("failed to load support tickets: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to load support tickets"), nil
+	}
+
+	response := struct {
+		Tickets []Ticket `json:"tickets"`
+	}{
+		Tickets: groupTickets(messages),
+	}
+
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		fmt.Printf("failed to marshal response: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to create response"), nil
+	}
+
+	return createResponse(http.StatusOK, string(jsonResponse)), nil
+}
+
+func main() {
+	filter, err := ipfilter.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load IP filter configuration: %v", err)
+		os.Exit(1)
+	}
+	shedder, err := shedding.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load latency budgets: %v", err)
+		os.Exit(1)
+	}
+	limits, err := requestbody.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load body limits: %v", err)
+		os.Exit(1)
+	}
+	handler := ipfilter.Middleware(filter, requestbody.Middleware(limits, handleRequest))
+	lambda.Start(requestid.Middleware(shedding.Middleware(shedder, handler)))
+}
+
+// handleRequest routes admin support ticket requests, access is restricted with IAM auth on the API Gateway route
+func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Remove trailing slash from path if present
+	path := strings.TrimSuffix(request.Path, "/")
+
+	switch {
+	case request.HTTPMethod == "GET" && path == "/admin/support-tickets":
+		return listTickets(request)
+	default:
+		return createResponse(http.StatusNotFound, "Not Found"), fmt.Errorf("unknown endpoint: %s %s", request.HTTPMethod, request.Path)
+	}
+}
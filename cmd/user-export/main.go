@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	awsLambda "github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/auth"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/mailer"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestbody"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/requestid"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/validation"
+)
+
+const (
+	defaultEmailAddress = "notifications.otp@evacrane.com"
+	authTableName       = "AUTH"
+	usageTableName      = "USAGE"
+	referralsTableName  = "REFERRALS"
+	// usageUserIndex is the USAGE GSI with user_hash as partition key
+	usageUserIndex = "user_hash-index"
+	// linkExpiry is the lifetime of the download link. Links signed with the role's temporary
+	// credentials stop working earlier if the credentials expire first.
+	linkExpiry = 24 * time.Hour
+)
+
+// ExportJob is the payload of the asynchronous invocation that builds the export
+type ExportJob struct {
+	UserHash   string `json:"user_hash"`
+	Identifier string `json:"identifier"`
+	Method     string `json:"method"`
+}
+
+// ExportRequest is the body of POST /users/me/export. The identifier has to belong to the authenticated user,
+// the download link is sent to it.
+type ExportRequest struct {
+	Identifier string `json:"identifier"`
+	Method     string `json:"method"`
+}
+
+// ExportBundle is the document stored in S3
+type ExportBundle struct {
+	GeneratedAt int64                    `json:"generated_at"`
+	User        map[string]interface{}   `json:"user"`
+	Referral    map[string]interface{}   `json:"referral,omitempty"`
+	Usage       []map[string]interface{} `json:"usage"`
+}
+
+func createResponse(statusCode int, body string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Body:       body,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
+
+// getUserHashFromAuth resolves the user behind an auth key
+func getUserHashFromAuth(dynamoClient *dynamodb.DynamoDB, authKey string) (string, error) {
+	result, err := dynamoClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(testmode.Table(authTableName)),
+		Key: map[string]*dynamodb.AttributeValue{
+			"key": {S: aws.String(auth.HashKey(authKey))},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get auth key: %w", err)
+	}
+	if result.Item == nil || result.Item["user_hash"] == nil {
+		return "", nil
+	}
+	if expiresAt := result.Item[auth.AttrKeyExpiresAt]; expiresAt != nil && auth.KeyExpired(aws.StringValue(expiresAt.N), time.Now()) {
+		return "", nil
+	}
+	// API keys are limited to their scopes, which don't cover this endpoint
+	if keyType := result.Item[auth.AttrKeyType]; keyType != nil && auth.IsAPIKey(aws.StringValue(keyType.S)) {
+		return "", nil
+	}
+	// Exports are for the user only, support impersonating the user can't request them
+	if keyType := result.Item[auth.AttrKeyType]; keyType != nil && auth.IsImpersonation(aws.StringValue(keyType.S)) {
+		return "", nil
+	}
+	return aws.StringValue(result.Item["user_hash"].S), nil
+}
+
+func requestExport(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	authKey, ok := auth.BearerToken(request.Headers)
+	if !ok {
+		return createResponse(http.StatusUnauthorized, "Missing auth key"), nil
+	}
+
+	var exportReq ExportRequest
+	err := json.Unmarshal([]byte(request.Body), &exportReq)
+	if err != nil {
+		fmt.Printf("failed to unmarshal request: %v", err)
+		return createResponse(http.StatusBadRequest, "Invalid request body"), nil
+	}
+
+	var validationErrs validation.Errors
+	validationErrs.Required("identifier", exportReq.Identifier)
+	validationErrs.OneOf("method", exportReq.Method, "sms", "email")
+	if err := validationErrs.Err(); err != nil {
+		fmt.Printf("invalid export request: %v\n", err)
+		return createResponse(http.StatusUnprocessableEntity, validationErrs.Body()), nil
+	}
+
+	sess := session.Must(session.NewSession())
+	dynamoClient := dynamodb.New(sess)
+
+	userHash, err := getUserHashFromAuth(dynamoClient, authKey)
+	if err != nil {
+		fmt.Printf("failed to resolve user: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to resolve user"), nil
+	}
+	if userHash == "" {
+		return createResponse(http.StatusUnauthorized, "Invalid auth key"), nil
+	}
+
+	// Only send the link to the identifier the user logged in with
+	if users.HashIdentifier(exportReq.Identifier) != userHash {
+		return createResponse(http.StatusForbidden, "Identifier doesn't match the authenticated user"), nil
+	}
+
+	job, err := json.Marshal(ExportJob{UserHash: userHash, Identifier: exportReq.Identifier, Method: exportReq.Method})
+	if err != nil {
+		fmt.Printf("failed to marshal export job: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to start export"), nil
+	}
+
+	// Gathering the data can take longer than API Gateway waits, so the export runs in an async invocation of this function
+	lambdaClient := awsLambda.New(sess)
+	_, err = lambdaClient.Invoke(&awsLambda.InvokeInput{
+		FunctionName:   aws.String(os.Getenv("AWS_LAMBDA_FUNCTION_NAME")),
+		InvocationType: aws.String(awsLambda.InvocationTypeEvent),
+		Payload:        job,
+	})
+	if err != nil {
+		fmt.Printf("failed to start export: %v", err)
+		return createResponse(http.StatusInternalServerError, "Failed to start export"), nil
+	}
+
+	return createResponse(http.StatusAccepted, `{"message":"Export started, a download link will be sent shortly"}`), nil
+}
+
+// loadItem returns a single item as a plain map, or nil if it doesn't exist
+func loadItem(dynamoClient *dynamodb.DynamoDB, tableName string, key map[string]*dynamodb.AttributeValue) (map[string]interface{}, error) {
+	result, err := dynamoClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key:       key,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s item: %w", tableName, err)
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+	var item map[string]interface{}
+	err = dynamodbattribute.UnmarshalMap(result.Item, &item)
+	return item, err
+}
+
+// loadUsage returns the user's usage records
+func loadUsage(dynamoClient *dynamodb.DynamoDB, userHash string) ([]map[string]interface{}, error) {
+	var items []map[string]*dynamodb.AttributeValue
+	err := dynamoClient.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(testmode.Table(usageTableName)),
+		IndexName:              aws.String(usageUserIndex),
+		KeyConditionExpression: aws.String("user_hash = :user_hash"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":user_hash": {S: aws.String(userHash)},
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		items = append(items, page.Items...)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage: %w", err)
+	}
+
+	usage := []map[string]interface{}{}
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &usage)
+	return usage, err
+}
+
+// buildBundle gathers everything stored about the user
+func buildBundle(dynamoClient *dynamodb.DynamoDB, userHash string) (ExportBundle, error) {
+	bundle := ExportBundle{GeneratedAt: time.Now().Unix()}
+
+	user, err := loadItem(dynamoClient, users.Table(), map[string]*dynamodb.AttributeValue{
+		users.AttrUserHash: {S: aws.String(userHash)},
+	})
+	if err != nil {
+		return bundle, err
+	}
+	bundle.User = user
+
+	if referralCode, ok := user["referral_code"].(string); ok {
+		bundle.Referral, err = loadItem(dynamoClient, testmode.Table(referralsTableName), map[string]*dynamodb.AttributeValue{
+			"referral_code": {S: aws.String(referralCode)},
+		})
+		if err != nil {
+			return bundle, err
+		}
+	}
+
+	bundle.Usage, err = loadUsage(dynamoClient, userHash)
+	return bundle, err
+}
+
+// exportMailer is created in main, where its sending identity is checked
+var exportMailer *mailer.Mailer
+
+// sendLink delivers the download link the same way OTPs are delivered
+func sendLink(sess *session.Session, job ExportJob, link string) error {
+	message := fmt.Sprintf("Your data export is ready: %s\nThe link expires in %v.", link, linkExpiry)
+	switch job.Method {
+	case "sms":
+		_, err := sns.New(sess).Publish(&sns.PublishInput{
+			Message:     aws.String(message),
+			PhoneNumber: aws.String(job.Identifier),
+		})
+		return err
+	case "email":
+		return exportMailer.Send(job.Identifier, "Your data export", message)
+	default:
+		return fmt.Errorf("invalid delivery method: %s", job.Method)
+	}
+}
+
+// runExport builds the bundle, stores it in USER_EXPORT_BUCKET and sends a presigned link to the user
+func runExport(job ExportJob) error {
+	bucket := os.Getenv("USER_EXPORT_BUCKET")
+	if bucket == "" {
+		return fmt.Errorf("USER_EXPORT_BUCKET is not set")
+	}
+
+	sess := session.Must(session.NewSession())
+	bundle, err := buildBundle(dynamodb.New(sess), job.UserHash)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal export: %w", err)
+	}
+
+	s3Client := s3.New(sess)
+	key := fmt.Sprintf("exports/%s/%d.json", job.UserHash, bundle.GeneratedAt)
+	_, err = s3Client.PutObject(&s3.PutObjectInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(key),
+		Body:                 bytes.NewReader(data),
+		ContentType:          aws.String("application/json"),
+		ServerSideEncryption: aws.String(s3.ServerSideEncryptionAes256),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store export: %w", err)
+	}
+
+	getReq, _ := s3Client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket:                     aws.String(bucket),
+		Key:                        aws.String(key),
+		ResponseContentDisposition: aws.String(`attachment; filename="export.json"`),
+	})
+	link, err := getReq.Presign(linkExpiry)
+	if err != nil {
+		return fmt.Errorf("failed to presign export link: %w", err)
+	}
+
+	err = sendLink(sess, job, link)
+	if err != nil {
+		return fmt.Errorf("failed to send export link: %w", err)
+	}
+	fmt.Printf("Export for user %s stored at %s\n", job.UserHash, key)
+	return nil
+}
+
+// handleEvent serves both the API Gateway request and the asynchronous export job it starts
+func handleEvent(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var job ExportJob
+	err := json.Unmarshal(payload, &job)
+	if err == nil && job.UserHash != "" {
+		return nil, runExport(job)
+	}
+
+	var request events.APIGatewayProxyRequest
+	err = json.Unmarshal(payload, &request)
+	if err != nil {
+		return nil, fmt.Errorf("unknown event: %w", err)
+	}
+	return apiHandler(ctx, request)
+}
+
+// apiHandler is handleRequest wrapped in the REST middlewares
+var apiHandler requestid.Handler
+
+func main() {
+	limits, err := requestbody.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to load body limits: %v", err)
+		os.Exit(1)
+	}
+	exportMailer = mailer.New(session.Must(session.NewSession()), defaultEmailAddress)
+	err = exportMailer.CheckIdentity()
+	if err != nil {
+		fmt.Printf("Can't send export links by email: %v", err)
+		os.Exit(1)
+	}
+	apiHandler = requestid.Middleware(requestbody.Middleware(limits, handleRequest))
+	lambda.Start(handleEvent)
+}
+
+// handleRequest routes user export requests
+func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Remove trailing slash from path if present
+	path := strings.TrimSuffix(request.Path, "/")
+
+	switch {
+	case request.HTTPMethod == "POST" && path == "/users/me/export":
+		return requestExport(request)
+	default:
+		return createResponse(http.StatusNotFound, "Not Found"), fmt.Errorf("unknown endpoint: %s %s", request.HTTPMethod, request.Path)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+)
+
+// MigrationEvent is the payload the migration is invoked with
+type MigrationEvent struct {
+	DryRun bool `json:"dry_run"`
+}
+
+// MigrationResult summarizes a migration run
+type MigrationResult struct {
+	Scanned  int `json:"scanned"`
+	Migrated int `json:"migrated"`
+	Skipped  int `json:"skipped"`
+}
+
+// getNumber reads a numeric attribute, returning nil if it is missing
+func getNumber(item map[string]types.AttributeValue, name string) (*int64, error) {
+	attr, ok := item[name].(*types.AttributeValueMemberN)
+	if !ok {
+		return nil, nil
+	}
+	value, err := strconv.ParseInt(attr.Value, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return &value, nil
+}
+
+// migrateUser writes the migrated balance. The condition on the old token value makes the update safe to rerun
+// and keeps it from clobbering a concurrent write.
+func migrateUser(ctx context.Context, client *dynamodb.Client, tableName string, user users.User, legacyTokens int64) error {
+	migrated := user.MigrateBalance()
+	added := migrated.RemainingRequests - user.RemainingRequests
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			users.AttrUserHash: &types.AttributeValueMemberS{Value: user.UserHash},
+		},
+		ConditionExpression: aws.String("#tokens = :old"),
+		ExpressionAttributeNames: map[string]string{
+			"#requests": users.AttrRemainingRequests,
+			"#tokens":   users.AttrLegacyRemainingTokens,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":old":   &types.AttributeValueMemberN{Value: strconv.FormatInt(legacyTokens, 10)},
+			":added": &types.AttributeValueMemberN{Value: strconv.FormatInt(added, 10)},
+			":zero":  &types.AttributeValueMemberN{Value: "0"},
+		},
+	}
+	if migrated.LegacyRemainingTokens == nil {
+		input.UpdateExpression = aws.String("SET #requests = if_not_exists(#requests, :zero) + :added REMOVE #tokens")
+	} else {
+		input.UpdateExpression = aws.String("SET #requests = if_not_exists(#requests, :zero) + :added, #tokens = :remainder")
+		input.ExpressionAttributeValues[":remainder"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(*migrated.LegacyRemainingTokens, 10)}
+	}
+
+	_, err := client.UpdateItem(ctx, input)
+	return err
+}
+
+// HandleRequest converts the legacy remaining_tokens balance of every USERS item into remaining_requests
+func HandleRequest(ctx context.Context, event MigrationEvent) (MigrationResult, error) {
+	var result MigrationResult
+
+	tableName := os.Getenv("USERS_TABLE")
+	if tableName == "" {
+		tableName = users.TableName
+	}
+	tableName = testmode.Table(tableName)
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return result, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	client := dynamodb.NewFromConfig(cfg)
+
+	paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{
+		TableName:        aws.String(tableName),
+		FilterExpression: aws.String("attribute_exists(#tokens)"),
+		ExpressionAttributeNames: map[string]string{
+			"#tokens": users.AttrLegacyRemainingTokens,
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return result, fmt.Errorf("failed to scan %s: %w", tableName, err)
+		}
+
+		for _, item := range page.Items {
+			result.Scanned++
+
+			userHash, _ := item[users.AttrUserHash].(*types.AttributeValueMemberS)
+			legacyTokens, err := getNumber(item, users.AttrLegacyRemainingTokens)
+			if err != nil || userHash == nil || legacyTokens == nil {
+				fmt.Printf("Skipping malformed item %v: %v\n", item[users.AttrUserHash], err)
+				result.Skipped++
+				continue
+			}
+			remainingRequests, err := getNumber(item, users.AttrRemainingRequests)
+			if err != nil {
+				fmt.Printf("Skipping user %s: %v\n", userHash.Value, err)
+				result.Skipped++
+				continue
+			}
+
+			user := users.User{UserHash: userHash.Value, LegacyRemainingTokens: legacyTokens}
+			if remainingRequests != nil {
+				user.RemainingRequests = *remainingRequests
+			}
+			fmt.Printf("User %s: %d requests + %d tokens -> %d requests\n", user.UserHash, user.RemainingRequests, *legacyTokens, user.Balance())
+
+			if event.DryRun {
+				continue
+			}
+
+			err = migrateUser(ctx, client, tableName, user, *legacyTokens)
+			var conditionErr *types.ConditionalCheckFailedException
+			if errors.As(err, &conditionErr) {
+				fmt.Printf("User %s changed during migration, skipping\n", user.UserHash)
+				result.Skipped++
+				continue
+			}
+			if err != nil {
+				return result, fmt.Errorf("failed to migrate user %s: %w", user.UserHash, err)
+			}
+			result.Migrated++
+		}
+	}
+
+	fmt.Printf("Migration result: %+v\n", result)
+	return result, nil
+}
+
+func main() {
+	lambda.Start(HandleRequest)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+)
+
+const (
+	defaultConnectionsTable = "WS_CONNECTIONS"
+	// connectionsUserIndex is the WS_CONNECTIONS GSI with user_hash as partition key
+	connectionsUserIndex = "user_hash-index"
+)
+
+// planAttributes are the USERS attributes copied into the connection plan snapshots
+var planAttributes = []string{
+	users.AttrRemainingRequests,
+	users.AttrLegacyRemainingTokens,
+	"plan",
+	"trial_expires_at",
+	users.AttrStatus,
+	users.AttrBanReason,
+	users.AttrBanExpiresAt,
+}
+
+// planChanged reports whether a USERS stream record changed any attribute held in the plan snapshots
+func planChanged(record events.DynamoDBEventRecord) bool {
+	if record.EventName == string(events.DynamoDBOperationTypeRemove) {
+		return true
+	}
+	for _, name := range planAttributes {
+		oldValue, oldOK := record.Change.OldImage[name]
+		newValue, newOK := record.Change.NewImage[name]
+		if oldOK != newOK || oldValue.String() != newValue.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidatePlanSnapshots clears plan_loaded_at on the user's open connections,
+// so the anthropic proxy reloads the plan on the next message
+func invalidatePlanSnapshots(ctx context.Context, client *dynamodb.Client, tableName string, userHash string) (int, error) {
+	invalidated := 0
+	paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String(connectionsUserIndex),
+		KeyConditionExpression: aws.String("user_hash = :user_hash"),
+		ProjectionExpression:   aws.String("connection_id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":user_hash": &types.AttributeValueMemberS{Value: userHash},
+		},
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return invalidated, fmt.Errorf("failed to query connections: %w", err)
+		}
+
+		for _, item := range page.Items {
+			_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+				TableName:           aws.String(tableName),
+				Key:                 map[string]types.AttributeValue{"connection_id": item["connection_id"]},
+				UpdateExpression:    aws.String("REMOVE plan_loaded_at"),
+				ConditionExpression: aws.String("attribute_exists(connection_id)"),
+			})
+			var conditionErr *types.ConditionalCheckFailedException
+			if errors.As(err, &conditionErr) {
+				// The connection was removed by $disconnect in the meantime
+				continue
+			}
+			if err != nil {
+				return invalidated, fmt.Errorf("failed to invalidate plan snapshot: %w", err)
+			}
+			invalidated++
+		}
+	}
+	return invalidated, nil
+}
+
+// HandleRequest processes a batch of USERS stream records. Invalidation is idempotent,
+// so returning an error and letting Lambda retry the whole batch is safe.
+func HandleRequest(ctx context.Context, event events.DynamoDBEvent) error {
+	tableName := os.Getenv("WS_CONNECTIONS_TABLE")
+	if tableName == "" {
+		tableName = defaultConnectionsTable
+	}
+	tableName = testmode.Table(tableName)
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	client := dynamodb.NewFromConfig(cfg)
+
+	for _, record := range event.Records {
+		if !planChanged(record) {
+			continue
+		}
+
+		userHash := record.Change.Keys[users.AttrUserHash].String()
+		invalidated, err := invalidatePlanSnapshots(ctx, client, tableName, userHash)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Invalidated %d plan snapshots for user %s\n", invalidated, userHash)
+	}
+	return nil
+}
+
+func main() {
+	lambda.Start(HandleRequest)
+}
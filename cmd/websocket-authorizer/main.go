@@ -5,7 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"strings"
+	"strconv"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -13,6 +14,9 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/auth"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
 )
 
 const (
@@ -48,21 +52,112 @@ func generatePolicy(principalId, effect, resource string) events.APIGatewayCusto
 	return authResponse
 }
 
-func handleRequest(ctx context.Context, event events.APIGatewayV2CustomAuthorizerV1Request) (events.APIGatewayCustomAuthorizerResponse, error) {
-	fmt.Printf("event: %+v\n", event)
+// getAuthItem looks up an AUTH item by its partition key
+func getAuthItem(ctx context.Context, client *dynamodb.Client, tableName, key string) (map[string]types.AttributeValue, error) {
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"key": &types.AttributeValueMemberS{Value: key},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.Item, nil
+}
+
+// getUserStatus loads the suspension attributes of the user behind an AUTH item
+func getUserStatus(ctx context.Context, client *dynamodb.Client, userHash string) (users.User, error) {
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(users.Table()),
+		Key: map[string]types.AttributeValue{
+			users.AttrUserHash: &types.AttributeValueMemberS{Value: userHash},
+		},
+		ProjectionExpression: aws.String("#status, ban_reason, ban_expires_at"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": users.AttrStatus,
+		},
+	})
+	if err != nil {
+		return users.User{}, err
+	}
+
+	user := users.User{UserHash: userHash}
+	if attr, ok := result.Item[users.AttrStatus].(*types.AttributeValueMemberS); ok {
+		user.Status = attr.Value
+	}
+	if attr, ok := result.Item[users.AttrBanReason].(*types.AttributeValueMemberS); ok {
+		user.BanReason = attr.Value
+	}
+	if attr, ok := result.Item[users.AttrBanExpiresAt].(*types.AttributeValueMemberN); ok {
+		user.BanExpiresAt, _ = strconv.ParseInt(attr.Value, 10, 64)
+	}
+	return user, nil
+}
+
+// useAPIKey counts a use of an API key against its rate limit and records when it was last used.
+// It returns false if the key used up its limit in the current window.
+func useAPIKey(ctx context.Context, client *dynamodb.Client, tableName string, item map[string]types.AttributeValue, now time.Time) (bool, error) {
+	limit := int64(auth.DefaultRateLimit)
+	if attr, ok := item[auth.AttrRateLimit].(*types.AttributeValueMemberN); ok {
+		limit, _ = strconv.ParseInt(attr.Value, 10, 64)
+	}
+	if limit < 1 {
+		return false, nil
+	}
+	values := map[string]types.AttributeValue{
+		":window": &types.AttributeValueMemberN{Value: strconv.FormatInt(auth.RateWindowStart(now), 10)},
+		":now":    &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		":one":    &types.AttributeValueMemberN{Value: "1"},
+		":limit":  &types.AttributeValueMemberN{Value: strconv.FormatInt(limit, 10)},
+	}
+	names := map[string]string{
+		"#window": auth.AttrRateWindow,
+		"#count":  auth.AttrRateCount,
+		"#used":   auth.AttrLastUsedAt,
+	}
+
+	// Count the use in the current window, or start a new window if the stored one is over
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       map[string]types.AttributeValue{"key": item["key"]},
+		UpdateExpression:          aws.String("SET #count = #count + :one, #used = :now"),
+		ConditionExpression:       aws.String("#window = :window AND #count < :limit"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if !errors.As(err, &conditionErr) {
+		return err == nil, err
+	}
+	// DynamoDB rejects unused expression values
+	delete(values, ":limit")
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       map[string]types.AttributeValue{"key": item["key"]},
+		UpdateExpression:          aws.String("SET #window = :window, #count = :one, #used = :now"),
+		ConditionExpression:       aws.String("attribute_not_exists(#window) OR #window < :window"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	if errors.As(err, &conditionErr) {
+		return false, nil
+	}
+	return err == nil, err
+}
 
+func handleRequest(ctx context.Context, event events.APIGatewayV2CustomAuthorizerV1Request) (events.APIGatewayCustomAuthorizerResponse, error) {
 	// Extract the auth key from Sec-WebSocket-Protocol header
-	authKey, ok := event.Headers["Sec-WebSocket-Protocol"]
+	protocolHeader, ok := auth.GetHeader(event.Headers, auth.ProtocolHeader)
 	if !ok {
 		return events.APIGatewayCustomAuthorizerResponse{}, errors.New("missing Sec-WebSocket-Protocol header")
-		//return events.APIGatewayCustomAuthorizerResponse{}, errors.New("missing Sec-WebSocket-Protocol header")
 	}
 
-	fmt.Printf("authKey before split: %v\n", authKey)
-	// If multiple protocols are specified, use the first one as the auth key
-	authKey = strings.Split(authKey, ",")[0]
-	authKey = strings.TrimSpace(authKey)
-	fmt.Printf("authKey: %v\n", authKey)
+	// If multiple protocols are specified, use the "auth." one or fall back to the first one
+	_, authKey := auth.SelectProtocol(protocolHeader)
+	if authKey == "" {
+		return events.APIGatewayCustomAuthorizerResponse{}, errors.New("empty Sec-WebSocket-Protocol header")
+	}
 	// Initialize DynamoDB client
 	cfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
@@ -77,25 +172,76 @@ func handleRequest(ctx context.Context, event events.APIGatewayV2CustomAuthorize
 	if tableName == "" {
 		tableName = defaultTableName
 	}
+	tableName = testmode.Table(tableName)
 	fmt.Printf("tableName: %v\n", tableName)
 
-	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
-		TableName: aws.String(tableName),
-		Key: map[string]types.AttributeValue{
-			"key": &types.AttributeValueMemberS{Value: authKey},
-		},
-	})
-
+	// Auth keys are stored hashed, see pkg/auth. Keys issued before hashing are moved to the hashed
+	// form by cmd/auth-keys-migrate, never looked up in plaintext here.
+	item, err := getAuthItem(ctx, client, tableName, auth.HashKey(authKey))
 	if err != nil {
 		fmt.Printf("Can't query DynamoDB: %s\n", err)
 		return events.APIGatewayCustomAuthorizerResponse{}, err
 	}
+	if item == nil {
+		fmt.Printf("Can't find auth key\n")
+		return generatePolicy("user", "Deny", event.MethodArn), nil
+	}
 
-	if result.Item == nil {
-		fmt.Printf("Can't find auth key: %s\n", authKey)
+	// Auth keys issued with a refresh token are short-lived, the client refreshes them at /auth/refresh
+	if expiresAt, ok := item[auth.AttrKeyExpiresAt].(*types.AttributeValueMemberN); ok && auth.KeyExpired(expiresAt.Value, time.Now()) {
+		fmt.Printf("Auth key expired\n")
 		return generatePolicy("user", "Deny", event.MethodArn), nil
 	}
 
+	// API keys need the chat scope to connect and are rate limited per key
+	if keyType, ok := item[auth.AttrKeyType].(*types.AttributeValueMemberS); ok && auth.IsAPIKey(keyType.Value) {
+		var scopes []string
+		if attr, ok := item[auth.AttrScopes].(*types.AttributeValueMemberSS); ok {
+			scopes = attr.Value
+		}
+		if !auth.HasScope(scopes, auth.ScopeChat) {
+			fmt.Printf("API key without the %s scope\n", auth.ScopeChat)
+			return generatePolicy("user", "Deny", event.MethodArn), nil
+		}
+		allowed, err := useAPIKey(ctx, client, tableName, item, time.Now())
+		if err != nil {
+			fmt.Printf("Can't update DynamoDB: %s\n", err)
+			return events.APIGatewayCustomAuthorizerResponse{}, err
+		}
+		if !allowed {
+			fmt.Printf("API key rate limited\n")
+			return generatePolicy("user", "Deny", event.MethodArn), nil
+		}
+	}
+
+	// Impersonation keys are logged on every connect, read-only ones can't chat because readings are charged
+	if keyType, ok := item[auth.AttrKeyType].(*types.AttributeValueMemberS); ok && auth.IsImpersonation(keyType.Value) {
+		var mode, impersonatedBy string
+		if attr, ok := item[auth.AttrImpersonationMode].(*types.AttributeValueMemberS); ok {
+			mode = attr.Value
+		}
+		if attr, ok := item[auth.AttrImpersonatedBy].(*types.AttributeValueMemberS); ok {
+			impersonatedBy = attr.Value
+		}
+		fmt.Printf("%s impersonation by %s connecting\n", mode, impersonatedBy)
+		if auth.ReadOnly(keyType.Value, mode) {
+			return generatePolicy("user", "Deny", event.MethodArn), nil
+		}
+	}
+
+	// Suspended and banned users keep their keys but can't connect until the ban is lifted
+	if userHashAttr, ok := item["user_hash"].(*types.AttributeValueMemberS); ok {
+		user, err := getUserStatus(ctx, client, userHashAttr.Value)
+		if err != nil {
+			fmt.Printf("Can't query DynamoDB: %s\n", err)
+			return events.APIGatewayCustomAuthorizerResponse{}, err
+		}
+		if suspension, blocked := auth.CheckUser(user, time.Now()); blocked {
+			fmt.Printf("Denying %s user: %s\n", suspension.Status, user.UserHash)
+			return generatePolicy("user", "Deny", event.MethodArn), nil
+		}
+	}
+
 	// If auth key is valid, return an "Allow" policy
 	//return events.APIGatewayV2CustomAuthorizerSimpleResponse{IsAuthorized: true}, nil
 	// If auth key is valid, return an "Allow" policy
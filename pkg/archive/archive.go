@@ -0,0 +1,172 @@
+// Package archive decides which readings are archived for quality audits and fine-tuning datasets, and what is kept of them.
+// Archiving is off unless a bucket and a sample rate are configured, and a sampled reading is only archived if its
+// user consented. The user hash is pseudonymized and email addresses, phone numbers and card numbers are redacted.
+// It has no AWS SDK dependency so both the v1 and v2 SDK based lambdas can use it.
+package archive
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	// EnvBucket is the S3 bucket readings are archived to, archiving is off without it
+	EnvBucket = "ARCHIVE_BUCKET"
+	// EnvSampleRate is the share of readings archived, from 0 (off) to 1 (all)
+	EnvSampleRate = "ARCHIVE_SAMPLE_RATE"
+	// EnvKMSKeyID is the KMS key archived readings are encrypted with, the AWS managed aws/s3 key if empty
+	EnvKMSKeyID = "ARCHIVE_KMS_KEY_ID"
+	// EnvRetentionDays is how long archived readings are kept, see RetentionTag
+	EnvRetentionDays = "ARCHIVE_RETENTION_DAYS"
+	// EnvHashKey is the HMAC key user hashes are pseudonymized with, so archives can't be joined with USERS
+	EnvHashKey = "ARCHIVE_HASH_KEY"
+	// EnvEnvironment names the environment in the object keys, so environments can share a bucket
+	EnvEnvironment = "ARCHIVE_ENVIRONMENT"
+
+	DefaultRetentionDays = 90
+	DefaultEnvironment   = "default"
+
+	// RetentionTag holds the retention in days on every archived object, bucket lifecycle rules expire objects by it
+	RetentionTag = "archive-retention-days"
+
+	// AttrConsent is the USERS map of the archiving purposes a user explicitly agreed to
+	AttrConsent = "archive_consent"
+	// ConsentQualityAudit allows reviewing the user's readings to check their quality
+	ConsentQualityAudit = "quality_audit"
+	// ConsentTraining allows using the user's readings in fine-tuning datasets
+	ConsentTraining = "training"
+
+	sampleBuckets = 10000
+)
+
+// Purposes are the purposes a user can consent to, in the order Consented returns them
+var Purposes = []string{ConsentQualityAudit, ConsentTraining}
+
+// Config holds the archive settings of one environment
+type Config struct {
+	Bucket        string
+	KMSKeyID      string
+	SampleRate    float64
+	RetentionDays int
+	HashKey       string
+	Environment   string
+}
+
+// Message is one archived prompt message
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// Record is the archived document of one reading
+type Record struct {
+	RequestID      string `json:"request_id"`
+	Environment    string `json:"environment"`
+	UserHash       string `json:"user_hash"`
+	PromptTemplate string `json:"prompt_template"`
+	Model          string `json:"model"`
+	// Purposes are the purposes the user consented to when the reading was archived
+	Purposes     []string  `json:"purposes"`
+	Messages     []Message `json:"messages"`
+	Response     string    `json:"response"`
+	InputTokens  int64     `json:"input_tokens"`
+	OutputTokens int64     `json:"output_tokens"`
+	CreatedAt    int64     `json:"created_at"`
+}
+
+// LoadFromEnv reads the archive settings
+func LoadFromEnv() (Config, error) {
+	cfg := Config{
+		Bucket:        os.Getenv(EnvBucket),
+		KMSKeyID:      os.Getenv(EnvKMSKeyID),
+		RetentionDays: DefaultRetentionDays,
+		HashKey:       os.Getenv(EnvHashKey),
+		Environment:   os.Getenv(EnvEnvironment),
+	}
+	if cfg.Environment == "" {
+		cfg.Environment = DefaultEnvironment
+	}
+
+	if rate := os.Getenv(EnvSampleRate); rate != "" {
+		value, err := strconv.ParseFloat(rate, 64)
+		if err != nil || value < 0 || value > 1 {
+			return cfg, fmt.Errorf("invalid rate in environment variable %s, from 0 to 1: %q", EnvSampleRate, rate)
+		}
+		cfg.SampleRate = value
+	}
+
+	if days := os.Getenv(EnvRetentionDays); days != "" {
+		value, err := strconv.Atoi(days)
+		if err != nil || value < 1 {
+			return cfg, fmt.Errorf("invalid day count in environment variable %s: %q", EnvRetentionDays, days)
+		}
+		cfg.RetentionDays = value
+	}
+
+	if cfg.Enabled() && cfg.HashKey == "" {
+		return cfg, fmt.Errorf("environment variable %s is required when archiving is enabled", EnvHashKey)
+	}
+	return cfg, nil
+}
+
+// Enabled reports whether any readings are archived
+func (c Config) Enabled() bool {
+	return c.Bucket != "" && c.SampleRate > 0
+}
+
+// Sampled reports whether the reading with requestID is in the sample. The same request is always sampled the same way.
+func (c Config) Sampled(requestID string) bool {
+	if !c.Enabled() || requestID == "" {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(requestID))
+	return float64(h.Sum32()%sampleBuckets) < c.SampleRate*sampleBuckets
+}
+
+// HashUser pseudonymizes a user hash for the archive
+func (c Config) HashUser(userHash string) string {
+	mac := hmac.New(sha256.New, []byte(c.HashKey))
+	mac.Write([]byte(userHash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Key returns the object key of a record, partitioned by environment and day
+func (c Config) Key(record Record) string {
+	day := time.Unix(record.CreatedAt, 0).UTC().Format("2006/01/02")
+	return fmt.Sprintf("%s/%s/%s.json", record.Environment, day, record.RequestID)
+}
+
+// Consented returns the purposes a user with the given USERS archive_consent map explicitly agreed to.
+// Purposes the user never set aren't consented to.
+func Consented(consent map[string]bool) []string {
+	var purposes []string
+	for _, purpose := range Purposes {
+		if consent[purpose] {
+			purposes = append(purposes, purpose)
+		}
+	}
+	return purposes
+}
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	// cardPattern matches 13 to 19 digits, optionally grouped by spaces or dashes
+	cardPattern = regexp.MustCompile(`\b(?:\d[ \-]?){12,18}\d\b`)
+	// phonePattern matches international and common local phone number formats
+	phonePattern = regexp.MustCompile(`(?:\+\d{1,3}[ .\-]?)?\(?\d{3}\)?[ .\-]?\d{3}[ .\-]?\d{4}\b`)
+)
+
+// Redact replaces email addresses, card numbers and phone numbers in text with placeholders
+func Redact(text string) string {
+	text = emailPattern.ReplaceAllString(text, "[email]")
+	text = cardPattern.ReplaceAllString(text, "[number]")
+	return phonePattern.ReplaceAllString(text, "[phone]")
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+// API keys are long-lived auth keys users create themselves for their scripts. They live in the AUTH table
+// next to the OTP-issued keys, stored under HashKey like those, and differ by key_type, their scopes and
+// their rate limit.
+const (
+	// AttrKeyType is "api" on API keys, OTP-issued session keys don't have it
+	AttrKeyType = "key_type"
+	KeyTypeAPI  = "api"
+	// AttrKeyID is the public id of an API key, used to list and revoke it without the key itself
+	AttrKeyID = "key_id"
+	// AttrKeyName is the label the user gave the API key
+	AttrKeyName = "name"
+	// AttrScopes is the string set of scopes an API key is limited to
+	AttrScopes = "scopes"
+	// AttrCreatedAt, AttrLastUsedAt and AttrRevokedAt are unix times, revoked keys also get expires_at set
+	AttrCreatedAt  = "created_at"
+	AttrLastUsedAt = "last_used_at"
+	AttrRevokedAt  = "revoked_at"
+	// AttrRateLimit is the number of uses per RateWindow an API key is allowed
+	AttrRateLimit = "rate_limit"
+	// AttrRateWindow and AttrRateCount count the uses in the current window
+	AttrRateWindow = "rate_window"
+	AttrRateCount  = "rate_count"
+
+	// ScopeReadUsage allows reading the user's usage
+	ScopeReadUsage = "read-usage"
+	// ScopeChat allows connecting to the LLM websocket proxy
+	ScopeChat = "chat"
+	// ScopePaymentsRead allows reading the user's payments
+	ScopePaymentsRead = "payments-read"
+
+	// APIKeyPrefix makes API keys recognizable in scripts and secret scanners
+	APIKeyPrefix = "sk_"
+	// DefaultRateLimit is the rate limit of API keys created without one
+	DefaultRateLimit = 60
+	// MaxRateLimit is the highest rate limit a user can give an API key
+	MaxRateLimit = 600
+	// RateWindow is the window rate limits count in
+	RateWindow = time.Minute
+)
+
+// Scopes are the scopes an API key can be given
+var Scopes = []string{ScopeReadUsage, ScopeChat, ScopePaymentsRead}
+
+// ValidScope reports whether scope is one of Scopes
+func ValidScope(scope string) bool {
+	for _, known := range Scopes {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAPIKey reports whether an AUTH item with the given key_type is an API key
+func IsAPIKey(keyType string) bool {
+	return keyType == KeyTypeAPI
+}
+
+// HasScope reports whether an API key with the given scopes may be used for scope
+func HasScope(scopes []string, scope string) bool {
+	for _, granted := range scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// NewAPIKey returns a new API key and its public id
+func NewAPIKey() (key string, keyID string, err error) {
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return "", "", err
+	}
+	id := make([]byte, 8)
+	_, err = rand.Read(id)
+	if err != nil {
+		return "", "", err
+	}
+	return APIKeyPrefix + base64.RawURLEncoding.EncodeToString(secret), "key_" + hex.EncodeToString(id), nil
+}
+
+// RateWindowStart returns the start of the rate limit window a use at t counts in, as a unix time
+func RateWindowStart(t time.Time) int64 {
+	return t.Truncate(RateWindow).Unix()
+}
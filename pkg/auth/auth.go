@@ -0,0 +1,46 @@
+// Package auth holds the auth key helpers shared by the lambdas that issue
+// and check websocket auth keys.
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+// AttrKeyExpiresAt is the AUTH attribute holding the unix time a short-lived auth key stops working
+const AttrKeyExpiresAt = "expires_at"
+
+// HashKey returns the hex encoded SHA-256 digest of an auth key.
+// Only the digest is stored in the AUTH table, so a dump of the table can't be
+// replayed as live bearer credentials.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// legacyKeyBytes is the size of the random auth keys issued before hashing, stored in plaintext as
+// base64url with padding
+const legacyKeyBytes = 36
+
+// IsLegacyKey reports whether key has the format of the plaintext auth keys issued before hashing.
+// HashKey digests are hex and never match, so a leaked digest can't pass as a legacy key.
+func IsLegacyKey(key string) bool {
+	if len(key) != base64.URLEncoding.EncodedLen(legacyKeyBytes) {
+		return false
+	}
+	decoded, err := base64.URLEncoding.DecodeString(key)
+	return err == nil && len(decoded) == legacyKeyBytes
+}
+
+// KeyExpired reports whether an auth key with the given expires_at number has expired.
+// Keys without expires_at were issued before refresh tokens and don't expire.
+func KeyExpired(expiresAt string, now time.Time) bool {
+	if expiresAt == "" {
+		return false
+	}
+	value, err := strconv.ParseInt(expiresAt, 10, 64)
+	return err == nil && now.Unix() >= value
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsLegacyKey(t *testing.T) {
+	legacy := make([]byte, legacyKeyBytes)
+	_, err := rand.Read(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyKey := base64.URLEncoding.EncodeToString(legacy)
+
+	tests := []struct {
+		name string
+		key  string
+		want bool
+	}{
+		{"legacy key", legacyKey, true},
+		{"digest of a key", HashKey(legacyKey), false},
+		{"digest of a digest", HashKey(HashKey(legacyKey)), false},
+		{"empty", "", false},
+		{"too short", legacyKey[:47], false},
+		{"standard base64", strings.Repeat("+", 48), false},
+		{"API key", APIKeyPrefix + legacyKey[:43], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsLegacyKey(tt.key); got != tt.want {
+				t.Errorf("IsLegacyKey(%q) = %v, want %v", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyExpired(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tests := []struct {
+		expiresAt string
+		want      bool
+	}{
+		{"", false},
+		{"999", true},
+		{"1000", true},
+		{"1001", false},
+		{"garbage", false},
+	}
+	for _, tt := range tests {
+		if got := KeyExpired(tt.expiresAt, now); got != tt.want {
+			t.Errorf("KeyExpired(%q) = %v, want %v", tt.expiresAt, got, tt.want)
+		}
+	}
+}
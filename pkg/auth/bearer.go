@@ -0,0 +1,19 @@
+package auth
+
+import "strings"
+
+// AuthorizationHeader carries the auth key on REST requests, as "Bearer <key>"
+const AuthorizationHeader = "Authorization"
+
+// BearerToken returns the auth key from the Authorization header
+func BearerToken(headers map[string]string) (string, bool) {
+	value, ok := GetHeader(headers, AuthorizationHeader)
+	if !ok {
+		return "", false
+	}
+	scheme, token, found := strings.Cut(strings.TrimSpace(value), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
@@ -0,0 +1,56 @@
+package auth
+
+import "strings"
+
+const (
+	// ProtocolHeader carries the auth key, browsers can't set any other header on a websocket handshake
+	ProtocolHeader = "Sec-WebSocket-Protocol"
+	// ProtocolPrefix marks the subprotocol entry that carries the auth key, e.g. "auth.<key>"
+	ProtocolPrefix = "auth."
+)
+
+// GetHeader looks up a header by name, ignoring the case used by the client
+func GetHeader(headers map[string]string, name string) (string, bool) {
+	if value, ok := headers[name]; ok {
+		return value, true
+	}
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// SelectProtocol picks the auth entry from a comma-separated Sec-WebSocket-Protocol value.
+// It returns the subprotocol to echo back to the client and the auth key it carries.
+// Clients that don't use the "auth." prefix send the bare key as the first entry.
+func SelectProtocol(header string) (protocol string, key string) {
+	var first string
+	for _, entry := range strings.Split(header, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.HasPrefix(entry, ProtocolPrefix) {
+			return entry, strings.TrimPrefix(entry, ProtocolPrefix)
+		}
+		if first == "" {
+			first = entry
+		}
+	}
+	return first, first
+}
+
+// ResponseHeaders returns the handshake response headers echoing only the selected subprotocol
+func ResponseHeaders(requestHeaders map[string]string) map[string]string {
+	header, ok := GetHeader(requestHeaders, ProtocolHeader)
+	if !ok {
+		return nil
+	}
+	protocol, _ := SelectProtocol(header)
+	if protocol == "" {
+		return nil
+	}
+	return map[string]string{ProtocolHeader: protocol}
+}
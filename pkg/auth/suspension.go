@@ -0,0 +1,23 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+)
+
+// Suspension tells a blocked user why and until when the account can't be used
+type Suspension struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+	// ExpiresAt is the unix time the suspension ends, 0 if it lasts until an admin lifts it
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
+// CheckUser returns the suspension of a user resolved from an auth key, and false if the user may continue
+func CheckUser(user users.User, now time.Time) (Suspension, bool) {
+	if !user.Blocked(now) {
+		return Suspension{}, false
+	}
+	return Suspension{Status: user.Status, Reason: user.BanReason, ExpiresAt: user.BanExpiresAt}, true
+}
@@ -0,0 +1,95 @@
+// Package connlimit holds the per-connection limits of the websocket proxies: the largest message a client may
+// send and how many messages a connection may send per minute, so a misbehaving client can't run up Anthropic spend.
+// The proxies count messages on the connection's WS_CONNECTIONS item, this package holds the settings and the
+// throttle frame. It has no AWS SDK dependency so both the v1 and v2 SDK based lambdas can use it.
+package connlimit
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	EnvMaxMessageBytes   = "WS_MAX_MESSAGE_BYTES"
+	EnvMessagesPerMinute = "WS_MESSAGES_PER_MINUTE"
+
+	DefaultMaxMessageBytes   = 32 * 1024
+	DefaultMessagesPerMinute = 30
+
+	// Window is the fixed window messages are counted in
+	Window = time.Minute
+	// AttrWindow and AttrCount count the messages of the current window on the WS_CONNECTIONS item
+	AttrWindow = "msg_window"
+	AttrCount  = "msg_count"
+
+	// FrameType is the type of the frame a throttled message is answered with
+	FrameType = "throttled"
+	// ReasonMessageTooLarge and ReasonRateLimited tell the client which limit it hit
+	ReasonMessageTooLarge = "message_too_large"
+	ReasonRateLimited     = "rate_limited"
+)
+
+// Limits are the per-connection limits, 0 turns a limit off
+type Limits struct {
+	MaxMessageBytes   int64
+	MessagesPerMinute int64
+}
+
+// Throttle tells the client why its message was refused
+type Throttle struct {
+	Reason string `json:"reason"`
+	// Limit is the byte or message limit that was hit
+	Limit int64 `json:"limit"`
+	// RetryAfter is the number of seconds until the connection may send again, only set for rate limits
+	RetryAfter int64 `json:"retry_after,omitempty"`
+}
+
+// Frame is the throttle frame of proxies that have no frame type of their own
+type Frame struct {
+	Type     string   `json:"type"`
+	Throttle Throttle `json:"throttle"`
+}
+
+// LoadFromEnv reads the limits, the defaults apply to unset variables
+func LoadFromEnv() (Limits, error) {
+	limits := Limits{
+		MaxMessageBytes:   DefaultMaxMessageBytes,
+		MessagesPerMinute: DefaultMessagesPerMinute,
+	}
+	if value := os.Getenv(EnvMaxMessageBytes); value != "" {
+		maxBytes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || maxBytes < 0 {
+			return limits, fmt.Errorf("invalid size in environment variable %s: %q", EnvMaxMessageBytes, value)
+		}
+		limits.MaxMessageBytes = maxBytes
+	}
+	if value := os.Getenv(EnvMessagesPerMinute); value != "" {
+		count, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || count < 0 {
+			return limits, fmt.Errorf("invalid message count in environment variable %s: %q", EnvMessagesPerMinute, value)
+		}
+		limits.MessagesPerMinute = count
+	}
+	return limits, nil
+}
+
+// CheckSize returns the throttle of a message of size bytes, false if it is within the limit
+func (l Limits) CheckSize(size int) (Throttle, bool) {
+	if l.MaxMessageBytes == 0 || int64(size) <= l.MaxMessageBytes {
+		return Throttle{}, false
+	}
+	return Throttle{Reason: ReasonMessageTooLarge, Limit: l.MaxMessageBytes}, true
+}
+
+// RateLimited returns the throttle of a message refused by the rate limit at now
+func (l Limits) RateLimited(now time.Time) Throttle {
+	windowEnd := now.Truncate(Window).Add(Window)
+	return Throttle{Reason: ReasonRateLimited, Limit: l.MessagesPerMinute, RetryAfter: int64(windowEnd.Sub(now).Seconds()) + 1}
+}
+
+// WindowStart returns the start of the window a message at t counts in, as a unix time
+func WindowStart(t time.Time) int64 {
+	return t.Truncate(Window).Unix()
+}
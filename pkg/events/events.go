@@ -0,0 +1,185 @@
+// Package events defines the versioned internal events exchanged between the lambdas.
+// Producers wrap a payload in an Envelope with Marshal, consumers check the type and version with Unmarshal.
+// Import it under an alias where github.com/aws/aws-lambda-go/events is used as well.
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/money"
+)
+
+const (
+	TypeOrderReceived    = "OrderReceived"
+	TypePaymentSucceeded = "PaymentSucceeded"
+	TypeTokensCredited   = "TokensCredited"
+	TypeReadingCompleted = "ReadingCompleted"
+	TypeUserCreated      = "UserCreated"
+
+	// Version is bumped for every payload change that isn't backwards compatible
+	Version = 1
+)
+
+// Event is implemented by every payload
+type Event interface {
+	// EventType returns the Type* constant of the payload
+	EventType() string
+	// Validate returns an error if a required field is missing
+	Validate() error
+}
+
+// Envelope is the JSON document sent on the bus
+type Envelope struct {
+	Type       string          `json:"type"`
+	Version    int             `json:"version"`
+	OccurredAt int64           `json:"occurred_at"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// OrderReceived is emitted when an order is recorded, before it is paid.
+// Amounts in events are in minor units of their currency, see pkg/money.
+type OrderReceived struct {
+	OrderID  string `json:"order_id"`
+	UserHash string `json:"user_hash"`
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+	Source   string `json:"source"`
+}
+
+// PaymentSucceeded is emitted when the payment of an order is captured
+type PaymentSucceeded struct {
+	OrderID   string `json:"order_id"`
+	UserHash  string `json:"user_hash"`
+	PaymentID string `json:"payment_id"`
+	Amount    int64  `json:"amount"`
+	Currency  string `json:"currency"`
+}
+
+// TokensCredited is emitted when requests are added to a user's balance
+type TokensCredited struct {
+	UserHash string `json:"user_hash"`
+	Requests int64  `json:"requests"`
+	Reason   string `json:"reason"`
+	OrderID  string `json:"order_id,omitempty"`
+}
+
+// ReadingCompleted is emitted when a streamed response finishes
+type ReadingCompleted struct {
+	RequestID      string  `json:"request_id"`
+	UserHash       string  `json:"user_hash"`
+	PromptTemplate string  `json:"prompt_template"`
+	Model          string  `json:"model"`
+	InputTokens    int64   `json:"input_tokens"`
+	OutputTokens   int64   `json:"output_tokens"`
+	EstimatedCost  float64 `json:"estimated_cost"`
+}
+
+// UserCreated is emitted when a user is provisioned on first login
+type UserCreated struct {
+	UserHash   string `json:"user_hash"`
+	Plan       string `json:"plan"`
+	ReferredBy string `json:"referred_by,omitempty"`
+}
+
+func (OrderReceived) EventType() string    { return TypeOrderReceived }
+func (PaymentSucceeded) EventType() string { return TypePaymentSucceeded }
+func (TokensCredited) EventType() string   { return TypeTokensCredited }
+func (ReadingCompleted) EventType() string { return TypeReadingCompleted }
+func (UserCreated) EventType() string      { return TypeUserCreated }
+
+// Money returns the order amount with its currency
+func (e OrderReceived) Money() money.Amount {
+	return money.New(e.Amount, e.Currency)
+}
+
+// Money returns the captured amount with its currency
+func (e PaymentSucceeded) Money() money.Amount {
+	return money.New(e.Amount, e.Currency)
+}
+
+// Validate implements Event
+func (e OrderReceived) Validate() error {
+	return required(map[string]string{"order_id": e.OrderID, "user_hash": e.UserHash, "currency": e.Currency})
+}
+
+// Validate implements Event
+func (e PaymentSucceeded) Validate() error {
+	return required(map[string]string{"order_id": e.OrderID, "user_hash": e.UserHash, "payment_id": e.PaymentID})
+}
+
+// Validate implements Event
+func (e TokensCredited) Validate() error {
+	if e.Requests <= 0 {
+		return errors.New("requests must be positive")
+	}
+	return required(map[string]string{"user_hash": e.UserHash, "reason": e.Reason})
+}
+
+// Validate implements Event
+func (e ReadingCompleted) Validate() error {
+	return required(map[string]string{"request_id": e.RequestID, "model": e.Model})
+}
+
+// Validate implements Event
+func (e UserCreated) Validate() error {
+	return required(map[string]string{"user_hash": e.UserHash, "plan": e.Plan})
+}
+
+// required returns an error naming an empty field
+func required(fields map[string]string) error {
+	for name, value := range fields {
+		if value == "" {
+			return fmt.Errorf("%s is required", name)
+		}
+	}
+	return nil
+}
+
+// Marshal validates the event and wraps it in an Envelope
+func Marshal(event Event, occurredAt time.Time) ([]byte, error) {
+	err := event.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s event: %w", event.EventType(), err)
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s event: %w", event.EventType(), err)
+	}
+
+	return json.Marshal(Envelope{
+		Type:       event.EventType(),
+		Version:    Version,
+		OccurredAt: occurredAt.Unix(),
+		Data:       data,
+	})
+}
+
+// ParseEnvelope reads the envelope without decoding the payload, so consumers can switch on the type
+func ParseEnvelope(body []byte) (Envelope, error) {
+	var envelope Envelope
+	err := json.Unmarshal(body, &envelope)
+	if err != nil {
+		return envelope, fmt.Errorf("failed to unmarshal event envelope: %w", err)
+	}
+	if envelope.Version > Version {
+		return envelope, fmt.Errorf("unsupported %s event version %d", envelope.Type, envelope.Version)
+	}
+	return envelope, nil
+}
+
+// Unmarshal decodes the envelope payload into event, which must be a pointer, and validates it.
+// The envelope type must match the event.
+func Unmarshal(envelope Envelope, event Event) error {
+	if envelope.Type != event.EventType() {
+		return fmt.Errorf("event type %s doesn't match %s", envelope.Type, event.EventType())
+	}
+	err := json.Unmarshal(envelope.Data, event)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal %s event: %w", envelope.Type, err)
+	}
+	return event.Validate()
+}
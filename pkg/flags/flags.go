@@ -0,0 +1,153 @@
+// Package flags reads feature flags from the FEATURE_FLAGS DynamoDB table so
+// features can be toggled per environment or per user bucket without a redeploy.
+package flags
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// DefaultTTL is how long flags are cached in memory between table scans
+	DefaultTTL = time.Minute
+	// EnvTableName is the environment variable holding the flags table name
+	EnvTableName = "FEATURE_FLAGS_TABLE"
+
+	fullRollout = 100
+)
+
+// Flag is a single FEATURE_FLAGS item
+type Flag struct {
+	Name    string
+	Enabled bool
+	// Rollout is the percentage (0-100) of subjects the flag is enabled for
+	Rollout int
+}
+
+// Store caches the FEATURE_FLAGS table in memory.
+// It is safe for concurrent use and meant to live for the lifetime of the lambda execution environment.
+type Store struct {
+	tableName string
+	ttl       time.Duration
+
+	mu       sync.Mutex
+	client   *dynamodb.Client
+	flags    map[string]Flag
+	loadedAt time.Time
+}
+
+// NewStore returns a Store for tableName. With an empty tableName every lookup returns its fallback.
+func NewStore(tableName string, ttl time.Duration) *Store {
+	return &Store{
+		tableName: tableName,
+		ttl:       ttl,
+	}
+}
+
+// Enabled reports whether the flag is enabled for subject (usually a user hash or connection ID).
+// fallback is returned when the flag doesn't exist or the table can't be read.
+func (s *Store) Enabled(ctx context.Context, name string, subject string, fallback bool) bool {
+	if s == nil || s.tableName == "" {
+		return fallback
+	}
+
+	flag, ok, err := s.get(ctx, name)
+	if err != nil {
+		fmt.Printf("Can't load feature flags: %v\n", err)
+		return fallback
+	}
+	if !ok {
+		return fallback
+	}
+
+	if !flag.Enabled {
+		return false
+	}
+	return bucket(name, subject) < flag.Rollout
+}
+
+// get returns a flag, reloading the table when the cache has expired
+func (s *Store) get(ctx context.Context, name string) (Flag, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.flags == nil || time.Since(s.loadedAt) > s.ttl {
+		flags, err := s.load(ctx)
+		if err != nil {
+			// Keep serving stale flags if we have them
+			if s.flags == nil {
+				return Flag{}, false, err
+			}
+			fmt.Printf("Can't refresh feature flags, using cached values: %v\n", err)
+		} else {
+			s.flags = flags
+			s.loadedAt = time.Now()
+		}
+	}
+
+	flag, ok := s.flags[name]
+	return flag, ok, nil
+}
+
+// load scans the whole flags table, which is expected to stay small
+func (s *Store) load(ctx context.Context) (map[string]Flag, error) {
+	if s.client == nil {
+		cfg, err := awsConfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS config: %w", err)
+		}
+		s.client = dynamodb.NewFromConfig(cfg)
+	}
+
+	flags := make(map[string]Flag)
+	paginator := dynamodb.NewScanPaginator(s.client, &dynamodb.ScanInput{
+		TableName: aws.String(s.tableName),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %w", s.tableName, err)
+		}
+		for _, item := range page.Items {
+			flag := parseFlag(item)
+			if flag.Name != "" {
+				flags[flag.Name] = flag
+			}
+		}
+	}
+	return flags, nil
+}
+
+// parseFlag converts a DynamoDB item into a Flag. A missing rollout_percent means 100.
+func parseFlag(item map[string]types.AttributeValue) Flag {
+	flag := Flag{Rollout: fullRollout}
+	if v, ok := item["name"].(*types.AttributeValueMemberS); ok {
+		flag.Name = v.Value
+	}
+	if v, ok := item["enabled"].(*types.AttributeValueMemberBOOL); ok {
+		flag.Enabled = v.Value
+	}
+	if v, ok := item["rollout_percent"].(*types.AttributeValueMemberN); ok {
+		rollout, err := strconv.Atoi(v.Value)
+		if err == nil {
+			flag.Rollout = rollout
+		}
+	}
+	return flag
+}
+
+// bucket maps a subject to a stable bucket in [0, 100) for the given flag
+func bucket(name string, subject string) int {
+	h := fnv.New32a()
+	h.Write([]byte(name + ":" + subject))
+	return int(h.Sum32() % fullRollout)
+}
@@ -0,0 +1,134 @@
+// Package health defines the SERVICE_HEALTH table the lambdas count dependency outcomes in, and how
+// the status page turns those counts into a component status.
+// It has no AWS SDK dependency so both the v1 and v2 SDK based lambdas can use it.
+package health
+
+import (
+	"time"
+
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+)
+
+const (
+	// TableName is the default SERVICE_HEALTH table name
+	TableName = "SERVICE_HEALTH"
+	// EnvTable overrides the table name
+	EnvTable = "HEALTH_TABLE"
+
+	// AttrComponent is the partition key, one of the Component* constants
+	AttrComponent = "component"
+	// AttrBucket is the sort key, the unix time of the start of the bucket
+	AttrBucket = "bucket"
+	// AttrOK and AttrErrors count the outcomes in the bucket
+	AttrOK     = "ok_count"
+	AttrErrors = "error_count"
+	// AttrExpiresAt is the TTL attribute
+	AttrExpiresAt = "expires_at"
+
+	ComponentLLM         = "llm"
+	ComponentPayments    = "payments"
+	ComponentOTPDelivery = "otp_delivery"
+	// ComponentAnthropic counts only the readings Anthropic itself answered, the anthropic proxy fails over
+	// to another provider on it. It isn't shown on the status page.
+	ComponentAnthropic = "anthropic"
+
+	StatusOperational = "operational"
+	StatusDegraded    = "degraded"
+	StatusOutage      = "outage"
+	// StatusUnknown is reported for components without enough recent calls to judge
+	StatusUnknown = "unknown"
+
+	// BucketSize is the granularity of the counters
+	BucketSize = time.Minute
+	// Retention is how long counters are kept
+	Retention = 24 * time.Hour
+)
+
+// Components are the components shown on the status page, in display order
+var Components = []string{ComponentLLM, ComponentPayments, ComponentOTPDelivery}
+
+// Counts are the outcomes of calls to a component
+type Counts struct {
+	OK     int64
+	Errors int64
+}
+
+// Total returns the number of calls
+func (c Counts) Total() int64 {
+	return c.OK + c.Errors
+}
+
+// ErrorRate returns the share of failed calls, 0 without calls
+func (c Counts) ErrorRate() float64 {
+	if c.Total() == 0 {
+		return 0
+	}
+	return float64(c.Errors) / float64(c.Total())
+}
+
+// Thresholds turn an error rate into a status
+type Thresholds struct {
+	Degraded float64
+	Outage   float64
+	// MinCalls is the number of calls needed before an error rate means anything
+	MinCalls int64
+}
+
+// DefaultThresholds reports a component degraded from 5% failed calls and down from 50%
+var DefaultThresholds = Thresholds{Degraded: 0.05, Outage: 0.5, MinCalls: 5}
+
+// Status returns the status of a component with the given counts
+func (t Thresholds) Status(counts Counts) string {
+	switch {
+	case counts.Total() < t.MinCalls:
+		return StatusUnknown
+	case counts.ErrorRate() >= t.Outage:
+		return StatusOutage
+	case counts.ErrorRate() >= t.Degraded:
+		return StatusDegraded
+	default:
+		return StatusOperational
+	}
+}
+
+// Worse reports whether status a is worse than status b, unknown counts as operational
+func Worse(a string, b string) bool {
+	return severity(a) > severity(b)
+}
+
+func severity(status string) int {
+	switch status {
+	case StatusOutage:
+		return 2
+	case StatusDegraded:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Table returns the SERVICE_HEALTH table name, the test table in test mode
+func Table(name string) string {
+	if name == "" {
+		name = TableName
+	}
+	return testmode.Table(name)
+}
+
+// Bucket returns the bucket a call at t is counted in
+func Bucket(t time.Time) int64 {
+	return t.Truncate(BucketSize).Unix()
+}
+
+// ExpiresAt returns the TTL of the bucket a call at t is counted in
+func ExpiresAt(t time.Time) int64 {
+	return t.Truncate(BucketSize).Add(Retention).Unix()
+}
+
+// CounterAttr returns the attribute a call outcome is added to
+func CounterAttr(failed bool) string {
+	if failed {
+		return AttrErrors
+	}
+	return AttrOK
+}
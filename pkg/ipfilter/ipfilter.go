@@ -0,0 +1,170 @@
+// Package ipfilter implements an optional source IP and country filter for the
+// REST lambdas behind API Gateway.
+package ipfilter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	envIPAllowlist      = "IP_ALLOWLIST"
+	envIPDenylist       = "IP_DENYLIST"
+	envCountryAllowlist = "COUNTRY_ALLOWLIST"
+	envCountryDenylist  = "COUNTRY_DENYLIST"
+	// envTrustCloudFront is "true" when the API is only reachable through CloudFront, which sets the
+	// country header. Anywhere else clients can set the header themselves.
+	envTrustCloudFront = "TRUST_CLOUDFRONT_COUNTRY"
+	countryHeader      = "CloudFront-Viewer-Country"
+)
+
+// Handler is the signature of the API Gateway REST lambda handlers
+type Handler func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
+
+// Filter holds CIDR and country rules. A zero Filter allows everything.
+type Filter struct {
+	AllowNets      []*net.IPNet
+	DenyNets       []*net.IPNet
+	AllowCountries map[string]bool
+	DenyCountries  map[string]bool
+	// TrustCloudFront takes the country from the CloudFront-Viewer-Country header, otherwise it is unknown
+	TrustCloudFront bool
+}
+
+// LoadFromEnv builds a Filter from the comma-separated IP_ALLOWLIST, IP_DENYLIST,
+// COUNTRY_ALLOWLIST and COUNTRY_DENYLIST environment variables. Country rules need
+// TRUST_CLOUDFRONT_COUNTRY, without a trusted country header they can't be enforced.
+func LoadFromEnv() (*Filter, error) {
+	allowNets, err := parseCIDRs(os.Getenv(envIPAllowlist))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", envIPAllowlist, err)
+	}
+	denyNets, err := parseCIDRs(os.Getenv(envIPDenylist))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", envIPDenylist, err)
+	}
+
+	filter := &Filter{
+		AllowNets:       allowNets,
+		DenyNets:        denyNets,
+		AllowCountries:  parseCountries(os.Getenv(envCountryAllowlist)),
+		DenyCountries:   parseCountries(os.Getenv(envCountryDenylist)),
+		TrustCloudFront: os.Getenv(envTrustCloudFront) == "true",
+	}
+	if (len(filter.AllowCountries) > 0 || len(filter.DenyCountries) > 0) && !filter.TrustCloudFront {
+		return nil, errors.New("country rules need " + envTrustCloudFront + "=true behind CloudFront")
+	}
+	return filter, nil
+}
+
+// parseCIDRs parses a comma-separated list of CIDRs or single IP addresses
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// parseCountries parses a comma-separated list of ISO country codes
+func parseCountries(list string) map[string]bool {
+	countries := make(map[string]bool)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToUpper(strings.TrimSpace(entry))
+		if entry != "" {
+			countries[entry] = true
+		}
+	}
+	return countries
+}
+
+// containsIP reports whether ip is inside any of nets
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns an error if the source IP or country is not allowed.
+// Deny rules win over allow rules. An empty country is only rejected when a country allowlist is set.
+func (f *Filter) Check(sourceIP, country string) error {
+	ip := net.ParseIP(sourceIP)
+	if ip == nil && (len(f.AllowNets) > 0 || len(f.DenyNets) > 0) {
+		return fmt.Errorf("invalid source IP: %q", sourceIP)
+	}
+	if ip != nil && containsIP(f.DenyNets, ip) {
+		return fmt.Errorf("source IP %s is denylisted", sourceIP)
+	}
+	if len(f.AllowNets) > 0 && !containsIP(f.AllowNets, ip) {
+		return fmt.Errorf("source IP %s is not allowlisted", sourceIP)
+	}
+
+	country = strings.ToUpper(country)
+	if f.DenyCountries[country] {
+		return fmt.Errorf("country %s is denylisted", country)
+	}
+	if len(f.AllowCountries) > 0 && !f.AllowCountries[country] {
+		return fmt.Errorf("country %q is not allowlisted", country)
+	}
+	return nil
+}
+
+// Middleware wraps handler and rejects requests that don't pass the filter with 403 Forbidden.
+// The country is taken from the CloudFront-Viewer-Country header only if the filter trusts CloudFront.
+func Middleware(f *Filter, handler Handler) Handler {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		country := ""
+		if f.TrustCloudFront {
+			for name, value := range request.Headers {
+				if strings.EqualFold(name, countryHeader) {
+					country = value
+				}
+			}
+		}
+
+		err := f.Check(request.RequestContext.Identity.SourceIP, country)
+		if err != nil {
+			fmt.Printf("Request blocked: %v\n", err)
+			body, _ := json.Marshal(struct {
+				Message string `json:"message"`
+			}{
+				Message: "Forbidden",
+			})
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusForbidden,
+				Body:       string(body),
+				Headers: map[string]string{
+					"Content-Type": "application/json",
+				},
+			}, nil
+		}
+
+		return handler(ctx, request)
+	}
+}
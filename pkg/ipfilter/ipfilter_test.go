@@ -0,0 +1,123 @@
+package ipfilter
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestCheck(t *testing.T) {
+	allowNets, err := parseCIDRs("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	denyNets, err := parseCIDRs("10.1.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter := &Filter{
+		AllowNets:      allowNets,
+		DenyNets:       denyNets,
+		AllowCountries: parseCountries("ca,us"),
+		DenyCountries:  parseCountries("US"),
+	}
+
+	tests := []struct {
+		name    string
+		ip      string
+		country string
+		allowed bool
+	}{
+		{"allowlisted", "10.2.3.4", "CA", true},
+		{"single address", "192.168.1.1", "ca", true},
+		{"not allowlisted", "172.16.0.1", "CA", false},
+		{"deny wins over allow", "10.1.2.3", "CA", false},
+		{"invalid address", "not-an-ip", "CA", false},
+		{"denylisted country", "10.2.3.4", "US", false},
+		{"country not allowlisted", "10.2.3.4", "FR", false},
+		{"unknown country", "10.2.3.4", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := filter.Check(tt.ip, tt.country)
+			if (err == nil) != tt.allowed {
+				t.Errorf("Check(%q, %q) = %v, want allowed %v", tt.ip, tt.country, err, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestLoadFromEnvNeedsTrustedCountryHeader(t *testing.T) {
+	t.Setenv(envCountryAllowlist, "CA")
+	_, err := LoadFromEnv()
+	if err == nil {
+		t.Fatal("country rules loaded without a trusted country header")
+	}
+
+	t.Setenv(envTrustCloudFront, "true")
+	filter, err := LoadFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filter.TrustCloudFront || !filter.AllowCountries["CA"] {
+		t.Errorf("unexpected filter %+v", filter)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	ok := func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+	}
+	request := func(country string) events.APIGatewayProxyRequest {
+		request := events.APIGatewayProxyRequest{Headers: map[string]string{"cloudfront-viewer-country": country}}
+		request.RequestContext.Identity.SourceIP = "203.0.113.7"
+		return request
+	}
+
+	tests := []struct {
+		name    string
+		filter  *Filter
+		country string
+		status  int
+	}{
+		{"trusted country header", &Filter{AllowCountries: parseCountries("CA"), TrustCloudFront: true}, "CA", http.StatusOK},
+		{"trusted country header not allowlisted", &Filter{AllowCountries: parseCountries("CA"), TrustCloudFront: true}, "FR", http.StatusForbidden},
+		{"untrusted country header is ignored", &Filter{AllowCountries: parseCountries("CA")}, "CA", http.StatusForbidden},
+		{"untrusted header can't dodge a denylist", &Filter{DenyNets: mustParseCIDRs(t, "203.0.113.0/24")}, "CA", http.StatusForbidden},
+		{"zero filter", &Filter{}, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := Middleware(tt.filter, ok)(context.Background(), request(tt.country))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", response.StatusCode, tt.status)
+			}
+			if response.StatusCode != http.StatusForbidden {
+				return
+			}
+			var body struct {
+				Message string `json:"message"`
+			}
+			err = json.Unmarshal([]byte(response.Body), &body)
+			if err != nil || body.Message == "" {
+				t.Errorf("body %q is not a JSON error: %v", response.Body, err)
+			}
+		})
+	}
+}
+
+func mustParseCIDRs(t *testing.T, list string) []*net.IPNet {
+	t.Helper()
+	nets, err := parseCIDRs(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nets
+}
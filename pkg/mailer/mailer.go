@@ -0,0 +1,126 @@
+// Package mailer sends the plain text emails of the lambdas through SES. It checks the sending identity
+// up front, so a misconfigured account fails at startup instead of on the first user's email.
+package mailer
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ses"
+)
+
+const (
+	// EnvRedirectTo sends every email to this address instead of the recipient, for non-production stages
+	EnvRedirectTo = "MAIL_REDIRECT_TO"
+
+	// sandboxSendQuota is the daily quota of SES accounts without production access
+	sandboxSendQuota = 200
+)
+
+// Mailer sends emails from one source address
+type Mailer struct {
+	client     *ses.SES
+	source     string
+	redirectTo string
+	// sandbox is set by CheckIdentity when the account can only send to verified addresses
+	sandbox bool
+}
+
+// New returns a Mailer sending from source, redirecting all mail if MAIL_REDIRECT_TO is set
+func New(sess *session.Session, source string) *Mailer {
+	return &Mailer{
+		client:     ses.New(sess),
+		source:     source,
+		redirectTo: strings.TrimSpace(os.Getenv(EnvRedirectTo)),
+	}
+}
+
+// verified reports whether the address or its domain is a verified SES identity
+func (m *Mailer) verified(address string) (bool, error) {
+	identities := []*string{aws.String(address)}
+	if _, domain, found := strings.Cut(address, "@"); found {
+		identities = append(identities, aws.String(domain))
+	}
+
+	result, err := m.client.GetIdentityVerificationAttributes(&ses.GetIdentityVerificationAttributesInput{
+		Identities: identities,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to get identity verification attributes: %w", err)
+	}
+	for _, attributes := range result.VerificationAttributes {
+		if aws.StringValue(attributes.VerificationStatus) == ses.VerificationStatusSuccess {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CheckIdentity returns an error if the source address can't send, and detects sandbox accounts.
+// In the sandbox the redirect address has to be verified as well.
+func (m *Mailer) CheckIdentity() error {
+	ok, err := m.verified(m.source)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("SES identity %s is not verified", m.source)
+	}
+
+	quota, err := m.client.GetSendQuota(&ses.GetSendQuotaInput{})
+	if err != nil {
+		return fmt.Errorf("failed to get send quota: %w", err)
+	}
+	m.sandbox = aws.Float64Value(quota.Max24HourSend) <= sandboxSendQuota
+	if m.sandbox {
+		fmt.Printf("SES account is in sandbox mode, only verified recipients get email\n")
+	}
+
+	if m.redirectTo != "" {
+		fmt.Printf("Redirecting all email to %s\n", m.redirectTo)
+		if m.sandbox {
+			ok, err = m.verified(m.redirectTo)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("SES is in sandbox mode and redirect address %s is not verified", m.redirectTo)
+			}
+		}
+	}
+	return nil
+}
+
+// Send emails a plain text message. Redirected mail keeps the original recipient in the subject.
+func (m *Mailer) Send(to, subject, body string) error {
+	if m.redirectTo != "" {
+		subject = fmt.Sprintf("[to %s] %s", to, subject)
+		to = m.redirectTo
+	} else if m.sandbox {
+		// SES would reject the email anyway, say why
+		ok, err := m.verified(to)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("SES is in sandbox mode and recipient %s is not verified", to)
+		}
+	}
+
+	_, err := m.client.SendEmail(&ses.SendEmailInput{
+		Source: aws.String(m.source),
+		Destination: &ses.Destination{
+			ToAddresses: []*string{aws.String(to)},
+		},
+		Message: &ses.Message{
+			Subject: &ses.Content{Data: aws.String(subject)},
+			Body: &ses.Body{
+				Text: &ses.Content{Data: aws.String(body)},
+			},
+		},
+	})
+	return err
+}
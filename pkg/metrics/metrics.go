@@ -0,0 +1,70 @@
+// Package metrics emits CloudWatch metrics in the Embedded Metric Format. The records are printed to stdout
+// with the rest of the logs and CloudWatch Logs extracts the metrics, so no API call is made per request.
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	// EnvNamespace overrides the CloudWatch namespace
+	EnvNamespace     = "METRICS_NAMESPACE"
+	defaultNamespace = "aws-lambdas-go"
+
+	UnitCount        = "Count"
+	UnitMilliseconds = "Milliseconds"
+)
+
+// Metric is a single value in an EMF record
+type Metric struct {
+	Name  string
+	Unit  string
+	Value float64
+}
+
+// Namespace returns the CloudWatch namespace from METRICS_NAMESPACE
+func Namespace() string {
+	if namespace := os.Getenv(EnvNamespace); namespace != "" {
+		return namespace
+	}
+	return defaultNamespace
+}
+
+// Emit prints one EMF record with the metrics aggregated over all the given dimensions together.
+// Dimension values should come from a small fixed set, every distinct combination is a separate metric.
+func Emit(dimensions map[string]string, metrics ...Metric) {
+	names := make([]string, 0, len(dimensions))
+	for name := range dimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	definitions := make([]map[string]string, len(metrics))
+	record := map[string]interface{}{}
+	for name, value := range dimensions {
+		record[name] = value
+	}
+	for i, metric := range metrics {
+		definitions[i] = map[string]string{"Name": metric.Name, "Unit": metric.Unit}
+		record[metric.Name] = metric.Value
+	}
+	record["_aws"] = map[string]interface{}{
+		"Timestamp": time.Now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  Namespace(),
+			"Dimensions": [][]string{names},
+			"Metrics":    definitions,
+		}},
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		fmt.Printf("Can't marshal metrics: %v\n", err)
+		return
+	}
+	fmt.Println(string(data))
+}
@@ -0,0 +1,180 @@
+// Package money handles amounts as integer minor units (cents for USD, yen for JPY) with their currency.
+// Amounts never go through float64, parsing and formatting work on the decimal string directly.
+// Minor units follow Stripe's, so Stripe amounts convert without scaling.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// zeroDecimal are the currencies without minor units, the amount is in whole units
+var zeroDecimal = map[string]bool{
+	"BIF": true, "CLP": true, "DJF": true, "GNF": true, "JPY": true, "KMF": true, "KRW": true, "MGA": true,
+	"PYG": true, "RWF": true, "UGX": true, "VND": true, "VUV": true, "XAF": true, "XOF": true, "XPF": true,
+}
+
+// threeDecimal are the currencies with 1000 minor units per unit
+var threeDecimal = map[string]bool{
+	"BHD": true, "JOD": true, "KWD": true, "OMR": true, "TND": true,
+}
+
+var (
+	// ErrCurrencyMismatch is returned when amounts in different currencies are combined
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+	// ErrOverflow is returned when the result doesn't fit in int64 minor units
+	ErrOverflow = errors.New("amount overflows")
+)
+
+// Amount is a sum of money in minor units of an ISO 4217 currency
+type Amount struct {
+	Minor    int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// New returns an amount of minor units, the currency code is normalized to upper case
+func New(minor int64, currency string) Amount {
+	return Amount{Minor: minor, Currency: strings.ToUpper(strings.TrimSpace(currency))}
+}
+
+// Exponent returns the number of decimal places of the currency's minor unit
+func Exponent(currency string) int {
+	currency = strings.ToUpper(currency)
+	switch {
+	case zeroDecimal[currency]:
+		return 0
+	case threeDecimal[currency]:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// Parse reads a decimal amount such as "12", "12.5" or "-0.99" in the currency's major units.
+// More decimal places than the currency has are rejected rather than rounded.
+func Parse(value string, currency string) (Amount, error) {
+	amount := New(0, currency)
+	exponent := Exponent(amount.Currency)
+
+	value = strings.TrimSpace(value)
+	negative := strings.HasPrefix(value, "-")
+	value = strings.TrimPrefix(value, "-")
+
+	whole, fraction, hasFraction := strings.Cut(value, ".")
+	if whole == "" || (hasFraction && fraction == "") {
+		return amount, fmt.Errorf("invalid amount %q", value)
+	}
+	if len(fraction) > exponent {
+		return amount, fmt.Errorf("amount %q has more than %d decimal places for %s", value, exponent, amount.Currency)
+	}
+	fraction += strings.Repeat("0", exponent-len(fraction))
+
+	for _, part := range []string{whole, fraction} {
+		if strings.Trim(part, "0123456789") != "" {
+			return amount, fmt.Errorf("invalid amount %q", value)
+		}
+	}
+
+	minor, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return amount, fmt.Errorf("invalid amount %q: %w", value, err)
+	}
+	if negative {
+		minor = -minor
+	}
+	amount.Minor = minor
+	return amount, nil
+}
+
+// Decimal formats the amount in major units with the currency's decimal places, e.g. "12.00"
+func (a Amount) Decimal() string {
+	exponent := Exponent(a.Currency)
+	minor := a.Minor
+	sign := ""
+	if minor < 0 {
+		sign = "-"
+	}
+	digits := strconv.FormatUint(absUint(minor), 10)
+	if exponent == 0 {
+		return sign + digits
+	}
+	if len(digits) <= exponent {
+		digits = strings.Repeat("0", exponent-len(digits)+1) + digits
+	}
+	split := len(digits) - exponent
+	return sign + digits[:split] + "." + digits[split:]
+}
+
+// String formats the amount with its currency code, e.g. "12.00 CAD"
+func (a Amount) String() string {
+	return a.Decimal() + " " + a.Currency
+}
+
+// IsZero reports whether the amount is zero
+func (a Amount) IsZero() bool {
+	return a.Minor == 0
+}
+
+// Add returns a + b, both have to be in the same currency
+func (a Amount) Add(b Amount) (Amount, error) {
+	if a.Currency != b.Currency {
+		return a, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, a.Currency, b.Currency)
+	}
+	if (b.Minor > 0 && a.Minor > math.MaxInt64-b.Minor) || (b.Minor < 0 && a.Minor < math.MinInt64-b.Minor) {
+		return a, ErrOverflow
+	}
+	return Amount{Minor: a.Minor + b.Minor, Currency: a.Currency}, nil
+}
+
+// Sub returns a - b, both have to be in the same currency
+func (a Amount) Sub(b Amount) (Amount, error) {
+	if b.Minor == math.MinInt64 {
+		return a, ErrOverflow
+	}
+	return a.Add(Amount{Minor: -b.Minor, Currency: b.Currency})
+}
+
+// Mul returns the amount times n, e.g. the price of n items
+func (a Amount) Mul(n int64) (Amount, error) {
+	if a.Minor == 0 || n == 0 {
+		return Amount{Currency: a.Currency}, nil
+	}
+	result := a.Minor * n
+	if result/n != a.Minor || (a.Minor == -1 && n == math.MinInt64) || (n == -1 && a.Minor == math.MinInt64) {
+		return a, ErrOverflow
+	}
+	return Amount{Minor: result, Currency: a.Currency}, nil
+}
+
+// Prorate returns the share part/whole of the amount rounded down to a minor unit, e.g. for a partial refund
+func (a Amount) Prorate(part int64, whole int64) (Amount, error) {
+	if whole <= 0 || part < 0 || part > whole {
+		return a, fmt.Errorf("invalid share %d/%d", part, whole)
+	}
+	share, err := a.Mul(part)
+	if err != nil {
+		return a, err
+	}
+	return Amount{Minor: share.Minor / whole, Currency: a.Currency}, nil
+}
+
+// FromStripe converts a Stripe amount and its lower case currency code
+func FromStripe(amount int64, currency string) Amount {
+	return New(amount, currency)
+}
+
+// Stripe returns the amount and lower case currency code as the Stripe API expects them
+func (a Amount) Stripe() (int64, string) {
+	return a.Minor, strings.ToLower(a.Currency)
+}
+
+// absUint returns |n| without overflowing on math.MinInt64
+func absUint(n int64) uint64 {
+	if n < 0 {
+		return uint64(-(n + 1)) + 1
+	}
+	return uint64(n)
+}
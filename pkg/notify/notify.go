@@ -0,0 +1,61 @@
+// Package notify holds the notification categories users can opt out of and the signed unsubscribe links
+package notify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+)
+
+const (
+	CategoryLowBalance      = "low_balance"
+	CategoryPaymentReceipts = "payment_receipts"
+	CategoryProductUpdates  = "product_updates"
+
+	// EnvUnsubscribeSecret holds the HMAC key of the unsubscribe tokens
+	EnvUnsubscribeSecret = "UNSUBSCRIBE_SECRET"
+)
+
+// Defaults applies to categories the user hasn't set. Product updates are marketing and need an opt-in.
+var Defaults = map[string]bool{
+	CategoryLowBalance:      true,
+	CategoryPaymentReceipts: true,
+	CategoryProductUpdates:  false,
+}
+
+// ValidCategory reports whether category is a known notification category
+func ValidCategory(category string) bool {
+	_, ok := Defaults[category]
+	return ok
+}
+
+// Wants reports whether a user with the given preferences (the USERS notifications map) gets category notifications
+func Wants(preferences map[string]bool, category string) bool {
+	if enabled, ok := preferences[category]; ok {
+		return enabled
+	}
+	return Defaults[category]
+}
+
+// UnsubscribeToken signs the user and category, so unsubscribe links work without logging in but can't be forged
+func UnsubscribeToken(secret, userHash, category string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(userHash + "|" + category))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyUnsubscribeToken checks a token created by UnsubscribeToken
+func VerifyUnsubscribeToken(secret, userHash, category, token string) bool {
+	expected := UnsubscribeToken(secret, userHash, category)
+	return hmac.Equal([]byte(expected), []byte(token))
+}
+
+// UnsubscribeURL returns the GET /unsubscribe link for the user and category
+func UnsubscribeURL(baseURL, secret, userHash, category string) string {
+	query := url.Values{}
+	query.Set("user", userHash)
+	query.Set("category", category)
+	query.Set("token", UnsubscribeToken(secret, userHash, category))
+	return baseURL + "/unsubscribe?" + query.Encode()
+}
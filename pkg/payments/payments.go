@@ -0,0 +1,162 @@
+// Package payments defines the ORDERS table schema and the order state machine shared by the lambdas.
+// An order moves through the states below only along the allowed transitions, and every transition is
+// appended to the state history on the item. Like pkg/users it has no AWS SDK dependency.
+package payments
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+)
+
+// State is the state of an order
+type State string
+
+const (
+	// TableName is the default ORDERS table name
+	TableName = "ORDERS"
+
+	// AttrOrderID is the partition key of the ORDERS table
+	AttrOrderID = "order_id"
+	// AttrState holds the current State
+	AttrState = "state"
+	// AttrStateHistory is the list of transitions, oldest first
+	AttrStateHistory = "state_history"
+	// AttrLegacyActive is the 0/1 flag written before the state machine, see Order.CurrentState
+	AttrLegacyActive = "active"
+
+	StateCreated         State = "created"
+	StateAwaitingPayment State = "awaiting_payment"
+	StatePaid            State = "paid"
+	StateFulfilled       State = "fulfilled"
+	StateExpired         State = "expired"
+	StateRefunded        State = "refunded"
+	StateDisputed        State = "disputed"
+
+	// TransitionUpdate moves an order to :to and appends :change, a one element list, to the history.
+	// Use it with TransitionCondition and the names and values documented there.
+	TransitionUpdate = "SET #state = :to, #history = list_append(if_not_exists(#history, :empty), :change), updated_at = :now REMOVE #active"
+	// TransitionCondition fails the update if another writer changed the state first.
+	// #state, #history and #active are AttrState, AttrStateHistory and AttrLegacyActive, :from is the state
+	// read before the update and :empty an empty list.
+	TransitionCondition = "#state = :from"
+	// LegacyTransitionCondition replaces TransitionCondition for items that only have the active flag,
+	// :active is the flag read before the update
+	LegacyTransitionCondition = "attribute_not_exists(#state) AND #active = :active"
+)
+
+// transitions lists the states an order may move to from each state.
+// Expired and refunded orders are final.
+var transitions = map[State][]State{
+	StateCreated:         {StateAwaitingPayment, StateExpired},
+	StateAwaitingPayment: {StatePaid, StateExpired},
+	StatePaid:            {StateFulfilled, StateRefunded, StateDisputed},
+	StateFulfilled:       {StateRefunded, StateDisputed},
+	// A won dispute returns the order to fulfilled, a lost one refunds it
+	StateDisputed: {StateFulfilled, StateRefunded},
+}
+
+// ErrInvalidTransition is returned for a transition the state machine doesn't allow
+var ErrInvalidTransition = errors.New("invalid order state transition")
+
+// Valid reports whether s is one of the order states
+func (s State) Valid() bool {
+	switch s {
+	case StateCreated, StateAwaitingPayment, StatePaid, StateFulfilled, StateExpired, StateRefunded, StateDisputed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Final reports whether no transition leaves s
+func (s State) Final() bool {
+	return s.Valid() && len(transitions[s]) == 0
+}
+
+// CanTransition reports whether an order in from may move to to
+func CanTransition(from State, to State) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// StateChange is one entry of the state history
+type StateChange struct {
+	From State `json:"from,omitempty" dynamodbav:"from,omitempty"`
+	To   State `json:"to" dynamodbav:"to"`
+	// At is the unix time of the transition
+	At int64 `json:"at" dynamodbav:"at"`
+	// Reason says what caused the transition, e.g. a payment id or "checkout session expired"
+	Reason string `json:"reason,omitempty" dynamodbav:"reason,omitempty"`
+}
+
+// Order is the ORDERS item. Amounts are in minor units of their currency, see pkg/money.
+type Order struct {
+	OrderID      string        `json:"order_id" dynamodbav:"order_id"`
+	UserHash     string        `json:"user_hash" dynamodbav:"user_hash"`
+	Amount       int64         `json:"amount" dynamodbav:"amount"`
+	Currency     string        `json:"currency" dynamodbav:"currency"`
+	State        State         `json:"state,omitempty" dynamodbav:"state,omitempty"`
+	StateHistory []StateChange `json:"state_history,omitempty" dynamodbav:"state_history,omitempty"`
+	// LegacyActive is only set on items written before the state machine
+	LegacyActive *int  `json:"-" dynamodbav:"active,omitempty"`
+	CreatedAt    int64 `json:"created_at" dynamodbav:"created_at"`
+	UpdatedAt    int64 `json:"updated_at,omitempty" dynamodbav:"updated_at,omitempty"`
+	// TestRecord marks orders created in test mode, see pkg/testmode
+	TestRecord bool `json:"-" dynamodbav:"test_record,omitempty"`
+}
+
+// Table returns the ORDERS table name, the test table in test mode
+func Table() string {
+	return testmode.Table(TableName)
+}
+
+// NewOrder returns an order in the created state
+func NewOrder(orderID string, userHash string, amount int64, currency string, now time.Time) Order {
+	return Order{
+		OrderID:      orderID,
+		UserHash:     userHash,
+		Amount:       amount,
+		Currency:     currency,
+		State:        StateCreated,
+		StateHistory: []StateChange{{To: StateCreated, At: now.Unix()}},
+		CreatedAt:    now.Unix(),
+		UpdatedAt:    now.Unix(),
+		TestRecord:   testmode.Enabled(),
+	}
+}
+
+// CurrentState returns the state of the order. Items written before the state machine only have the
+// active flag: 1 was an open order and maps to awaiting payment. 0 was a closed order, and since closed
+// orders can't be told apart it maps to fulfilled, which can still be refunded or disputed.
+func (o Order) CurrentState() State {
+	if o.State != "" || o.LegacyActive == nil {
+		return o.State
+	}
+	if *o.LegacyActive == 1 {
+		return StateAwaitingPayment
+	}
+	return StateFulfilled
+}
+
+// Transition moves the order to to and appends the change to the state history.
+// The order is left unchanged if the state machine doesn't allow the transition.
+// Store the result with TransitionUpdate, conditioned on the state the order was read in.
+func (o *Order) Transition(to State, reason string, now time.Time) (StateChange, error) {
+	from := o.CurrentState()
+	if !CanTransition(from, to) {
+		return StateChange{}, fmt.Errorf("%w from %q to %q", ErrInvalidTransition, from, to)
+	}
+	change := StateChange{From: from, To: to, At: now.Unix(), Reason: reason}
+	o.State = to
+	o.StateHistory = append(o.StateHistory, change)
+	o.LegacyActive = nil
+	o.UpdatedAt = now.Unix()
+	return change, nil
+}
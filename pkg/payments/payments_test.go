@@ -0,0 +1,108 @@
+package payments
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var allStates = []State{StateCreated, StateAwaitingPayment, StatePaid, StateFulfilled, StateExpired, StateRefunded, StateDisputed}
+
+func TestCanTransition(t *testing.T) {
+	// allowed lists every allowed transition, every other pair of states is forbidden
+	allowed := map[State][]State{
+		StateCreated:         {StateAwaitingPayment, StateExpired},
+		StateAwaitingPayment: {StatePaid, StateExpired},
+		StatePaid:            {StateFulfilled, StateRefunded, StateDisputed},
+		StateFulfilled:       {StateRefunded, StateDisputed},
+		StateDisputed:        {StateFulfilled, StateRefunded},
+	}
+	for _, from := range allStates {
+		for _, to := range allStates {
+			want := false
+			for _, next := range allowed[from] {
+				want = want || next == to
+			}
+			if got := CanTransition(from, to); got != want {
+				t.Errorf("CanTransition(%s, %s) = %v, want %v", from, to, got, want)
+			}
+		}
+		if final := len(allowed[from]) == 0; from.Final() != final {
+			t.Errorf("%s.Final() = %v, want %v", from, from.Final(), final)
+		}
+	}
+
+	for _, state := range []State{"", "active", "PAID"} {
+		if state.Valid() || state.Final() {
+			t.Errorf("%q is a valid state", state)
+		}
+		if CanTransition(state, StatePaid) || CanTransition(StateCreated, state) {
+			t.Errorf("transition with unknown state %q is allowed", state)
+		}
+	}
+}
+
+func TestCurrentState(t *testing.T) {
+	one, zero := 1, 0
+	tests := []struct {
+		name  string
+		order Order
+		want  State
+	}{
+		{"state", Order{State: StatePaid}, StatePaid},
+		{"state wins over the active flag", Order{State: StateRefunded, LegacyActive: &one}, StateRefunded},
+		{"legacy active", Order{LegacyActive: &one}, StateAwaitingPayment},
+		{"legacy closed", Order{LegacyActive: &zero}, StateFulfilled},
+		{"neither", Order{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.order.CurrentState(); got != tt.want {
+				t.Errorf("CurrentState() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransition(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	order := NewOrder("order-1", "user-1", 500, "USD", now)
+	if order.CurrentState() != StateCreated || len(order.StateHistory) != 1 {
+		t.Fatalf("new order = %+v", order)
+	}
+
+	_, err := order.Transition(StatePaid, "skipped checkout", now)
+	if !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("created to paid: error = %v", err)
+	}
+	if order.State != StateCreated || len(order.StateHistory) != 1 {
+		t.Errorf("forbidden transition changed the order: %+v", order)
+	}
+
+	later := now.Add(time.Minute)
+	change, err := order.Transition(StateAwaitingPayment, "checkout", later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := StateChange{From: StateCreated, To: StateAwaitingPayment, At: later.Unix(), Reason: "checkout"}
+	if change != want || order.StateHistory[1] != want || order.State != StateAwaitingPayment || order.UpdatedAt != later.Unix() {
+		t.Errorf("transition = %+v, order = %+v", change, order)
+	}
+}
+
+func TestTransitionFromLegacyFlag(t *testing.T) {
+	closed := 0
+	order := Order{OrderID: "order-1", LegacyActive: &closed}
+	change, err := order.Transition(StateRefunded, "refund", time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.From != StateFulfilled || order.State != StateRefunded || order.LegacyActive != nil {
+		t.Errorf("transition = %+v, order = %+v", change, order)
+	}
+
+	_, err = order.Transition(StateFulfilled, "", time.Unix(1700000000, 0))
+	if !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("refunded order moved on: %v", err)
+	}
+}
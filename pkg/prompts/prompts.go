@@ -0,0 +1,174 @@
+// Package prompts resolves the prompt_template a client sends to the system prompt stored in the environment,
+// and renders prompts that take template_params.
+// Only allowlisted templates are read, so a client can't make a lambda send any of its environment
+// variables, like API keys, to the LLM. It has no AWS SDK dependency so both the v1 and v2 SDK based lambdas can use it.
+package prompts
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	// EnvAllowlist is a comma-separated list of the environment variables clients may use as prompt_template
+	EnvAllowlist = "PROMPT_TEMPLATE_ALLOWLIST"
+	// Prefix marks environment variables that are always allowed as prompt_template, e.g. PROMPTS_INDEED
+	Prefix = "PROMPTS_"
+)
+
+var (
+	// ErrNotAllowed is returned by Lookup for templates that aren't allowlisted
+	ErrNotAllowed = errors.New("prompt template is not allowed")
+	// ErrNotFound is returned by Lookup for allowlisted templates that aren't set
+	ErrNotFound = errors.New("prompt template not found")
+)
+
+// Allowed reports whether name may be used as a prompt_template
+func Allowed(name string) bool {
+	if name == "" {
+		return false
+	}
+	if strings.HasPrefix(name, Prefix) && len(name) > len(Prefix) {
+		return true
+	}
+	for _, allowed := range strings.Split(os.Getenv(EnvAllowlist), ",") {
+		if strings.TrimSpace(allowed) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup returns the prompt stored under name, if name is allowed and set
+func Lookup(name string) (string, error) {
+	if !Allowed(name) {
+		return "", fmt.Errorf("%w: %s", ErrNotAllowed, name)
+	}
+	prompt := os.Getenv(name)
+	if prompt == "" {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return prompt, nil
+}
+
+// FuncMap holds the functions prompts rendered with Render can use besides the text/template builtins
+var FuncMap = template.FuncMap{
+	"joinInts":    joinInts,
+	"joinStrings": joinStrings,
+	"commaFormat": commaFormat,
+}
+
+// Render runs prompt through text/template with params, e.g. "Cards: {{joinInts .cards \", \"}}".
+// Params referenced by the prompt but missing from params are an error.
+func Render(prompt string, params map[string]interface{}) (string, error) {
+	tmpl, err := template.New("prompt").Funcs(FuncMap).Option("missingkey=error").Parse(prompt)
+	if err != nil {
+		return "", fmt.Errorf("invalid prompt template: %w", err)
+	}
+	var rendered strings.Builder
+	err = tmpl.Execute(&rendered, params)
+	if err != nil {
+		return "", fmt.Errorf("failed to render prompt template: %w", err)
+	}
+	return rendered.String(), nil
+}
+
+// toSlice returns the elements of a JSON array param, which decodes to []interface{}, or of a Go slice
+func toSlice(values interface{}) ([]interface{}, error) {
+	switch v := values.(type) {
+	case []interface{}:
+		return v, nil
+	case []string:
+		result := make([]interface{}, len(v))
+		for i, value := range v {
+			result[i] = value
+		}
+		return result, nil
+	case []int:
+		result := make([]interface{}, len(v))
+		for i, value := range v {
+			result[i] = value
+		}
+		return result, nil
+	default:
+		return nil, fmt.Errorf("expected a list, got %T", values)
+	}
+}
+
+// toInt returns a whole number param as an int64. JSON numbers decode to float64.
+func toInt(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case float64:
+		if v != math.Trunc(v) {
+			return 0, fmt.Errorf("expected a whole number, got %v", v)
+		}
+		return int64(v), nil
+	default:
+		return 0, fmt.Errorf("expected a number, got %T", value)
+	}
+}
+
+// joinInts joins a list of whole numbers with sep
+func joinInts(values interface{}, sep string) (string, error) {
+	list, err := toSlice(values)
+	if err != nil {
+		return "", err
+	}
+	parts := make([]string, len(list))
+	for i, value := range list {
+		n, err := toInt(value)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = strconv.FormatInt(n, 10)
+	}
+	return strings.Join(parts, sep), nil
+}
+
+// joinStrings joins a list of strings with sep
+func joinStrings(values interface{}, sep string) (string, error) {
+	list, err := toSlice(values)
+	if err != nil {
+		return "", err
+	}
+	parts := make([]string, len(list))
+	for i, value := range list {
+		text, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("expected a string, got %T", value)
+		}
+		parts[i] = text
+	}
+	return strings.Join(parts, sep), nil
+}
+
+// commaFormat formats a whole number with thousands separators, e.g. 1234567 becomes 1,234,567
+func commaFormat(value interface{}) (string, error) {
+	n, err := toInt(value)
+	if err != nil {
+		return "", err
+	}
+	sign := ""
+	if n < 0 {
+		sign = "-"
+		n = -n
+	}
+	digits := strconv.FormatInt(n, 10)
+	var formatted strings.Builder
+	for i, digit := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			formatted.WriteByte(',')
+		}
+		formatted.WriteRune(digit)
+	}
+	return sign + formatted.String(), nil
+}
@@ -0,0 +1,71 @@
+package prompts
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	t.Setenv(EnvAllowlist, "READING_PROMPT, OTHER_PROMPT")
+	t.Setenv("READING_PROMPT", "You read tarot cards")
+	t.Setenv("PROMPTS_TAROT", "You are a tarot reader")
+	t.Setenv("PROMPTS_EMPTY", "")
+	t.Setenv("ANTHROPIC_KEY", "sk-secret")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "aws-secret")
+
+	tests := []struct {
+		name   string
+		prompt string
+		err    error
+	}{
+		{"READING_PROMPT", "You read tarot cards", nil},
+		{"PROMPTS_TAROT", "You are a tarot reader", nil},
+		{"OTHER_PROMPT", "", ErrNotFound},
+		{"PROMPTS_EMPTY", "", ErrNotFound},
+		{"ANTHROPIC_KEY", "", ErrNotAllowed},
+		{"AWS_SECRET_ACCESS_KEY", "", ErrNotAllowed},
+		{"PROMPTS_", "", ErrNotAllowed},
+		{"", "", ErrNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prompt, err := Lookup(tt.name)
+			if !errors.Is(err, tt.err) || prompt != tt.prompt {
+				t.Errorf("Lookup(%q) = %q, %v, want %q, %v", tt.name, prompt, err, tt.prompt, tt.err)
+			}
+			if allowed := Allowed(tt.name); allowed != !errors.Is(tt.err, ErrNotAllowed) {
+				t.Errorf("Allowed(%q) = %v", tt.name, allowed)
+			}
+		})
+	}
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name     string
+		prompt   string
+		params   map[string]interface{}
+		rendered string
+		err      bool
+	}{
+		{"no params", "You are a tarot reader", nil, "You are a tarot reader", false},
+		{"plain param", "Reading for {{.name}}", map[string]interface{}{"name": "Ada"}, "Reading for Ada", false},
+		{"joinInts", "Cards: {{joinInts .cards \", \"}}", map[string]interface{}{"cards": []interface{}{3.0, 16.0, 21.0}}, "Cards: 3, 16, 21", false},
+		{"joinStrings", "Spread: {{joinStrings .spread \" / \"}}", map[string]interface{}{"spread": []interface{}{"past", "present"}}, "Spread: past / present", false},
+		{"commaFormat", "{{commaFormat .readings}} readings", map[string]interface{}{"readings": 1234567.0}, "1,234,567 readings", false},
+		{"negative commaFormat", "{{commaFormat .delta}}", map[string]interface{}{"delta": -1000.0}, "-1,000", false},
+		{"malformed template", "Cards: {{joinInts .cards", map[string]interface{}{"cards": []interface{}{1.0}}, "", true},
+		{"unknown function", "{{shuffle .cards}}", map[string]interface{}{"cards": []interface{}{1.0}}, "", true},
+		{"missing param", "Reading for {{.name}}", map[string]interface{}{}, "", true},
+		{"fractional card", "{{joinInts .cards \",\"}}", map[string]interface{}{"cards": []interface{}{1.5}}, "", true},
+		{"list of the wrong type", "{{joinStrings .spread \",\"}}", map[string]interface{}{"spread": []interface{}{1.0}}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rendered, err := Render(tt.prompt, tt.params)
+			if (err != nil) != tt.err || rendered != tt.rendered {
+				t.Errorf("Render() = %q, %v, want %q, error %v", rendered, err, tt.rendered, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+// Package quota decides whether a user may spend requests and how their balance is topped up.
+// Every lambda that checks or changes remaining_requests asks the Policy instead of comparing balances itself.
+// It has no AWS SDK dependency so both the v1 and v2 SDK based lambdas can use it.
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+)
+
+const (
+	envRequestCost = "QUOTA_REQUEST_COST"
+	envOverdraft   = "QUOTA_OVERDRAFT"
+	envPlans       = "QUOTA_PLANS"
+
+	defaultRequestCost = 1
+
+	// ReasonExhausted is returned when the balance can't cover the request, even with the overdraft
+	ReasonExhausted = "exhausted"
+	// ReasonTrialExpired is returned when the user's trial ran out
+	ReasonTrialExpired = "trial_expired"
+)
+
+// Plan holds the balance rules of one plan
+type Plan struct {
+	// Ceiling is the highest balance credits and refills can raise the balance to, 0 for no ceiling
+	Ceiling int64
+	// RefillAmount is the balance the user is topped up to every RefillInterval, 0 for no refills
+	RefillAmount   int64
+	RefillInterval time.Duration
+}
+
+// planJSON is a Plan as configured in QUOTA_PLANS, e.g. {"monthly": {"ceiling": 500, "refill_amount": 100, "refill_interval": "720h"}}
+type planJSON struct {
+	Ceiling        int64  `json:"ceiling"`
+	RefillAmount   int64  `json:"refill_amount"`
+	RefillInterval string `json:"refill_interval"`
+}
+
+// Policy holds the quota rules
+type Policy struct {
+	// RequestCost is how many requests one reading costs
+	RequestCost int64
+	// Overdraft is how far below zero a balance may go, so a reading isn't refused over a single request
+	Overdraft int64
+	Plans     map[string]Plan
+}
+
+// Decision is the outcome of a quota check
+type Decision struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+	Cost    int64  `json:"cost"`
+	// Remaining is the balance after the request is charged
+	Remaining int64 `json:"remaining"`
+}
+
+// DefaultPolicy charges one request per reading, without overdraft, ceilings or refills
+func DefaultPolicy() Policy {
+	return Policy{RequestCost: defaultRequestCost, Plans: make(map[string]Plan)}
+}
+
+// LoadFromEnv reads the policy from QUOTA_REQUEST_COST, QUOTA_OVERDRAFT and QUOTA_PLANS
+func LoadFromEnv() (Policy, error) {
+	policy := DefaultPolicy()
+	for env, target := range map[string]*int64{envRequestCost: &policy.RequestCost, envOverdraft: &policy.Overdraft} {
+		if value := os.Getenv(env); value != "" {
+			number, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || number < 0 {
+				return policy, fmt.Errorf("invalid %s: %q", env, value)
+			}
+			*target = number
+		}
+	}
+
+	if value := os.Getenv(envPlans); value != "" {
+		var plans map[string]planJSON
+		err := json.Unmarshal([]byte(value), &plans)
+		if err != nil {
+			return policy, fmt.Errorf("invalid JSON in %s: %w", envPlans, err)
+		}
+		for name, plan := range plans {
+			rules := Plan{Ceiling: plan.Ceiling, RefillAmount: plan.RefillAmount}
+			if plan.RefillAmount > 0 {
+				rules.RefillInterval, err = time.ParseDuration(plan.RefillInterval)
+				if err != nil || rules.RefillInterval <= 0 {
+					return policy, fmt.Errorf("invalid refill_interval of plan %s in %s: %q", name, envPlans, plan.RefillInterval)
+				}
+			}
+			policy.Plans[name] = rules
+		}
+	}
+	return policy, nil
+}
+
+// Cost returns what a reading answered by the given number of models costs. Every model's answer, e.g. a
+// second opinion, is charged like a reading of its own.
+func (p Policy) Cost(models int) int64 {
+	return p.RequestCost * int64(models)
+}
+
+// Decide reports whether the user may make a request and what it leaves of the balance
+func (p Policy) Decide(user users.User, now time.Time) Decision {
+	return p.DecideCost(user, p.RequestCost, now)
+}
+
+// DecideCost is Decide for a request costing cost, see Cost
+func (p Policy) DecideCost(user users.User, cost int64, now time.Time) Decision {
+	decision := Decision{Cost: cost, Remaining: user.Balance() - cost}
+	switch {
+	case user.TrialExpired(now):
+		decision.Reason = ReasonTrialExpired
+	case decision.Remaining < -p.Overdraft:
+		decision.Reason = ReasonExhausted
+	default:
+		decision.Allowed = true
+	}
+	return decision
+}
+
+// ChargeFloor returns the lowest balance that can still be charged cost without going past the overdraft.
+// Charges are conditional on it, so readings finishing concurrently can't overdraw the balance together.
+func (p Policy) ChargeFloor(cost int64) int64 {
+	return cost - p.Overdraft
+}
+
+// Credit returns how much of amount can be added to the user's balance without going over the plan ceiling
+func (p Policy) Credit(user users.User, amount int64) int64 {
+	ceiling := p.Plans[user.Plan].Ceiling
+	if ceiling == 0 || amount <= 0 {
+		return amount
+	}
+	room := ceiling - user.Balance()
+	if room <= 0 {
+		return 0
+	}
+	return min(amount, room)
+}
+
+// NextRefill returns when the user's plan tops up the balance next, or false if the plan has no refills.
+// Users who were never refilled count from their signup.
+func (p Policy) NextRefill(user users.User) (time.Time, bool) {
+	plan := p.Plans[user.Plan]
+	if plan.RefillAmount <= 0 {
+		return time.Time{}, false
+	}
+	last := user.LastRefillAt
+	if last == 0 {
+		last = user.CreatedAt
+	}
+	return time.Unix(last, 0).Add(plan.RefillInterval), true
+}
+
+// Refill returns how many requests to add to top the user up to the plan's refill amount,
+// and whether a refill is due at all. A due refill is recorded even if it adds nothing.
+func (p Policy) Refill(user users.User, now time.Time) (int64, bool) {
+	next, ok := p.NextRefill(user)
+	if !ok || now.Before(next) {
+		return 0, false
+	}
+	missing := p.Plans[user.Plan].RefillAmount - user.Balance()
+	if missing <= 0 {
+		return 0, true
+	}
+	return p.Credit(user, missing), true
+}
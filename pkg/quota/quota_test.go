@@ -0,0 +1,177 @@
+package quota
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+)
+
+func TestDecideCost(t *testing.T) {
+	now := time.Unix(1000, 0)
+	policy := Policy{RequestCost: 2, Overdraft: 1}
+	legacyTokens := users.TokensFromRequests(3)
+
+	tests := []struct {
+		name      string
+		user      users.User
+		cost      int64
+		allowed   bool
+		reason    string
+		remaining int64
+	}{
+		{"covered", users.User{RemainingRequests: 5}, 2, true, "", 3},
+		{"exactly covered", users.User{RemainingRequests: 2}, 2, true, "", 0},
+		{"within overdraft", users.User{RemainingRequests: 1}, 2, true, "", -1},
+		{"past overdraft", users.User{RemainingRequests: 0}, 2, false, ReasonExhausted, -2},
+		{"combined cost past overdraft", users.User{RemainingRequests: 2}, 4, false, ReasonExhausted, -2},
+		{"unmigrated legacy balance", users.User{RemainingRequests: 0, LegacyRemainingTokens: &legacyTokens}, 2, true, "", 1},
+		{"live trial", users.User{RemainingRequests: 5, Plan: users.PlanTrial, TrialExpiresAt: 1001}, 2, true, "", 3},
+		{"expired trial", users.User{RemainingRequests: 5, Plan: users.PlanTrial, TrialExpiresAt: 1000}, 2, false, ReasonTrialExpired, 3},
+		{"trial expiry of another plan", users.User{RemainingRequests: 5, Plan: "monthly", TrialExpiresAt: 1000}, 2, true, "", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := policy.DecideCost(tt.user, tt.cost, now)
+			want := Decision{Allowed: tt.allowed, Reason: tt.reason, Cost: tt.cost, Remaining: tt.remaining}
+			if decision != want {
+				t.Errorf("DecideCost() = %+v, want %+v", decision, want)
+			}
+		})
+	}
+}
+
+func TestDecideChargesRequestCost(t *testing.T) {
+	policy := Policy{RequestCost: 3}
+	decision := policy.Decide(users.User{RemainingRequests: 3}, time.Unix(0, 0))
+	if !decision.Allowed || decision.Cost != 3 || decision.Remaining != 0 {
+		t.Errorf("Decide() = %+v", decision)
+	}
+	if cost := policy.Cost(2); cost != 6 {
+		t.Errorf("Cost(2) = %d, want 6", cost)
+	}
+}
+
+func TestChargeFloor(t *testing.T) {
+	if floor := (Policy{Overdraft: 0}).ChargeFloor(2); floor != 2 {
+		t.Errorf("ChargeFloor without overdraft = %d, want 2", floor)
+	}
+	if floor := (Policy{Overdraft: 3}).ChargeFloor(2); floor != -1 {
+		t.Errorf("ChargeFloor with overdraft = %d, want -1", floor)
+	}
+}
+
+func TestCredit(t *testing.T) {
+	policy := Policy{Plans: map[string]Plan{"capped": {Ceiling: 10}}}
+
+	tests := []struct {
+		name   string
+		user   users.User
+		amount int64
+		want   int64
+	}{
+		{"no ceiling", users.User{RemainingRequests: 100}, 50, 50},
+		{"below ceiling", users.User{Plan: "capped", RemainingRequests: 2}, 5, 5},
+		{"capped at ceiling", users.User{Plan: "capped", RemainingRequests: 8}, 5, 2},
+		{"at ceiling", users.User{Plan: "capped", RemainingRequests: 10}, 5, 0},
+		{"over ceiling", users.User{Plan: "capped", RemainingRequests: 12}, 5, 0},
+		{"debit isn't capped", users.User{Plan: "capped", RemainingRequests: 12}, -5, -5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.Credit(tt.user, tt.amount); got != tt.want {
+				t.Errorf("Credit() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefill(t *testing.T) {
+	day := 24 * time.Hour
+	policy := Policy{Plans: map[string]Plan{
+		"monthly": {RefillAmount: 100, RefillInterval: 30 * day},
+		"capped":  {Ceiling: 50, RefillAmount: 100, RefillInterval: day},
+	}}
+	start := time.Unix(1_700_000_000, 0)
+
+	tests := []struct {
+		name   string
+		user   users.User
+		now    time.Time
+		amount int64
+		due    bool
+	}{
+		{"no refills", users.User{RemainingRequests: 0}, start.Add(365 * day), 0, false},
+		{"not due since signup", users.User{Plan: "monthly", CreatedAt: start.Unix()}, start.Add(29 * day), 0, false},
+		{"due since signup", users.User{Plan: "monthly", CreatedAt: start.Unix(), RemainingRequests: 30}, start.Add(30 * day), 70, true},
+		{"not due since last refill", users.User{Plan: "monthly", CreatedAt: 0, LastRefillAt: start.Unix()}, start.Add(29 * day), 0, false},
+		{"due since last refill", users.User{Plan: "monthly", LastRefillAt: start.Unix()}, start.Add(31 * day), 100, true},
+		{"due but full", users.User{Plan: "monthly", LastRefillAt: start.Unix(), RemainingRequests: 120}, start.Add(31 * day), 0, true},
+		{"due up to ceiling", users.User{Plan: "capped", LastRefillAt: start.Unix(), RemainingRequests: 20}, start.Add(day), 30, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			amount, due := policy.Refill(tt.user, tt.now)
+			if amount != tt.amount || due != tt.due {
+				t.Errorf("Refill() = %d, %v, want %d, %v", amount, due, tt.amount, tt.due)
+			}
+		})
+	}
+
+	next, ok := policy.NextRefill(users.User{Plan: "monthly", CreatedAt: start.Unix()})
+	if !ok || !next.Equal(start.Add(30*day)) {
+		t.Errorf("NextRefill() = %v, %v", next, ok)
+	}
+}
+
+func TestLoadFromEnv(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		policy, err := LoadFromEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if policy.RequestCost != defaultRequestCost || policy.Overdraft != 0 || len(policy.Plans) != 0 {
+			t.Errorf("unexpected default policy %+v", policy)
+		}
+	})
+
+	t.Run("configured", func(t *testing.T) {
+		t.Setenv(envRequestCost, "2")
+		t.Setenv(envOverdraft, "1")
+		t.Setenv(envPlans, `{"monthly": {"ceiling": 500, "refill_amount": 100, "refill_interval": "720h"}, "capped": {"ceiling": 20}}`)
+		policy, err := LoadFromEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if policy.RequestCost != 2 || policy.Overdraft != 1 {
+			t.Errorf("unexpected policy %+v", policy)
+		}
+		if plan := policy.Plans["monthly"]; plan != (Plan{Ceiling: 500, RefillAmount: 100, RefillInterval: 720 * time.Hour}) {
+			t.Errorf("unexpected monthly plan %+v", plan)
+		}
+		if plan := policy.Plans["capped"]; plan != (Plan{Ceiling: 20}) {
+			t.Errorf("unexpected capped plan %+v", plan)
+		}
+	})
+
+	invalid := []struct {
+		name  string
+		env   string
+		value string
+	}{
+		{"negative cost", envRequestCost, "-1"},
+		{"non numeric overdraft", envOverdraft, "lots"},
+		{"plans not JSON", envPlans, "monthly"},
+		{"refill without interval", envPlans, `{"monthly": {"refill_amount": 100}}`},
+		{"negative interval", envPlans, `{"monthly": {"refill_amount": 100, "refill_interval": "-1h"}}`},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(tt.env, tt.value)
+			_, err := LoadFromEnv()
+			if err == nil {
+				t.Errorf("%s=%q loaded without error", tt.env, tt.value)
+			}
+		})
+	}
+}
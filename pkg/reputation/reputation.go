@@ -0,0 +1,289 @@
+// Package reputation tracks OTP request patterns per source IP and identifier in the REPUTATION table
+// and turns them into a risk score, so the OTP lambdas can challenge or deny suspicious signups.
+package reputation
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/users"
+)
+
+const (
+	// DefaultTableName is the default REPUTATION table name
+	DefaultTableName = "REPUTATION"
+
+	envTableName       = "REPUTATION_TABLE"
+	envWindow          = "REPUTATION_WINDOW"
+	envVelocityLimit   = "REPUTATION_VELOCITY_LIMIT"
+	envCaptchaScore    = "REPUTATION_CAPTCHA_SCORE"
+	envDenyScore       = "REPUTATION_DENY_SCORE"
+	envDisposableExtra = "DISPOSABLE_DOMAINS"
+
+	defaultWindow        = time.Hour
+	defaultVelocityLimit = 5
+	defaultCaptchaScore  = 50
+	defaultDenyScore     = 80
+	// retention keeps old windows around for the admin API before the table TTL removes them
+	retention = 7 * 24 * time.Hour
+
+	// Score weights, a score is capped at MaxScore
+	MaxScore             = 100
+	velocityPointsPerReq = 10
+	maxVelocityPoints    = 50
+	maxFailurePoints     = 60
+	minVerifyAttempts    = 3
+	disposablePoints     = 50
+)
+
+// defaultDisposableDomains are throwaway mail providers seen in signup abuse, DISPOSABLE_DOMAINS adds more
+var defaultDisposableDomains = []string{
+	"mailinator.com",
+	"guerrillamail.com",
+	"10minutemail.com",
+	"tempmail.com",
+	"temp-mail.org",
+	"yopmail.com",
+	"trashmail.com",
+	"getnada.com",
+	"sharklasers.com",
+	"dispostable.com",
+}
+
+// Decision is what the OTP lambdas do with a request
+type Decision string
+
+const (
+	DecisionAllow   Decision = "allow"
+	DecisionCaptcha Decision = "captcha"
+	DecisionDeny    Decision = "deny"
+)
+
+// Record holds the counters of one subject in one window
+type Record struct {
+	Subject         string `json:"subject" dynamodbav:"subject"`
+	WindowStart     int64  `json:"window_start" dynamodbav:"window_start"`
+	Requests        int64  `json:"requests" dynamodbav:"requests"`
+	VerifyFailures  int64  `json:"verify_failures" dynamodbav:"verify_failures"`
+	VerifySuccesses int64  `json:"verify_successes" dynamodbav:"verify_successes"`
+	DisposableHits  int64  `json:"disposable_hits" dynamodbav:"disposable_hits"`
+	UpdatedAt       int64  `json:"updated_at" dynamodbav:"updated_at"`
+	ExpiresAt       int64  `json:"-" dynamodbav:"expires_at"`
+}
+
+// Config holds the scoring thresholds
+type Config struct {
+	TableName string
+	Window    time.Duration
+	// VelocityLimit is how many OTP requests a subject may make per window before the score goes up
+	VelocityLimit     int64
+	CaptchaScore      int
+	DenyScore         int
+	DisposableDomains map[string]bool
+}
+
+// LoadFromEnv reads the thresholds from REPUTATION_WINDOW, REPUTATION_VELOCITY_LIMIT,
+// REPUTATION_CAPTCHA_SCORE and REPUTATION_DENY_SCORE
+func LoadFromEnv() (Config, error) {
+	cfg := Config{
+		TableName:         os.Getenv(envTableName),
+		Window:            defaultWindow,
+		VelocityLimit:     defaultVelocityLimit,
+		CaptchaScore:      defaultCaptchaScore,
+		DenyScore:         defaultDenyScore,
+		DisposableDomains: make(map[string]bool),
+	}
+	if cfg.TableName == "" {
+		cfg.TableName = DefaultTableName
+	}
+	cfg.TableName = testmode.Table(cfg.TableName)
+
+	if value := os.Getenv(envWindow); value != "" {
+		window, err := time.ParseDuration(value)
+		if err != nil || window <= 0 {
+			return cfg, fmt.Errorf("invalid %s: %q", envWindow, value)
+		}
+		cfg.Window = window
+	}
+	for env, target := range map[string]*int{envCaptchaScore: &cfg.CaptchaScore, envDenyScore: &cfg.DenyScore} {
+		if value := os.Getenv(env); value != "" {
+			score, err := strconv.Atoi(value)
+			if err != nil || score <= 0 {
+				return cfg, fmt.Errorf("invalid %s: %q", env, value)
+			}
+			*target = score
+		}
+	}
+	if value := os.Getenv(envVelocityLimit); value != "" {
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || limit <= 0 {
+			return cfg, fmt.Errorf("invalid %s: %q", envVelocityLimit, value)
+		}
+		cfg.VelocityLimit = limit
+	}
+
+	for _, domain := range defaultDisposableDomains {
+		cfg.DisposableDomains[domain] = true
+	}
+	for _, domain := range strings.Split(os.Getenv(envDisposableExtra), ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain != "" {
+			cfg.DisposableDomains[domain] = true
+		}
+	}
+	return cfg, nil
+}
+
+// IPSubject is the REPUTATION subject of a source IP
+func IPSubject(ip string) string {
+	return "ip#" + ip
+}
+
+// IdentifierSubject is the REPUTATION subject of a phone number or email address.
+// It uses the user hash so the table doesn't hold the identifiers themselves.
+func IdentifierSubject(identifier string) string {
+	return "id#" + users.HashIdentifier(identifier)
+}
+
+// IsDisposable reports whether an email address belongs to a disposable mail provider
+func (c Config) IsDisposable(identifier string) bool {
+	_, domain, found := strings.Cut(strings.ToLower(strings.TrimSpace(identifier)), "@")
+	return found && c.DisposableDomains[domain]
+}
+
+// Score returns the risk score of a record between 0 and MaxScore
+func (c Config) Score(r Record) int {
+	score := 0
+	if r.Requests > c.VelocityLimit {
+		score += min(int(r.Requests-c.VelocityLimit)*velocityPointsPerReq, maxVelocityPoints)
+	}
+	if attempts := r.VerifyFailures + r.VerifySuccesses; attempts >= minVerifyAttempts {
+		score += int(r.VerifyFailures * maxFailurePoints / attempts)
+	}
+	if r.DisposableHits > 0 {
+		score += disposablePoints
+	}
+	return min(score, MaxScore)
+}
+
+// Decide maps a score to what happens to the request
+func (c Config) Decide(score int) Decision {
+	switch {
+	case score >= c.DenyScore:
+		return DecisionDeny
+	case score >= c.CaptchaScore:
+		return DecisionCaptcha
+	default:
+		return DecisionAllow
+	}
+}
+
+// windowStart returns the start of the window now falls into
+func (c Config) windowStart(now time.Time) int64 {
+	return now.Truncate(c.Window).Unix()
+}
+
+// Store reads and updates REPUTATION records
+type Store struct {
+	client *dynamodb.DynamoDB
+	config Config
+}
+
+// NewStore returns a Store for the table in cfg
+func NewStore(client *dynamodb.DynamoDB, cfg Config) *Store {
+	return &Store{client: client, config: cfg}
+}
+
+// add increments counters of the subject's current window and returns the updated record
+func (s *Store) add(subject string, now time.Time, counters map[string]int64) (Record, error) {
+	windowStart := s.config.windowStart(now)
+	assignments := []string{"updated_at = :now", "expires_at = :expires"}
+	values := map[string]*dynamodb.AttributeValue{
+		":now":     {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+		":expires": {N: aws.String(strconv.FormatInt(now.Add(retention).Unix(), 10))},
+	}
+	var additions []string
+	for name, value := range counters {
+		additions = append(additions, fmt.Sprintf("%s :%s", name, name))
+		values[":"+name] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(value, 10))}
+	}
+
+	result, err := s.client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(s.config.TableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"subject":      {S: aws.String(subject)},
+			"window_start": {N: aws.String(strconv.FormatInt(windowStart, 10))},
+		},
+		UpdateExpression:          aws.String("SET " + strings.Join(assignments, ", ") + " ADD " + strings.Join(additions, ", ")),
+		ExpressionAttributeValues: values,
+		ReturnValues:              aws.String(dynamodb.ReturnValueAllNew),
+	})
+	if err != nil {
+		return Record{}, fmt.Errorf("failed to update reputation of %s: %w", subject, err)
+	}
+
+	var record Record
+	err = dynamodbattribute.UnmarshalMap(result.Attributes, &record)
+	return record, err
+}
+
+// RecordOTPRequest counts an OTP request for the source IP and the identifier and returns the
+// decision for the riskier of the two, together with its score
+func (s *Store) RecordOTPRequest(sourceIP, identifier string, now time.Time) (Decision, int, error) {
+	counters := map[string]int64{"requests": 1}
+	if s.config.IsDisposable(identifier) {
+		counters["disposable_hits"] = 1
+	}
+
+	score := 0
+	for _, subject := range []string{IPSubject(sourceIP), IdentifierSubject(identifier)} {
+		record, err := s.add(subject, now, counters)
+		if err != nil {
+			return DecisionAllow, 0, err
+		}
+		score = max(score, s.config.Score(record))
+	}
+	return s.config.Decide(score), score, nil
+}
+
+// RecordVerification counts a successful or failed OTP verification for the source IP and the identifier
+func (s *Store) RecordVerification(sourceIP, identifier string, success bool, now time.Time) error {
+	counter := "verify_failures"
+	if success {
+		counter = "verify_successes"
+	}
+
+	var errs []error
+	for _, subject := range []string{IPSubject(sourceIP), IdentifierSubject(identifier)} {
+		_, err := s.add(subject, now, map[string]int64{counter: 1})
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Get returns the subject's records still in the table, newest window first
+func (s *Store) Get(subject string) ([]Record, error) {
+	result, err := s.client.Query(&dynamodb.QueryInput{
+		TableName:              aws.String(s.config.TableName),
+		KeyConditionExpression: aws.String("subject = :subject"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":subject": {S: aws.String(subject)},
+		},
+		ScanIndexForward: aws.Bool(false),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query reputation of %s: %w", subject, err)
+	}
+
+	records := []Record{}
+	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &records)
+	return records, err
+}
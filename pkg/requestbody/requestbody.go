@@ -0,0 +1,153 @@
+// Package requestbody decodes base64 and gzip encoded API Gateway request bodies and enforces size limits,
+// so handlers always get a plain body they can parse
+package requestbody
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	envMaxBodyBytes = "MAX_BODY_BYTES"
+	envBodyLimits   = "BODY_LIMITS"
+
+	// DefaultMaxBytes is the body limit of endpoints without their own limit
+	DefaultMaxBytes = 64 * 1024
+)
+
+// Handler is the signature of the API Gateway REST lambda handlers, an alias so other middlewares can be stacked
+type Handler = func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
+
+// Limits holds the maximum decoded body size per endpoint
+type Limits struct {
+	Default int64
+	// Endpoints is keyed by "METHOD /resource", e.g. "POST /otp/verify"
+	Endpoints map[string]int64
+}
+
+// LoadFromEnv reads the default limit from MAX_BODY_BYTES and per endpoint limits
+// from the BODY_LIMITS JSON environment variable, e.g. {"POST /otp/verify": 4096}
+func LoadFromEnv() (*Limits, error) {
+	limits := &Limits{
+		Default:   DefaultMaxBytes,
+		Endpoints: make(map[string]int64),
+	}
+
+	if value := os.Getenv(envMaxBodyBytes); value != "" {
+		maxBytes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || maxBytes <= 0 {
+			return nil, fmt.Errorf("invalid %s: %q", envMaxBodyBytes, value)
+		}
+		limits.Default = maxBytes
+	}
+
+	if value := os.Getenv(envBodyLimits); value != "" {
+		err := json.Unmarshal([]byte(value), &limits.Endpoints)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", envBodyLimits, err)
+		}
+	}
+	return limits, nil
+}
+
+// For returns the limit of an endpoint
+func (l *Limits) For(endpoint string) int64 {
+	if maxBytes, ok := l.Endpoints[endpoint]; ok {
+		return maxBytes
+	}
+	return l.Default
+}
+
+// ErrTooLarge is returned by Decode when the body exceeds the limit
+var ErrTooLarge = errors.New("request body too large")
+
+// Decode returns the plain request body, undoing API Gateway base64 encoding and gzip content encoding.
+// Decompression stops as soon as maxBytes is exceeded, so small compressed bodies can't expand without bound.
+func Decode(request events.APIGatewayProxyRequest, maxBytes int64) (string, error) {
+	body, err := DecodeBase64(request.Body, request.IsBase64Encoded)
+	if err != nil {
+		return "", err
+	}
+
+	if isGzip(request.Headers) {
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return "", fmt.Errorf("invalid gzip body: %w", err)
+		}
+		defer reader.Close()
+		body, err = io.ReadAll(io.LimitReader(reader, maxBytes+1))
+		if err != nil {
+			return "", fmt.Errorf("invalid gzip body: %w", err)
+		}
+	}
+
+	if int64(len(body)) > maxBytes {
+		return "", ErrTooLarge
+	}
+	return string(body), nil
+}
+
+// DecodeBase64 undoes the base64 encoding API Gateway applies to binary payloads, for REST and websocket events alike
+func DecodeBase64(body string, isBase64Encoded bool) ([]byte, error) {
+	if !isBase64Encoded {
+		return []byte(body), nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 body: %w", err)
+	}
+	return decoded, nil
+}
+
+// isGzip reports whether the Content-Encoding header is gzip
+func isGzip(headers map[string]string) bool {
+	for name, value := range headers {
+		if strings.EqualFold(name, "Content-Encoding") {
+			return strings.EqualFold(strings.TrimSpace(value), "gzip")
+		}
+	}
+	return false
+}
+
+// Middleware wraps handler, passing it the decoded body. Oversized bodies are rejected with 413 Request Entity Too Large
+// and undecodable ones with 400 Bad Request before the handler parses them.
+func Middleware(limits *Limits, handler Handler) Handler {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		endpoint := request.HTTPMethod + " " + request.Resource
+		body, err := Decode(request, limits.For(endpoint))
+		if errors.Is(err, ErrTooLarge) {
+			fmt.Printf("Rejecting oversized body for %s\n", endpoint)
+			return errorResponse(http.StatusRequestEntityTooLarge, "Request body too large"), nil
+		}
+		if err != nil {
+			fmt.Printf("Rejecting body for %s: %v\n", endpoint, err)
+			return errorResponse(http.StatusBadRequest, "Invalid request body encoding"), nil
+		}
+
+		request.Body = body
+		request.IsBase64Encoded = false
+		return handler(ctx, request)
+	}
+}
+
+func errorResponse(statusCode int, message string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Body:       message,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
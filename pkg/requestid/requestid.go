@@ -0,0 +1,53 @@
+// Package requestid carries a request ID through the context and echoes it back to clients
+package requestid
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Header is the response header holding the request ID. A client supplied value is reused.
+const Header = "X-Request-Id"
+
+// contextKey is unexported so no other package can collide with the context value
+type contextKey struct{}
+
+// Handler is the signature of the API Gateway REST lambda handlers.
+// It is an alias so handlers wrapped by other middlewares, e.g. ipfilter, can be passed in directly.
+type Handler = func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
+
+// NewContext returns a copy of ctx carrying the request ID
+func NewContext(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, contextKey{}, requestID)
+}
+
+// FromContext returns the request ID stored in ctx, or an empty string if there is none
+func FromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(contextKey{}).(string)
+	return requestID
+}
+
+// FromRequest returns the client supplied X-Request-Id header, falling back to the API Gateway request ID
+func FromRequest(request events.APIGatewayProxyRequest) string {
+	for name, value := range request.Headers {
+		if strings.EqualFold(name, Header) && value != "" {
+			return value
+		}
+	}
+	return request.RequestContext.RequestID
+}
+
+// Middleware stores the request ID in the handler context and sets the X-Request-Id response header
+func Middleware(handler Handler) Handler {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		requestID := FromRequest(request)
+		response, err := handler(NewContext(ctx, requestID), request)
+		if response.Headers == nil {
+			response.Headers = make(map[string]string)
+		}
+		response.Headers[Header] = requestID
+		return response, err
+	}
+}
@@ -0,0 +1,156 @@
+// Package shedding tracks per-endpoint latency and rejects low priority requests while an endpoint is over budget.
+// The statistics live in the warm Lambda container, so every container sheds on its own view of recent traffic.
+package shedding
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	envLatencyBudgets = "LATENCY_BUDGETS"
+
+	PriorityHigh = "high"
+	PriorityLow  = "low"
+
+	// window is how long a latency sample counts, so shedding stops once the samples of a slow period expire
+	window = time.Minute
+	// minSamples keeps a couple of slow requests from tripping the budget
+	minSamples = 10
+	retryAfter = window
+)
+
+// Handler is the signature of the API Gateway REST lambda handlers, an alias so other middlewares can be stacked
+type Handler = func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
+
+// Budget is the p95 latency an endpoint is allowed. Only low priority endpoints are shed, high priority ones are just logged.
+type Budget struct {
+	BudgetMS int64  `json:"budget_ms"`
+	Priority string `json:"priority"`
+}
+
+type sample struct {
+	at       time.Time
+	duration time.Duration
+}
+
+// Shedder holds the budgets and the recent latency samples per endpoint
+type Shedder struct {
+	mu      sync.Mutex
+	budgets map[string]Budget
+	samples map[string][]sample
+}
+
+// NewShedder returns a Shedder for budgets keyed by "METHOD /resource", e.g. "GET /admin/referrals"
+func NewShedder(budgets map[string]Budget) *Shedder {
+	return &Shedder{
+		budgets: budgets,
+		samples: make(map[string][]sample),
+	}
+}
+
+// LoadFromEnv builds a Shedder from the LATENCY_BUDGETS JSON environment variable,
+// e.g. {"GET /admin/support-tickets": {"budget_ms": 2000, "priority": "low"}}
+func LoadFromEnv() (*Shedder, error) {
+	budgets := make(map[string]Budget)
+	if value := os.Getenv(envLatencyBudgets); value != "" {
+		err := json.Unmarshal([]byte(value), &budgets)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", envLatencyBudgets, err)
+		}
+	}
+	return NewShedder(budgets), nil
+}
+
+// Observe records the latency of one request to the endpoint
+func (s *Shedder) Observe(endpoint string, duration time.Duration, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples[endpoint] = append(s.prune(endpoint, now), sample{at: now, duration: duration})
+}
+
+// prune drops the samples that fell out of the window. The caller holds the lock.
+func (s *Shedder) prune(endpoint string, now time.Time) []sample {
+	samples := s.samples[endpoint]
+	i := 0
+	for i < len(samples) && now.Sub(samples[i].at) > window {
+		i++
+	}
+	s.samples[endpoint] = samples[i:]
+	return s.samples[endpoint]
+}
+
+// P95 returns the 95th percentile latency of the endpoint, or false if there are too few recent samples
+func (s *Shedder) P95(endpoint string, now time.Time) (time.Duration, bool) {
+	s.mu.Lock()
+	samples := s.prune(endpoint, now)
+	durations := make([]time.Duration, len(samples))
+	for i, sample := range samples {
+		durations[i] = sample.duration
+	}
+	s.mu.Unlock()
+
+	if len(durations) < minSamples {
+		return 0, false
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[(len(durations)*95-1)/100], true
+}
+
+// OverBudget reports whether the endpoint's p95 latency exceeds its budget
+func (s *Shedder) OverBudget(endpoint string, now time.Time) bool {
+	budget, ok := s.budgets[endpoint]
+	if !ok || budget.BudgetMS <= 0 {
+		return false
+	}
+	p95, ok := s.P95(endpoint, now)
+	return ok && p95 > time.Duration(budget.BudgetMS)*time.Millisecond
+}
+
+// ShouldShed reports whether a request to the endpoint should be rejected right away
+func (s *Shedder) ShouldShed(endpoint string, now time.Time) bool {
+	return s.budgets[endpoint].Priority == PriorityLow && s.OverBudget(endpoint, now)
+}
+
+// Middleware wraps handler, measuring its latency and answering low priority requests with 503 Service Unavailable
+// while their endpoint is over budget
+func Middleware(s *Shedder, handler Handler) Handler {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		endpoint := request.HTTPMethod + " " + request.Resource
+		start := time.Now()
+		if s.ShouldShed(endpoint, start) {
+			fmt.Printf("Shedding request to %s, p95 latency is over budget\n", endpoint)
+			body, _ := json.Marshal(struct {
+				Message    string `json:"message"`
+				RetryAfter int    `json:"retry_after"`
+			}{
+				Message:    "Service is degraded, try again later",
+				RetryAfter: int(retryAfter / time.Second),
+			})
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusServiceUnavailable,
+				Body:       string(body),
+				Headers: map[string]string{
+					"Content-Type": "application/json",
+					"Retry-After":  strconv.Itoa(int(retryAfter / time.Second)),
+				},
+			}, nil
+		}
+
+		response, err := handler(ctx, request)
+		s.Observe(endpoint, time.Since(start), time.Now())
+		if s.OverBudget(endpoint, time.Now()) {
+			fmt.Printf("Endpoint %s is over its latency budget\n", endpoint)
+		}
+		return response, err
+	}
+}
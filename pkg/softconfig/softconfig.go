@@ -0,0 +1,169 @@
+// Package softconfig reloads selected settings from the RUNTIME_CONFIG DynamoDB table inside warm lambda
+// execution environments, so operational tuning like prompt templates, allowlists and rate limits doesn't
+// need a deploy or a cold start. Items override the environment variable of the same name, only for names
+// the lambda allows, and removing an item restores the deployed value. Feature flags reload on their own,
+// see pkg/flags.
+package softconfig
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// DefaultInterval is how long the table is cached in memory between scans
+	DefaultInterval = time.Minute
+	// EnvTableName is the environment variable holding the runtime config table name
+	EnvTableName = "RUNTIME_CONFIG_TABLE"
+
+	// AttrName is the partition key, the name of the environment variable an item overrides
+	AttrName = "name"
+	// AttrValue is the value the environment variable is set to
+	AttrValue = "value"
+)
+
+// deployed is the value an environment variable had before it was first overridden
+type deployed struct {
+	value string
+	set   bool
+}
+
+// Store applies the runtime config table to the environment.
+// It is safe for concurrent use and meant to live for the lifetime of the lambda execution environment.
+type Store struct {
+	tableName string
+	interval  time.Duration
+	// allowed reports whether an item may override the environment variable it names
+	allowed func(name string) bool
+
+	mu       sync.Mutex
+	client   *dynamodb.Client
+	loadedAt time.Time
+	// applied holds the overrides currently set, deployed the values they replaced
+	applied  map[string]string
+	deployed map[string]deployed
+}
+
+// NewStore returns a Store for tableName that overrides the environment variables allowed accepts.
+// With an empty tableName Apply does nothing.
+func NewStore(tableName string, interval time.Duration, allowed func(name string) bool) *Store {
+	return &Store{
+		tableName: tableName,
+		interval:  interval,
+		allowed:   allowed,
+		applied:   make(map[string]string),
+		deployed:  make(map[string]deployed),
+	}
+}
+
+// Apply rescans the table once the interval has passed and sets the environment variables it overrides.
+// If anything changed, validate runs with the new values, e.g. the lambda's config loader. When it fails
+// the previous values are restored, so a bad item can't break a working lambda. On errors the previous
+// values stay in place until the next scan.
+func (s *Store) Apply(ctx context.Context, validate func() error) error {
+	if s == nil || s.tableName == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.loadedAt.IsZero() && time.Since(s.loadedAt) < s.interval {
+		return nil
+	}
+	// Scan again after the interval even if this scan fails, instead of on every invocation
+	s.loadedAt = time.Now()
+
+	values, err := s.load(ctx)
+	if err != nil {
+		return err
+	}
+
+	previous := s.applied
+	changed := s.set(values)
+	if !changed || validate == nil {
+		return nil
+	}
+	err = validate()
+	if err != nil {
+		s.set(previous)
+		return fmt.Errorf("runtime config rejected, keeping the previous values: %w", err)
+	}
+	return nil
+}
+
+// set makes values the overrides in the environment, restoring the deployed value of the overrides
+// values no longer has. It reports whether any variable changed.
+func (s *Store) set(values map[string]string) bool {
+	changed := false
+	for name := range s.applied {
+		if _, ok := values[name]; ok {
+			continue
+		}
+		if original := s.deployed[name]; original.set {
+			os.Setenv(name, original.value)
+		} else {
+			os.Unsetenv(name)
+		}
+		changed = true
+	}
+	for name, value := range values {
+		if current, ok := s.applied[name]; ok && current == value {
+			continue
+		}
+		if _, ok := s.deployed[name]; !ok {
+			original, set := os.LookupEnv(name)
+			s.deployed[name] = deployed{value: original, set: set}
+		}
+		os.Setenv(name, value)
+		changed = true
+	}
+	s.applied = values
+	return changed
+}
+
+// load scans the whole table, which is expected to stay small, and returns the allowed overrides
+func (s *Store) load(ctx context.Context) (map[string]string, error) {
+	if s.client == nil {
+		cfg, err := awsConfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS config: %w", err)
+		}
+		s.client = dynamodb.NewFromConfig(cfg)
+	}
+
+	values := make(map[string]string)
+	paginator := dynamodb.NewScanPaginator(s.client, &dynamodb.ScanInput{
+		TableName: aws.String(s.tableName),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %w", s.tableName, err)
+		}
+		for _, item := range page.Items {
+			name, ok := item[AttrName].(*types.AttributeValueMemberS)
+			if !ok || name.Value == "" {
+				continue
+			}
+			value, ok := item[AttrValue].(*types.AttributeValueMemberS)
+			if !ok {
+				continue
+			}
+			if s.allowed == nil || !s.allowed(name.Value) {
+				fmt.Printf("Ignoring runtime config %s, it can't be changed at runtime\n", name.Value)
+				continue
+			}
+			values[name.Value] = value.Value
+		}
+	}
+	return values, nil
+}
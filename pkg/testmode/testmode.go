@@ -0,0 +1,49 @@
+// Package testmode isolates staging runs from production data. With TEST_MODE=true the lambdas use
+// the _test variant of every user data table and tag the records they create, and live Stripe keys are refused.
+package testmode
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// EnvTestMode turns test mode on
+	EnvTestMode = "TEST_MODE"
+	// TableSuffix is appended to table names in test mode
+	TableSuffix = "_test"
+	// AttrTestRecord is set to true on records created in test mode
+	AttrTestRecord = "test_record"
+
+	stripeLivePrefix = "sk_live_"
+	stripeTestPrefix = "sk_test_"
+)
+
+// Enabled reports whether TEST_MODE is set to a true value
+func Enabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv(EnvTestMode))
+	return enabled
+}
+
+// Table returns the table name to use, with TableSuffix in test mode
+func Table(name string) string {
+	if !Enabled() || strings.HasSuffix(name, TableSuffix) {
+		return name
+	}
+	return name + TableSuffix
+}
+
+// CheckStripeKey refuses live Stripe keys in test mode and test keys outside it,
+// so test payments can't credit production balances and live payments can't land in test tables
+func CheckStripeKey(key string) error {
+	switch {
+	case Enabled() && strings.HasPrefix(key, stripeLivePrefix):
+		return fmt.Errorf("live Stripe key used with %s set", EnvTestMode)
+	case !Enabled() && strings.HasPrefix(key, stripeTestPrefix):
+		return fmt.Errorf("test Stripe key used without %s", EnvTestMode)
+	default:
+		return nil
+	}
+}
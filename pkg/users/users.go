@@ -0,0 +1,158 @@
+// Package users defines the USERS table schema shared by the lambdas.
+// It has no AWS SDK dependency so both the v1 and v2 SDK based lambdas can use it.
+package users
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/zerobugdebug/aws-lambdas-go/pkg/testmode"
+)
+
+const (
+	// TableName is the default USERS table name
+	TableName = "USERS"
+
+	// AttrUserHash is the partition key of the USERS table
+	AttrUserHash = "user_hash"
+	// AttrRemainingRequests is the canonical balance attribute, every reader and writer uses it
+	AttrRemainingRequests = "remaining_requests"
+	// AttrLegacyRemainingTokens is the balance attribute written by older code, see MigrateBalance
+	AttrLegacyRemainingTokens = "remaining_tokens"
+
+	// TokensPerRequest is how many legacy tokens buy one request
+	TokensPerRequest = 1
+
+	// PlanTrial is the plan of users provisioned on first login
+	PlanTrial = "trial"
+
+	// AttrStatus holds the account status, missing for active accounts
+	AttrStatus = "status"
+	// AttrBanReason is the reason shown to a suspended or banned user
+	AttrBanReason = "ban_reason"
+	// AttrBanExpiresAt is the unix time a suspension ends
+	AttrBanExpiresAt = "ban_expires_at"
+
+	// AttrLastRefillAt is the unix time the plan last topped up the balance, see pkg/quota
+	AttrLastRefillAt = "last_refill_at"
+
+	// StatusSuspended blocks the account until BanExpiresAt
+	StatusSuspended = "suspended"
+	// StatusBanned blocks the account until an admin lifts the ban
+	StatusBanned = "banned"
+)
+
+// User is the USERS item
+type User struct {
+	UserHash          string `json:"user_hash" dynamodbav:"user_hash"`
+	RemainingRequests int64  `json:"remaining_requests" dynamodbav:"remaining_requests"`
+	// LegacyRemainingTokens is only set on items that haven't been migrated yet
+	LegacyRemainingTokens *int64 `json:"-" dynamodbav:"remaining_tokens,omitempty"`
+	Plan                  string `json:"plan,omitempty" dynamodbav:"plan,omitempty"`
+	// TrialExpiresAt is the unix time the trial requests stop being usable, 0 if the user isn't on a trial
+	TrialExpiresAt int64  `json:"trial_expires_at,omitempty" dynamodbav:"trial_expires_at,omitempty"`
+	CreatedAt      int64  `json:"created_at,omitempty" dynamodbav:"created_at,omitempty"`
+	ReferralCode   string `json:"referral_code,omitempty" dynamodbav:"referral_code,omitempty"`
+	// ReferredBy is the referral code the user signed up with
+	ReferredBy string `json:"referred_by,omitempty" dynamodbav:"referred_by,omitempty"`
+	// NotificationEmail is the address the user last logged in with by email, notifications go there
+	NotificationEmail string `json:"notification_email,omitempty" dynamodbav:"notification_email,omitempty"`
+	// Notifications holds the categories the user set explicitly, see pkg/notify for the defaults
+	Notifications map[string]bool `json:"notifications,omitempty" dynamodbav:"notifications,omitempty"`
+	// ArchiveConsent holds the archiving purposes the user explicitly agreed to, see pkg/archive
+	ArchiveConsent map[string]bool `json:"archive_consent,omitempty" dynamodbav:"archive_consent,omitempty"`
+	// Status is StatusSuspended or StatusBanned for blocked accounts, empty otherwise
+	Status       string `json:"status,omitempty" dynamodbav:"status,omitempty"`
+	BanReason    string `json:"ban_reason,omitempty" dynamodbav:"ban_reason,omitempty"`
+	BanExpiresAt int64  `json:"ban_expires_at,omitempty" dynamodbav:"ban_expires_at,omitempty"`
+	// LastRefillAt is the unix time of the last plan refill, 0 if the user was never refilled
+	LastRefillAt int64 `json:"last_refill_at,omitempty" dynamodbav:"last_refill_at,omitempty"`
+	// TestRecord marks users created in test mode, see pkg/testmode
+	TestRecord bool `json:"-" dynamodbav:"test_record,omitempty"`
+}
+
+// Table returns the USERS table name, the test table in test mode
+func Table() string {
+	return testmode.Table(TableName)
+}
+
+// HashIdentifier returns the user hash for a phone number or email address.
+// The identifier is normalized first so the same address always maps to the same user.
+func HashIdentifier(identifier string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(identifier))))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateReferralCode derives the user's referral code from the user hash, so concurrent first logins agree on it
+func GenerateReferralCode(userHash string) string {
+	sum := sha256.Sum256([]byte("referral:" + userHash))
+	return base32.StdEncoding.EncodeToString(sum[:])[:10]
+}
+
+// NewTrialUser returns a user on the trial plan with the given number of requests
+func NewTrialUser(userHash string, requests int64, duration time.Duration, now time.Time) User {
+	return User{
+		UserHash:          userHash,
+		RemainingRequests: requests,
+		Plan:              PlanTrial,
+		TrialExpiresAt:    now.Add(duration).Unix(),
+		CreatedAt:         now.Unix(),
+		ReferralCode:      GenerateReferralCode(userHash),
+	}
+}
+
+// TrialExpired reports whether the user is on a trial that has run out
+func (u User) TrialExpired(now time.Time) bool {
+	return u.Plan == PlanTrial && u.TrialExpiresAt > 0 && now.Unix() >= u.TrialExpiresAt
+}
+
+// Blocked reports whether the account is banned or in an unexpired suspension.
+// A suspension without an expiry time lasts until an admin lifts it, like a ban.
+func (u User) Blocked(now time.Time) bool {
+	switch u.Status {
+	case StatusBanned:
+		return true
+	case StatusSuspended:
+		return u.BanExpiresAt == 0 || now.Unix() < u.BanExpiresAt
+	default:
+		return false
+	}
+}
+
+// RequestsFromTokens converts a legacy token amount into requests and the tokens left over
+func RequestsFromTokens(tokens int64) (requests int64, remainder int64) {
+	return tokens / TokensPerRequest, tokens % TokensPerRequest
+}
+
+// TokensFromRequests converts requests back into legacy tokens, RequestsFromTokens(TokensFromRequests(n)) == n
+func TokensFromRequests(requests int64) int64 {
+	return requests * TokensPerRequest
+}
+
+// Balance returns the user's balance in requests, including a legacy token balance that hasn't been migrated
+func (u User) Balance() int64 {
+	if u.LegacyRemainingTokens == nil {
+		return u.RemainingRequests
+	}
+	requests, _ := RequestsFromTokens(*u.LegacyRemainingTokens)
+	return u.RemainingRequests + requests
+}
+
+// MigrateBalance folds the legacy token balance into remaining_requests.
+// Tokens that don't add up to a whole request stay in the legacy attribute.
+func (u User) MigrateBalance() User {
+	if u.LegacyRemainingTokens == nil {
+		return u
+	}
+	requests, remainder := RequestsFromTokens(*u.LegacyRemainingTokens)
+	u.RemainingRequests += requests
+	if remainder == 0 {
+		u.LegacyRemainingTokens = nil
+	} else {
+		u.LegacyRemainingTokens = &remainder
+	}
+	return u
+}
@@ -0,0 +1,99 @@
+// Package validation collects request field errors so they can be returned to clients as structured JSON
+package validation
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	RuleRequired = "required"
+	RuleOneOf    = "oneof"
+	RuleFormat   = "format"
+	RuleMax      = "max"
+)
+
+// otpPattern matches the 6 digit codes generated by lambda-otp-send
+var otpPattern = regexp.MustCompile(`^[0-9]{6}$`)
+
+// FieldError describes one invalid field. Field is the JSON path of the field, e.g. "messages[1].role".
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+	// Limit is the violated limit of RuleMax errors
+	Limit int `json:"limit,omitempty"`
+}
+
+// Errors is the list of field errors found in a request
+type Errors []FieldError
+
+// Error joins the field messages, so Errors can be returned and logged as an error
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, fieldErr := range e {
+		messages[i] = fmt.Sprintf("%s: %s", fieldErr.Field, fieldErr.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Add records a field error
+func (e *Errors) Add(field, rule, message string) {
+	*e = append(*e, FieldError{Field: field, Rule: rule, Message: message})
+}
+
+// Required records an error if value is empty
+func (e *Errors) Required(field, value string) {
+	if strings.TrimSpace(value) == "" {
+		e.Add(field, RuleRequired, fmt.Sprintf("%s is required", field))
+	}
+}
+
+// OneOf records an error if value isn't one of the allowed values
+func (e *Errors) OneOf(field, value string, allowed ...string) {
+	for _, allowedValue := range allowed {
+		if value == allowedValue {
+			return
+		}
+	}
+	e.Add(field, RuleOneOf, fmt.Sprintf("%s must be one of: %s", field, strings.Join(allowed, ", ")))
+}
+
+// Max records an error if value is over limit, e.g. the length of a field. A limit of 0 is no limit.
+func (e *Errors) Max(field string, value, limit int, unit string) {
+	if limit > 0 && value > limit {
+		*e = append(*e, FieldError{Field: field, Rule: RuleMax, Message: fmt.Sprintf("%s must be at most %d %s", field, limit, unit), Limit: limit})
+	}
+}
+
+// OTP records an error if value isn't a 6 digit code
+func (e *Errors) OTP(field, value string) {
+	if !otpPattern.MatchString(value) {
+		e.Add(field, RuleFormat, fmt.Sprintf("%s must be a 6 digit code", field))
+	}
+}
+
+// Err returns the errors, or nil if there are none
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Body returns the JSON response body for the errors
+func (e Errors) Body() string {
+	body, err := json.Marshal(struct {
+		Message string `json:"message"`
+		Errors  Errors `json:"errors"`
+	}{
+		Message: "Validation failed",
+		Errors:  e,
+	})
+	if err != nil {
+		return `{"message":"Validation failed"}`
+	}
+	return string(body)
+}